@@ -0,0 +1,184 @@
+// Package broker fans out live experiment data to streaming clients.
+//
+// Every experiment is a topic with a monotonically increasing sequence number
+// and a ring of recent events, so reconnecting clients can resume from the
+// last sequence they saw without touching the database.
+package broker
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"back/models"
+)
+
+const (
+	ringSize      = 4096 // events kept per experiment for resume
+	subBufferSize = 256  // per-subscriber channel buffer
+	topicLinger   = 5 * time.Minute
+)
+
+// Event kinds
+const (
+	KindMeasurement = "measurement"
+	KindStatus      = "status"
+	KindEvent       = "event"
+)
+
+// Event is one item on an experiment stream
+type Event struct {
+	Seq          uint64                  `json:"seq"`
+	Kind         string                  `json:"kind"`
+	ExperimentID uint                    `json:"experiment_id"`
+	InstrumentID uint                    `json:"instrument_id,omitempty"`
+	Measurement  *models.Measurement     `json:"measurement,omitempty"`
+	Status       string                  `json:"status,omitempty"`
+	Event        *models.ExperimentEvent `json:"event,omitempty"`
+	At           time.Time               `json:"at"`
+}
+
+// Subscription receives events of one experiment
+type Subscription struct {
+	C       chan Event
+	topic   *topic
+	dropped atomic.Uint64
+}
+
+// Dropped returns how many events were dropped because the subscriber was too slow
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+type topic struct {
+	id       uint
+	seq      uint64
+	ring     []Event
+	subs     map[*Subscription]struct{}
+	closedAt time.Time
+}
+
+// Broker holds one topic per experiment
+type Broker struct {
+	mu     sync.Mutex
+	topics map[uint]*topic
+}
+
+var Default = New()
+
+// New creates an empty broker
+func New() *Broker {
+	return &Broker{topics: make(map[uint]*topic)}
+}
+
+func (b *Broker) topicLocked(experimentID uint) *topic {
+	t, ok := b.topics[experimentID]
+	if !ok {
+		t = &topic{id: experimentID, subs: make(map[*Subscription]struct{})}
+		b.topics[experimentID] = t
+	}
+	return t
+}
+
+// PublishMeasurement pushes a measurement to every subscriber of its experiment
+func (b *Broker) PublishMeasurement(m models.Measurement) {
+	b.publish(Event{
+		Kind:         KindMeasurement,
+		ExperimentID: m.ExperimentID,
+		InstrumentID: m.InstrumentID,
+		Measurement:  &m,
+		At:           m.RecordedAt,
+	})
+}
+
+// PublishStatus pushes an experiment status change (e.g. completed) to subscribers
+func (b *Broker) PublishStatus(experimentID uint, status models.ExperimentStatus) {
+	b.publish(Event{
+		Kind:         KindStatus,
+		ExperimentID: experimentID,
+		Status:       string(status),
+		At:           time.Now(),
+	})
+}
+
+// PublishEvent pushes a timeline event to subscribers
+func (b *Broker) PublishEvent(e models.ExperimentEvent) {
+	ev := Event{
+		Kind:         KindEvent,
+		ExperimentID: e.ExperimentID,
+		Event:        &e,
+		At:           e.CreatedAt,
+	}
+	if e.InstrumentID != nil {
+		ev.InstrumentID = *e.InstrumentID
+	}
+	b.publish(ev)
+}
+
+func (b *Broker) publish(ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t := b.topicLocked(ev.ExperimentID)
+	t.seq++
+	ev.Seq = t.seq
+	if len(t.ring) >= ringSize {
+		copy(t.ring, t.ring[1:])
+		t.ring = t.ring[:len(t.ring)-1]
+	}
+	t.ring = append(t.ring, ev)
+
+	for sub := range t.subs {
+		select {
+		case sub.C <- ev:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Subscribe registers a subscriber. Events after lastSeq still in the ring are returned
+// as backlog; gap is true when some events after lastSeq were already evicted
+// (the client should backfill from /experiments/:id/data).
+func (b *Broker) Subscribe(experimentID uint, lastSeq uint64) (sub *Subscription, backlog []Event, gap bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t := b.topicLocked(experimentID)
+	if lastSeq > 0 {
+		for _, ev := range t.ring {
+			if ev.Seq > lastSeq {
+				backlog = append(backlog, ev)
+			}
+		}
+		if len(t.ring) > 0 && t.ring[0].Seq > lastSeq+1 {
+			gap = true
+		}
+	}
+
+	sub = &Subscription{C: make(chan Event, subBufferSize), topic: t}
+	t.subs[sub] = struct{}{}
+	return sub, backlog, gap
+}
+
+// Unsubscribe removes a subscriber
+func (b *Broker) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(sub.topic.subs, sub)
+}
+
+// Finish marks an experiment stream as ended. The ring is kept for a while so late
+// reconnects can still drain it, then the topic is dropped.
+func (b *Broker) Finish(experimentID uint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if t, ok := b.topics[experimentID]; ok {
+		t.closedAt = time.Now()
+	}
+	for id, t := range b.topics {
+		if !t.closedAt.IsZero() && time.Since(t.closedAt) > topicLinger && len(t.subs) == 0 {
+			delete(b.topics, id)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"back/models"
+)
+
+func measurement(expID, instID uint) models.Measurement {
+	return models.Measurement{ExperimentID: expID, InstrumentID: instID, RecordedAt: time.Now()}
+}
+
+func TestPublishDelivers(t *testing.T) {
+	b := New()
+	sub, backlog, gap := b.Subscribe(1, 0)
+	defer b.Unsubscribe(sub)
+	if len(backlog) != 0 || gap {
+		t.Fatalf("fresh subscription: backlog %d, gap %v", len(backlog), gap)
+	}
+	other, _, _ := b.Subscribe(2, 0)
+	defer b.Unsubscribe(other)
+
+	b.PublishMeasurement(measurement(1, 7))
+	b.PublishStatus(1, models.StatusCompleted)
+	b.PublishMeasurement(measurement(2, 7))
+
+	ev := <-sub.C
+	if ev.Seq != 1 || ev.Kind != KindMeasurement || ev.InstrumentID != 7 || ev.Measurement == nil {
+		t.Fatalf("first event %+v", ev)
+	}
+	ev = <-sub.C
+	if ev.Seq != 2 || ev.Kind != KindStatus || ev.Status != string(models.StatusCompleted) {
+		t.Fatalf("second event %+v", ev)
+	}
+	select {
+	case ev := <-sub.C:
+		t.Fatalf("got another experiment's event %+v", ev)
+	default:
+	}
+	// sequences are per experiment
+	if ev := <-other.C; ev.Seq != 1 {
+		t.Fatalf("experiment 2 seq %d", ev.Seq)
+	}
+}
+
+func TestSubscribeResume(t *testing.T) {
+	b := New()
+	for i := 0; i < 5; i++ {
+		b.PublishMeasurement(measurement(1, 1))
+	}
+	sub, backlog, gap := b.Subscribe(1, 3)
+	defer b.Unsubscribe(sub)
+	if gap || len(backlog) != 2 || backlog[0].Seq != 4 || backlog[1].Seq != 5 {
+		t.Fatalf("resume after 3: gap %v, backlog %+v", gap, backlog)
+	}
+	b.PublishMeasurement(measurement(1, 1))
+	if ev := <-sub.C; ev.Seq != 6 {
+		t.Fatalf("live event seq %d after backlog", ev.Seq)
+	}
+}
+
+func TestSubscribeGap(t *testing.T) {
+	b := New()
+	for i := 0; i < ringSize+10; i++ {
+		b.PublishMeasurement(measurement(1, 1))
+	}
+	_, backlog, gap := b.Subscribe(1, 5)
+	if !gap {
+		t.Fatal("no gap reported for evicted events")
+	}
+	if len(backlog) != ringSize || backlog[0].Seq != 11 {
+		t.Fatalf("backlog %d events from seq %d", len(backlog), backlog[0].Seq)
+	}
+	// the client saw everything up to the oldest kept event: nothing is missing
+	if _, _, gap := b.Subscribe(1, 10); gap {
+		t.Fatal("gap reported when only seen events were evicted")
+	}
+}
+
+func TestSlowSubscriberDrops(t *testing.T) {
+	b := New()
+	sub, _, _ := b.Subscribe(1, 0)
+	for i := 0; i < subBufferSize+3; i++ {
+		b.PublishMeasurement(measurement(1, 1))
+	}
+	if d := sub.Dropped(); d != 3 {
+		t.Fatalf("dropped %d, want 3", d)
+	}
+	b.Unsubscribe(sub)
+	for len(sub.C) > 0 {
+		<-sub.C
+	}
+	b.PublishMeasurement(measurement(1, 1))
+	if len(sub.C) != 0 || sub.Dropped() != 3 {
+		t.Fatal("unsubscribed subscriber still receives events")
+	}
+}
+
+func TestFinishDropsLingeringTopics(t *testing.T) {
+	b := New()
+	b.PublishMeasurement(measurement(1, 1))
+	b.PublishMeasurement(measurement(2, 1))
+	b.Finish(1)
+	if _, ok := b.topics[1]; !ok {
+		t.Fatal("finished topic dropped before linger")
+	}
+	b.topics[1].closedAt = time.Now().Add(-topicLinger - time.Second)
+	b.Finish(2)
+	if _, ok := b.topics[1]; ok {
+		t.Fatal("topic kept after linger")
+	}
+	if _, ok := b.topics[2]; !ok {
+		t.Fatal("just finished topic dropped")
+	}
+}
@@ -0,0 +1,88 @@
+// Command th2690sim runs one or more simulated TH2690 electrometers.
+//
+//	go run ./cmd/th2690sim -addr 127.0.0.1:45454 -count 3 -drop 0.01
+//
+// and start the backend with the printed INSTRUMENTS value.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"back/simulator"
+)
+
+func main() {
+	def := simulator.DefaultConfig()
+
+	addr := flag.String("addr", "127.0.0.1:45454", "listen address of the first instrument")
+	count := flag.Int("count", 1, "number of instruments on consecutive ports")
+	resistance := flag.Float64("resistance", def.Resistance, "sample resistance, ohms")
+	noise := flag.Float64("noise", def.Noise, "current noise sigma, A")
+	drift := flag.Float64("drift", def.Drift, "current drift, A/s")
+	delay := flag.Duration("delay", def.Delay, "base reply latency")
+	slow := flag.Float64("slow", 0, "probability of a slow reply")
+	slowDelay := flag.Duration("slow-delay", def.SlowDelay, "extra latency of a slow reply")
+	drop := flag.Float64("drop", 0, "probability a query gets no reply")
+	reset := flag.Float64("reset", 0, "probability the connection is reset on a command")
+	split := flag.Float64("split", 0, "probability a reply is split across TCP segments")
+	term := flag.String("term", "crlf", "reply terminator: crlf or lf")
+	verbose := flag.Bool("v", false, "log every command")
+	flag.Parse()
+
+	host, portStr, err := net.SplitHostPort(*addr)
+	if err != nil {
+		log.Fatalf("invalid -addr: %v", err)
+	}
+	basePort, err := strconv.Atoi(portStr)
+	if err != nil {
+		log.Fatalf("invalid -addr port: %v", err)
+	}
+
+	terminator := "\r\n"
+	if *term == "lf" {
+		terminator = "\n"
+	}
+
+	var servers []*simulator.Server
+	var entries []string
+	for i := 0; i < *count; i++ {
+		cfg := def
+		cfg.Serial = fmt.Sprintf("SIM%07d", i+1)
+		cfg.Terminator = terminator
+		cfg.Resistance = *resistance
+		cfg.Noise = *noise
+		cfg.Drift = *drift
+		cfg.Delay = *delay
+		cfg.SlowRate = *slow
+		cfg.SlowDelay = *slowDelay
+		cfg.DropRate = *drop
+		cfg.ResetRate = *reset
+		cfg.SplitRate = *split
+		cfg.LogCommand = *verbose
+
+		srv := simulator.New(cfg)
+		listen := net.JoinHostPort(host, strconv.Itoa(basePort+i))
+		if err := srv.Listen(listen); err != nil {
+			log.Fatalf("listen %s: %v", listen, err)
+		}
+		servers = append(servers, srv)
+		entries = append(entries, fmt.Sprintf("SIM-%d=%s", i+1, srv.Addr()))
+		log.Printf("TH2690 simulator %s listening on %s", cfg.Serial, srv.Addr())
+	}
+	log.Printf("INSTRUMENTS=%q", strings.Join(entries, ","))
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	for _, srv := range servers {
+		srv.Close()
+	}
+}
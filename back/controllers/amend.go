@@ -0,0 +1,279 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"back/database"
+	"back/events"
+	"back/middleware"
+	"back/models"
+	"back/scpi"
+)
+
+// SettingsChange lists the measurement settings that may change while an experiment runs.
+// Function and source stay as started; the source voltage is changed through the HV schedule.
+type SettingsChange struct {
+	AutoRange   *bool    `json:"auto_range"`
+	Range       *string  `json:"range"`
+	Frequency   *float64 `json:"frequency"`
+	ZeroCorrect *bool    `json:"zero_correct"`
+}
+
+type AmendExperimentRequest struct {
+	DurationSec *int                       `json:"duration_sec"` // new planned duration, counted from the start (0 = unlimited)
+	HvSchedule  map[string]json.RawMessage `json:"hv_schedule"`  // key = instrument ID; replaces the program, null removes it
+	Settings    map[string]*SettingsChange `json:"settings"`     // key = instrument ID
+	Comment     string                     `json:"comment"`
+}
+
+// AmendExperiment changes the duration, HV programs or measurement settings of a running
+// experiment. The change is applied to every instrument or to none, and stored as the
+// next plan revision.
+func AmendExperiment(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	exp, ok := loadOwnExperiment(c, user)
+	if !ok {
+		return
+	}
+	if exp.Status != models.StatusRunning || !scpi.DefaultRunner.IsRunning(exp.ID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "only a running experiment can be amended"})
+		return
+	}
+
+	var req AmendExperimentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.DurationSec == nil && len(req.HvSchedule) == 0 && len(req.Settings) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "nothing to change"})
+		return
+	}
+
+	plan, err := scpi.ParseRunPlan(exp.RunPlanJSON)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot amend: " + err.Error()})
+		return
+	}
+	instruments := experimentInstruments(exp)
+
+	// Settings in effect; plans stored before they were recorded fall back to the request
+	var requested map[string]*scpi.InstrumentSettings
+	json.Unmarshal([]byte(exp.SettingsJSON), &requested)
+	settingsPerInst := make(map[uint]scpi.InstrumentSettings, len(instruments))
+	for _, inst := range instruments {
+		s, ok := plan.Settings[inst.ID]
+		if !ok {
+			s = scpi.DefaultSettings()
+			if r := requested[strconv.Itoa(int(inst.ID))]; r != nil {
+				s = *r
+			}
+		}
+		settingsPerInst[inst.ID] = s
+	}
+
+	am := scpi.PlanAmendment{DurationSec: req.DurationSec}
+
+	if req.DurationSec != nil {
+		d := *req.DurationSec
+		if d < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "duration_sec must not be negative"})
+			return
+		}
+		if elapsed := time.Since(plan.ClockStart()); d > 0 && time.Duration(d)*time.Second <= elapsed {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("duration_sec %d has already elapsed (%.0fs)", d, elapsed.Seconds())})
+			return
+		}
+	}
+
+	if len(req.Settings) > 0 {
+		am.Settings = make(map[uint]scpi.InstrumentSettings, len(req.Settings))
+	}
+	for key, change := range req.Settings {
+		id, err := strconv.Atoi(key)
+		s, known := settingsPerInst[uint(id)]
+		if err != nil || !known {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("settings: instrument %q is not part of the experiment", key)})
+			return
+		}
+		if change == nil {
+			continue
+		}
+		if change.AutoRange != nil {
+			s.AutoRange = *change.AutoRange
+		}
+		if change.Range != nil {
+			s.Range = *change.Range
+		}
+		if change.Frequency != nil {
+			if *change.Frequency <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("settings[%d]: frequency must be positive", id)})
+				return
+			}
+			s.Frequency = *change.Frequency
+		}
+		if change.ZeroCorrect != nil {
+			s.ZeroCorrect = *change.ZeroCorrect
+		}
+		settingsPerInst[uint(id)] = s
+		am.Settings[uint(id)] = s
+	}
+
+	// New programs are checked like at start; null entries remove a program
+	programs := make(map[string]json.RawMessage)
+	if len(req.HvSchedule) > 0 {
+		am.HvSchedule = make(map[uint]*scpi.HvProgram, len(req.HvSchedule))
+	}
+	for key, raw := range req.HvSchedule {
+		id, err := strconv.Atoi(key)
+		if _, known := settingsPerInst[uint(id)]; err != nil || !known {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("hv_schedule: instrument %q is not part of the experiment", key)})
+			return
+		}
+		if strings.TrimSpace(string(raw)) == "null" {
+			am.HvSchedule[uint(id)] = nil
+			continue
+		}
+		var prog scpi.HvProgram
+		if err := json.Unmarshal(raw, &prog); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("hv_schedule[%d]: %v", id, err)})
+			return
+		}
+		programs[key] = raw
+		am.HvSchedule[uint(id)] = &prog
+	}
+	if err := validateHvSchedule(programs, settingsPerInst); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkVoltageLimits(instruments, settingsPerInst, programs); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	newPlan, err := scpi.DefaultRunner.Amend(exp.ID, am)
+	if err != nil {
+		var mismatch *scpi.SettingsMismatch
+		if errors.As(err, &mismatch) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "diffs": mismatch.Diffs})
+			return
+		}
+		if errors.Is(err, scpi.ErrSequenceAmend) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, scpi.ErrNotPolling) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The experiment keeps describing the plan in effect; each change is kept as a revision
+	updates := map[string]interface{}{}
+	if req.DurationSec != nil {
+		updates["duration_sec"] = *req.DurationSec
+	}
+	if len(am.Settings) > 0 {
+		if requested == nil {
+			requested = make(map[string]*scpi.InstrumentSettings)
+		}
+		for id, s := range am.Settings {
+			s := s
+			requested[strconv.Itoa(int(id))] = &s
+		}
+		if b, err := json.Marshal(requested); err == nil {
+			updates["settings_json"] = string(b)
+		}
+	}
+	if len(am.HvSchedule) > 0 {
+		schedule := make(map[string]json.RawMessage)
+		if exp.HvScheduleJSON != "" {
+			json.Unmarshal([]byte(exp.HvScheduleJSON), &schedule)
+		}
+		for key, raw := range req.HvSchedule {
+			if _, ok := programs[key]; ok {
+				schedule[key] = raw
+			} else {
+				delete(schedule, key)
+			}
+		}
+		if b, err := json.Marshal(schedule); err == nil {
+			updates["hv_schedule_json"] = string(b)
+		}
+	}
+	planJSON, _ := json.Marshal(newPlan)
+	changesJSON, _ := json.Marshal(req)
+	updates["run_plan_json"] = string(planJSON)
+
+	var rev models.ExperimentPlanRevision
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(exp).UpdateColumn("plan_revision", gorm.Expr("plan_revision + 1")).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(exp).Select("plan_revision").First(exp).Error; err != nil {
+			return err
+		}
+		rev = models.ExperimentPlanRevision{
+			ExperimentID: exp.ID,
+			Revision:     exp.PlanRevision,
+			ChangesJSON:  string(changesJSON),
+			RunPlanJSON:  string(planJSON),
+			Comment:      req.Comment,
+			CreatedBy:    user.ID,
+		}
+		if err := tx.Create(&rev).Error; err != nil {
+			return err
+		}
+		return tx.Model(exp).Updates(updates).Error
+	})
+	if err != nil {
+		// The runner already uses the new plan; only its history is missing
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "plan amended but not saved: " + err.Error()})
+		return
+	}
+
+	events.Record(exp.ID, 0, events.PlanAmended, fmt.Sprintf("plan revision %d by %s", rev.Revision, user.Login),
+		gin.H{"user_id": user.ID, "revision": rev.Revision, "changes": req})
+
+	database.DB.First(exp, exp.ID)
+	c.JSON(http.StatusOK, gin.H{"experiment": exp, "revision": rev})
+}
+
+// ListPlanRevisions returns the amendments made to an experiment's plan, oldest first
+func ListPlanRevisions(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	user := middleware.GetCurrentUser(c)
+	var exp models.Experiment
+	if err := database.DB.First(&exp, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "experiment not found"})
+		return
+	}
+
+	if user.Role != models.RoleAdmin && user.Permission == models.PermReadOwn && exp.UserID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
+	revisions := []models.ExperimentPlanRevision{}
+	if err := database.DB.Where("experiment_id = ?", exp.ID).Order("revision").Find(&revisions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revisions": revisions})
+}
@@ -0,0 +1,239 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"back/database"
+	"back/middleware"
+	"back/models"
+	"back/scpi"
+)
+
+type CalibrateRequest struct {
+	Settings *scpi.InstrumentSettings `json:"settings"` // measurement settings; the source is always off (defaults if missing)
+	Samples  int                      `json:"samples"`  // readings averaged into the baseline (default 20)
+	Zero     bool                     `json:"zero"`     // acquire a new zero correction at the instrument first
+	Comment  string                   `json:"comment"`
+}
+
+// CalibrateInstrument runs the calibration procedure on an idle instrument and stores
+// the measured offset as its latest calibration
+func CalibrateInstrument(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	if !user.InstrumentAccess && user.Role != models.RoleAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "no instrument access"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	var req CalibrateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	settings := scpi.DefaultSettings()
+	if req.Settings != nil {
+		settings = *req.Settings
+	}
+	if req.Samples == 0 {
+		req.Samples = scpi.DefaultCalibrationSamples
+	}
+	if req.Samples < 2 || req.Samples > scpi.MaxCalibrationSamples {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("samples must be between 2 and %d", scpi.MaxCalibrationSamples)})
+		return
+	}
+	// The request waits for the whole procedure, so it has to stay short
+	if d := scpi.CalibrationDuration(settings, req.Samples); d > scpi.MaxCalibrationDuration {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%d samples take %s, longer than %s: use fewer samples or a higher frequency",
+			req.Samples, d, scpi.MaxCalibrationDuration)})
+		return
+	}
+
+	// Held like a run, so no experiment can start on the instrument meanwhile
+	inst, err := scpi.ReserveForCalibration(uint(id))
+	var conflict *scpi.ReservationConflict
+	var busy *scpi.CalibrationInProgress
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	case errors.As(err, &conflict):
+		c.JSON(http.StatusConflict, gin.H{"error": conflict.Error(), "conflict": conflict})
+		return
+	case errors.As(err, &busy):
+		c.JSON(http.StatusConflict, gin.H{"error": busy.Error(), "calibration": busy})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer scpi.ReleaseCalibration(inst.ID)
+
+	cal, err := scpi.Calibrate(*inst, settings, req.Samples, req.Zero)
+	if err != nil {
+		var mismatch *scpi.SettingsMismatch
+		if errors.As(err, &mismatch) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "diffs": mismatch.Diffs})
+			return
+		}
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Stored as measured: source off, zero correction on when a zero was acquired
+	settings.SourceOn, settings.SourceVolt = false, 0
+	settings.ZeroCorrect = settings.ZeroCorrect || req.Zero
+	settingsJSON, _ := json.Marshal(settings)
+	samplesJSON, _ := json.Marshal(cal.Samples)
+	rec := models.InstrumentCalibration{
+		InstrumentID:  inst.ID,
+		UserID:        user.ID,
+		Driver:        scpi.DriverFor(*inst).Name(),
+		Serial:        inst.Serial,
+		SettingsJSON:  string(settingsJSON),
+		ZeroCorrected: cal.ZeroCorrected,
+		Samples:       len(cal.Samples),
+		OffsetCurrent: cal.Offset,
+		NoiseCurrent:  cal.Noise,
+		MinCurrent:    cal.Min,
+		MaxCurrent:    cal.Max,
+		SamplesJSON:   string(samplesJSON),
+		Comment:       req.Comment,
+	}
+	if err := database.DB.Create(&rec).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "calibration measured but not saved: " + err.Error(), "calibration": cal})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"calibration": rec})
+}
+
+// ListInstrumentCalibrations returns the calibrations of an instrument, newest first
+func ListInstrumentCalibrations(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	calibrations := []models.InstrumentCalibration{}
+	if err := database.DB.Where("instrument_id = ?", id).Order("created_at DESC").Find(&calibrations).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"calibrations": calibrations})
+}
+
+// latestCalibration returns the last calibration of an instrument taken before a time
+func latestCalibration(instrumentID uint, before time.Time) (*models.InstrumentCalibration, error) {
+	var cal models.InstrumentCalibration
+	if err := database.DB.Where("instrument_id = ? AND created_at <= ?", instrumentID, before).
+		Order("created_at DESC").First(&cal).Error; err != nil {
+		return nil, err
+	}
+	return &cal, nil
+}
+
+// planBaselines looks up the latest calibration of every instrument when their offsets
+// are to be subtracted
+func planBaselines(instruments []models.Instrument, subtract bool) (map[uint]scpi.Baseline, *startFailure) {
+	if !subtract {
+		return nil, nil
+	}
+	baselines := make(map[uint]scpi.Baseline, len(instruments))
+	for _, inst := range instruments {
+		cal, err := latestCalibration(inst.ID, time.Now())
+		if err != nil {
+			return nil, failStart(http.StatusBadRequest, fmt.Sprintf("subtract_baseline: instrument %s has no calibration", inst.Name))
+		}
+		baselines[inst.ID] = scpi.NewBaseline(*cal)
+	}
+	return baselines, nil
+}
+
+// exportBaselines returns the offsets to subtract from the stored currents of an
+// experiment: the last calibration before its start, for every instrument whose
+// readings were not already corrected while recording and that measured with the
+// calibrated function, range and zero correction for the whole run. Instruments whose
+// settings changed away from the calibration during the run are left out.
+func exportBaselines(exp *models.Experiment) map[uint]scpi.Baseline {
+	if exp.StartTime == nil {
+		return nil
+	}
+	plan, err := scpi.ParseRunPlan(exp.RunPlanJSON)
+	if err != nil {
+		plan = &scpi.RunPlan{}
+	}
+	var revisions []models.ExperimentPlanRevision
+	database.DB.Where("experiment_id = ?", exp.ID).Order("revision").Find(&revisions)
+	instruments := experimentInstruments(exp)
+	used := runSettings(plan, instruments, revisions, experimentSteps(exp.ID))
+
+	out := make(map[uint]scpi.Baseline)
+	for _, inst := range instruments {
+		settings, known := used[inst.ID]
+		if _, ok := plan.Baselines[inst.ID]; ok || !known {
+			continue
+		}
+		cal, err := latestCalibration(inst.ID, *exp.StartTime)
+		if err != nil {
+			continue
+		}
+		b := scpi.NewBaseline(*cal)
+		matches := true
+		for _, s := range settings {
+			matches = matches && b.Matches(s)
+		}
+		if matches {
+			out[inst.ID] = b
+		}
+	}
+	return out
+}
+
+// runSettings lists the settings each instrument measured with during an experiment:
+// those of the plan in effect and those of every sequence step. Instruments whose range
+// or zero correction an amendment changed are left out, as the settings they had before
+// the change are not kept.
+func runSettings(plan *scpi.RunPlan, instruments []models.Instrument, revisions []models.ExperimentPlanRevision,
+	steps []models.ExperimentStep) map[uint][]scpi.InstrumentSettings {
+	out := make(map[uint][]scpi.InstrumentSettings, len(instruments))
+	for _, inst := range instruments {
+		s, ok := plan.Settings[inst.ID]
+		if !ok {
+			s = scpi.DefaultSettings()
+		}
+		out[inst.ID] = []scpi.InstrumentSettings{s}
+	}
+	for _, st := range steps {
+		var settings map[uint]scpi.InstrumentSettings
+		json.Unmarshal([]byte(st.SettingsJSON), &settings)
+		for id, s := range settings {
+			if _, ok := out[id]; ok {
+				out[id] = append(out[id], s)
+			}
+		}
+	}
+	for _, rev := range revisions {
+		var req AmendExperimentRequest
+		json.Unmarshal([]byte(rev.ChangesJSON), &req)
+		for key, ch := range req.Settings {
+			id, err := strconv.Atoi(key)
+			if err != nil || ch == nil || (ch.AutoRange == nil && ch.Range == nil && ch.ZeroCorrect == nil) {
+				continue
+			}
+			delete(out, uint(id))
+		}
+	}
+	return out
+}
@@ -3,14 +3,18 @@ package controllers
 import (
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"back/database"
+	"back/events"
 	"back/middleware"
 	"back/models"
+	"back/scpi"
 )
 
 func ListExperiments(c *gin.Context) {
@@ -119,6 +123,15 @@ func GetExperimentData(c *gin.Context) {
 		q.Count(&filteredCount)
 	}
 
+	// Timeline events annotate the charts and the table
+	timeline, err := events.List(uint(id), "", 0)
+	if err != nil {
+		timeline = []models.ExperimentEvent{}
+	}
+	// Pauses leave gaps in the readings that charts must not bridge
+	pauses := experimentPauses(exp.ID)
+	steps := experimentSteps(exp.ID)
+
 	// ── Aggregate mode: ?aggregate=minmax&max_points=N ──
 	// Returns NTILE-bucketed min/max per instrument for chart rendering
 	if c.Query("aggregate") == "minmax" {
@@ -195,6 +208,9 @@ func GetExperimentData(c *gin.Context) {
 			"max_points": maxPoints,
 			"time_min":   stats.TimeMin,
 			"time_max":   stats.TimeMax,
+			"events":     timeline,
+			"pauses":     pauses,
+			"steps":      steps,
 		})
 		return
 	}
@@ -245,6 +261,7 @@ func GetExperimentData(c *gin.Context) {
 		if measurements == nil {
 			measurements = []models.Measurement{}
 		}
+		decodeErrors(measurements)
 
 		c.JSON(http.StatusOK, gin.H{
 			"experiment":     exp,
@@ -255,6 +272,9 @@ func GetExperimentData(c *gin.Context) {
 			"per_page":       perPage,
 			"time_min":       stats.TimeMin,
 			"time_max":       stats.TimeMax,
+			"events":         timeline,
+			"pauses":         pauses,
+			"steps":          steps,
 		})
 		return
 	}
@@ -269,6 +289,7 @@ func GetExperimentData(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	decodeErrors(measurements)
 
 	c.JSON(http.StatusOK, gin.H{
 		"experiment":     exp,
@@ -279,9 +300,119 @@ func GetExperimentData(c *gin.Context) {
 		"per_page":       perPage,
 		"time_min":       stats.TimeMin,
 		"time_max":       stats.TimeMax,
+		"events":         timeline,
+		"pauses":         pauses,
+		"steps":          steps,
 	})
 }
 
+// decodeErrors fills in the human-readable reason of every error code
+func decodeErrors(measurements []models.Measurement) {
+	for i := range measurements {
+		measurements[i].ErrorText = scpi.ErrorText(measurements[i].ErrorCode)
+	}
+}
+
+// ListExperimentEvents returns the timeline of an experiment (?type=, ?instrument_id=)
+func ListExperimentEvents(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	user := middleware.GetCurrentUser(c)
+	var exp models.Experiment
+	if err := database.DB.First(&exp, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "experiment not found"})
+		return
+	}
+
+	if user.Role != models.RoleAdmin && user.Permission == models.PermReadOwn && exp.UserID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
+	instFilter := 0
+	if instStr := c.Query("instrument_id"); instStr != "" {
+		if v, err := strconv.Atoi(instStr); err == nil {
+			instFilter = v
+		}
+	}
+
+	evs, err := events.List(exp.ID, c.Query("type"), uint(instFilter))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": evs})
+}
+
+// ListExperimentSnapshots returns the instrument state captured when the experiment started
+func ListExperimentSnapshots(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	user := middleware.GetCurrentUser(c)
+	var exp models.Experiment
+	if err := database.DB.First(&exp, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "experiment not found"})
+		return
+	}
+
+	if user.Role != models.RoleAdmin && user.Permission == models.PermReadOwn && exp.UserID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
+	var snapshots []models.InstrumentSnapshot
+	if err := database.DB.Where("experiment_id = ?", exp.ID).Order("instrument_id").Find(&snapshots).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"snapshots": snapshots})
+}
+
+// ListExperimentSteps returns the steps a sequence experiment went through, in order
+func ListExperimentSteps(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	user := middleware.GetCurrentUser(c)
+	var exp models.Experiment
+	if err := database.DB.First(&exp, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "experiment not found"})
+		return
+	}
+
+	if user.Role != models.RoleAdmin && user.Permission == models.PermReadOwn && exp.UserID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"steps": experimentSteps(exp.ID)})
+}
+
+// experimentSteps lists the sequence steps of an experiment with their boundaries
+func experimentSteps(expID uint) []models.ExperimentStep {
+	steps := []models.ExperimentStep{}
+	database.DB.Where("experiment_id = ?", expID).Order("position").Find(&steps)
+	return steps
+}
+
+// csvEscaper keeps free text inside one field of the semicolon-separated export
+var csvEscaper = strings.NewReplacer(";", ",", "\n", " ", "\r", " ")
+
+// csvField makes a text value safe for a column of the CSV export
+func csvField(s string) string {
+	return csvEscaper.Replace(s)
+}
+
 func ExportExperimentCSV(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -309,6 +440,12 @@ func ExportExperimentCSV(c *gin.Context) {
 		}
 	}
 
+	// Optional subtraction of the calibrated offset from readings stored without it
+	var baselines map[uint]scpi.Baseline
+	if c.Query("baseline") == "1" {
+		baselines = exportBaselines(&exp)
+	}
+
 	filename := fmt.Sprintf("experiment_%d.csv", id)
 	if instFilter > 0 {
 		filename = fmt.Sprintf("experiment_%d_inst_%d.csv", id, instFilter)
@@ -317,7 +454,7 @@ func ExportExperimentCSV(c *gin.Context) {
 	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
 	// BOM for Excel UTF-8 detection + sep hint for Excel auto-delimiter
 	c.Writer.Write([]byte("\xEF\xBB\xBFsep=;\n"))
-	c.Writer.Write([]byte("id;experiment_id;instrument_id;recorded_at;voltage;current;charge;resistance;temperature;humidity;source;math_value;error_code\n"))
+	c.Writer.Write([]byte("id;experiment_id;instrument_id;recorded_at;acquired_at;round_trip_ms;voltage;current;charge;resistance;temperature;humidity;source;math_value;error_code;error_text\n"))
 
 	const batchSize = 5000
 	var lastID uint = 0
@@ -332,16 +469,75 @@ func ExportExperimentCSV(c *gin.Context) {
 			break
 		}
 		for _, m := range rows {
-			line := fmt.Sprintf("%d;%d;%d;%s;%g;%g;%g;%g;%g;%g;%g;%g;%d\n",
+			acquiredAt := ""
+			if m.AcquiredAt != nil {
+				acquiredAt = m.AcquiredAt.Format(time.RFC3339Nano)
+			}
+			line := fmt.Sprintf("%d;%d;%d;%s;%s;%.3f;%g;%g;%g;%g;%g;%g;%g;%g;%d;%s\n",
 				m.ID, m.ExperimentID, m.InstrumentID,
-				m.RecordedAt.Format(time.RFC3339Nano),
-				m.Voltage, m.Current, m.Charge, m.Resistance,
-				m.Temperature, m.Humidity, m.Source, m.MathValue, m.ErrorCode)
+				m.RecordedAt.Format(time.RFC3339Nano), acquiredAt, m.RoundTripMs,
+				m.Voltage, m.Current-baselines[m.InstrumentID].Current, m.Charge, m.Resistance,
+				m.Temperature, m.Humidity, m.Source, m.MathValue, m.ErrorCode, csvField(scpi.ErrorText(m.ErrorCode)))
 			c.Writer.Write([]byte(line))
 		}
 		c.Writer.Flush()
 		lastID = rows[len(rows)-1].ID
 	}
+
+	if len(baselines) > 0 {
+		c.Writer.Write([]byte("\ninstrument_id;calibration_id;baseline_current\n"))
+		ids := make([]uint, 0, len(baselines))
+		for instID := range baselines {
+			ids = append(ids, instID)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, instID := range ids {
+			b := baselines[instID]
+			c.Writer.Write([]byte(fmt.Sprintf("%d;%d;%g\n", instID, b.CalibrationID, b.Current)))
+		}
+	}
+
+	// Pauses, steps, then the timeline after the readings, each separated by an empty line
+	if pauses := experimentPauses(uint(id)); len(pauses) > 0 {
+		c.Writer.Write([]byte("\npause_id;paused_at;resumed_at;hv_mode;reason\n"))
+		for _, p := range pauses {
+			resumedAt := ""
+			if p.ResumedAt != nil {
+				resumedAt = p.ResumedAt.Format(time.RFC3339Nano)
+			}
+			reason := csvField(p.Reason)
+			c.Writer.Write([]byte(fmt.Sprintf("%d;%s;%s;%s;%s\n",
+				p.ID, p.PausedAt.Format(time.RFC3339Nano), resumedAt, csvField(p.HvMode), reason)))
+		}
+	}
+
+	if steps := experimentSteps(uint(id)); len(steps) > 0 {
+		c.Writer.Write([]byte("\nstep;name;iteration;started_at;ended_at;end_reason\n"))
+		for _, st := range steps {
+			endedAt := ""
+			if st.EndedAt != nil {
+				endedAt = st.EndedAt.Format(time.RFC3339Nano)
+			}
+			name := csvField(st.Name)
+			c.Writer.Write([]byte(fmt.Sprintf("%d;%s;%d;%s;%s;%s\n",
+				st.StepIndex+1, name, st.Iteration+1, st.StartedAt.Format(time.RFC3339Nano), endedAt, csvField(st.EndReason))))
+		}
+	}
+
+	evs, _ := events.List(uint(id), "", uint(instFilter))
+	if len(evs) == 0 {
+		return
+	}
+	c.Writer.Write([]byte("\nevent_id;created_at;instrument_id;type;message\n"))
+	for _, ev := range evs {
+		instID := ""
+		if ev.InstrumentID != nil {
+			instID = strconv.FormatUint(uint64(*ev.InstrumentID), 10)
+		}
+		message := csvField(ev.Message)
+		c.Writer.Write([]byte(fmt.Sprintf("%d;%s;%s;%s;%s\n",
+			ev.ID, ev.CreatedAt.Format(time.RFC3339Nano), instID, csvField(ev.Type), message)))
+	}
 }
 
 func DeleteExperiment(c *gin.Context) {
@@ -366,8 +562,18 @@ func DeleteExperiment(c *gin.Context) {
 		}
 	}
 
-	// Delete measurements first
+	if scpi.DefaultRunner.IsRunning(exp.ID) || scpi.DefaultRunner.IsPaused(exp.ID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "experiment is running, stop it first"})
+		return
+	}
+
+	// Delete measurements, the timeline and the snapshots first
 	database.DB.Where("experiment_id = ?", id).Delete(&models.Measurement{})
+	database.DB.Where("experiment_id = ?", id).Delete(&models.ExperimentEvent{})
+	database.DB.Where("experiment_id = ?", id).Delete(&models.InstrumentSnapshot{})
+	database.DB.Where("experiment_id = ?", id).Delete(&models.ExperimentPause{})
+	database.DB.Where("experiment_id = ?", id).Delete(&models.ExperimentPlanRevision{})
+	database.DB.Where("experiment_id = ?", id).Delete(&models.ExperimentStep{})
 	if err := database.DB.Delete(&exp).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"back/models"
+	"back/scpi"
+)
+
+func TestCSVField(t *testing.T) {
+	got := csvField("HV 1; sample A\r\nrun 2")
+	if want := "HV 1, sample A  run 2"; got != want {
+		t.Fatalf("csvField = %q, want %q", got, want)
+	}
+}
+
+// TestRunSettings: sequence steps add the settings they switched to, and an amendment of
+// the range or zero correction makes the settings before it unknown
+func TestRunSettings(t *testing.T) {
+	lo, hi := scpi.DefaultSettings(), scpi.DefaultSettings()
+	hi.AutoRange, hi.Range = false, "2e-6"
+	plan := &scpi.RunPlan{Settings: map[uint]scpi.InstrumentSettings{1: lo, 2: lo, 3: lo}}
+	instruments := []models.Instrument{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}}
+	revisions := []models.ExperimentPlanRevision{
+		{Revision: 1, ChangesJSON: `{"settings":{"2":{"frequency":5}}}`},
+		{Revision: 2, ChangesJSON: `{"settings":{"3":{"range":"2e-6"}}}`},
+	}
+	steps := []models.ExperimentStep{{SettingsJSON: `{"1":` + mustJSON(t, hi) + `}`}}
+
+	got := runSettings(plan, instruments, revisions, steps)
+	if len(got[1]) != 2 || got[1][1].Range != hi.Range {
+		t.Errorf("instrument 1 (sequence step): %+v", got[1])
+	}
+	if len(got[2]) != 1 {
+		t.Errorf("instrument 2 (frequency amended): %+v", got[2])
+	}
+	if _, ok := got[3]; ok {
+		t.Errorf("instrument 3 (range amended) kept: %+v", got[3])
+	}
+	if len(got[4]) != 1 || got[4][0] != scpi.DefaultSettings() {
+		t.Errorf("instrument 4 (not in plan): %+v", got[4])
+	}
+
+	b := scpi.NewBaseline(models.InstrumentCalibration{SettingsJSON: mustJSON(t, lo)})
+	if !b.Matches(got[2][0]) || b.Matches(got[1][1]) {
+		t.Error("baseline matched the wrong settings")
+	}
+}
+
+func mustJSON(t *testing.T, v any) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -10,8 +11,11 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 
+	"back/broker"
 	"back/database"
+	"back/events"
 	"back/middleware"
 	"back/models"
 	"back/recorder"
@@ -26,14 +30,41 @@ func ListInstruments(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	// Check online status for all instruments
+	checkOnline(instruments, listIdentifyTimeout)
 	for i := range instruments {
-		_, err := scpi.Identify(instruments[i].Host, instruments[i].Port)
-		instruments[i].Online = err == nil
+		instruments[i].Driver = scpi.DriverFor(instruments[i]).Name()
 	}
 	c.JSON(http.StatusOK, instruments)
 }
 
+// listIdentifyTimeout bounds how long the instrument list waits for *IDN? replies
+const listIdentifyTimeout = 2 * time.Second
+
+// checkOnline identifies all instruments at once and marks those that answered within
+// timeout as online; a slow or unreachable instrument does not hold up the others
+func checkOnline(instruments []models.Instrument, timeout time.Duration) {
+	answered := make(chan int, len(instruments))
+	for i := range instruments {
+		go func(i int, inst models.Instrument) {
+			if _, err := scpi.IdentifyInstrument(inst); err != nil {
+				i = -1
+			}
+			answered <- i
+		}(i, instruments[i])
+	}
+	deadline := time.After(timeout)
+	for range instruments {
+		select {
+		case i := <-answered:
+			if i >= 0 {
+				instruments[i].Online = true
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
 // ToggleInstrument switches active on/off
 func ToggleInstrument(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
@@ -51,6 +82,39 @@ func ToggleInstrument(c *gin.Context) {
 	c.JSON(http.StatusOK, inst)
 }
 
+// UpdateInstrumentLimits sets the interlock voltage limit of an instrument (admin only).
+// The new limit applies to the next command, including those of a running experiment.
+func UpdateInstrumentLimits(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var inst models.Instrument
+	if err := database.DB.First(&inst, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	var body struct {
+		MaxVoltage float64 `json:"max_voltage"` // 0 removes the limit
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if body.MaxVoltage < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_voltage must not be negative"})
+		return
+	}
+	if err := database.DB.Model(&inst).Update("max_voltage", body.MaxVoltage).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	database.DB.First(&inst, id)
+	scpi.DefaultSessions.Get(inst)
+	c.JSON(http.StatusOK, inst)
+}
+
 // --- Ping instrument (check SCPI connectivity) ---
 
 func PingInstrument(c *gin.Context) {
@@ -64,17 +128,36 @@ func PingInstrument(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
 		return
 	}
-	info, err := scpi.QueryIDN(inst.Host, inst.Port)
+	info, err := scpi.IdentifyInstrument(inst)
 	if err != nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": fmt.Sprintf("instrument unreachable: %v", err)})
 		return
 	}
-	// Update stored model/firmware/serial
-	inst.Model = info.Model
-	inst.Firmware = info.Firmware
-	inst.Serial = info.Serial
-	database.DB.Save(&inst)
-	c.JSON(http.StatusOK, gin.H{"idn": info.Raw, "model": info.Model, "firmware": info.Firmware, "serial": info.Serial})
+	// Update stored model/firmware/serial; the session follows the driver it selects
+	scpi.RecordIdentity(&inst, info)
+	c.JSON(http.StatusOK, gin.H{
+		"idn":          info.Raw,
+		"manufacturer": info.Manufacturer,
+		"model":        info.Model,
+		"firmware":     info.Firmware,
+		"serial":       info.Serial,
+		"driver":       scpi.DriverFor(inst).Name(),
+	})
+}
+
+// GetInstrumentSession returns connection health and latency stats of the instrument session
+func GetInstrumentSession(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var inst models.Instrument
+	if err := database.DB.First(&inst, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	c.JSON(http.StatusOK, scpi.DefaultSessions.Get(inst).Stats())
 }
 
 // --- Probe SCPI commands (diagnostic) ---
@@ -128,7 +211,7 @@ func ProbeInstrument(c *gin.Context) {
 
 	results := make([]gin.H, 0, len(testCmds))
 	for _, cmd := range testCmds {
-		resp, err := scpi.Send(inst.Host, inst.Port, cmd, 2*time.Second)
+		resp, err := scpi.SendRaw(inst, cmd)
 		entry := gin.H{"cmd": cmd, "resp": resp}
 		if err != nil {
 			entry["err"] = err.Error()
@@ -142,113 +225,192 @@ func ProbeInstrument(c *gin.Context) {
 
 // --- Start / Stop experiment ---
 
+// ExperimentPlan is everything needed to start an experiment apart from its name.
+// Templates store one per version.
+type ExperimentPlan struct {
+	InstrumentIDs    string                              `json:"instrument_ids" binding:"required"` // comma-separated
+	Notes            string                              `json:"notes"`
+	Settings         map[string]*scpi.InstrumentSettings `json:"settings"`          // key = instrument ID
+	DurationSec      int                                 `json:"duration_sec"`      // planned duration in seconds (0 = unlimited)
+	HvSchedule       map[string]json.RawMessage          `json:"hv_schedule"`       // key = instrument ID; scpi.HvProgram or []scpi.HvPoint
+	Rules            []scpi.Rule                         `json:"rules"`             // actions triggered by readings
+	Watchdog         scpi.WatchdogConfig                 `json:"watchdog"`          // when a silent instrument is degraded / fails the run
+	AutoClearErrors  bool                                `json:"auto_clear_errors"` // clear error codes reported by readings
+	Sequence         *scpi.Sequence                      `json:"sequence"`          // run as steps; settings apply before the first step
+	SubtractBaseline bool                                `json:"subtract_baseline"` // subtract the latest calibrated offset from the recorded currents
+}
+
 type StartExperimentRequest struct {
-	Name          string                              `json:"name" binding:"required"`
-	InstrumentIDs string                              `json:"instrument_ids" binding:"required"` // comma-separated
-	Notes         string                              `json:"notes"`
-	Settings      map[string]*scpi.InstrumentSettings `json:"settings"`     // key = instrument ID
-	DurationSec   int                                 `json:"duration_sec"` // planned duration in seconds (0 = unlimited)
-	HvSchedule    map[string][]scpi.HvPoint           `json:"hv_schedule"`  // key = instrument ID
+	Name string `json:"name" binding:"required"`
+	ExperimentPlan
 }
 
-func StartExperiment(c *gin.Context) {
-	user := middleware.GetCurrentUser(c)
-	if !user.InstrumentAccess && user.Role != models.RoleAdmin {
-		c.JSON(http.StatusForbidden, gin.H{"error": "no instrument access"})
-		return
-	}
+// startFailure is the response for an experiment that could not be started
+type startFailure struct {
+	status int
+	body   gin.H
+}
 
-	// Prevent double-start: check if any experiment is already running
-	var runningCount int64
-	database.DB.Model(&models.Experiment{}).Where("status = ?", models.StatusRunning).Count(&runningCount)
-	if runningCount > 0 {
-		c.JSON(http.StatusConflict, gin.H{"error": "Уже есть запущенный эксперимент. Остановите его перед запуском нового."})
-		return
-	}
+func failStart(status int, err string) *startFailure {
+	return &startFailure{status: status, body: gin.H{"error": err}}
+}
 
-	var req StartExperimentRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
+func (f *startFailure) Error() string {
+	msg, _ := f.body["error"].(string)
+	return msg
+}
+
+// resolvedPlan is an ExperimentPlan checked against the instruments it names
+type resolvedPlan struct {
+	instruments     []models.Instrument
+	instrumentIDs   []uint
+	settingsPerInst map[uint]scpi.InstrumentSettings
+}
+
+// resolvePlan loads the instruments of a plan and validates everything that does not
+// depend on their current state
+func resolvePlan(plan ExperimentPlan) (*resolvedPlan, *startFailure) {
+	rp := &resolvedPlan{settingsPerInst: make(map[uint]scpi.InstrumentSettings)}
 
 	// Parse and validate instrument IDs
-	idStrs := strings.Split(req.InstrumentIDs, ",")
-	var instruments []models.Instrument
-	for _, s := range idStrs {
+	seen := make(map[int]bool)
+	for _, s := range strings.Split(plan.InstrumentIDs, ",") {
 		id, err := strconv.Atoi(strings.TrimSpace(s))
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid instrument_ids"})
-			return
+			return nil, failStart(http.StatusBadRequest, "invalid instrument_ids")
+		}
+		if seen[id] {
+			continue
 		}
+		seen[id] = true
 		var inst models.Instrument
 		if err := database.DB.First(&inst, id).Error; err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("instrument %d not found", id)})
-			return
+			return nil, failStart(http.StatusNotFound, fmt.Sprintf("instrument %d not found", id))
 		}
-		instruments = append(instruments, inst)
+		rp.instruments = append(rp.instruments, inst)
+		rp.instrumentIDs = append(rp.instrumentIDs, inst.ID)
 	}
 
-	// Apply per-instrument settings in parallel
-	var maxFreq float64 = 5
-	settingsPerInst := make(map[uint]scpi.InstrumentSettings, len(instruments))
-	for _, inst := range instruments {
+	// Resolve per-instrument settings
+	for _, inst := range rp.instruments {
 		idStr := strconv.Itoa(int(inst.ID))
 		settings := scpi.DefaultSettings()
-		if req.Settings != nil {
-			if s, ok := req.Settings[idStr]; ok && s != nil {
+		if plan.Settings != nil {
+			if s, ok := plan.Settings[idStr]; ok && s != nil {
 				settings = *s
 			}
 		}
-		if settings.Frequency > maxFreq {
-			maxFreq = settings.Frequency
+		rp.settingsPerInst[inst.ID] = settings
+	}
+
+	// Validate HV programs before touching any instrument
+	if err := validateHvSchedule(plan.HvSchedule, rp.settingsPerInst); err != nil {
+		return nil, failStart(http.StatusBadRequest, err.Error())
+	}
+	for i, rule := range plan.Rules {
+		if err := rule.Validate(rp.instrumentIDs); err != nil {
+			return nil, failStart(http.StatusBadRequest, fmt.Sprintf("rules[%d]: %v", i, err))
+		}
+	}
+	if err := plan.Watchdog.Validate(); err != nil {
+		return nil, failStart(http.StatusBadRequest, err.Error())
+	}
+	if plan.Sequence != nil {
+		if len(plan.HvSchedule) > 0 {
+			return nil, failStart(http.StatusBadRequest, "hv_schedule cannot be combined with a sequence, give each step its programs")
+		}
+		if err := plan.Sequence.Validate(rp.settingsPerInst); err != nil {
+			return nil, failStart(http.StatusBadRequest, err.Error())
 		}
-		settingsPerInst[inst.ID] = settings
 	}
+	return rp, nil
+}
 
-	var applyWg sync.WaitGroup
-	var applyMu sync.Mutex
-	var applyErr error
-	for _, inst := range instruments {
-		applyWg.Add(1)
-		go func(inst models.Instrument, s scpi.InstrumentSettings) {
-			defer applyWg.Done()
-			if err := scpi.ApplySettings(inst.Host, inst.Port, s); err != nil {
-				applyMu.Lock()
-				if applyErr == nil {
-					applyErr = fmt.Errorf("failed to configure %s: %v", inst.Name, err)
-				}
-				applyMu.Unlock()
+// checkPlanLimits checks the settings and programs of a plan, every sequence step
+// included, against the voltage limits of its instruments
+func checkPlanLimits(rp *resolvedPlan, plan ExperimentPlan) error {
+	if err := checkVoltageLimits(rp.instruments, rp.settingsPerInst, plan.HvSchedule); err != nil {
+		return err
+	}
+	if plan.Sequence == nil {
+		return nil
+	}
+	settings := rp.settingsPerInst
+	for i, step := range plan.Sequence.Steps {
+		settings = plan.Sequence.Apply(i, settings)
+		schedule := make(map[string]json.RawMessage, len(step.HvSchedule))
+		for id, prog := range step.HvSchedule {
+			if prog == nil {
+				continue
 			}
-		}(inst, settingsPerInst[inst.ID])
+			b, err := json.Marshal(prog)
+			if err != nil {
+				return err
+			}
+			schedule[strconv.Itoa(int(id))] = b
+		}
+		if err := checkVoltageLimits(rp.instruments, settings, schedule); err != nil {
+			return fmt.Errorf("sequence.steps[%d]: %v", i, err)
+		}
 	}
-	applyWg.Wait()
-	if applyErr != nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": applyErr.Error()})
+	return nil
+}
+
+func StartExperiment(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	if !user.InstrumentAccess && user.Role != models.RoleAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "no instrument access"})
+		return
+	}
+
+	var req StartExperimentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Send FUNC:RUN to all instruments in parallel
-	var runWg sync.WaitGroup
+	exp, fail := startExperiment(user, req, nil)
+	if fail != nil {
+		c.JSON(fail.status, fail.body)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"experiment": exp})
+}
+
+// startInstruments sends FUNC:RUN to all instruments in parallel. If any of them fails,
+// every instrument is put in its safe state: the others may already run with HV applied.
+func startInstruments(instruments []models.Instrument) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
 	var runErr error
 	for _, inst := range instruments {
-		runWg.Add(1)
+		wg.Add(1)
 		go func(inst models.Instrument) {
-			defer runWg.Done()
-			if err := scpi.Run(inst.Host, inst.Port); err != nil {
-				applyMu.Lock()
+			defer wg.Done()
+			if err := scpi.StartInstrument(inst); err != nil {
+				mu.Lock()
 				if runErr == nil {
 					runErr = fmt.Errorf("failed to start %s: %v", inst.Name, err)
 				}
-				applyMu.Unlock()
+				mu.Unlock()
 			}
 		}(inst)
 	}
-	runWg.Wait()
+	wg.Wait()
 	if runErr != nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": runErr.Error()})
-		return
+		scpi.SafeStateAll(instruments)
 	}
+	return runErr
+}
+
+// startExperiment configures the instruments of a request and starts polling them.
+// tmpl is the template version the request was built from, if any.
+func startExperiment(user *models.User, req StartExperimentRequest, tmpl *models.ExperimentTemplateVersion) (*models.Experiment, *startFailure) {
+	rp, fail := resolvePlan(req.ExperimentPlan)
+	if fail != nil {
+		return nil, fail
+	}
+	instruments, instrumentIDs, settingsPerInst := rp.instruments, rp.instrumentIDs, rp.settingsPerInst
 
 	// Serialize settings to JSON for storage
 	settingsJSON := "{}"
@@ -258,9 +420,24 @@ func StartExperiment(c *gin.Context) {
 		}
 	}
 
-	// Use highest frequency from all instruments
-	pollingSettings := scpi.DefaultSettings()
-	pollingSettings.Frequency = maxFreq
+	if err := checkPlanLimits(rp, req.ExperimentPlan); err != nil {
+		return nil, failStart(http.StatusForbidden, err.Error())
+	}
+	baselines, fail := planBaselines(instruments, req.SubtractBaseline)
+	if fail != nil {
+		return nil, fail
+	}
+	// A sequence starts with the settings of its first step
+	if req.Sequence != nil {
+		settingsPerInst = req.Sequence.Apply(0, settingsPerInst)
+	}
+
+	rulesJSON := ""
+	if len(req.Rules) > 0 {
+		if b, err := json.Marshal(req.Rules); err == nil {
+			rulesJSON = string(b)
+		}
+	}
 
 	// Serialize HV schedule
 	hvScheduleJSON := "{}"
@@ -281,20 +458,181 @@ func StartExperiment(c *gin.Context) {
 		SettingsJSON:   settingsJSON,
 		DurationSec:    req.DurationSec,
 		HvScheduleJSON: hvScheduleJSON,
+		RulesJSON:      rulesJSON,
+	}
+	if tmpl != nil {
+		exp.TemplateID = &tmpl.TemplateID
+		exp.TemplateVersion = tmpl.Version
 	}
 
-	if err := database.DB.Create(&exp).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	// Create the experiment and reserve its instruments atomically, before touching them
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&exp).Error; err != nil {
+			return err
+		}
+		return scpi.ReserveInstruments(tx, exp.ID, instrumentIDs)
+	})
+	var conflict *scpi.ReservationConflict
+	if errors.As(err, &conflict) {
+		return nil, &startFailure{status: http.StatusConflict, body: gin.H{"error": conflict.Error(), "conflict": conflict}}
+	}
+	var calibrating *scpi.CalibrationInProgress
+	if errors.As(err, &calibrating) {
+		return nil, &startFailure{status: http.StatusConflict, body: gin.H{"error": calibrating.Error(), "calibration": calibrating}}
+	}
+	if err != nil {
+		return nil, failStart(http.StatusInternalServerError, err.Error())
+	}
+
+	// Apply per-instrument settings in parallel
+	var applyWg sync.WaitGroup
+	var applyMu sync.Mutex
+	var applyErr error
+	var mismatches []*scpi.SettingsMismatch
+	for _, inst := range instruments {
+		applyWg.Add(1)
+		go func(inst models.Instrument, s scpi.InstrumentSettings) {
+			defer applyWg.Done()
+			err := scpi.ApplySettings(inst, s)
+			if err == nil {
+				return
+			}
+			applyMu.Lock()
+			defer applyMu.Unlock()
+			var mismatch *scpi.SettingsMismatch
+			if errors.As(err, &mismatch) {
+				mismatches = append(mismatches, mismatch)
+			} else if applyErr == nil {
+				applyErr = fmt.Errorf("failed to configure %s: %v", inst.Name, err)
+			}
+		}(inst, settingsPerInst[inst.ID])
 	}
+	applyWg.Wait()
+	if applyErr == nil && len(mismatches) > 0 {
+		applyErr = mismatches[0]
+	}
+	if applyErr != nil {
+		// Some instruments may already have their source on
+		scpi.SafeStateAll(instruments)
+		abortStart(&exp)
+		return nil, &startFailure{status: http.StatusServiceUnavailable, body: gin.H{"error": applyErr.Error(), "mismatches": mismatches}}
+	}
+
+	// Record what every instrument is actually configured to before it starts measuring
+	snapshots := make([]*models.InstrumentSnapshot, len(instruments))
+	var snapWg sync.WaitGroup
+	for i, inst := range instruments {
+		snapWg.Add(1)
+		go func(i int, inst models.Instrument) {
+			defer snapWg.Done()
+			// An unreadable instrument still gets a snapshot, with the reason in Error
+			snap, _ := scpi.Snapshot(inst, settingsPerInst[inst.ID])
+			snap.ExperimentID = exp.ID
+			snapshots[i] = snap
+		}(i, inst)
+	}
+	snapWg.Wait()
+	if err := database.DB.Create(&snapshots).Error; err != nil {
+		scpi.SafeStateAll(instruments)
+		abortStart(&exp)
+		return nil, failStart(http.StatusInternalServerError, "failed to save instrument snapshots: "+err.Error())
+	}
+
+	if err := startInstruments(instruments); err != nil {
+		abortStart(&exp)
+		return nil, failStart(http.StatusServiceUnavailable, err.Error())
+	}
+
+	// The run clock starts once every instrument is measuring
+	now = time.Now()
+	exp.StartTime = &now
+	database.DB.Model(&exp).Update("start_time", now)
 
-	// Start polling goroutine at max frequency
-	scpi.DefaultRunner.Start(&exp, instruments, pollingSettings.PollingInterval())
+	for _, inst := range instruments {
+		events.Record(exp.ID, inst.ID, events.SettingsApplied, "settings applied to "+inst.Name, settingsPerInst[inst.ID])
+	}
+	events.Record(exp.ID, 0, events.ExperimentStarted, "started by "+user.Login,
+		gin.H{"user_id": user.ID, "instrument_ids": instrumentIDs, "duration_sec": req.DurationSec, "baselines": baselines})
+
+	// Start polling, each instrument at its own frequency
+	scpi.DefaultRunner.Start(&exp, instruments, settingsPerInst, scpi.RunOptions{
+		Watchdog:        req.Watchdog,
+		AutoClearErrors: req.AutoClearErrors,
+		Sequence:        req.Sequence,
+		Baselines:       baselines,
+	})
 
 	// Start video recording if cameras available
 	recorder.Default.Start(exp.ID)
 
-	c.JSON(http.StatusOK, gin.H{"experiment": exp})
+	return &exp, nil
+}
+
+// validateHvSchedule checks every HV program against the instruments of the experiment
+// and the source voltage their settings start from
+func validateHvSchedule(schedule map[string]json.RawMessage, settings map[uint]scpi.InstrumentSettings) error {
+	for key, raw := range schedule {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			return fmt.Errorf("hv_schedule: invalid instrument id %q", key)
+		}
+		s, ok := settings[uint(id)]
+		if !ok {
+			return fmt.Errorf("hv_schedule: instrument %d is not part of the experiment", id)
+		}
+		var prog scpi.HvProgram
+		if err := json.Unmarshal(raw, &prog); err != nil {
+			return fmt.Errorf("hv_schedule[%d]: %v", id, err)
+		}
+		start := 0.0
+		if s.SourceOn {
+			start = s.SourceVolt
+		}
+		if err := prog.Validate(start); err != nil {
+			return fmt.Errorf("hv_schedule[%d]: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// checkVoltageLimits refuses settings and HV programs that would exceed an instrument's
+// interlock limit, so the run doesn't fail part-way through its schedule
+func checkVoltageLimits(instruments []models.Instrument, settings map[uint]scpi.InstrumentSettings, schedule map[string]json.RawMessage) error {
+	for _, inst := range instruments {
+		s := settings[inst.ID]
+		start := 0.0
+		if s.SourceOn {
+			start = s.SourceVolt
+		}
+		if err := scpi.CheckVoltage(inst, start); err != nil {
+			return fmt.Errorf("settings of %s: %v", inst.Name, err)
+		}
+		raw, ok := schedule[strconv.Itoa(int(inst.ID))]
+		if !ok {
+			continue
+		}
+		var prog scpi.HvProgram
+		if err := json.Unmarshal(raw, &prog); err != nil {
+			return fmt.Errorf("hv_schedule[%d]: %v", inst.ID, err)
+		}
+		pv, err := prog.Preview(start)
+		if err != nil {
+			return fmt.Errorf("hv_schedule[%d]: %v", inst.ID, err)
+		}
+		for _, v := range []float64{pv.MinVoltage, pv.MaxVoltage} {
+			if err := scpi.CheckVoltage(inst, v); err != nil {
+				return fmt.Errorf("hv_schedule[%d]: %v", inst.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// abortStart removes an experiment whose instruments could not be started and frees them
+func abortStart(exp *models.Experiment) {
+	database.DB.Where("experiment_id = ?", exp.ID).Delete(&models.InstrumentSnapshot{})
+	database.DB.Delete(exp)
+	scpi.ReleaseInstruments(exp.ID)
 }
 
 func StopExperiment(c *gin.Context) {
@@ -311,7 +649,7 @@ func StopExperiment(c *gin.Context) {
 		return
 	}
 
-	if exp.Status != models.StatusRunning {
+	if exp.Status != models.StatusRunning && exp.Status != models.StatusPaused {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "experiment is not running"})
 		return
 	}
@@ -323,7 +661,8 @@ func StopExperiment(c *gin.Context) {
 	}
 
 	// Atomically mark as stopping to prevent double-stop race
-	res := database.DB.Model(&exp).Where("status = ?", models.StatusRunning).Update("status", "stopping")
+	res := database.DB.Model(&exp).Where("status IN ?", []models.ExperimentStatus{models.StatusRunning, models.StatusPaused}).
+		Update("status", "stopping")
 	if res.RowsAffected == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "experiment already stopping"})
 		return
@@ -331,24 +670,16 @@ func StopExperiment(c *gin.Context) {
 
 	// Stop polling
 	scpi.DefaultRunner.Stop(exp.ID)
+	events.Record(exp.ID, 0, events.ExperimentStopped, "stopped by "+user.Login, gin.H{"user_id": user.ID})
 
-	// Stop instruments and reset to safe state — in parallel
-	idStrs := strings.Split(exp.InstrumentIDs, ",")
-	var stopWg sync.WaitGroup
-	for _, s := range idStrs {
-		instID, _ := strconv.Atoi(strings.TrimSpace(s))
-		var inst models.Instrument
-		if database.DB.First(&inst, instID).Error == nil {
-			stopWg.Add(1)
-			go func(inst models.Instrument) {
-				defer stopWg.Done()
-				scpi.Stop(inst.Host, inst.Port)
-				scpi.Send(inst.Host, inst.Port, "FUNC:SRC OFF", 2*time.Second)
-				scpi.Send(inst.Host, inst.Port, "FUNC:AMMET OFF", 2*time.Second)
-			}(inst)
-		}
+	// Stop instruments and verify the source is off — in parallel
+	instruments := experimentInstruments(&exp)
+	exp.Status = models.StatusCompleted
+	if failures := scpi.SafeStateAll(instruments); len(failures) > 0 {
+		exp.Status = models.StatusError
+		exp.StatusReason = scpi.SafeStateFailures(instruments, failures)
 	}
-	stopWg.Wait()
+	scpi.ReleaseInstruments(exp.ID)
 
 	// Stop video recording and upload
 	if videoPath := recorder.Default.Stop(exp.ID); videoPath != "" {
@@ -356,9 +687,12 @@ func StopExperiment(c *gin.Context) {
 	}
 
 	now := time.Now()
-	exp.Status = models.StatusCompleted
 	exp.EndTime = &now
 	database.DB.Save(&exp)
+	scpi.ClosePauses([]uint{exp.ID}, now)
+	scpi.CloseSteps([]uint{exp.ID}, now, "stopped")
+	broker.Default.PublishStatus(exp.ID, exp.Status)
+	broker.Default.Finish(exp.ID)
 
 	c.JSON(http.StatusOK, gin.H{"experiment": exp})
 }
@@ -377,15 +711,27 @@ func ExperimentStatusCheck(c *gin.Context) {
 	}
 
 	running := scpi.DefaultRunner.IsRunning(exp.ID)
+	paused := scpi.DefaultRunner.IsPaused(exp.ID)
 
 	// Count measurements
 	var count int64
 	database.DB.Model(&models.Measurement{}).Where("experiment_id = ?", exp.ID).Count(&count)
 
+	// Rows not yet in the database: queued in the writer or spilled to the journal
+	pendingWrites := scpi.DefaultWriter.Pending(exp.ID)
+	pendingJournal := scpi.DefaultJournal.Pending(exp.ID)
+
 	c.JSON(http.StatusOK, gin.H{
 		"experiment":        exp,
 		"polling_active":    running,
+		"paused":            paused,
+		"pauses":            experimentPauses(exp.ID),
+		"steps":             experimentSteps(exp.ID),
 		"measurement_count": count,
+		"pending_writes":    pendingWrites,
+		"pending_journal":   pendingJournal,
+		"pending_rows":      pendingWrites + pendingJournal,
+		"instruments":       scpi.DefaultRunner.Health(exp.ID), // watchdog state while polling
 	})
 }
 
@@ -401,7 +747,7 @@ func GetInstrumentSettings(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
 		return
 	}
-	settings, err := scpi.ReadSettings(inst.Host, inst.Port)
+	settings, err := scpi.ReadSettings(inst)
 	if err != nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
 		return
@@ -421,16 +767,29 @@ func ApplySettingsEndpoint(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
 		return
 	}
+	if holder := scpi.InstrumentHolder(inst); holder != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": holder.Error(), "conflict": holder})
+		return
+	}
 	var settings scpi.InstrumentSettings
 	if err := c.ShouldBindJSON(&settings); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := scpi.ApplySettings(inst.Host, inst.Port, settings); err != nil {
+	if err := scpi.CheckVoltage(inst, settings.SourceVolt); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err := scpi.ApplySettings(inst, settings); err != nil {
+		var mismatch *scpi.SettingsMismatch
+		if errors.As(err, &mismatch) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "diffs": mismatch.Diffs})
+			return
+		}
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"ok": true})
+	c.JSON(http.StatusOK, gin.H{"ok": true, "diffs": []scpi.SettingsDiff{}})
 }
 
 // SendCommand sends an arbitrary SCPI command to an instrument
@@ -454,10 +813,66 @@ func SendCommand(c *gin.Context) {
 		return
 	}
 
-	resp, err := scpi.SendRaw(inst.Host, inst.Port, body.Command)
+	resp, err := scpi.SendRaw(inst, body.Command)
+
+	// Manual commands during a run can change what is being measured: keep them on its timeline
+	if holder := scpi.InstrumentHolder(inst); holder != nil {
+		user := middleware.GetCurrentUser(c)
+		data := gin.H{"user_id": user.ID, "command": body.Command, "response": resp}
+		if err != nil {
+			data["error"] = err.Error()
+		}
+		events.Record(holder.ExperimentID, inst.ID, events.ScpiCommand, fmt.Sprintf("%s sent %q", user.Login, body.Command), data)
+	}
+
+	var limitErr *scpi.VoltageLimitError
+	if errors.As(err, &limitErr) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error(), "interlock": limitErr})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"response": resp})
+	// Instruments with an error queue report rejected commands only there
+	instErrors, _ := scpi.ReadErrors(inst)
+	c.JSON(http.StatusOK, gin.H{"response": resp, "instrument_errors": instErrors})
+}
+
+// ListErrorCodes returns the catalogue of instrument error codes
+func ListErrorCodes(c *gin.Context) {
+	c.JSON(http.StatusOK, scpi.ErrorCatalogue())
+}
+
+// ClearInstrumentError drains the error queue of an instrument and clears its latched error code
+func ClearInstrumentError(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var inst models.Instrument
+	if err := database.DB.First(&inst, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	msgs, err := clearInstrumentErrors(inst)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error(), "instrument_errors": msgs})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "instrument_errors": msgs})
+}
+
+// clearInstrumentErrors drains the error queue of an instrument, then clears its latched
+// error code. Drivers with only a queue are clear once it is drained.
+func clearInstrumentErrors(inst models.Instrument) ([]string, error) {
+	msgs, err := scpi.ReadErrors(inst)
+	if err != nil {
+		return msgs, err
+	}
+	if err := scpi.ClearError(inst); err != nil && !errors.Is(err, scpi.ErrNoErrorCode) {
+		return msgs, err
+	}
+	return msgs, nil
 }
@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"back/models"
+	"back/scpi"
+	"back/simulator"
+)
+
+func TestStartInstrumentsSafeStatesOnFailure(t *testing.T) {
+	sim, first := startSimulator(t, 9101)
+
+	// The second instrument cannot be reached, so its FUNC:RUN fails
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+	second := models.Instrument{ID: 9102, Name: "gone", Host: "127.0.0.1", Port: addr.Port}
+
+	s := scpi.DefaultSettings()
+	s.SourceOn = true
+	s.SourceVolt = 100
+	if err := scpi.ApplySettings(first, s); err != nil {
+		t.Fatal(err)
+	}
+	if !sim.SourceOn() {
+		t.Fatal("source should be on after configuring")
+	}
+
+	if err := startInstruments([]models.Instrument{first, second}); err == nil {
+		t.Fatal("startInstruments succeeded with an unreachable instrument")
+	}
+
+	if sim.SourceOn() {
+		t.Error("first instrument: source still on, want FUNC:SRC OFF")
+	}
+	if sim.Running() {
+		t.Error("first instrument: still measuring, want FUNC:STOP")
+	}
+	resp, err := scpi.SendRaw(first, "SRC:VALUE?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := strconv.ParseFloat(resp, 64); err != nil || v != 0 {
+		t.Errorf("first instrument: SRC:VALUE? = %q, want 0", resp)
+	}
+}
+
+// TestCheckOnlineInParallel: a slow instrument is reported offline after the deadline
+// instead of delaying the list, and the others are checked meanwhile
+func TestCheckOnlineInParallel(t *testing.T) {
+	_, online := startSimulator(t, 9571)
+	cfg := simulator.DefaultConfig()
+	cfg.Delay = 1500 * time.Millisecond
+	slow := simulator.New(cfg)
+	if err := slow.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	lagging := models.Instrument{ID: 9572, Name: "lagging"}
+	lagging.Host, lagging.Port = slow.HostPort()
+	offline := models.Instrument{ID: 9573, Name: "offline", Host: "127.0.0.1", Port: 1}
+
+	instruments := []models.Instrument{lagging, offline, online}
+	start := time.Now()
+	checkOnline(instruments, 500*time.Millisecond)
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("checking took %s", took)
+	}
+	if instruments[0].Online || instruments[1].Online || !instruments[2].Online {
+		t.Fatalf("online: lagging %v, offline %v, simulator %v", instruments[0].Online, instruments[1].Online, instruments[2].Online)
+	}
+}
+
+// TestClearInstrumentErrors: the latched error code is cleared, and a failure to clear it
+// is reported
+func TestClearInstrumentErrors(t *testing.T) {
+	_, inst := startSimulator(t, 9581)
+	errorCode := func() int {
+		var resp *scpi.Response
+		err := scpi.DefaultSessions.Get(inst).Exec(scpi.PriorityUI, func(c scpi.Conn) error {
+			var err error
+			resp, err = scpi.DriverFor(inst).Fetch(c)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.ErrorCode
+	}
+	// a positive setpoint on the negative source range latches the HV_V alert
+	if _, err := scpi.DefaultSessions.Get(inst).Query(scpi.PriorityUI, "SRC:RANGE 3;SRC:VALUE 50", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if code := errorCode(); code != simulator.ErrSourceRange {
+		t.Fatalf("error code %d", code)
+	}
+	if _, err := clearInstrumentErrors(inst); err != nil {
+		t.Fatal(err)
+	}
+	if code := errorCode(); code != 0 {
+		t.Fatalf("error code %d after clearing", code)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	if _, err := clearInstrumentErrors(models.Instrument{ID: 9582, Host: "127.0.0.1", Port: port}); err == nil {
+		t.Fatal("no error clearing an unreachable instrument")
+	}
+}
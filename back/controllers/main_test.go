@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"log"
+	"os"
+	"testing"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"back/database"
+	"back/models"
+	"back/scpi"
+	"back/simulator"
+)
+
+// TestMain points the package at an unreachable database and keeps the measurement
+// journal in a temporary directory
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "controllers-journal-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Setenv("JOURNAL_DIR", dir)
+	scpi.DefaultJournal = scpi.NewJournal(dir)
+
+	database.DB, err = gorm.Open(postgres.Open("host=127.0.0.1 port=1 user=test dbname=test sslmode=disable connect_timeout=1"),
+		&gorm.Config{DisableAutomaticPing: true, Logger: logger.Discard})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// startSimulator starts a simulated TH2690 and returns it with an instrument pointing at it
+func startSimulator(t *testing.T, id uint) (*simulator.Server, models.Instrument) {
+	t.Helper()
+	sim := simulator.New(simulator.DefaultConfig())
+	if err := sim.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sim.Close() })
+	host, port := sim.HostPort()
+	inst := models.Instrument{ID: id, Name: sim.Addr(), Host: host, Port: port}
+	return sim, inst
+}
@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"back/broker"
+	"back/database"
+	"back/events"
+	"back/middleware"
+	"back/models"
+	"back/scpi"
+)
+
+// errNotRunning aborts the pause transaction when the experiment is no longer running
+var errNotRunning = errors.New("experiment is not running")
+
+type PauseExperimentRequest struct {
+	HvMode string `json:"hv_mode"` // hold (default) or zero
+	Reason string `json:"reason"`
+}
+
+// experimentInstruments loads the instruments of an experiment, skipping deleted ones
+func experimentInstruments(exp *models.Experiment) []models.Instrument {
+	var instruments []models.Instrument
+	for _, s := range strings.Split(exp.InstrumentIDs, ",") {
+		instID, _ := strconv.Atoi(strings.TrimSpace(s))
+		var inst models.Instrument
+		if database.DB.First(&inst, instID).Error == nil {
+			instruments = append(instruments, inst)
+		}
+	}
+	return instruments
+}
+
+// loadOwnExperiment reads the experiment in the :id parameter for a state change, which
+// only admins and the owner may make
+func loadOwnExperiment(c *gin.Context, user *models.User) (*models.Experiment, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return nil, false
+	}
+	var exp models.Experiment
+	if err := database.DB.First(&exp, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "experiment not found"})
+		return nil, false
+	}
+	if user.Role != models.RoleAdmin && exp.UserID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return nil, false
+	}
+	return &exp, true
+}
+
+// PauseExperiment suspends polling; the run clock, the planned duration and the HV schedule
+// stop until the experiment is resumed. The HV source is held or set to 0 V.
+func PauseExperiment(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	exp, ok := loadOwnExperiment(c, user)
+	if !ok {
+		return
+	}
+
+	var req PauseExperimentRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	switch req.HvMode {
+	case "":
+		req.HvMode = scpi.PauseHoldHV
+	case scpi.PauseHoldHV, scpi.PauseZeroHV:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "hv_mode must be hold or zero"})
+		return
+	}
+
+	// Persist the pause before touching the runner, so a failed write leaves the run going
+	pause := models.ExperimentPause{
+		ExperimentID: exp.ID,
+		PausedAt:     time.Now(),
+		HvMode:       req.HvMode,
+		Reason:       req.Reason,
+		PausedBy:     user.ID,
+	}
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(exp).Where("status = ?", models.StatusRunning).Update("status", models.StatusPaused)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errNotRunning
+		}
+		return tx.Create(&pause).Error
+	})
+	if errors.Is(err, errNotRunning) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "experiment is not running"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	scpi.DefaultRunner.Pause(exp.ID)
+
+	hvErrors := gin.H{}
+	if req.HvMode == scpi.PauseZeroHV {
+		for _, inst := range experimentInstruments(exp) {
+			if err := scpi.SetSourceVoltage(inst, 0); err != nil {
+				hvErrors[strconv.Itoa(int(inst.ID))] = err.Error()
+				events.Record(exp.ID, inst.ID, events.HvSetpointFailed, "setting 0 V for the pause failed: "+err.Error(), nil)
+			}
+		}
+	}
+
+	msg := "paused by " + user.Login
+	if req.Reason != "" {
+		msg += ": " + req.Reason
+	}
+	events.Record(exp.ID, 0, events.ExperimentPaused, msg, gin.H{"user_id": user.ID, "hv_mode": req.HvMode})
+	broker.Default.PublishStatus(exp.ID, models.StatusPaused)
+
+	exp.Status = models.StatusPaused
+	c.JSON(http.StatusOK, gin.H{"experiment": exp, "pause": pause, "hv_errors": hvErrors})
+}
+
+// ResumeExperiment continues polling a paused experiment where its run clock stopped
+func ResumeExperiment(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	exp, ok := loadOwnExperiment(c, user)
+	if !ok {
+		return
+	}
+	if exp.Status != models.StatusPaused {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "experiment is not paused"})
+		return
+	}
+
+	plan, err := scpi.ParseRunPlan(exp.RunPlanJSON)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot resume: " + err.Error()})
+		return
+	}
+
+	res := database.DB.Model(exp).Where("status = ?", models.StatusPaused).Update("status", models.StatusRunning)
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "experiment is not paused"})
+		return
+	}
+
+	// The time since the pause started no longer counts towards the run
+	now := time.Now()
+	var pause models.ExperimentPause
+	if err := database.DB.Where("experiment_id = ? AND resumed_at IS NULL", exp.ID).
+		Order("id DESC").First(&pause).Error; err == nil {
+		database.DB.Model(&pause).Updates(map[string]interface{}{"resumed_at": now, "resumed_by": user.ID})
+		pause.ResumedAt = &now
+		pause.ResumedBy = user.ID
+		plan.PausedSec += now.Sub(pause.PausedAt).Seconds()
+	}
+	if b, err := json.Marshal(plan); err == nil {
+		exp.RunPlanJSON = string(b)
+		database.DB.Model(exp).Update("run_plan_json", exp.RunPlanJSON)
+	}
+
+	// Programs set their own voltage on the first poll; a fixed source needs it back
+	instruments := experimentInstruments(exp)
+	if pause.HvMode == scpi.PauseZeroHV {
+		for _, inst := range instruments {
+			v, on := plan.StartVolts[inst.ID]
+			if !on || plan.HvSchedule[inst.ID] != nil {
+				continue
+			}
+			if err := scpi.SetSourceVoltage(inst, v); err != nil {
+				events.Record(exp.ID, inst.ID, events.HvSetpointFailed, fmt.Sprintf("restoring %.1f V failed: %v", v, err), nil)
+			}
+		}
+	}
+
+	scpi.DefaultRunner.Resume(exp.ID, instruments, *plan)
+	events.Record(exp.ID, 0, events.ExperimentResumed, "resumed by "+user.Login,
+		gin.H{"user_id": user.ID, "paused_sec": plan.PausedSec})
+	broker.Default.PublishStatus(exp.ID, models.StatusRunning)
+
+	exp.Status = models.StatusRunning
+	c.JSON(http.StatusOK, gin.H{"experiment": exp, "pause": pause})
+}
+
+// experimentPauses lists the pause intervals of an experiment, oldest first
+func experimentPauses(expID uint) []models.ExperimentPause {
+	pauses := []models.ExperimentPause{}
+	database.DB.Where("experiment_id = ?", expID).Order("paused_at").Find(&pauses)
+	return pauses
+}
@@ -0,0 +1,531 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"back/database"
+	"back/middleware"
+	"back/models"
+	"back/scpi"
+)
+
+const (
+	queueInterval        = 5 * time.Second // how often the queue looks for due runs
+	defaultMinFreeDiskMB = 1024
+)
+
+// Notification types
+const (
+	NotifyRunSkipped = "queued_run_skipped"
+	NotifyRunFailed  = "queued_run_failed"
+)
+
+type EnqueueRequest struct {
+	Name          string         `json:"name" binding:"required"`
+	StartAt       *time.Time     `json:"start_at"`         // nil = when the previous run in the queue has finished
+	MaxDelaySec   int            `json:"max_delay_sec"`    // scheduled runs: skip when not started this long after start_at (0 = never)
+	MinFreeDiskMB int            `json:"min_free_disk_mb"` // 0 = 1024
+	SkipCameras   bool           `json:"skip_cameras"`
+	Plan          ExperimentPlan `json:"plan"`
+}
+
+// PreCheck is the result of one pre-start check
+type PreCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// queueState is the in-memory copy of models.QueueState. A pause takes effect at once and
+// is stored in the background, so it holds while the database is down.
+var queueState struct {
+	mu     sync.Mutex
+	state  models.QueueState
+	pauses int        // counts PauseQueue calls, so a resume does not undo a newer pause
+	save   sync.Mutex // serialises writes: the last one stored is the latest state
+}
+
+// PauseQueue stops the queue from starting runs until an admin resumes it
+func PauseQueue(reason string) {
+	now := time.Now()
+	queueState.mu.Lock()
+	queueState.state = models.QueueState{ID: 1, Paused: true, Reason: reason, PausedAt: &now}
+	queueState.pauses++
+	queueState.mu.Unlock()
+	log.Printf("[QUEUE] paused: %s", reason)
+
+	go func() {
+		for attempt := 0; ; attempt++ {
+			err := saveQueueState()
+			if err == nil {
+				return
+			}
+			if attempt%30 == 0 {
+				log.Printf("[QUEUE] storing the paused state failed, retrying: %v", err)
+			}
+			time.Sleep(2 * time.Second)
+		}
+	}()
+}
+
+// saveQueueState stores the current in-memory queue state
+func saveQueueState() error {
+	queueState.save.Lock()
+	defer queueState.save.Unlock()
+	queueState.mu.Lock()
+	st := queueState.state
+	queueState.mu.Unlock()
+	return database.DB.Save(&st).Error
+}
+
+// loadQueueState reads the stored queue state. A pause stored by a previous process is
+// kept; a pause made since this process started is never cleared by it.
+func loadQueueState() error {
+	var st models.QueueState
+	if err := database.DB.FirstOrCreate(&st, models.QueueState{ID: 1}).Error; err != nil {
+		return err
+	}
+	queueState.mu.Lock()
+	defer queueState.mu.Unlock()
+	if st.Paused && !queueState.state.Paused {
+		queueState.state = st
+	}
+	return nil
+}
+
+// queuePaused reports whether the queue is held by an emergency stop
+func queuePaused() bool {
+	queueState.mu.Lock()
+	defer queueState.mu.Unlock()
+	return queueState.state.Paused
+}
+
+// StartQueue starts the background loop that starts queued runs when they are due
+func StartQueue() {
+	// Runs a previous process was starting: the experiment, if created, was recovered with the others
+	var interrupted []models.QueuedRun
+	database.DB.Where("status = ?", models.QueueStarting).Find(&interrupted)
+	for i := range interrupted {
+		finishQueuedRun(&interrupted[i], models.QueueFailed, "start interrupted by a restart")
+	}
+
+	// No run starts before the stored pause, if any, is known
+	loaded := loadQueueState() == nil
+	go func() {
+		for range time.Tick(queueInterval) {
+			if !loaded {
+				if err := loadQueueState(); err != nil {
+					log.Printf("[QUEUE] reading the queue state failed: %v", err)
+					continue
+				}
+				loaded = true
+			}
+			processQueue()
+		}
+	}()
+}
+
+// processQueue walks the queue in order and starts the runs that are due. A run without
+// start_at is due once the run before it has finished, was skipped or failed. Nothing
+// starts while the queue is paused.
+func processQueue() {
+	if queuePaused() {
+		return
+	}
+	var runs []models.QueuedRun
+	if err := database.DB.Where("status IN ?", []models.QueueStatus{models.QueueWaiting, models.QueueStarted}).
+		Order("position, id").Find(&runs).Error; err != nil {
+		log.Printf("[QUEUE] reading the queue failed: %v", err)
+		return
+	}
+
+	previousDone := true
+	for i := range runs {
+		run := &runs[i]
+		if run.Status == models.QueueWaiting {
+			due := previousDone
+			if run.StartAt != nil {
+				due = !time.Now().Before(*run.StartAt)
+			}
+			if due {
+				startQueuedRun(run)
+			}
+		}
+		if run.Status == models.QueueStarted && !queuedRunActive(run) {
+			database.DB.Model(run).Update("status", models.QueueFinished)
+			run.Status = models.QueueFinished
+		}
+		previousDone = run.Status != models.QueueWaiting && run.Status != models.QueueStarted
+	}
+}
+
+// queuedRunActive reports whether the experiment of a started run still holds its instruments
+func queuedRunActive(run *models.QueuedRun) bool {
+	if run.ExperimentID == nil {
+		return false
+	}
+	var exp models.Experiment
+	if err := database.DB.Select("status").First(&exp, *run.ExperimentID).Error; err != nil {
+		return false
+	}
+	return exp.Status == models.StatusRunning || exp.Status == models.StatusPaused || exp.Status == "stopping"
+}
+
+// startQueuedRun checks a due run and starts its experiment. A run whose instruments are
+// still held by another experiment keeps waiting.
+func startQueuedRun(run *models.QueuedRun) {
+	if run.StartAt != nil && run.MaxDelaySec > 0 &&
+		time.Since(*run.StartAt) > time.Duration(run.MaxDelaySec)*time.Second {
+		finishQueuedRun(run, models.QueueSkipped, fmt.Sprintf("not started within %ds of %s", run.MaxDelaySec, run.StartAt.Format(time.RFC3339)))
+		return
+	}
+
+	var plan ExperimentPlan
+	if err := json.Unmarshal([]byte(run.PlanJSON), &plan); err != nil {
+		finishQueuedRun(run, models.QueueFailed, "invalid plan: "+err.Error())
+		return
+	}
+	rp, fail := resolvePlan(plan)
+	if fail != nil {
+		finishQueuedRun(run, models.QueueFailed, fail.Error())
+		return
+	}
+	for _, inst := range rp.instruments {
+		if inst.CalibratingSince != nil || scpi.InstrumentHolder(inst) != nil {
+			return
+		}
+	}
+
+	// Claim the run so a concurrent cancel cannot slip in between the checks and the start
+	res := database.DB.Model(run).Where("status = ?", models.QueueWaiting).Update("status", models.QueueStarting)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return
+	}
+	run.Status = models.QueueStarting
+
+	checks, ok := preStartChecks(run, rp.instruments)
+	if b, err := json.Marshal(checks); err == nil {
+		run.ChecksJSON = string(b)
+		database.DB.Model(run).Update("checks_json", run.ChecksJSON)
+	}
+	if !ok {
+		var failed []string
+		for _, ch := range checks {
+			if !ch.OK {
+				failed = append(failed, ch.Name+": "+ch.Message)
+			}
+		}
+		finishQueuedRun(run, models.QueueSkipped, "pre-start checks failed: "+strings.Join(failed, "; "))
+		return
+	}
+	// An emergency stop during the checks holds the run back
+	if queuePaused() {
+		run.Status = models.QueueWaiting
+		database.DB.Model(run).Update("status", run.Status)
+		return
+	}
+
+	var user models.User
+	if err := database.DB.First(&user, run.UserID).Error; err != nil {
+		finishQueuedRun(run, models.QueueFailed, "owner not found")
+		return
+	}
+	if !user.InstrumentAccess && user.Role != models.RoleAdmin {
+		finishQueuedRun(run, models.QueueFailed, "owner has no instrument access")
+		return
+	}
+
+	exp, fail := startExperiment(&user, StartExperimentRequest{Name: run.Name, ExperimentPlan: plan}, nil)
+	if fail != nil {
+		finishQueuedRun(run, models.QueueFailed, fail.Error())
+		return
+	}
+	now := time.Now()
+	run.Status = models.QueueStarted
+	run.ExperimentID = &exp.ID
+	run.StartedAt = &now
+	database.DB.Model(run).Updates(map[string]interface{}{
+		"status":        run.Status,
+		"experiment_id": exp.ID,
+		"started_at":    now,
+	})
+	log.Printf("[QUEUE] run=%d started as exp=%d", run.ID, exp.ID)
+}
+
+// finishQueuedRun ends a run that will not start and notifies its owner
+func finishQueuedRun(run *models.QueuedRun, status models.QueueStatus, reason string) {
+	run.Status = status
+	run.Reason = reason
+	database.DB.Model(run).Updates(map[string]interface{}{"status": status, "reason": reason})
+	log.Printf("[QUEUE] run=%d %s: %s", run.ID, status, reason)
+
+	typ := NotifyRunFailed
+	if status == models.QueueSkipped {
+		typ = NotifyRunSkipped
+	}
+	id := run.ID
+	database.DB.Create(&models.Notification{
+		UserID:      run.UserID,
+		Type:        typ,
+		Message:     fmt.Sprintf("Queued run %q was %s: %s", run.Name, status, reason),
+		QueuedRunID: &id,
+	})
+}
+
+// preStartChecks verifies that the instruments answer, the active cameras are reachable
+// and the disk has room for the data. ok is false when any check failed.
+func preStartChecks(run *models.QueuedRun, instruments []models.Instrument) (checks []PreCheck, ok bool) {
+	checks = make([]PreCheck, len(instruments))
+	var wg sync.WaitGroup
+	for i, inst := range instruments {
+		wg.Add(1)
+		go func(i int, inst models.Instrument) {
+			defer wg.Done()
+			ch := PreCheck{Name: "instrument " + inst.Name, OK: true}
+			if info, err := scpi.IdentifyInstrument(inst); err != nil {
+				ch.OK = false
+				ch.Message = fmt.Sprintf("unreachable: %v", err)
+			} else {
+				ch.Message = info.Raw
+				scpi.RecordIdentity(&inst, info)
+			}
+			checks[i] = ch
+		}(i, inst)
+	}
+
+	if !run.SkipCameras {
+		var cameras []models.Camera
+		database.DB.Where("active = ?", true).Order("id").Find(&cameras)
+		for _, cam := range cameras {
+			ch := PreCheck{Name: "camera " + cam.Name, OK: checkCameraOnline(cam.RTSPURL)}
+			if !ch.OK {
+				ch.Message = "unreachable"
+			}
+			checks = append(checks, ch)
+		}
+	}
+
+	minFree := run.MinFreeDiskMB
+	if minFree <= 0 {
+		minFree = defaultMinFreeDiskMB
+	}
+	disk := PreCheck{Name: "disk"}
+	if usage, err := diskUsage(); err != nil {
+		disk.Message = err.Error()
+	} else {
+		disk.OK = usage.FreeBytes >= uint64(minFree)<<20
+		disk.Message = fmt.Sprintf("%d MB free, %d MB needed", usage.FreeBytes>>20, minFree)
+	}
+
+	wg.Wait()
+	checks = append(checks, disk)
+	ok = true
+	for _, ch := range checks {
+		ok = ok && ch.OK
+	}
+	return checks, ok
+}
+
+// loadQueuedRun reads the queued run in the :id parameter; only admins and the owner may change it
+func loadQueuedRun(c *gin.Context, user *models.User) (*models.QueuedRun, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return nil, false
+	}
+	var run models.QueuedRun
+	if err := database.DB.First(&run, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "queued run not found"})
+		return nil, false
+	}
+	if user.Role != models.RoleAdmin && run.UserID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return nil, false
+	}
+	return &run, true
+}
+
+// ListQueue returns the queue in start order. By default only runs that have not ended are
+// listed; ?status=skipped,failed selects others.
+func ListQueue(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	statuses := []string{string(models.QueueWaiting), string(models.QueueStarting), string(models.QueueStarted)}
+	if s := c.Query("status"); s != "" {
+		statuses = strings.Split(s, ",")
+	}
+
+	query := database.DB.Preload("User").Where("status IN ?", statuses).Order("position, id")
+	if user.Role != models.RoleAdmin && user.Permission == models.PermReadOwn {
+		query = query.Where("user_id = ?", user.ID)
+	}
+	runs := []models.QueuedRun{}
+	if err := query.Find(&runs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, runs)
+}
+
+// GetQueueState reports whether the queue is paused and why
+func GetQueueState(c *gin.Context) {
+	queueState.mu.Lock()
+	st := queueState.state
+	queueState.mu.Unlock()
+	c.JSON(http.StatusOK, st)
+}
+
+// ResumeQueue lets the queue start runs again after an emergency stop. The resumed state
+// is stored before it takes effect, so a restart cannot bring the pause back.
+func ResumeQueue(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	queueState.mu.Lock()
+	pauses := queueState.pauses
+	queueState.mu.Unlock()
+
+	queueState.save.Lock()
+	defer queueState.save.Unlock()
+	st := models.QueueState{ID: 1}
+	if err := database.DB.Save(&st).Error; err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	queueState.mu.Lock()
+	defer queueState.mu.Unlock()
+	if queueState.pauses != pauses {
+		// paused again meanwhile: that pause is stored after this write
+		c.JSON(http.StatusConflict, gin.H{"error": "queue paused again: " + queueState.state.Reason})
+		return
+	}
+	queueState.state = st
+	log.Printf("[QUEUE] resumed by %s", user.Login)
+	c.JSON(http.StatusOK, st)
+}
+
+// EnqueueExperiment adds a run to the end of the queue
+func EnqueueExperiment(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	if !user.InstrumentAccess && user.Role != models.RoleAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "no instrument access"})
+		return
+	}
+
+	var req EnqueueRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.MaxDelaySec < 0 || req.MinFreeDiskMB < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_delay_sec and min_free_disk_mb must not be negative"})
+		return
+	}
+	rp, fail := resolvePlan(req.Plan)
+	if fail != nil {
+		c.JSON(fail.status, fail.body)
+		return
+	}
+	if err := checkPlanLimits(rp, req.Plan); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	planJSON, err := json.Marshal(req.Plan)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	run := models.QueuedRun{
+		Name:          req.Name,
+		UserID:        user.ID,
+		StartAt:       req.StartAt,
+		MaxDelaySec:   req.MaxDelaySec,
+		MinFreeDiskMB: req.MinFreeDiskMB,
+		SkipCameras:   req.SkipCameras,
+		PlanJSON:      string(planJSON),
+		Status:        models.QueueWaiting,
+	}
+	var last models.QueuedRun
+	if database.DB.Order("position DESC").First(&last).Error == nil {
+		run.Position = last.Position + 1
+	}
+	if err := database.DB.Create(&run).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, run)
+}
+
+// CancelQueuedRun removes a run from the queue before it starts
+func CancelQueuedRun(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	run, ok := loadQueuedRun(c, user)
+	if !ok {
+		return
+	}
+	res := database.DB.Model(run).Where("status = ?", models.QueueWaiting).Update("status", models.QueueCancelled)
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("run is %s, only queued runs can be cancelled", run.Status)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// CheckQueuedRun runs the pre-start checks of a queued run now, without starting it
+func CheckQueuedRun(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	run, ok := loadQueuedRun(c, user)
+	if !ok {
+		return
+	}
+	var plan ExperimentPlan
+	if err := json.Unmarshal([]byte(run.PlanJSON), &plan); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid plan: " + err.Error()})
+		return
+	}
+	rp, fail := resolvePlan(plan)
+	if fail != nil {
+		c.JSON(fail.status, fail.body)
+		return
+	}
+	checks, passed := preStartChecks(run, rp.instruments)
+	c.JSON(http.StatusOK, gin.H{"ok": passed, "checks": checks})
+}
+
+// ListNotifications returns the current user's notifications, newest first (?unread=1 for unread only)
+func ListNotifications(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	query := database.DB.Where("user_id = ?", user.ID).Order("id DESC").Limit(200)
+	if c.Query("unread") == "1" {
+		query = query.Where("read_at IS NULL")
+	}
+	notifications := []models.Notification{}
+	if err := query.Find(&notifications).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, notifications)
+}
+
+func MarkNotificationRead(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	user := middleware.GetCurrentUser(c)
+	res := database.DB.Model(&models.Notification{}).Where("id = ? AND user_id = ? AND read_at IS NULL", id, user.ID).
+		Update("read_at", time.Now())
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": res.Error.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"back/database"
+	"back/middleware"
+	"back/models"
+	"back/simulator"
+)
+
+func TestPreStartChecks(t *testing.T) {
+	sim := simulator.New(simulator.DefaultConfig())
+	if err := sim.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	host, port := sim.HostPort()
+	online := models.Instrument{ID: 9531, Name: "online", Host: host, Port: port}
+	// nothing listens on port 1
+	offline := models.Instrument{ID: 9532, Name: "offline", Host: "127.0.0.1", Port: 1}
+
+	run := &models.QueuedRun{SkipCameras: true, MinFreeDiskMB: 1}
+	checks, ok := preStartChecks(run, []models.Instrument{online})
+	if !ok || len(checks) != 2 || checks[0].Name != "instrument online" || !strings.HasPrefix(checks[0].Message, "TH2690") ||
+		checks[1].Name != "disk" || !checks[1].OK {
+		t.Fatalf("checks %+v, ok=%v", checks, ok)
+	}
+
+	checks, ok = preStartChecks(run, []models.Instrument{online, offline})
+	if ok || checks[1].OK || !strings.HasPrefix(checks[1].Message, "unreachable") {
+		t.Fatalf("unreachable instrument passed: %+v", checks)
+	}
+
+	run.MinFreeDiskMB = 1 << 40
+	checks, ok = preStartChecks(run, []models.Instrument{online})
+	if ok || checks[len(checks)-1].OK {
+		t.Fatalf("a disk without room passed: %+v", checks)
+	}
+}
+
+func TestQueuedRunActiveWithoutExperiment(t *testing.T) {
+	if queuedRunActive(&models.QueuedRun{}) {
+		t.Fatal("a run that never started an experiment is active")
+	}
+}
+
+// TestEmergencyStopPausesQueue: after an emergency stop the queue does not even look for
+// due runs, and with the database down an admin cannot resume it
+func TestEmergencyStopPausesQueue(t *testing.T) {
+	t.Cleanup(func() {
+		queueState.mu.Lock()
+		queueState.state = models.QueueState{}
+		queueState.mu.Unlock()
+	})
+
+	var mu sync.Mutex
+	var tables []string
+	database.DB.Callback().Query().Before("gorm:query").Register("test:queue_reads", func(db *gorm.DB) {
+		mu.Lock()
+		tables = append(tables, db.Statement.Table)
+		mu.Unlock()
+	})
+	t.Cleanup(func() { database.DB.Callback().Query().Remove("test:queue_reads") })
+	queueReads := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		n := 0
+		for _, table := range tables {
+			if table == "queued_runs" {
+				n++
+			}
+		}
+		tables = nil
+		return n
+	}
+
+	processQueue()
+	if queueReads() == 0 {
+		t.Fatal("an unpaused queue did not read the queue")
+	}
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("claims", &middleware.Claims{UserID: 1, Login: "operator"})
+	EmergencyStop(c)
+	if !queuePaused() {
+		t.Fatal("queue not paused by the emergency stop")
+	}
+
+	processQueue()
+	if n := queueReads(); n != 0 {
+		t.Fatalf("paused queue read the queue %d times", n)
+	}
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Set("user", &models.User{Login: "admin", Role: models.RoleAdmin})
+	ResumeQueue(c)
+	if w.Code != http.StatusServiceUnavailable || !queuePaused() {
+		t.Fatalf("resume without a database: %d, paused %v", w.Code, queuePaused())
+	}
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	GetQueueState(c)
+	if !strings.Contains(w.Body.String(), `"reason":"emergency stop by operator"`) {
+		t.Fatalf("queue state %s", w.Body.String())
+	}
+}
@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"back/database"
+	"back/events"
+	"back/middleware"
+	"back/models"
+	"back/recorder"
+	"back/scpi"
+)
+
+// EmergencyStop halts every running experiment, switches every instrument's source off and
+// pauses the queue until an admin resumes it.
+// It sits behind TokenRequired rather than AuthRequired so it works while the database is
+// down, and any logged-in user may use it.
+func EmergencyStop(c *gin.Context) {
+	claims := middleware.GetClaims(c)
+	reason := "emergency stop by " + claims.Login
+
+	// Hold the queue first so no queued run starts while the stop is under way
+	PauseQueue(reason)
+	halted, results := scpi.EmergencyStop(reason)
+	for _, id := range halted {
+		events.Record(id, 0, events.EmergencyStop, reason, gin.H{"user_id": claims.UserID, "instruments": results})
+		go func(id uint) {
+			if videoPath := recorder.Default.Stop(id); videoPath != "" {
+				database.DB.Model(&models.Experiment{}).Where("id = ?", id).Update("video_path", videoPath)
+			}
+		}(id)
+	}
+
+	ok := true
+	for _, r := range results {
+		ok = ok && r.OK
+	}
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{"ok": ok, "halted_experiments": halted, "instruments": results})
+}
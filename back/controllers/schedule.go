@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"back/scpi"
+)
+
+type HvPreviewRequest struct {
+	Program      json.RawMessage `json:"program" binding:"required"` // scpi.HvProgram or []scpi.HvPoint
+	StartVoltage float64         `json:"start_voltage"`              // source voltage before the program starts
+}
+
+// PreviewHvSchedule validates an HV program and returns its computed voltage profile
+func PreviewHvSchedule(c *gin.Context) {
+	var req HvPreviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var prog scpi.HvProgram
+	if err := json.Unmarshal(req.Program, &prog); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	preview, err := prog.Preview(req.StartVoltage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"program": prog, "preview": preview})
+}
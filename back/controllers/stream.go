@@ -0,0 +1,150 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"back/broker"
+	"back/database"
+	"back/middleware"
+	"back/models"
+	"back/scpi"
+)
+
+const streamHeartbeat = 15 * time.Second
+
+// StreamExperiment pushes live measurements of an experiment as Server-Sent Events.
+//
+// Query params:
+//
+//	instrument_id  only stream this instrument
+//	max_rate       max measurements per second per instrument (server-side decimation)
+//	last_id        resume after this event id (same as the Last-Event-ID header)
+//
+// EventSource cannot set headers, so the JWT may be passed as ?token=.
+// If the client falls behind, the effective rate is halved and a "decimation" event is sent.
+func StreamExperiment(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	user := middleware.GetCurrentUser(c)
+	var exp models.Experiment
+	if err := database.DB.First(&exp, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "experiment not found"})
+		return
+	}
+	if user.Role != models.RoleAdmin && user.Permission == models.PermReadOwn && exp.UserID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
+	var instFilter uint
+	if v, err := strconv.Atoi(c.Query("instrument_id")); err == nil && v > 0 {
+		instFilter = uint(v)
+	}
+	var minInterval time.Duration
+	if v, err := strconv.ParseFloat(c.Query("max_rate"), 64); err == nil && v > 0 {
+		minInterval = time.Duration(float64(time.Second) / v)
+	}
+	lastID := c.GetHeader("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.Query("last_id")
+	}
+	lastSeq, _ := strconv.ParseUint(lastID, 10, 64)
+
+	sub, backlog, gap := broker.Default.Subscribe(exp.ID, lastSeq)
+	defer broker.Default.Unsubscribe(sub)
+
+	w := c.Writer
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	writeEvent := func(seq uint64, kind string, payload interface{}) bool {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return true
+		}
+		if seq > 0 {
+			fmt.Fprintf(w, "id: %d\n", seq)
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", kind, data); err != nil {
+			return false
+		}
+		w.Flush()
+		return true
+	}
+
+	if gap {
+		writeEvent(0, "gap", gin.H{"message": "events were evicted, backfill from /experiments/:id/data"})
+	}
+
+	lastSent := make(map[uint]time.Time)
+	var lastDropped uint64
+	send := func(ev broker.Event) bool {
+		if ev.Kind == broker.KindMeasurement {
+			if instFilter > 0 && ev.InstrumentID != instFilter {
+				return true
+			}
+			if minInterval > 0 && ev.At.Sub(lastSent[ev.InstrumentID]) < minInterval {
+				return true
+			}
+			lastSent[ev.InstrumentID] = ev.At
+		}
+		return writeEvent(ev.Seq, ev.Kind, ev)
+	}
+
+	for _, ev := range backlog {
+		if !send(ev) {
+			return
+		}
+	}
+
+	// Nothing more will come for a finished experiment; a paused one may resume
+	if !scpi.DefaultRunner.IsRunning(exp.ID) && !scpi.DefaultRunner.IsPaused(exp.ID) {
+		writeEvent(0, broker.KindStatus, gin.H{"experiment_id": exp.ID, "status": exp.Status})
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	ctx := c.Request.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			w.Flush()
+		case ev := <-sub.C:
+			if !send(ev) {
+				return
+			}
+			if ev.Kind == broker.KindStatus && ev.Status != string(models.StatusRunning) && ev.Status != string(models.StatusPaused) {
+				return
+			}
+			// Slow client: halve the rate each time new drops are observed
+			if d := sub.Dropped(); d > lastDropped {
+				lastDropped = d
+				if minInterval == 0 {
+					minInterval = 100 * time.Millisecond
+				} else if minInterval < 10*time.Second {
+					minInterval *= 2
+				}
+				writeEvent(0, "decimation", gin.H{"dropped": d, "max_rate": float64(time.Second) / float64(minInterval)})
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"math"
+	"net/http"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DiskUsage is the usage of the filesystem holding the data
+type DiskUsage struct {
+	TotalBytes uint64  `json:"total_bytes"`
+	FreeBytes  uint64  `json:"free_bytes"`
+	UsedBytes  uint64  `json:"used_bytes"`
+	UsedPct    float64 `json:"used_pct"`
+}
+
+func diskUsage() (*DiskUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs("/", &stat); err != nil {
+		return nil, err
+	}
+	total := stat.Blocks * uint64(stat.Bsize)
+	free := stat.Bavail * uint64(stat.Bsize)
+	used := total - free
+	pct := float64(0)
+	if total > 0 {
+		pct = float64(used) / float64(total) * 100
+	}
+	return &DiskUsage{
+		TotalBytes: total,
+		FreeBytes:  free,
+		UsedBytes:  used,
+		UsedPct:    math.Round(pct*10) / 10,
+	}, nil
+}
+
+// SystemDisk returns the disk usage (for the header indicator)
+func SystemDisk(c *gin.Context) {
+	usage, err := diskUsage()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, usage)
+}
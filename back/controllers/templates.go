@@ -0,0 +1,340 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"back/database"
+	"back/middleware"
+	"back/models"
+	"back/scpi"
+)
+
+type CreateTemplateRequest struct {
+	Name    string         `json:"name" binding:"required"`
+	Shared  bool           `json:"shared"`
+	Comment string         `json:"comment"`
+	Plan    ExperimentPlan `json:"plan"`
+}
+
+type UpdateTemplateRequest struct {
+	Name    *string         `json:"name"`
+	Shared  *bool           `json:"shared"`
+	Comment string          `json:"comment"`
+	Plan    *ExperimentPlan `json:"plan"` // a new plan adds a version
+}
+
+type StartFromTemplateRequest struct {
+	Name    string  `json:"name" binding:"required"`
+	Version int     `json:"version"` // 0 = latest
+	Notes   *string `json:"notes"`   // replaces the template's notes
+}
+
+type CloneExperimentRequest struct {
+	Name   string `json:"name" binding:"required"`
+	Shared bool   `json:"shared"`
+}
+
+// canSeeTemplate: owners, admins and, for shared templates, everyone
+func canSeeTemplate(user *models.User, t *models.ExperimentTemplate) bool {
+	return t.Shared || t.UserID == user.ID || user.Role == models.RoleAdmin
+}
+
+func canEditTemplate(user *models.User, t *models.ExperimentTemplate) bool {
+	return t.UserID == user.ID || user.Role == models.RoleAdmin
+}
+
+// loadTemplate reads the template in the :id parameter and writes the error response
+// when it cannot be used
+func loadTemplate(c *gin.Context, user *models.User) (*models.ExperimentTemplate, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return nil, false
+	}
+	var t models.ExperimentTemplate
+	if err := database.DB.First(&t, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "template not found"})
+		return nil, false
+	}
+	if !canSeeTemplate(user, &t) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return nil, false
+	}
+	return &t, true
+}
+
+// addTemplateVersion stores plan as the next version of t
+func addTemplateVersion(tx *gorm.DB, t *models.ExperimentTemplate, plan ExperimentPlan, comment string, userID uint) error {
+	b, err := json.Marshal(plan)
+	if err != nil {
+		return err
+	}
+	v := models.ExperimentTemplateVersion{
+		TemplateID: t.ID,
+		Version:    t.Version,
+		PlanJSON:   string(b),
+		Comment:    comment,
+		CreatedBy:  userID,
+	}
+	return tx.Create(&v).Error
+}
+
+// createTemplate saves a new template with plan as version 1
+func createTemplate(user *models.User, name string, shared bool, plan ExperimentPlan, comment string) (*models.ExperimentTemplate, error) {
+	t := models.ExperimentTemplate{Name: name, UserID: user.ID, Shared: shared, Version: 1}
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&t).Error; err != nil {
+			return err
+		}
+		return addTemplateVersion(tx, &t, plan, comment, user.ID)
+	})
+	return &t, err
+}
+
+// ListTemplates returns the user's own templates and every shared one
+func ListTemplates(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	var templates []models.ExperimentTemplate
+
+	query := database.DB.Preload("User").Order("name, id")
+	if user.Role != models.RoleAdmin {
+		query = query.Where("user_id = ? OR shared = ?", user.ID, true)
+	}
+	if err := query.Find(&templates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, templates)
+}
+
+// GetTemplate returns a template with all its versions, newest first
+func GetTemplate(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	t, ok := loadTemplate(c, user)
+	if !ok {
+		return
+	}
+	if err := database.DB.Where("template_id = ?", t.ID).Order("version DESC").Find(&t.Versions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+func CreateTemplate(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	var req CreateTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, fail := resolvePlan(req.Plan); fail != nil {
+		c.JSON(fail.status, fail.body)
+		return
+	}
+
+	t, err := createTemplate(user, req.Name, req.Shared, req.Plan, req.Comment)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"id": t.ID, "version": t.Version})
+}
+
+// UpdateTemplate renames or (un)shares a template; a new plan is stored as the next version
+func UpdateTemplate(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	t, ok := loadTemplate(c, user)
+	if !ok {
+		return
+	}
+	if !canEditTemplate(user, t) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
+	var req UpdateTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name != nil {
+		if *req.Name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name must not be empty"})
+			return
+		}
+		t.Name = *req.Name
+	}
+	if req.Shared != nil {
+		t.Shared = *req.Shared
+	}
+	if req.Plan != nil {
+		if _, fail := resolvePlan(*req.Plan); fail != nil {
+			c.JSON(fail.status, fail.body)
+			return
+		}
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if req.Plan != nil {
+			t.Version++
+			if err := addTemplateVersion(tx, t, *req.Plan, req.Comment, user.ID); err != nil {
+				return err
+			}
+		}
+		return tx.Model(t).Select("name", "shared", "version").Updates(t).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "version": t.Version})
+}
+
+// DeleteTemplate removes a template and its versions. Experiments started from it keep
+// their template_id and version.
+func DeleteTemplate(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	t, ok := loadTemplate(c, user)
+	if !ok {
+		return
+	}
+	if !canEditTemplate(user, t) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("template_id = ?", t.ID).Delete(&models.ExperimentTemplateVersion{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(t).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// StartFromTemplate starts an experiment from a template version (the latest by default)
+func StartFromTemplate(c *gin.Context) {
+	user := middleware.GetCurrentUser(c)
+	if !user.InstrumentAccess && user.Role != models.RoleAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "no instrument access"})
+		return
+	}
+	t, ok := loadTemplate(c, user)
+	if !ok {
+		return
+	}
+
+	var req StartFromTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	version := req.Version
+	if version == 0 {
+		version = t.Version
+	}
+
+	var v models.ExperimentTemplateVersion
+	if err := database.DB.Where("template_id = ? AND version = ?", t.ID, version).First(&v).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("template version %d not found", version)})
+		return
+	}
+	start := StartExperimentRequest{Name: req.Name}
+	if err := json.Unmarshal([]byte(v.PlanJSON), &start.ExperimentPlan); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid template plan: " + err.Error()})
+		return
+	}
+	if req.Notes != nil {
+		start.Notes = *req.Notes
+	}
+
+	exp, fail := startExperiment(user, start, &v)
+	if fail != nil {
+		c.JSON(fail.status, fail.body)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"experiment": exp})
+}
+
+// CloneExperimentAsTemplate saves the setup of an experiment as a new template
+func CloneExperimentAsTemplate(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	user := middleware.GetCurrentUser(c)
+	var exp models.Experiment
+	if err := database.DB.First(&exp, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "experiment not found"})
+		return
+	}
+	if user.Role != models.RoleAdmin && user.Permission == models.PermReadOwn && exp.UserID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return
+	}
+
+	var req CloneExperimentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	plan, err := planFromExperiment(&exp)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	t, err := createTemplate(user, req.Name, req.Shared, plan, fmt.Sprintf("cloned from experiment %d", exp.ID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"id": t.ID, "version": t.Version})
+}
+
+// planFromExperiment rebuilds the plan an experiment was started with from its stored JSON
+func planFromExperiment(exp *models.Experiment) (ExperimentPlan, error) {
+	plan := ExperimentPlan{
+		InstrumentIDs: exp.InstrumentIDs,
+		Notes:         exp.Notes,
+		DurationSec:   exp.DurationSec,
+	}
+	if exp.SettingsJSON != "" {
+		if err := json.Unmarshal([]byte(exp.SettingsJSON), &plan.Settings); err != nil {
+			return plan, fmt.Errorf("settings_json: %v", err)
+		}
+	}
+	if exp.HvScheduleJSON != "" {
+		if err := json.Unmarshal([]byte(exp.HvScheduleJSON), &plan.HvSchedule); err != nil {
+			return plan, fmt.Errorf("hv_schedule_json: %v", err)
+		}
+	}
+	if exp.RulesJSON != "" {
+		if err := json.Unmarshal([]byte(exp.RulesJSON), &plan.Rules); err != nil {
+			return plan, fmt.Errorf("rules_json: %v", err)
+		}
+	}
+	// Watchdog, error handling and the sequence are only kept in the run plan
+	if exp.RunPlanJSON != "" {
+		if rp, err := scpi.ParseRunPlan(exp.RunPlanJSON); err == nil {
+			plan.Watchdog = rp.Watchdog
+			plan.AutoClearErrors = rp.AutoClearErrors
+			plan.Sequence = rp.Sequence
+			plan.SubtractBaseline = len(rp.Baselines) > 0
+		}
+	}
+	return plan, nil
+}
@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"back/models"
+	"back/scpi"
+)
+
+func TestTemplateAccess(t *testing.T) {
+	owner := &models.User{ID: 1, Role: models.RoleUser}
+	other := &models.User{ID: 2, Role: models.RoleUser}
+	admin := &models.User{ID: 3, Role: models.RoleAdmin}
+	private := &models.ExperimentTemplate{UserID: 1}
+	shared := &models.ExperimentTemplate{UserID: 1, Shared: true}
+
+	for _, tt := range []struct {
+		user      *models.User
+		tmpl      *models.ExperimentTemplate
+		see, edit bool
+	}{
+		{owner, private, true, true},
+		{other, private, false, false},
+		{other, shared, true, false},
+		{admin, private, true, true},
+	} {
+		if got := canSeeTemplate(tt.user, tt.tmpl); got != tt.see {
+			t.Errorf("user %d, shared=%v: see %v", tt.user.ID, tt.tmpl.Shared, got)
+		}
+		if got := canEditTemplate(tt.user, tt.tmpl); got != tt.edit {
+			t.Errorf("user %d, shared=%v: edit %v", tt.user.ID, tt.tmpl.Shared, got)
+		}
+	}
+}
+
+func TestPlanFromExperiment(t *testing.T) {
+	settings := scpi.DefaultSettings()
+	settings.SourceVolt = 120
+	want := ExperimentPlan{
+		InstrumentIDs:   "4,5",
+		Notes:           "cloned",
+		Settings:        map[string]*scpi.InstrumentSettings{"4": &settings},
+		DurationSec:     600,
+		HvSchedule:      map[string]json.RawMessage{"4": json.RawMessage(`[{"time_sec":0,"voltage":120}]`)},
+		Rules:           []scpi.Rule{{InstrumentID: 4, Metric: "current", Op: ">", Value: 1e-6, Action: "stop"}},
+		Watchdog:        scpi.WatchdogConfig{Failures: 3, FailAfterSec: 30},
+		AutoClearErrors: true,
+	}
+
+	marshal := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	exp := &models.Experiment{
+		InstrumentIDs:  want.InstrumentIDs,
+		Notes:          want.Notes,
+		DurationSec:    want.DurationSec,
+		SettingsJSON:   marshal(want.Settings),
+		HvScheduleJSON: marshal(want.HvSchedule),
+		RulesJSON:      marshal(want.Rules),
+		RunPlanJSON:    marshal(scpi.RunPlan{InstrumentIDs: []uint{4, 5}, StartedAt: time.Now(), Watchdog: want.Watchdog, AutoClearErrors: true}),
+	}
+	got, err := planFromExperiment(exp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marshal(got) != marshal(want) || !reflect.DeepEqual(*got.Settings["4"], settings) {
+		t.Fatalf("plan\n%s\nwant\n%s", marshal(got), marshal(want))
+	}
+
+	exp.SettingsJSON = "{"
+	if _, err := planFromExperiment(exp); err == nil {
+		t.Fatal("broken settings_json accepted")
+	}
+}
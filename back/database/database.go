@@ -30,6 +30,17 @@ func Init() {
 		&models.Camera{},
 		&models.Experiment{},
 		&models.Measurement{},
+		&models.ExperimentEvent{},
+		&models.InstrumentSnapshot{},
+		&models.ExperimentTemplate{},
+		&models.ExperimentTemplateVersion{},
+		&models.ExperimentPause{},
+		&models.ExperimentPlanRevision{},
+		&models.QueuedRun{},
+		&models.QueueState{},
+		&models.Notification{},
+		&models.ExperimentStep{},
+		&models.InstrumentCalibration{},
 	); err != nil {
 		log.Fatal("Auto-migration failed:", err)
 	}
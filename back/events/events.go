@@ -0,0 +1,116 @@
+// Package events records the timeline of an experiment: state changes, HV schedule
+// progress, communication problems, manual commands and video recording.
+//
+// Events are written asynchronously so pollers never wait for the database, and are
+// published on the live stream so charts can be annotated while the run is going.
+package events
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"back/broker"
+	"back/database"
+	"back/models"
+)
+
+// Event types
+const (
+	ExperimentStarted      = "experiment_started"
+	ExperimentStopped      = "experiment_stopped" // stopped by a user
+	ExperimentPaused       = "experiment_paused"
+	ExperimentResumed      = "experiment_resumed"
+	PlanAmended            = "plan_amended"  // duration, HV schedule or settings changed while running
+	SequenceStep           = "sequence_step" // a sequence moved to its next step
+	AutoStop               = "auto_stop"     // planned duration elapsed
+	SettingsApplied        = "settings_applied"
+	HvSegment              = "hv_segment" // the HV schedule moved to its next step
+	HvSetpointFailed       = "hv_setpoint_failed"
+	FetchError             = "fetch_error"     // first failed fetch after a good one
+	FetchRecovered         = "fetch_recovered" // first good fetch after failures
+	Reconnect              = "reconnect"
+	InstrumentError        = "instrument_error"         // a reading reported an error code, or the error queue had messages
+	InstrumentErrorCleared = "instrument_error_cleared" // readings report no error again
+	InstrumentDegraded     = "instrument_degraded"      // watchdog: too many consecutive failed polls
+	InstrumentRecovered    = "instrument_recovered"     // watchdog: a degraded instrument answers again
+	InstrumentFailed       = "instrument_failed"        // watchdog: degraded past the grace period, experiment failed
+	RuleFired              = "rule_fired"
+	RuleCleared            = "rule_cleared"
+	ScpiCommand            = "scpi_command" // manual command sent to an instrument of a running experiment
+	RecordingStarted       = "recording_started"
+	RecordingStopped       = "recording_stopped"
+	RecordingFailed        = "recording_failed"
+	EmergencyStop          = "emergency_stop"
+	BaselineSuspended      = "baseline_suspended" // function or range differ from the calibration, the offset is not subtracted
+	BaselineResumed        = "baseline_resumed"   // the calibrated function and range are back, the offset is subtracted again
+)
+
+const (
+	queueSize     = 1024
+	storeAttempts = 60 // one per second, then the event is dropped
+)
+
+var queue = make(chan models.ExperimentEvent, queueSize)
+
+func init() {
+	go writer()
+}
+
+// Record queues an event of an experiment. instrumentID may be 0 for experiment-wide
+// events; data is stored as JSON when not nil. Never blocks: on overflow the event is logged and dropped.
+func Record(experimentID, instrumentID uint, typ, message string, data interface{}) {
+	ev := models.ExperimentEvent{
+		ExperimentID: experimentID,
+		Type:         typ,
+		Message:      message,
+		CreatedAt:    time.Now(),
+	}
+	if instrumentID != 0 {
+		id := instrumentID
+		ev.InstrumentID = &id
+	}
+	if data != nil {
+		if b, err := json.Marshal(data); err == nil {
+			ev.DataJSON = string(b)
+		}
+	}
+
+	broker.Default.PublishEvent(ev)
+
+	select {
+	case queue <- ev:
+	default:
+		log.Printf("[EVENTS] queue full, dropped exp=%d %s: %s", experimentID, typ, message)
+	}
+}
+
+// List returns the events of an experiment in time order, optionally filtered
+func List(experimentID uint, typ string, instrumentID uint) ([]models.ExperimentEvent, error) {
+	q := database.DB.Where("experiment_id = ?", experimentID)
+	if typ != "" {
+		q = q.Where("type = ?", typ)
+	}
+	if instrumentID != 0 {
+		q = q.Where("instrument_id = ? OR instrument_id IS NULL", instrumentID)
+	}
+	evs := []models.ExperimentEvent{}
+	err := q.Order("created_at ASC, id ASC").Find(&evs).Error
+	return evs, err
+}
+
+func writer() {
+	for ev := range queue {
+		// Retry for a while so short database outages don't lose the timeline
+		var err error
+		for attempt := 0; attempt < storeAttempts; attempt++ {
+			if err = database.DB.Create(&ev).Error; err == nil {
+				break
+			}
+			time.Sleep(time.Second)
+		}
+		if err != nil {
+			log.Printf("[EVENTS] dropped exp=%d %s after %d attempts: %v", ev.ExperimentID, ev.Type, storeAttempts, err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package events
+
+import (
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"back/broker"
+	"back/database"
+)
+
+// TestMain gives the background writer an unreachable database: stores fail and are
+// retried, nothing here waits for them
+func TestMain(m *testing.M) {
+	var err error
+	database.DB, err = gorm.Open(postgres.Open("host=127.0.0.1 port=1 user=test dbname=test sslmode=disable connect_timeout=1"),
+		&gorm.Config{DisableAutomaticPing: true, Logger: logger.Discard})
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestRecordPublishes(t *testing.T) {
+	sub, _, _ := broker.Default.Subscribe(9501, 0)
+	defer broker.Default.Unsubscribe(sub)
+
+	before := time.Now()
+	Record(9501, 3, RuleFired, "leak -> stop", map[string]interface{}{"value": 2e-9})
+	Record(9501, 0, AutoStop, "planned duration elapsed", nil)
+
+	ev := <-sub.C
+	if ev.Kind != broker.KindEvent || ev.InstrumentID != 3 || ev.Event == nil {
+		t.Fatalf("first event %+v", ev)
+	}
+	e := ev.Event
+	if e.Type != RuleFired || e.Message != "leak -> stop" || e.DataJSON != `{"value":2e-9}` ||
+		e.InstrumentID == nil || *e.InstrumentID != 3 || e.CreatedAt.Before(before) || !ev.At.Equal(e.CreatedAt) {
+		t.Fatalf("first event %+v", e)
+	}
+
+	ev = <-sub.C
+	if ev.InstrumentID != 0 || ev.Event.InstrumentID != nil || ev.Event.DataJSON != "" || ev.Event.Type != AutoStop {
+		t.Fatalf("experiment-wide event %+v", ev.Event)
+	}
+}
@@ -3,8 +3,8 @@ package main
 import (
 	"fmt"
 	"log"
-	"math"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"syscall"
@@ -22,22 +22,50 @@ import (
 	"back/storage"
 )
 
+// shutdownHaltWait bounds how long shutdown waits for the pollers to stop
+const shutdownHaltWait = 5 * time.Second
+
 func main() {
 	database.Init()
 	storage.Init()
 
-	// Clean orphaned experiments: if server restarted, mark stale "running"/"stopping" as "error"
-	var orphanCount int64
-	database.DB.Model(&models.Experiment{}).Where("status IN ?", []string{"running", "stopping"}).Count(&orphanCount)
-	if orphanCount > 0 {
-		database.DB.Model(&models.Experiment{}).Where("status IN ?", []string{"running", "stopping"}).
-			Update("status", models.StatusError)
-		log.Printf("[STARTUP] Cleaned %d orphaned running/stopping experiments", orphanCount)
-	}
-
 	syncInstruments()
 	syncCameras()
 
+	// Sessions for every instrument, so the interlock knows their limits and the
+	// emergency stop can reach them without the database
+	var instruments []models.Instrument
+	database.DB.Find(&instruments)
+	scpi.DefaultSessions.Open(instruments)
+
+	// Calibrations cut short by a previous process no longer hold their instruments
+	scpi.ReleaseCalibrations()
+
+	// Replay measurements spilled to disk while the database was unavailable
+	scpi.DefaultJournal.Start()
+
+	// Experiments left running by a previous process: resume polling or shut down safely
+	for _, id := range scpi.Recover(scpi.RecoveryModeFromEnv()) {
+		recorder.Default.Start(id)
+	}
+
+	// Scheduled and queued experiments
+	controllers.StartQueue()
+
+	// On SIGINT/SIGTERM stop polling, so no new readings arrive, then persist the buffered
+	// ones. Runs stay running in the database and are recovered by the next process.
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		halted := scpi.DefaultRunner.Halt(shutdownHaltWait)
+		log.Printf("[SHUTDOWN] halted %d runs, flushing measurement writer", len(halted))
+		scpi.DefaultWriter.Flush()
+		scpi.DefaultWriter.Close()
+		scpi.DefaultJournal.Close()
+		os.Exit(0)
+	}()
+
 	r := gin.Default()
 
 	// CORS — allow all origins so the frontend can reach the backend from any IP/domain
@@ -53,30 +81,14 @@ func main() {
 	r.GET("/health", func(c *gin.Context) { c.JSON(200, gin.H{"ok": true}) })
 
 	// System disk usage (for header indicator)
-	r.GET("/system/disk", func(c *gin.Context) {
-		var stat syscall.Statfs_t
-		if err := syscall.Statfs("/", &stat); err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
-			return
-		}
-		total := stat.Blocks * uint64(stat.Bsize)
-		free := stat.Bavail * uint64(stat.Bsize)
-		used := total - free
-		pct := float64(0)
-		if total > 0 {
-			pct = float64(used) / float64(total) * 100
-		}
-		c.JSON(200, gin.H{
-			"total_bytes": total,
-			"free_bytes":  free,
-			"used_bytes":  used,
-			"used_pct":    math.Round(pct*10) / 10,
-		})
-	})
+	r.GET("/system/disk", controllers.SystemDisk)
 
 	// Auth (public)
 	r.POST("/auth/login", controllers.Login)
 
+	// Emergency stop: token only, no database lookup
+	r.POST("/emergency-stop", middleware.TokenRequired(), controllers.EmergencyStop)
+
 	// All routes below require auth
 	auth := r.Group("/")
 	auth.Use(middleware.AuthRequired())
@@ -92,15 +104,25 @@ func main() {
 			admin.POST("/users", controllers.CreateUser)
 			admin.PUT("/users/:id", controllers.UpdateUser)
 			admin.DELETE("/users/:id", controllers.DeleteUser)
+			admin.PUT("/instruments/:id/limits", controllers.UpdateInstrumentLimits)
+			admin.POST("/queue/resume", controllers.ResumeQueue)
+
+			// Measurement write pipeline metrics (buffer fill, dropped rows, flush latency)
+			admin.GET("/system/writer", func(c *gin.Context) { c.JSON(200, scpi.DefaultWriter.Stats()) })
 		}
 
 		// Instruments (read-only + toggle active)
 		auth.GET("/instruments", controllers.ListInstruments)
+		auth.GET("/instruments/error-codes", controllers.ListErrorCodes)
 		auth.GET("/instruments/:id/ping", controllers.PingInstrument)
 		auth.GET("/instruments/:id/probe", controllers.ProbeInstrument)
+		auth.GET("/instruments/:id/session", controllers.GetInstrumentSession)
 		auth.GET("/instruments/:id/settings", controllers.GetInstrumentSettings)
 		auth.POST("/instruments/:id/command", controllers.SendCommand)
+		auth.POST("/instruments/:id/clear-error", controllers.ClearInstrumentError)
 		auth.POST("/instruments/:id/settings", controllers.ApplySettingsEndpoint)
+		auth.POST("/instruments/:id/calibrate", controllers.CalibrateInstrument)
+		auth.GET("/instruments/:id/calibrations", controllers.ListInstrumentCalibrations)
 		auth.PUT("/instruments/:id/toggle", controllers.ToggleInstrument)
 
 		// Cameras
@@ -112,6 +134,11 @@ func main() {
 		auth.GET("/experiments/:id", controllers.GetExperiment)
 		auth.GET("/experiments/:id/data", controllers.GetExperimentData)
 		auth.GET("/experiments/:id/status", controllers.ExperimentStatusCheck)
+		auth.GET("/experiments/:id/events", controllers.ListExperimentEvents)
+		auth.GET("/experiments/:id/snapshots", controllers.ListExperimentSnapshots)
+		auth.GET("/experiments/:id/steps", controllers.ListExperimentSteps)
+		auth.GET("/experiments/:id/plan/revisions", controllers.ListPlanRevisions)
+		auth.GET("/experiments/:id/stream", controllers.StreamExperiment)
 		auth.GET("/experiments/:id/video", controllers.GetExperimentVideo)
 		auth.GET("/experiments/:id/csv", controllers.ExportExperimentCSV)
 		auth.DELETE("/experiments/:id", controllers.DeleteExperiment)
@@ -119,6 +146,29 @@ func main() {
 		// Start / Stop measurement
 		auth.POST("/experiments/start", controllers.StartExperiment)
 		auth.POST("/experiments/:id/stop", controllers.StopExperiment)
+		auth.POST("/experiments/:id/pause", controllers.PauseExperiment)
+		auth.POST("/experiments/:id/resume", controllers.ResumeExperiment)
+		auth.PUT("/experiments/:id/plan", controllers.AmendExperiment)
+		auth.POST("/hv-schedule/preview", controllers.PreviewHvSchedule)
+
+		// Experiment templates
+		auth.GET("/templates", controllers.ListTemplates)
+		auth.GET("/templates/:id", controllers.GetTemplate)
+		auth.POST("/templates", controllers.CreateTemplate)
+		auth.PUT("/templates/:id", controllers.UpdateTemplate)
+		auth.DELETE("/templates/:id", controllers.DeleteTemplate)
+		auth.POST("/templates/:id/start", controllers.StartFromTemplate)
+		auth.POST("/experiments/:id/template", controllers.CloneExperimentAsTemplate)
+
+		// Experiment queue
+		auth.GET("/queue", controllers.ListQueue)
+		auth.GET("/queue/state", controllers.GetQueueState)
+		auth.POST("/queue", controllers.EnqueueExperiment)
+		auth.POST("/queue/:id/check", controllers.CheckQueuedRun)
+		auth.DELETE("/queue/:id", controllers.CancelQueuedRun)
+
+		auth.GET("/notifications", controllers.ListNotifications)
+		auth.POST("/notifications/:id/read", controllers.MarkNotificationRead)
 	}
 
 	if err := r.Run(":8080"); err != nil {
@@ -183,12 +233,9 @@ func syncInstruments() {
 			log.Printf("Instrument renamed: %s (%s:%d)", e.Name, e.Host, e.Port)
 		}
 		// Query *IDN?
-		if info, err := scpi.QueryIDN(inst.Host, inst.Port); err == nil {
-			inst.Model = info.Model
-			inst.Firmware = info.Firmware
-			inst.Serial = info.Serial
-			database.DB.Save(&inst)
-			log.Printf("Instrument OK: %s (model=%s fw=%s)", inst.Name, info.Model, info.Firmware)
+		if info, err := scpi.IdentifyInstrument(inst); err == nil {
+			scpi.RecordIdentity(&inst, info)
+			log.Printf("Instrument OK: %s (model=%s fw=%s driver=%s)", inst.Name, info.Model, info.Firmware, scpi.DriverFor(inst).Name())
 		} else {
 			log.Printf("Instrument %s (%s:%d) unreachable: %v", inst.Name, inst.Host, inst.Port, err)
 		}
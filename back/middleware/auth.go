@@ -103,6 +103,40 @@ func AdminRequired() gin.HandlerFunc {
 	}
 }
 
+// TokenRequired only validates the JWT, without loading the user, so routes behind it
+// keep working while the database is down. The claims are stored as "claims".
+func TokenRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenStr := ""
+		if parts := strings.SplitN(c.GetHeader("Authorization"), " ", 2); len(parts) == 2 && parts[0] == "Bearer" {
+			tokenStr = parts[1]
+		}
+		if tokenStr == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization required"})
+			return
+		}
+		claims := &Claims{}
+		token, err := jwt.ParseWithClaims(tokenStr, claims, func(t *jwt.Token) (interface{}, error) {
+			return jwtSecret, nil
+		})
+		if err != nil || !token.Valid {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+			return
+		}
+		c.Set("claims", claims)
+		c.Next()
+	}
+}
+
+// GetClaims returns the token claims stored by TokenRequired
+func GetClaims(c *gin.Context) *Claims {
+	cl, exists := c.Get("claims")
+	if !exists {
+		return nil
+	}
+	return cl.(*Claims)
+}
+
 func GetCurrentUser(c *gin.Context) *models.User {
 	u, exists := c.Get("user")
 	if !exists {
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// InstrumentCalibration is one run of the calibration procedure: an optional zero
+// correction at the instrument, then the offset current measured with the source off.
+type InstrumentCalibration struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	InstrumentID  uint      `gorm:"not null;index" json:"instrument_id"`
+	UserID        uint      `json:"user_id"`
+	Driver        string    `gorm:"size:50" json:"driver"`
+	Serial        string    `gorm:"size:100" json:"serial"`         // instrument serial at the time, the offset belongs to the unit
+	SettingsJSON  string    `gorm:"type:text" json:"settings_json"` // JSON: scpi.InstrumentSettings measured with
+	ZeroCorrected bool      `json:"zero_corrected"`                 // the instrument acquired a new zero first
+	Samples       int       `json:"samples"`
+	OffsetCurrent float64   `json:"offset_current"` // mean current (A), the baseline
+	NoiseCurrent  float64   `json:"noise_current"`  // standard deviation (A)
+	MinCurrent    float64   `json:"min_current"`
+	MaxCurrent    float64   `json:"max_current"`
+	SamplesJSON   string    `gorm:"type:text" json:"samples_json"` // JSON: []float64 currents
+	Comment       string    `gorm:"type:text" json:"comment"`
+	CreatedAt     time.Time `gorm:"index" json:"created_at"`
+}
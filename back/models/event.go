@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// ExperimentEvent is something that happened during an experiment (rule firing, state change, ...)
+type ExperimentEvent struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	ExperimentID uint      `gorm:"not null;index" json:"experiment_id"`
+	InstrumentID *uint     `json:"instrument_id"` // nil for experiment-wide events
+	Type         string    `gorm:"size:50;not null" json:"type"`
+	Message      string    `gorm:"type:text" json:"message"`
+	DataJSON     string    `gorm:"type:text" json:"data_json"` // optional JSON details
+	CreatedAt    time.Time `gorm:"index" json:"created_at"`
+}
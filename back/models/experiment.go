@@ -6,25 +6,32 @@ type ExperimentStatus string
 
 const (
 	StatusRunning   ExperimentStatus = "running"
+	StatusPaused    ExperimentStatus = "paused" // polling suspended, instruments still reserved
 	StatusStopped   ExperimentStatus = "stopped"
 	StatusCompleted ExperimentStatus = "completed"
 	StatusError     ExperimentStatus = "error"
 )
 
 type Experiment struct {
-	ID             uint             `gorm:"primaryKey" json:"id"`
-	Name           string           `gorm:"size:300;not null" json:"name"`
-	UserID         uint             `gorm:"not null;index" json:"user_id"`
-	User           User             `gorm:"foreignKey:UserID" json:"user,omitempty"`
-	Status         ExperimentStatus `gorm:"size:20;not null;default:stopped" json:"status"`
-	StartTime      *time.Time       `json:"start_time"`
-	EndTime        *time.Time       `json:"end_time"`
-	InstrumentIDs  string           `gorm:"size:500" json:"instrument_ids"` // comma-separated IDs
-	Notes          string           `gorm:"type:text" json:"notes"`
-	SettingsJSON   string           `gorm:"type:text" json:"settings_json"`    // JSON: map[instrumentId]InstrumentSettings
-	DurationSec    int              `json:"duration_sec"`                      // planned duration in seconds (0 = unlimited)
-	HvScheduleJSON string           `gorm:"type:text" json:"hv_schedule_json"` // JSON: map[instrumentId][]HvPoint
-	VideoPath      string           `gorm:"size:500" json:"video_path"`
-	CreatedAt      time.Time        `json:"created_at"`
-	UpdatedAt      time.Time        `json:"updated_at"`
+	ID              uint             `gorm:"primaryKey" json:"id"`
+	Name            string           `gorm:"size:300;not null" json:"name"`
+	UserID          uint             `gorm:"not null;index" json:"user_id"`
+	User            User             `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	Status          ExperimentStatus `gorm:"size:20;not null;default:stopped" json:"status"`
+	StartTime       *time.Time       `json:"start_time"`
+	EndTime         *time.Time       `json:"end_time"`
+	InstrumentIDs   string           `gorm:"size:500" json:"instrument_ids"` // comma-separated IDs
+	Notes           string           `gorm:"type:text" json:"notes"`
+	SettingsJSON    string           `gorm:"type:text" json:"settings_json"`    // JSON: map[instrumentId]InstrumentSettings
+	DurationSec     int              `json:"duration_sec"`                      // planned duration in seconds (0 = unlimited)
+	HvScheduleJSON  string           `gorm:"type:text" json:"hv_schedule_json"` // JSON: map[instrumentId]HvProgram (or legacy []HvPoint)
+	RulesJSON       string           `gorm:"type:text" json:"rules_json"`       // JSON: []scpi.Rule
+	RunPlanJSON     string           `gorm:"type:text" json:"run_plan_json"`    // JSON: scpi.RunPlan, used to resume after a restart
+	StatusReason    string           `gorm:"type:text" json:"status_reason"`    // why the experiment ended up in its status (e.g. restart recovery)
+	VideoPath       string           `gorm:"size:500" json:"video_path"`
+	TemplateID      *uint            `gorm:"index" json:"template_id"` // template the experiment was started from
+	TemplateVersion int              `json:"template_version"`         // version of that template
+	PlanRevision    int              `json:"plan_revision"`            // number of amendments made while running
+	CreatedAt       time.Time        `json:"created_at"`
+	UpdatedAt       time.Time        `json:"updated_at"`
 }
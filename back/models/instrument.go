@@ -3,15 +3,19 @@ package models
 import "time"
 
 type Instrument struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	Name      string    `gorm:"size:200;not null" json:"name"`
-	Host      string    `gorm:"size:100;not null" json:"host"`
-	Port      int       `gorm:"not null" json:"port"`
-	Active    bool      `gorm:"not null;default:true" json:"active"`
-	Model     string    `gorm:"size:100" json:"model"`
-	Firmware  string    `gorm:"size:100" json:"firmware"`
-	Serial    string    `gorm:"size:100" json:"serial"`
-	Online    bool      `gorm:"-" json:"online"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID               uint       `gorm:"primaryKey" json:"id"`
+	Name             string     `gorm:"size:200;not null" json:"name"`
+	Host             string     `gorm:"size:100;not null" json:"host"`
+	Port             int        `gorm:"not null" json:"port"`
+	Active           bool       `gorm:"not null;default:true" json:"active"`
+	Model            string     `gorm:"size:100" json:"model"`
+	Firmware         string     `gorm:"size:100" json:"firmware"`
+	Serial           string     `gorm:"size:100" json:"serial"`
+	ReservedBy       *uint      `gorm:"index" json:"reserved_by"`              // running experiment that owns the instrument
+	CalibratingSince *time.Time `json:"calibrating_since"`                     // set while the calibration procedure holds the instrument
+	MaxVoltage       float64    `gorm:"not null;default:0" json:"max_voltage"` // interlock: |source voltage| limit, 0 = none
+	Online           bool       `gorm:"-" json:"online"`
+	Driver           string     `gorm:"-" json:"driver"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
 }
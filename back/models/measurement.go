@@ -3,18 +3,22 @@ package models
 import "time"
 
 type Measurement struct {
-	ID           uint      `gorm:"primaryKey" json:"id"`
-	ExperimentID uint      `gorm:"not null;index" json:"experiment_id"`
-	InstrumentID uint      `gorm:"not null;index" json:"instrument_id"`
-	DeviceTime   string    `gorm:"size:30" json:"device_time"`
-	RecordedAt   time.Time `gorm:"autoCreateTime" json:"recorded_at"`
-	Voltage      float64   `json:"voltage"`
-	Current      float64   `json:"current"`
-	Charge       float64   `json:"charge"`
-	Resistance   float64   `json:"resistance"`
-	Temperature  float64   `json:"temperature"`
-	Humidity     float64   `json:"humidity"`
-	Source       float64   `json:"source"`
-	MathValue    float64   `json:"math_value"`
-	ErrorCode    int       `json:"error_code"`
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	ExperimentID uint       `gorm:"not null;index" json:"experiment_id"`
+	InstrumentID uint       `gorm:"not null;index" json:"instrument_id"`
+	DeviceTime   string     `gorm:"size:30" json:"device_time"`
+	RecordedAt   time.Time  `gorm:"autoCreateTime" json:"recorded_at"`
+	AcquiredAt   *time.Time `json:"acquired_at"`   // device timestamp mapped to host time (request midpoint if the device has no clock)
+	RoundTripMs  float64    `json:"round_trip_ms"` // duration of the fetch request
+	Voltage      float64    `json:"voltage"`
+	Current      float64    `json:"current"`               // baseline subtracted when the run has one
+	RawCurrent   *float64   `json:"raw_current,omitempty"` // reading before the baseline was subtracted, nil when it was not
+	Charge       float64    `json:"charge"`
+	Resistance   float64    `json:"resistance"`
+	Temperature  float64    `json:"temperature"`
+	Humidity     float64    `json:"humidity"`
+	Source       float64    `json:"source"`
+	MathValue    float64    `json:"math_value"`
+	ErrorCode    int        `json:"error_code"`
+	ErrorText    string     `gorm:"-" json:"error_text,omitempty"` // decoded ErrorCode, filled in by the API
 }
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// Notification is a message for a user about something that happened without them,
+// such as a queued run that was skipped. ReadAt is nil until the user has seen it.
+type Notification struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	UserID      uint       `gorm:"not null;index" json:"user_id"`
+	Type        string     `gorm:"size:50;not null" json:"type"`
+	Message     string     `gorm:"type:text" json:"message"`
+	QueuedRunID *uint      `json:"queued_run_id"`
+	ReadAt      *time.Time `json:"read_at"`
+	CreatedAt   time.Time  `gorm:"index" json:"created_at"`
+}
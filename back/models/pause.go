@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// ExperimentPause is one interval during which a running experiment was paused.
+// ResumedAt is nil while the pause lasts.
+type ExperimentPause struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	ExperimentID uint       `gorm:"not null;index" json:"experiment_id"`
+	PausedAt     time.Time  `gorm:"not null" json:"paused_at"`
+	ResumedAt    *time.Time `json:"resumed_at"`
+	HvMode       string     `gorm:"size:10;not null" json:"hv_mode"` // hold or zero
+	Reason       string     `gorm:"type:text" json:"reason"`
+	PausedBy     uint       `json:"paused_by"`
+	ResumedBy    uint       `json:"resumed_by"`
+}
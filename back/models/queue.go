@@ -0,0 +1,47 @@
+package models
+
+import "time"
+
+type QueueStatus string
+
+const (
+	QueueWaiting   QueueStatus = "queued"    // waiting for its time or for the previous run
+	QueueStarting  QueueStatus = "starting"  // pre-checks and start in progress
+	QueueStarted   QueueStatus = "started"   // experiment running
+	QueueFinished  QueueStatus = "finished"  // experiment ended
+	QueueSkipped   QueueStatus = "skipped"   // a pre-check failed or the start window passed
+	QueueFailed    QueueStatus = "failed"    // the start itself failed
+	QueueCancelled QueueStatus = "cancelled" // removed by a user before it started
+)
+
+// QueuedRun is an experiment waiting to be started by the queue: at StartAt, or when
+// the run before it in the queue has finished if StartAt is nil.
+type QueuedRun struct {
+	ID            uint        `gorm:"primaryKey" json:"id"`
+	Name          string      `gorm:"size:300;not null" json:"name"`
+	UserID        uint        `gorm:"not null;index" json:"user_id"`
+	User          User        `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	Position      int         `gorm:"not null;index" json:"position"`             // queue order
+	StartAt       *time.Time  `json:"start_at"`                                   // nil = after the previous run
+	MaxDelaySec   int         `json:"max_delay_sec"`                              // scheduled runs: how long to wait for busy instruments (0 = forever)
+	MinFreeDiskMB int         `json:"min_free_disk_mb"`                           // pre-check: free space needed on the data disk
+	SkipCameras   bool        `gorm:"not null;default:false" json:"skip_cameras"` // do not require the active cameras to be reachable
+	PlanJSON      string      `gorm:"type:text;not null" json:"plan_json"`        // JSON: controllers.ExperimentPlan
+	Status        QueueStatus `gorm:"size:20;not null;default:queued;index" json:"status"`
+	Reason        string      `gorm:"type:text" json:"reason"`      // why the run was skipped or failed
+	ChecksJSON    string      `gorm:"type:text" json:"checks_json"` // JSON: results of the last pre-check
+	ExperimentID  *uint       `gorm:"index" json:"experiment_id"`
+	StartedAt     *time.Time  `json:"started_at"`
+	CreatedAt     time.Time   `json:"created_at"`
+	UpdatedAt     time.Time   `json:"updated_at"`
+}
+
+// QueueState is the single row (ID 1) recording whether the queue may start runs. An
+// emergency stop pauses it; only an admin resumes it.
+type QueueState struct {
+	ID        uint       `gorm:"primaryKey" json:"-"`
+	Paused    bool       `gorm:"not null;default:false" json:"paused"`
+	Reason    string     `gorm:"type:text" json:"reason"`
+	PausedAt  *time.Time `json:"paused_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// ExperimentPlanRevision is one change made to the plan of a running experiment.
+// Revision 0 is the plan the experiment started with and is not stored.
+type ExperimentPlanRevision struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	ExperimentID uint      `gorm:"not null;uniqueIndex:idx_plan_revision" json:"experiment_id"`
+	Revision     int       `gorm:"not null;uniqueIndex:idx_plan_revision" json:"revision"`
+	ChangesJSON  string    `gorm:"type:text" json:"changes_json"`  // JSON: the amendment as requested
+	RunPlanJSON  string    `gorm:"type:text" json:"run_plan_json"` // JSON: scpi.RunPlan in effect after the change
+	Comment      string    `gorm:"type:text" json:"comment"`
+	CreatedBy    uint      `json:"created_by"`
+	CreatedAt    time.Time `json:"created_at"`
+}
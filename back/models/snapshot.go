@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// InstrumentSnapshot is the configuration an instrument actually had when an experiment
+// started, as read from the instrument. Written once at start and never updated.
+type InstrumentSnapshot struct {
+	ID              uint      `gorm:"primaryKey" json:"id"`
+	ExperimentID    uint      `gorm:"not null;uniqueIndex:idx_snapshot_exp_inst" json:"experiment_id"`
+	InstrumentID    uint      `gorm:"not null;uniqueIndex:idx_snapshot_exp_inst" json:"instrument_id"`
+	InstrumentName  string    `gorm:"size:200" json:"instrument_name"`
+	Host            string    `gorm:"size:200" json:"host"`
+	Port            int       `json:"port"`
+	Driver          string    `gorm:"size:50" json:"driver"`
+	IDN             string    `gorm:"size:300" json:"idn"` // raw *IDN? reply
+	Manufacturer    string    `gorm:"size:200" json:"manufacturer"`
+	Model           string    `gorm:"size:100" json:"model"`
+	Firmware        string    `gorm:"size:100" json:"firmware"`
+	Serial          string    `gorm:"size:100" json:"serial"`
+	CalibrationDate string    `gorm:"size:50" json:"calibration_date"` // empty when the instrument does not report it
+	RequestedJSON   string    `gorm:"type:text" json:"requested_json"` // JSON: scpi.InstrumentSettings the experiment asked for
+	SettingsJSON    string    `gorm:"type:text" json:"settings_json"`  // JSON: scpi.InstrumentSettings read back from the instrument
+	StateJSON       string    `gorm:"type:text" json:"state_json"`     // JSON: map[query]reply of every readable setting
+	Error           string    `gorm:"type:text" json:"error"`          // what could not be read
+	CreatedAt       time.Time `json:"created_at"`
+}
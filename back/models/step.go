@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// ExperimentStep is one step of an experiment run as a sequence. EndedAt is nil while
+// the step runs.
+type ExperimentStep struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	ExperimentID uint       `gorm:"not null;uniqueIndex:idx_experiment_step" json:"experiment_id"`
+	Position     int        `gorm:"not null;uniqueIndex:idx_experiment_step" json:"position"` // steps run so far, repeats included
+	StepIndex    int        `gorm:"not null" json:"step_index"`                               // index in the sequence
+	Iteration    int        `gorm:"not null" json:"iteration"`                                // repetition of the sequence, from 0
+	Name         string     `gorm:"size:200" json:"name"`
+	SettingsJSON string     `gorm:"type:text" json:"settings_json"` // JSON: map[instrumentId]scpi.InstrumentSettings in effect
+	StartedAt    time.Time  `gorm:"not null" json:"started_at"`
+	EndedAt      *time.Time `json:"ended_at"`
+	EndReason    string     `gorm:"size:50" json:"end_reason"` // duration, condition, or how the experiment ended
+}
@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// ExperimentTemplate is a named experiment setup a user can start again. Every change
+// adds a version; experiments record the version they were started from.
+type ExperimentTemplate struct {
+	ID        uint                        `gorm:"primaryKey" json:"id"`
+	Name      string                      `gorm:"size:300;not null" json:"name"`
+	UserID    uint                        `gorm:"not null;index" json:"user_id"`
+	User      User                        `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	Shared    bool                        `gorm:"not null;default:false" json:"shared"` // visible to and startable by every user
+	Version   int                         `gorm:"not null;default:1" json:"version"`    // latest version
+	Versions  []ExperimentTemplateVersion `gorm:"foreignKey:TemplateID" json:"versions,omitempty"`
+	CreatedAt time.Time                   `json:"created_at"`
+	UpdatedAt time.Time                   `json:"updated_at"`
+}
+
+// ExperimentTemplateVersion is one immutable revision of a template
+type ExperimentTemplateVersion struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	TemplateID uint      `gorm:"not null;uniqueIndex:idx_template_version" json:"template_id"`
+	Version    int       `gorm:"not null;uniqueIndex:idx_template_version" json:"version"`
+	PlanJSON   string    `gorm:"type:text;not null" json:"plan_json"` // JSON: controllers.ExperimentPlan
+	Comment    string    `gorm:"type:text" json:"comment"`
+	CreatedBy  uint      `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
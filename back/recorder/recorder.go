@@ -10,6 +10,7 @@ import (
 	"sync"
 
 	"back/database"
+	"back/events"
 	"back/models"
 	"back/storage"
 )
@@ -138,6 +139,7 @@ func (m *Manager) Start(experimentID uint) {
 
 	if err := cmd.Start(); err != nil {
 		log.Printf("[Recorder] FFmpeg start error for exp=%d: %v", experimentID, err)
+		events.Record(experimentID, 0, events.RecordingFailed, fmt.Sprintf("camera %s: %v", cam.Name, err), nil)
 		return
 	}
 
@@ -160,9 +162,17 @@ func (m *Manager) Start(experimentID uint) {
 		if stderrBuf.Len() > 0 {
 			log.Printf("[Recorder] FFmpeg stderr for exp=%d: %s", experimentID, stderrBuf.String())
 		}
+		// Still registered means nobody asked it to stop
+		m.mu.Lock()
+		unexpected := m.recordings[experimentID] == rec
+		m.mu.Unlock()
+		if unexpected {
+			events.Record(experimentID, 0, events.RecordingFailed, fmt.Sprintf("camera %s: ffmpeg exited during the experiment", cam.Name), nil)
+		}
 	}()
 
 	log.Printf("[Recorder] Started recording for exp=%d camera=%s -> %s", experimentID, cam.Name, filePath)
+	events.Record(experimentID, 0, events.RecordingStarted, "camera "+cam.Name, map[string]interface{}{"camera": cam.Name})
 }
 
 // Stop stops recording, uploads to MinIO, returns the object name
@@ -187,6 +197,7 @@ func (m *Manager) Stop(experimentID uint) string {
 	// Upload to MinIO
 	if err := storage.UploadFile(rec.objName, rec.filePath, "video/mp4"); err != nil {
 		log.Printf("[Recorder] Upload error for exp=%d: %v", experimentID, err)
+		events.Record(experimentID, 0, events.RecordingFailed, fmt.Sprintf("upload failed: %v", err), nil)
 		return ""
 	}
 
@@ -194,6 +205,7 @@ func (m *Manager) Stop(experimentID uint) string {
 	os.Remove(rec.filePath)
 
 	log.Printf("[Recorder] Uploaded video for exp=%d -> %s", experimentID, rec.objName)
+	events.Record(experimentID, 0, events.RecordingStopped, "video saved", map[string]interface{}{"object": rec.objName})
 	return rec.objName
 }
 
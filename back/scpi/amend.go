@@ -0,0 +1,349 @@
+package scpi
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// amendTimeout bounds how long Amend waits for the pollers to pick up a change
+const amendTimeout = 30 * time.Second
+
+// ErrNotPolling is returned when amending an experiment that is not being polled
+var ErrNotPolling = errors.New("experiment is not being polled")
+
+// ErrSequenceAmend is returned when changing the settings or programs of a sequence,
+// whose steps set their own
+var ErrSequenceAmend = errors.New("settings and HV programs of a sequence cannot be amended, only its duration")
+
+// measurementDriver is implemented by drivers that can change speed, range and zero
+// correction without touching the source, as needed while an experiment runs
+type measurementDriver interface {
+	ConfigureMeasurement(c Conn, s InstrumentSettings) error
+}
+
+// PlanAmendment changes the plan of a running experiment. Nil and missing entries are
+// left unchanged.
+type PlanAmendment struct {
+	DurationSec *int                        // new planned duration (0 = unlimited)
+	HvSchedule  map[uint]*HvProgram         // replaces an instrument's program; a nil program removes it
+	Settings    map[uint]InstrumentSettings // new measurement settings; function and source are not changed
+}
+
+// amendRequest carries an amendment to the run coordinator
+type amendRequest struct {
+	am    PlanAmendment
+	reply chan amendResult
+}
+
+type amendResult struct {
+	plan *RunPlan
+	err  error
+}
+
+// instAmendment is the part of an amendment or sequence step for one poller. The poller
+// applies the settings, reports on result, and waits on commit: true keeps the change,
+// false restores the previous settings.
+type instAmendment struct {
+	settings *InstrumentSettings
+	setHV    bool
+	prog     *HvProgram // nil removes the program
+	result   chan error
+	commit   chan bool
+
+	// A new program starts from the setpoint in effect, timed from the moment the change
+	// is committed; the poller sets both, then closes applied
+	fromV   float64
+	at      float64
+	applied chan struct{}
+
+	// Sequence steps configure everything, function and source included, and time the
+	// program from the start of the step
+	step     bool
+	position int
+	until    *HvCondition // exit condition of the step read by this instrument
+}
+
+// Amend applies a plan change to a running experiment: every instrument's settings are
+// applied and read back first, and only when all succeed do the pollers switch to the new
+// settings and programs and the deadline move. Returns the plan now in effect.
+func (r *Runner) Amend(experimentID uint, am PlanAmendment) (*RunPlan, error) {
+	r.mu.Lock()
+	h, ok := r.runs[experimentID]
+	r.mu.Unlock()
+	if !ok {
+		return nil, ErrNotPolling
+	}
+
+	req := amendRequest{am: am, reply: make(chan amendResult, 1)}
+	select {
+	case h.amend <- req:
+	case <-h.halted:
+		return nil, ErrNotPolling
+	case <-time.After(amendTimeout):
+		return nil, fmt.Errorf("runner busy, amendment not applied")
+	}
+	res := <-req.reply
+	return res.plan, res.err
+}
+
+// amend runs on the coordinator goroutine; plan is the plan in effect and is updated in place
+func (r *Runner) amend(experimentID uint, plan *RunPlan, states []instState, am PlanAmendment) error {
+	if plan.Sequence != nil && (len(am.HvSchedule) > 0 || len(am.Settings) > 0) {
+		return ErrSequenceAmend
+	}
+
+	// Compile the programs before any instrument is touched
+	parts := make(map[int]*instAmendment)
+	part := func(i int) *instAmendment {
+		if parts[i] == nil {
+			parts[i] = &instAmendment{result: make(chan error, 1), commit: make(chan bool, 1), applied: make(chan struct{})}
+		}
+		return parts[i]
+	}
+	index := make(map[uint]int, len(states))
+	for i := range states {
+		index[states[i].inst.ID] = i
+	}
+	for id, prog := range am.HvSchedule {
+		i, ok := index[id]
+		if !ok {
+			return fmt.Errorf("instrument %d is not part of the experiment", id)
+		}
+		p := part(i)
+		p.setHV = true
+		if prog != nil {
+			if _, err := newHvExecutor(prog, plan.StartVolts[id]); err != nil {
+				return fmt.Errorf("hv_schedule[%d]: %v", id, err)
+			}
+			p.prog = prog
+		}
+	}
+	for id, s := range am.Settings {
+		i, ok := index[id]
+		if !ok {
+			return fmt.Errorf("instrument %d is not part of the experiment", id)
+		}
+		s := s
+		part(i).settings = &s
+	}
+
+	if err := dispatch(states, parts); err != nil {
+		log.Printf("[SCPI] exp=%d amendment rolled back: %v", experimentID, err)
+		return err
+	}
+
+	if am.DurationSec != nil {
+		plan.DurationSec = *am.DurationSec
+	}
+	for id, prog := range am.HvSchedule {
+		if plan.HvSchedule == nil {
+			plan.HvSchedule = make(map[uint]*HvProgram)
+		}
+		if prog == nil {
+			delete(plan.HvSchedule, id)
+			delete(plan.HvStartedSec, id)
+		} else {
+			plan.HvSchedule[id] = prog
+			plan.startProgram(id, parts[index[id]])
+		}
+	}
+	for id, s := range am.Settings {
+		if plan.Settings == nil {
+			plan.Settings = make(map[uint]InstrumentSettings)
+		}
+		plan.Settings[id] = s
+		if plan.PollIntervalsMs == nil {
+			plan.PollIntervalsMs = make(map[uint]int64)
+		}
+		plan.PollIntervalsMs[id] = s.PollingInterval().Milliseconds()
+	}
+	log.Printf("[SCPI] exp=%d plan amended", experimentID)
+	return nil
+}
+
+// dispatch hands every poller its part of a change and waits until all have applied it,
+// then has them keep it when all succeeded and roll it back otherwise
+func dispatch(states []instState, parts map[int]*instAmendment) error {
+	// Phase 1: every poller applies its settings between two polls
+	var firstErr error
+	sent := make(map[int]*instAmendment, len(parts))
+	for i, p := range parts {
+		select {
+		case states[i].amend <- p:
+			sent[i] = p
+		case <-states[i].exited:
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s is no longer polled", states[i].inst.Name)
+			}
+		}
+	}
+	for i, p := range sent {
+		select {
+		case err := <-p.result:
+			var mismatch *SettingsMismatch
+			if err != nil && firstErr == nil {
+				if errors.As(err, &mismatch) {
+					firstErr = err // already names the instrument
+				} else {
+					firstErr = fmt.Errorf("%s: %w", states[i].inst.Name, err)
+				}
+			}
+		case <-states[i].exited:
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s is no longer polled", states[i].inst.Name)
+			}
+		}
+	}
+
+	// Phase 2: all or nothing
+	for _, p := range sent {
+		p.commit <- firstErr == nil
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	for i, p := range sent {
+		select {
+		case <-p.applied:
+		case <-states[i].exited:
+		}
+	}
+	return nil
+}
+
+// applyAmendment runs on the poller goroutine between two polls; clock reads the poller's
+// schedule clock, from which a new program is timed
+func (s *instState) applyAmendment(experimentID uint, a *instAmendment, ticker *time.Ticker, clock func() float64) {
+	var err error
+	var ex *hvExecutor
+	if a.prog != nil {
+		// The program takes over from the voltage on the output, so it never jumps
+		a.fromV = s.setpoint()
+		ex, err = newHvExecutor(a.prog, a.fromV)
+	}
+	if err == nil && a.settings != nil {
+		if a.step {
+			if a.prog != nil && a.settings.SourceOn {
+				a.settings.SourceVolt = a.fromV
+			}
+			err = s.configure(*a.settings)
+		} else {
+			err = s.configureMeasurement(*a.settings)
+		}
+	}
+	a.result <- err
+
+	if !<-a.commit {
+		// A step that cannot start ends the experiment, which puts the instruments in a safe state
+		if a.settings != nil && err == nil && !a.step {
+			if s.settings == nil {
+				log.Printf("[SCPI] exp=%d inst=%d previous settings unknown, not restored", experimentID, s.inst.ID)
+			} else if err := s.configureMeasurement(*s.settings); err != nil {
+				log.Printf("[SCPI] exp=%d inst=%d restoring settings failed: %v", experimentID, s.inst.ID, err)
+			}
+		}
+		return
+	}
+
+	if a.settings != nil {
+		s.settings = a.settings
+		if iv := a.settings.PollingInterval(); iv != s.interval {
+			s.interval = iv
+			s.wd.interval = iv
+			ticker.Reset(iv)
+		}
+		if a.step {
+			s.startV = sourceVoltage(*a.settings)
+			s.lastHV = s.startV
+			if rd, ok := s.drv.(sourceRangeDriver); ok {
+				s.srcRange = rd.SourceRange(s.startV, 0)
+			}
+		}
+	}
+	if a.setHV {
+		if ex != nil {
+			a.at = clock()
+			ex.segStart = a.at
+		}
+		s.hv = ex
+		s.hvSeg = 0
+		s.hvPausers = nil
+	}
+	if a.step {
+		s.step = a.position
+		s.until = a.until
+	}
+	close(a.applied)
+}
+
+// setpoint is the source voltage last sent, or the one the settings left the source at
+func (s *instState) setpoint() float64 {
+	if math.IsNaN(s.lastHV) {
+		return s.startV
+	}
+	return s.lastHV
+}
+
+// startProgram records where and when the program a poller took over begins, so a
+// resumed run continues it from the same point
+func (p *RunPlan) startProgram(instrumentID uint, a *instAmendment) {
+	if p.StartVolts == nil {
+		p.StartVolts = make(map[uint]float64)
+	}
+	if p.HvStartedSec == nil {
+		p.HvStartedSec = make(map[uint]float64)
+	}
+	p.StartVolts[instrumentID] = a.fromV
+	p.HvStartedSec[instrumentID] = a.at
+}
+
+// configure applies the complete settings of a sequence step, reads them back and
+// restarts the measurement. The source goes through 0 V when the step reverses polarity.
+func (s *instState) configure(settings InstrumentSettings) error {
+	var diffs []SettingsDiff
+	err := s.sess.Exec(PriorityPoll, func(c Conn) error {
+		if s.setpoint()*sourceVoltage(settings) < 0 {
+			if err := s.drv.SetVoltage(c, 0); err != nil {
+				return err
+			}
+		}
+		var err error
+		if diffs, err = configure(c, s.inst, s.drv, settings); err != nil || len(diffs) > 0 {
+			return err
+		}
+		return s.drv.Start(c)
+	})
+	if err != nil {
+		return err
+	}
+	if len(diffs) > 0 {
+		return &SettingsMismatch{InstrumentID: s.inst.ID, Name: s.inst.Name, Diffs: diffs}
+	}
+	return nil
+}
+
+// configureMeasurement applies measurement settings and reads them back
+func (s *instState) configureMeasurement(settings InstrumentSettings) error {
+	md, ok := s.drv.(measurementDriver)
+	if !ok {
+		return fmt.Errorf("driver %s cannot change settings while measuring", s.drv.Name())
+	}
+	return s.sess.Exec(PriorityPoll, func(c Conn) error {
+		if err := md.ConfigureMeasurement(c, settings); err != nil {
+			return err
+		}
+		var diffs []SettingsDiff
+		for _, d := range readback(c, s.drv, settings) {
+			if d.Setting == "speed" || d.Setting == "range" || d.Setting == "zero" {
+				diffs = append(diffs, d)
+			}
+		}
+		if len(diffs) > 0 {
+			return &SettingsMismatch{InstrumentID: s.inst.ID, Name: s.inst.Name, Diffs: diffs}
+		}
+		return nil
+	})
+}
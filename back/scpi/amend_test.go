@@ -0,0 +1,124 @@
+package scpi
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"back/models"
+	"back/simulator"
+)
+
+func TestAmendNotPolling(t *testing.T) {
+	if _, err := DefaultRunner.Amend(9521, PlanAmendment{}); !errors.Is(err, ErrNotPolling) {
+		t.Fatalf("amending an unknown experiment: %v", err)
+	}
+}
+
+func TestAmendRunningExperiment(t *testing.T) {
+	sim, inst := liveSim(t, 9522)
+	s := DefaultSettings()
+	s.SourceOn = true
+	DefaultRunner.Resume(9522, []models.Instrument{inst}, RunPlan{
+		InstrumentIDs:   []uint{inst.ID},
+		Settings:        map[uint]InstrumentSettings{inst.ID: s},
+		PollIntervalsMs: map[uint]int64{inst.ID: s.PollingInterval().Milliseconds()},
+		DurationSec:     60,
+		StartedAt:       time.Now(),
+	})
+	defer DefaultRunner.Stop(9522)
+
+	if _, err := DefaultRunner.Amend(9522, PlanAmendment{Settings: map[uint]InstrumentSettings{9: s}}); err == nil {
+		t.Fatal("amendment for an instrument outside the experiment accepted")
+	}
+
+	// the simulator has no current range 12: nothing changes
+	bad := s
+	bad.AutoRange, bad.Range, bad.Frequency = false, "12", 10
+	_, err := DefaultRunner.Amend(9522, PlanAmendment{Settings: map[uint]InstrumentSettings{inst.ID: bad}})
+	var mismatch *SettingsMismatch
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("unsupported range: %v", err)
+	}
+
+	good := s
+	good.Frequency = 10
+	plan, err := DefaultRunner.Amend(9522, PlanAmendment{Settings: map[uint]InstrumentSettings{inst.ID: good}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Settings[inst.ID] != good || plan.IntervalFor(inst.ID) != good.PollingInterval() || plan.DurationSec != 60 {
+		t.Fatalf("plan after the amendment: %+v", plan)
+	}
+
+	// shortening the run moves its deadline
+	one := 1
+	if _, err := DefaultRunner.Amend(9522, PlanAmendment{DurationSec: &one}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for DefaultRunner.IsRunning(9522) {
+		if time.Now().After(deadline) {
+			t.Fatal("run kept polling past its amended duration")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	waitSafe(t, sim)
+}
+
+func TestAmendedProgramStartsFromSetpoint(t *testing.T) {
+	sim, inst := startSim(t, 9202, simulator.DefaultConfig())
+	s := DefaultSettings()
+	s.Frequency = 10
+	s.SourceOn = true
+	if err := ApplySettings(inst, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartInstrument(inst); err != nil {
+		t.Fatal(err)
+	}
+
+	// 0 V -> 100 V in 0.5 s, then 100 V stays
+	now := time.Now()
+	exp := &models.Experiment{ID: 9202, StartTime: &now,
+		HvScheduleJSON: `{"9202":{"steps":[{"type":"ramp","voltage":100,"duration_sec":0.5}]}}`}
+	r := newTestRunner()
+	r.Start(exp, []models.Instrument{inst}, map[uint]InstrumentSettings{inst.ID: s}, RunOptions{})
+	defer r.Stop(exp.ID)
+
+	time.Sleep(1500 * time.Millisecond)
+	if v := sim.SourceValue(); v != 100 {
+		t.Fatalf("setpoint before the amendment = %g, want 100", v)
+	}
+
+	// At 1.5 s, a 1 s ramp to 300 V: counted from the start of the run it would be over
+	v300 := 300.0
+	stop := make(chan struct{})
+	samples := sampleSetpoints(sim, stop)
+	plan, err := r.Amend(exp.ID, PlanAmendment{HvSchedule: map[uint]*HvProgram{
+		inst.ID: {Steps: []HvStep{{Type: HvStepRamp, Voltage: &v300, DurationSec: 1}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	close(stop)
+	vs := <-samples
+
+	first := 0.0
+	for _, v := range vs {
+		if v != 100 {
+			first = v
+			break
+		}
+	}
+	if first <= 100 || first > 160 {
+		t.Errorf("first setpoint after the amendment = %g, want a little above 100", first)
+	}
+	if last := vs[len(vs)-1]; last != 300 {
+		t.Errorf("setpoint at the end of the new program = %g, want 300", last)
+	}
+	if plan.StartVolts[inst.ID] != 100 || plan.HvStartedSec[inst.ID] < 1.4 {
+		t.Errorf("plan: start volts %g at %gs, want 100 V at about 1.5 s", plan.StartVolts[inst.ID], plan.HvStartedSec[inst.ID])
+	}
+}
@@ -0,0 +1,139 @@
+package scpi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// B2980 is the driver for Keysight B2980-series picoammeters/electrometers
+var B2980 Driver = b2980{}
+
+func init() {
+	RegisterDriver(B2980, "B2981", "B2983", "B2985", "B2987")
+}
+
+// b2980 uses the B2980 SCPI tree:
+//
+//	:SENS:FUNC "CURR", :SENS:CURR:NPLC, :SENS:CURR:RANG, :INP, :SOUR:VOLT, :OUTP, :MEAS:CURR?
+//
+// Only the B2985/B2987 have a voltage source; on the others source commands are ignored.
+type b2980 struct{}
+
+func (b2980) Name() string { return "b2980" }
+
+// Framing: the instrument terminates commands and replies with LF only
+func (b2980) Framing() Framing {
+	return Framing{WriteTerm: "\n", ReadTerm: "\n"}
+}
+
+func (b2980) Identify(c Conn) (*IDNInfo, error) {
+	return identify(c)
+}
+
+func (b2980) Configure(c Conn, s InstrumentSettings) error {
+	fn := keithleyFunction(s.Function)
+
+	cmds := []string{fmt.Sprintf(":SENS:FUNC \"%s\"", fn)}
+	cmds = append(cmds, senseCommands(s)...)
+	cmds = append(cmds, ":INP ON")
+
+	if s.SourceOn {
+		cmds = append(cmds,
+			fmt.Sprintf(":SOUR:VOLT %.3f", s.SourceVolt),
+			":OUTP ON")
+	} else {
+		cmds = append(cmds, ":OUTP OFF")
+	}
+	return sendAll(c, cmds, 2*time.Second, 0)
+}
+
+// ConfigureMeasurement changes speed and range without touching the source
+func (b2980) ConfigureMeasurement(c Conn, s InstrumentSettings) error {
+	return sendAll(c, senseCommands(s), 2*time.Second, 0)
+}
+
+// stateQueries lists every setting Configure touches, for all measurement functions
+func (b2980) stateQueries() []string {
+	qs := append([]string{":SENS:FUNC?"}, senseStateQueries()...)
+	return append(qs, ":INP?", ":SOUR:VOLT?", ":OUTP?")
+}
+
+// readbackChecks lists the queries that confirm what Configure wrote
+func (b2980) readbackChecks(s InstrumentSettings) []readbackCheck {
+	checks := senseReadbackChecks(s)
+	checks = append(checks, readbackCheck{setting: "source", query: ":OUTP?", want: onOff(s.SourceOn)})
+	if s.SourceOn {
+		checks = append(checks, readbackCheck{setting: "source_volt", query: ":SOUR:VOLT?", want: fmt.Sprintf("%.3f", s.SourceVolt), numeric: true})
+	}
+	return checks
+}
+
+func (b2980) Start(c Conn) error {
+	_, err := c.Send(":INIT:CONT ON", defaultTimeout)
+	return err
+}
+
+func (b2980) SetVoltage(c Conn, v float64) error {
+	_, err := c.Send(fmt.Sprintf(":SOUR:VOLT %.3f", v), defaultTimeout)
+	return err
+}
+
+// Fetch reads current and source voltage with two queries — the B2980 has no combined row
+func (b2980) Fetch(c Conn) (*Response, error) {
+	raw, err := c.Send(":MEAS:CURR?", defaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+	r := &Response{}
+	r.Current, err = strconv.ParseFloat(strings.TrimSpace(raw), 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse current %q: %w", raw, err)
+	}
+	if src, err := c.Send(":SOUR:VOLT?", defaultTimeout); err == nil && src != "" {
+		if v, err := strconv.ParseFloat(strings.TrimSpace(src), 64); err == nil {
+			r.Source = v
+			r.Voltage = v
+		}
+	}
+	return r, nil
+}
+
+func (b2980) SafeState(c Conn) error {
+	var firstErr error
+	for _, cmd := range []string{":OUTP OFF", ":SOUR:VOLT 0", ":INIT:CONT OFF", ":INP OFF"} {
+		if _, err := c.Send(cmd, 2*time.Second); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %w", cmd, err)
+		}
+	}
+	return firstErr
+}
+
+func (b2980) ReadErrors(c Conn) ([]string, error) {
+	return readErrorQueue(c)
+}
+
+func (b2980) SourceState(c Conn) (bool, error) {
+	resp, err := c.Send(":OUTP?", defaultTimeout)
+	if err != nil {
+		return false, err
+	}
+	return parseOnOff(resp)
+}
+
+// ReadSettings queries every setting Configure writes and fails on a missing or
+// unexpected reply. The B2980 has no zero correction, so ZeroCorrect is always false.
+func (b2980) ReadSettings(c Conn) (*InstrumentSettings, error) {
+	s, err := readSenseSettings(c)
+	if err != nil {
+		return nil, err
+	}
+	if s.SourceOn, err = queryOnOff(c, ":OUTP?"); err != nil {
+		return nil, err
+	}
+	if s.SourceVolt, err = queryFloat(c, ":SOUR:VOLT?"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,164 @@
+package scpi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"back/models"
+)
+
+const (
+	DefaultCalibrationSamples = 20
+	MaxCalibrationSamples     = 1000
+	calibrationSettle         = 2 * time.Second // readings after Start are discarded for this long
+	MaxCalibrationDuration    = 2 * time.Minute // longest calibration, settling and sampling
+)
+
+// zeroDriver is implemented by drivers that can acquire a new zero correction at the
+// instrument (zero check / zero correct)
+type zeroDriver interface {
+	AcquireZero(c Conn) error
+}
+
+// Baseline is an offset current subtracted from the readings of an instrument. The
+// offset depends on the measurement function, range and zero correction, so it only
+// applies to readings taken with those it was measured with.
+type Baseline struct {
+	CalibrationID uint    `json:"calibration_id"`
+	Current       float64 `json:"current"`      // A
+	Function      string  `json:"function"`     // CURR, RES, CHAR
+	Range         string  `json:"range"`        // manual range, "" = autorange
+	ZeroCorrect   bool    `json:"zero_correct"` // zero correction was on
+}
+
+// NewBaseline returns the baseline of a stored calibration. A calibration that acquired
+// a zero ran with zero correction on, whatever its settings say.
+func NewBaseline(cal models.InstrumentCalibration) Baseline {
+	b := Baseline{CalibrationID: cal.ID, Current: cal.OffsetCurrent}
+	var s InstrumentSettings
+	if err := json.Unmarshal([]byte(cal.SettingsJSON), &s); err == nil {
+		b.Function, b.Range = s.Function, measurementRange(s)
+		b.ZeroCorrect = s.ZeroCorrect || cal.ZeroCorrected
+	}
+	return b
+}
+
+// Matches reports whether readings taken with s have the offset of the baseline:
+// same function, same range, same zero correction
+func (b Baseline) Matches(s InstrumentSettings) bool {
+	return b.Function != "" && b.Function == s.Function && b.Range == measurementRange(s) &&
+		b.ZeroCorrect == s.ZeroCorrect
+}
+
+// measurementRange is the manual range of s, "" with autorange
+func measurementRange(s InstrumentSettings) string {
+	if s.AutoRange {
+		return ""
+	}
+	return s.Range
+}
+
+// Calibration is the result of the calibration procedure
+type Calibration struct {
+	ZeroCorrected bool      `json:"zero_corrected"`
+	Samples       []float64 `json:"samples"` // currents (A)
+	Offset        float64   `json:"offset"`  // mean
+	Noise         float64   `json:"noise"`   // standard deviation
+	Min           float64   `json:"min"`
+	Max           float64   `json:"max"`
+}
+
+// CalibrationDuration is how long a calibration with samples readings at the polling
+// interval of s takes, without communication delays
+func CalibrationDuration(s InstrumentSettings, samples int) time.Duration {
+	return calibrationSettle + time.Duration(samples)*s.PollingInterval()
+}
+
+// Calibrate measures the offset current of an instrument with its source off: the
+// settings are applied with the source forced off, a new zero is acquired if zero is
+// set, then samples readings are taken at the polling interval of the settings. It
+// gives up after MaxCalibrationDuration. The instrument is left in its safe state.
+// The caller makes sure no experiment uses it.
+func Calibrate(inst models.Instrument, s InstrumentSettings, samples int, zero bool) (*Calibration, error) {
+	drv := DriverFor(inst)
+	zd, canZero := drv.(zeroDriver)
+	if zero && !canZero {
+		return nil, fmt.Errorf("driver %s cannot acquire a zero correction", drv.Name())
+	}
+	if samples < 2 || samples > MaxCalibrationSamples {
+		return nil, fmt.Errorf("samples must be between 2 and %d", MaxCalibrationSamples)
+	}
+	if d := CalibrationDuration(s, samples); d > MaxCalibrationDuration {
+		return nil, fmt.Errorf("%d samples at %s take %s, longer than %s", samples, s.PollingInterval(), d, MaxCalibrationDuration)
+	}
+	deadline := time.Now().Add(MaxCalibrationDuration)
+
+	s.SourceOn = false
+	s.SourceVolt = 0
+	s.ZeroCorrect = s.ZeroCorrect || zero
+	defer func() {
+		if err := SafeState(inst); err != nil {
+			log.Printf("[SCPI] calibrate %s:%d safe-state failed: %v", inst.Host, inst.Port, err)
+		}
+	}()
+
+	if err := ApplySettings(inst, s); err != nil {
+		return nil, err
+	}
+	cal := &Calibration{Samples: make([]float64, 0, samples)}
+	err := withConn(inst, PriorityUI, func(c Conn) error {
+		if zero {
+			if err := zd.AcquireZero(c); err != nil {
+				return fmt.Errorf("zero correction: %w", err)
+			}
+			cal.ZeroCorrected = true
+		}
+		return drv.Start(c)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	time.Sleep(calibrationSettle)
+	interval := s.PollingInterval()
+	for len(cal.Samples) < samples {
+		// Slow replies must not stretch the procedure past its bound
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("calibration exceeded %s after %d of %d samples", MaxCalibrationDuration, len(cal.Samples), samples)
+		}
+		var resp *Response
+		err := withConn(inst, PriorityUI, func(c Conn) error {
+			var err error
+			resp, err = drv.Fetch(c)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("sample %d: %w", len(cal.Samples)+1, err)
+		}
+		if resp.ErrorCode != 0 {
+			return nil, fmt.Errorf("sample %d: error %d: %s", len(cal.Samples)+1, resp.ErrorCode, ErrorText(resp.ErrorCode))
+		}
+		cal.Samples = append(cal.Samples, resp.Current)
+		time.Sleep(interval)
+	}
+
+	cal.Min, cal.Max = math.Inf(1), math.Inf(-1)
+	var sum float64
+	for _, v := range cal.Samples {
+		sum += v
+		cal.Min = math.Min(cal.Min, v)
+		cal.Max = math.Max(cal.Max, v)
+	}
+	cal.Offset = sum / float64(len(cal.Samples))
+	var sq float64
+	for _, v := range cal.Samples {
+		sq += (v - cal.Offset) * (v - cal.Offset)
+	}
+	cal.Noise = math.Sqrt(sq / float64(len(cal.Samples)-1))
+	log.Printf("[SCPI] calibrate %s:%d driver=%s zero=%v offset=%.4gA noise=%.3gA n=%d",
+		inst.Host, inst.Port, drv.Name(), cal.ZeroCorrected, cal.Offset, cal.Noise, len(cal.Samples))
+	return cal, nil
+}
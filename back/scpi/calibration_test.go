@@ -0,0 +1,153 @@
+package scpi
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"back/broker"
+	"back/models"
+)
+
+func TestCalibrateRejectsBadRequests(t *testing.T) {
+	inst := models.Instrument{ID: 9551, Host: "127.0.0.1", Port: 1, Model: "TH2690"}
+	for _, n := range []int{1, MaxCalibrationSamples + 1} {
+		if _, err := Calibrate(inst, DefaultSettings(), n, false); err == nil || !strings.Contains(err.Error(), "samples") {
+			t.Errorf("%d samples: %v", n, err)
+		}
+	}
+	// 1000 readings at 5 Hz would hold the request for over three minutes
+	if _, err := Calibrate(inst, DefaultSettings(), MaxCalibrationSamples, false); err == nil || !strings.Contains(err.Error(), "longer than") {
+		t.Errorf("%d samples at 5 Hz: %v", MaxCalibrationSamples, err)
+	}
+	fast := DefaultSettings()
+	fast.Frequency = 20
+	if d := CalibrationDuration(fast, MaxCalibrationSamples); d != 52*time.Second {
+		t.Errorf("%d samples at 20 Hz take %s", MaxCalibrationSamples, d)
+	}
+	b2980 := models.Instrument{ID: 9552, Host: "127.0.0.1", Port: 1, Model: "B2985B"}
+	if _, err := Calibrate(b2980, DefaultSettings(), 5, true); err == nil || !strings.Contains(err.Error(), "zero") {
+		t.Errorf("zero on a driver without zero acquisition: %v", err)
+	}
+}
+
+func TestCalibrateMeasuresOffset(t *testing.T) {
+	// the simulator adds 2e-13 A of offset unless zero correction is on
+	sim, inst := liveSim(t, 9553)
+	s := DefaultSettings()
+	s.Frequency = 10
+	s.ZeroCorrect = false
+
+	cal, err := Calibrate(inst, s, 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cal.Samples) != 5 || cal.ZeroCorrected || math.Abs(cal.Offset-2e-13) > 3e-14 ||
+		cal.Noise <= 0 || cal.Min > cal.Offset || cal.Max < cal.Offset {
+		t.Fatalf("calibration %+v", cal)
+	}
+	waitSafe(t, sim)
+
+	cal, err = Calibrate(inst, s, 5, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cal.ZeroCorrected || math.Abs(cal.Offset) > 3e-14 {
+		t.Fatalf("zero-corrected calibration %+v", cal)
+	}
+	waitSafe(t, sim)
+}
+
+func TestRunnerSubtractsBaseline(t *testing.T) {
+	_, inst := liveSim(t, 9554)
+	sub, _, _ := broker.Default.Subscribe(9554, 0)
+	defer broker.Default.Unsubscribe(sub)
+	DefaultRunner.Resume(9554, []models.Instrument{inst}, RunPlan{
+		InstrumentIDs:  []uint{inst.ID},
+		PollIntervalMs: 50,
+		StartedAt:      time.Now(),
+		Settings:       map[uint]InstrumentSettings{inst.ID: DefaultSettings()},
+		Baselines:      map[uint]Baseline{inst.ID: {CalibrationID: 1, Current: 2e-13, Function: "CURR", ZeroCorrect: true}},
+	})
+	defer DefaultRunner.Stop(9554)
+
+	for n := 0; n < 3; {
+		select {
+		case ev := <-sub.C:
+			if ev.Kind != broker.KindMeasurement {
+				continue
+			}
+			if i := ev.Measurement.Current; math.Abs(i) > 3e-14 {
+				t.Fatalf("stored current %g, want the 2e-13 A offset removed", i)
+			}
+			if raw := ev.Measurement.RawCurrent; raw == nil || math.Abs(*raw-ev.Measurement.Current-2e-13) > 1e-20 {
+				t.Fatalf("raw current %v next to %g", raw, ev.Measurement.Current)
+			}
+			n++
+		case <-time.After(2 * time.Second):
+			t.Fatal("no measurements")
+		}
+	}
+}
+
+func TestBaselineAppliesOnlyWithCalibratedSettings(t *testing.T) {
+	calibrated := DefaultSettings()
+	raw, _ := json.Marshal(calibrated)
+	b := NewBaseline(models.InstrumentCalibration{ID: 7, OffsetCurrent: 2e-13, SettingsJSON: string(raw)})
+	if b.CalibrationID != 7 || b.Current != 2e-13 || b.Function != "CURR" || b.Range != "" {
+		t.Fatalf("baseline = %+v", b)
+	}
+
+	settings := calibrated
+	s := &instState{inst: models.Instrument{ID: 9321}, baseline: &b, settings: &settings}
+	check := func(what string, want bool) {
+		t.Helper()
+		off, ok := s.offset(0, 0)
+		if ok != want || (ok && off != b.Current) {
+			t.Fatalf("%s: offset = %g, %v; want applied %v", what, off, ok, want)
+		}
+		if s.baselineOff == want {
+			t.Fatalf("%s: baselineOff = %v", what, s.baselineOff)
+		}
+	}
+
+	check("calibrated settings", true)
+	settings.Frequency, settings.SourceOn, settings.SourceVolt = 10, true, 100
+	check("speed and source changed", true)
+	settings.AutoRange, settings.Range = false, "5"
+	check("manual range", false)
+	settings.AutoRange, settings.Range, settings.Function = true, "", "RES"
+	check("other function", false)
+	settings.Function = "CURR"
+	check("back to the calibrated settings", true)
+
+	s.baseline = &Baseline{CalibrationID: 8, Current: 1e-13} // settings unknown
+	check("calibration without settings", false)
+}
+
+// TestBaselineZeroCorrect: an offset measured after acquiring a zero belongs to readings
+// taken with zero correction on, even when the stored settings had it off
+func TestBaselineZeroCorrect(t *testing.T) {
+	measured := DefaultSettings()
+	measured.ZeroCorrect = false
+	raw, _ := json.Marshal(measured)
+
+	b := NewBaseline(models.InstrumentCalibration{ID: 9, OffsetCurrent: 2e-13, SettingsJSON: string(raw), ZeroCorrected: true})
+	if !b.ZeroCorrect {
+		t.Fatal("baseline of a zero-corrected calibration without zero correction")
+	}
+	if b.Matches(measured) {
+		t.Fatal("baseline with zero correction matches readings without it")
+	}
+	measured.ZeroCorrect = true
+	if !b.Matches(measured) {
+		t.Fatal("baseline does not match readings with zero correction")
+	}
+
+	b = NewBaseline(models.InstrumentCalibration{ID: 10, OffsetCurrent: 2e-13, SettingsJSON: string(raw)})
+	if b.ZeroCorrect || b.Matches(measured) {
+		t.Fatalf("baseline without zero correction %+v matches readings with it", b)
+	}
+}
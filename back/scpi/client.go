@@ -25,188 +25,127 @@ type Response struct {
 	ErrorCode   int
 }
 
-// Send sends a SCPI command and returns the trimmed response string
-func Send(host string, port int, cmd string, timeout time.Duration) (string, error) {
-	if timeout == 0 {
-		timeout = defaultTimeout
-	}
-	addr := fmt.Sprintf("%s:%d", host, port)
-	conn, err := net.DialTimeout("tcp", addr, timeout)
-	if err != nil {
-		return "", fmt.Errorf("connect %s: %w", addr, err)
-	}
-	defer conn.Close()
-
-	conn.SetDeadline(time.Now().Add(timeout))
-	_, err = conn.Write([]byte(cmd + "\r\n"))
-	if err != nil {
-		return "", fmt.Errorf("write: %w", err)
-	}
-
-	buf := make([]byte, 4096)
-	n, err := conn.Read(buf)
-	if err != nil {
-		// timeout is OK for commands that have no reply
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			return "", nil
-		}
-		return "", fmt.Errorf("read: %w", err)
-	}
-	return strings.TrimSpace(string(buf[:n])), nil
-}
-
-// SendBatch sends multiple SCPI commands on a single TCP connection.
-// TH2690 requires all settings commands on the same connection session.
-// Returns a map of command -> response for each command.
-func SendBatch(host string, port int, cmds []string, perCmdTimeout time.Duration) (map[string]string, error) {
-	if perCmdTimeout == 0 {
-		perCmdTimeout = defaultTimeout
-	}
-	addr := fmt.Sprintf("%s:%d", host, port)
-	conn, err := net.DialTimeout("tcp", addr, perCmdTimeout)
-	if err != nil {
-		return nil, fmt.Errorf("connect %s: %w", addr, err)
-	}
-	defer conn.Close()
-
-	results := make(map[string]string, len(cmds))
-	buf := make([]byte, 4096)
-
-	for _, cmd := range cmds {
-		conn.SetDeadline(time.Now().Add(perCmdTimeout))
-		_, err = conn.Write([]byte(cmd + "\r\n"))
-		if err != nil {
-			return results, fmt.Errorf("write %q: %w", cmd, err)
-		}
-
-		n, err := conn.Read(buf)
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				results[cmd] = ""
-				continue
-			}
-			return results, fmt.Errorf("read %q: %w", cmd, err)
-		}
-		results[cmd] = strings.TrimSpace(string(buf[:n]))
-		time.Sleep(50 * time.Millisecond)
-	}
-	return results, nil
-}
-
 // IDNInfo holds parsed *IDN? data
 type IDNInfo struct {
-	Model    string
-	Firmware string
-	Serial   string
-	Raw      string
-}
-
-// Identify sends *IDN? and returns the identity string
-func Identify(host string, port int) (string, error) {
-	return Send(host, port, "*IDN?", defaultTimeout)
+	Manufacturer string
+	Model        string
+	Firmware     string
+	Serial       string
+	Raw          string
 }
 
-// QueryIDN sends *IDN? and parses the response into structured fields.
-// TH2690 returns: "model,firmware,serial" e.g. "TH2690,V1.0.22,R08C240109"
-func QueryIDN(host string, port int) (*IDNInfo, error) {
-	raw, err := Identify(host, port)
+// identify queries *IDN? on an open connection
+func identify(c Conn) (*IDNInfo, error) {
+	raw, err := c.Send("*IDN?", defaultTimeout)
 	if err != nil {
 		return nil, err
 	}
+	return ParseIDN(raw)
+}
+
+// ParseIDN parses an *IDN? reply.
+// TH2690 returns three fields: "model,firmware,serial" e.g. "TH2690,V1.0.22,R08C240109".
+// IEEE 488.2 instruments return four: "manufacturer,model,serial,firmware"
+// e.g. "KEITHLEY INSTRUMENTS INC.,MODEL 6517B,4096123,A13/700x".
+func ParseIDN(raw string) (*IDNInfo, error) {
 	if raw == "" {
 		return nil, fmt.Errorf("empty IDN response")
 	}
 	info := &IDNInfo{Raw: raw}
 	parts := strings.Split(raw, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	if len(parts) >= 4 {
+		info.Manufacturer = parts[0]
+		info.Model = parts[1]
+		info.Serial = parts[2]
+		info.Firmware = parts[3]
+		return info, nil
+	}
 	if len(parts) >= 1 {
-		info.Model = strings.TrimSpace(parts[0])
+		info.Model = parts[0]
 	}
 	if len(parts) >= 2 {
-		info.Firmware = strings.TrimSpace(parts[1])
+		info.Firmware = parts[1]
 	}
 	if len(parts) >= 3 {
-		info.Serial = strings.TrimSpace(parts[2])
+		info.Serial = parts[2]
 	}
 	return info, nil
 }
 
-// FetchAll sends FETCH:ALL_S? and parses the response
-func FetchAll(host string, port int) (*Response, error) {
-	raw, err := Send(host, port, "FETCH:ALL_S?", defaultTimeout)
-	if err != nil {
-		return nil, err
-	}
-	return ParseAllS(raw)
-}
-
-// Run sends FUNC:RUN
-func Run(host string, port int) error {
-	resp, err := Send(host, port, "FUNC:RUN", defaultTimeout)
-	log.Printf("[SCPI] FUNC:RUN %s:%d resp=%q err=%v", host, port, resp, err)
-	return err
+// persistentConn wraps a TCP connection with send/receive for SCPI over persistent socket
+type persistentConn struct {
+	host    string
+	port    int
+	framing Framing
+	conn    net.Conn
+	rd      *responseReader
 }
 
-// Stop sends FUNC:STOP
-func Stop(host string, port int) error {
-	resp, err := Send(host, port, "FUNC:STOP", defaultTimeout)
-	log.Printf("[SCPI] FUNC:STOP %s:%d resp=%q err=%v", host, port, resp, err)
-	return err
+func newPersistentConn(host string, port int, framing Framing) *persistentConn {
+	return &persistentConn{host: host, port: port, framing: framing}
 }
 
-// ClearError sends HAND:ERROR
-func ClearError(host string, port int) error {
-	_, err := Send(host, port, "HAND:ERROR", defaultTimeout)
-	return err
-}
-
-// ParseAllS parses a FETCH:ALL_S? response CSV string
-// Format: voltage,current,charge,resistance,time,source,math,temperature,humidity,error_code
-func ParseAllS(raw string) (*Response, error) {
-	parts := strings.Split(raw, ",")
-	if len(parts) < 10 {
-		return nil, fmt.Errorf("unexpected ALL_S format: %q (got %d fields)", raw, len(parts))
+func (pc *persistentConn) connect() error {
+	if pc.conn != nil {
+		pc.conn.Close()
+		pc.conn = nil
 	}
-
-	r := &Response{}
-	var err error
-
-	r.Voltage, err = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
-	if err != nil {
-		return nil, fmt.Errorf("parse voltage: %w", err)
-	}
-	r.Current, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	addr := net.JoinHostPort(pc.host, strconv.Itoa(pc.port))
+	conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
 	if err != nil {
-		return nil, fmt.Errorf("parse current: %w", err)
+		return err
 	}
-	r.Charge, err = strconv.ParseFloat(strings.TrimSpace(parts[2]), 64)
-	if err != nil {
-		return nil, fmt.Errorf("parse charge: %w", err)
+	pc.conn = conn
+	pc.rd = newResponseReader(conn, pc.framing.ReadTerm)
+	return nil
+}
+
+func (pc *persistentConn) close() {
+	if pc.conn != nil {
+		pc.conn.Close()
+		pc.conn = nil
+		pc.rd = nil
 	}
-	r.Resistance, err = strconv.ParseFloat(strings.TrimSpace(parts[3]), 64)
-	if err != nil {
-		return nil, fmt.Errorf("parse resistance: %w", err)
+}
+
+// Send sends a command on the persistent connection and, for queries, reads one framed reply.
+// A query that gets no complete reply within timeout fails with ErrTimeout.
+// On any error the connection is closed so the next call reconnects with a clean stream.
+func (pc *persistentConn) Send(cmd string, timeout time.Duration) (string, error) {
+	if timeout == 0 {
+		timeout = defaultTimeout
 	}
-	r.DeviceTime = strings.TrimSpace(parts[4])
-	r.Source, err = strconv.ParseFloat(strings.TrimSpace(parts[5]), 64)
-	if err != nil {
-		return nil, fmt.Errorf("parse source: %w", err)
+	if pc.conn == nil {
+		if err := pc.connect(); err != nil {
+			return "", fmt.Errorf("connect %s:%d: %w", pc.host, pc.port, err)
+		}
 	}
-	r.MathValue, err = strconv.ParseFloat(strings.TrimSpace(parts[6]), 64)
-	if err != nil {
-		return nil, fmt.Errorf("parse math: %w", err)
+	query := IsQuery(cmd)
+	if query {
+		if stale := pc.rd.discardBuffered(); stale != "" {
+			log.Printf("[SCPI] %s:%d discarded stale input before %q: %q", pc.host, pc.port, cmd, stale)
+		}
 	}
-	r.Temperature, err = strconv.ParseFloat(strings.TrimSpace(parts[7]), 64)
-	if err != nil {
-		return nil, fmt.Errorf("parse temperature: %w", err)
+
+	pc.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := pc.conn.Write([]byte(cmd + pc.framing.WriteTerm)); err != nil {
+		pc.close()
+		return "", fmt.Errorf("write: %w", err)
 	}
-	r.Humidity, err = strconv.ParseFloat(strings.TrimSpace(parts[8]), 64)
-	if err != nil {
-		return nil, fmt.Errorf("parse humidity: %w", err)
+	if !query {
+		return "", nil
 	}
-	r.ErrorCode, err = strconv.Atoi(strings.TrimSpace(parts[9]))
+
+	resp, err := pc.rd.ReadResponse()
 	if err != nil {
-		return nil, fmt.Errorf("parse error_code: %w", err)
+		pc.close()
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return "", fmt.Errorf("%w: %q after %s", ErrTimeout, cmd, timeout)
+		}
+		return "", fmt.Errorf("read: %w", err)
 	}
-
-	return r, nil
+	return resp, nil
 }
@@ -0,0 +1,162 @@
+package scpi
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	clockWindow      = 300    // samples kept for the offset/drift fit
+	clockMinSpanSec  = 5.0    // device time span needed before drift is estimated
+	clockMaxDriftPpm = 1000.0 // larger fitted drift is treated as noise
+)
+
+// ClockStats describes the current host/device clock estimate of an instrument
+type ClockStats struct {
+	Samples      int       `json:"samples"`
+	DeviceEpoch  time.Time `json:"device_epoch"`  // host time at device time zero
+	DriftPpm     float64   `json:"drift_ppm"`     // device clock rate error, positive = device slow
+	ResidualMs   float64   `json:"residual_ms"`   // weighted RMS error of the fit
+	CorrectionMs float64   `json:"correction_ms"` // last corrected time minus its request midpoint
+	Resets       int       `json:"resets"`        // device clock restarts detected (power cycle, overflow)
+}
+
+type clockSample struct {
+	dev  float64 // device seconds
+	host float64 // host seconds (relative to base) at the request midpoint
+	w    float64 // weight: low round-trip samples pin the clock tighter
+}
+
+// ClockEstimator maps device time to host time for one instrument.
+//
+// Every reading is assumed to be taken at the midpoint of the request that returned it;
+// the error of that assumption is at most half the round trip, so samples are weighted by
+// 1/rtt² and host = a + b·device is fitted by weighted least squares over a sliding window.
+type ClockEstimator struct {
+	mu      sync.Mutex
+	base    time.Time
+	samples []clockSample
+	lastDev float64
+	a, b    float64
+	stats   ClockStats
+}
+
+// NewClockEstimator creates an estimator with no samples
+func NewClockEstimator() *ClockEstimator {
+	return &ClockEstimator{b: 1}
+}
+
+// Observe adds a reading with device time dev (seconds) fetched by a request sent at
+// sent and answered at received, and returns the corrected acquisition time.
+func (e *ClockEstimator) Observe(dev float64, sent, received time.Time) time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	rtt := received.Sub(sent)
+	mid := sent.Add(rtt / 2)
+
+	// Device clock went backwards: it was restarted, the old fit is meaningless
+	if len(e.samples) > 0 && dev < e.lastDev-0.001 {
+		e.samples = e.samples[:0]
+		e.stats.Resets++
+	}
+	if len(e.samples) == 0 {
+		e.base = mid
+	}
+	e.lastDev = dev
+
+	rttMs := float64(rtt.Microseconds()) / 1000
+	e.samples = append(e.samples, clockSample{
+		dev:  dev,
+		host: mid.Sub(e.base).Seconds(),
+		w:    1 / ((rttMs + 1) * (rttMs + 1)),
+	})
+	if len(e.samples) > clockWindow {
+		e.samples = append(e.samples[:0], e.samples[len(e.samples)-clockWindow:]...)
+	}
+	e.fit()
+
+	at := e.hostTime(dev)
+	e.stats.Samples = len(e.samples)
+	e.stats.DeviceEpoch = e.hostTime(0)
+	e.stats.DriftPpm = (e.b - 1) * 1e6
+	e.stats.CorrectionMs = float64(at.Sub(mid).Microseconds()) / 1000
+	return at
+}
+
+// Stats returns the current estimate
+func (e *ClockEstimator) Stats() ClockStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.stats
+}
+
+func (e *ClockEstimator) hostTime(dev float64) time.Time {
+	sec := e.a + e.b*dev
+	return e.base.Add(time.Duration(sec * float64(time.Second)))
+}
+
+// fit recomputes a and b; drift is only estimated once the window spans clockMinSpanSec
+func (e *ClockEstimator) fit() {
+	var sw, sd, sh float64
+	minDev, maxDev := math.Inf(1), math.Inf(-1)
+	for _, s := range e.samples {
+		sw += s.w
+		sd += s.w * s.dev
+		sh += s.w * s.host
+		minDev = math.Min(minDev, s.dev)
+		maxDev = math.Max(maxDev, s.dev)
+	}
+	md, mh := sd/sw, sh/sw
+
+	b := 1.0
+	if maxDev-minDev >= clockMinSpanSec {
+		var sdd, sdh float64
+		for _, s := range e.samples {
+			sdd += s.w * (s.dev - md) * (s.dev - md)
+			sdh += s.w * (s.dev - md) * (s.host - mh)
+		}
+		if sdd > 0 {
+			if fb := sdh / sdd; math.Abs(fb-1)*1e6 <= clockMaxDriftPpm {
+				b = fb
+			}
+		}
+	}
+	e.b = b
+	e.a = mh - b*md
+
+	var sr float64
+	for _, s := range e.samples {
+		r := s.host - (e.a + e.b*s.dev)
+		sr += s.w * r * r
+	}
+	e.stats.ResidualMs = math.Sqrt(sr/sw) * 1000
+}
+
+// ParseDeviceTime parses an instrument timestamp in seconds ("12.345", "+0000012.345secs")
+// or as a clock time ("hh:mm:ss.sss"). ok is false when there is no usable timestamp.
+func ParseDeviceTime(raw string) (sec float64, ok bool) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, false
+	}
+	if strings.Contains(raw, ":") {
+		parts := strings.Split(raw, ":")
+		for _, p := range parts {
+			v, err := strconv.ParseFloat(p, 64)
+			if err != nil {
+				return 0, false
+			}
+			sec = sec*60 + v
+		}
+		return sec, true
+	}
+	v, _, err := splitUnit(raw)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, false
+	}
+	return v, true
+}
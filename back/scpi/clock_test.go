@@ -0,0 +1,104 @@
+package scpi
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseDeviceTime(t *testing.T) {
+	for raw, want := range map[string]float64{
+		"12.345":           12.345,
+		" 7 ":              7,
+		"+0000012.345secs": 12.345,
+		"01:02:03.5":       3723.5,
+		"02:30":            150,
+		"1.5E+02":          150,
+	} {
+		got, ok := ParseDeviceTime(raw)
+		if !ok || math.Abs(got-want) > 1e-9 {
+			t.Errorf("ParseDeviceTime(%q) = %v, %v; want %v", raw, got, ok, want)
+		}
+	}
+	for _, raw := range []string{"", "  ", "abc", "1:xx:3", "NaN"} {
+		if got, ok := ParseDeviceTime(raw); ok {
+			t.Errorf("ParseDeviceTime(%q) = %v, want not ok", raw, got)
+		}
+	}
+}
+
+// TestClockEstimatorDrift feeds readings from a device clock running 200 ppm slow with
+// jittery round trips and expects the fit to recover the drift and the true times
+func TestClockEstimatorDrift(t *testing.T) {
+	e := NewClockEstimator()
+	epoch := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	const drift = 200e-6
+
+	var worst time.Duration
+	for i := 0; i < 200; i++ {
+		truth := epoch.Add(time.Duration(i) * 100 * time.Millisecond)
+		dev := truth.Sub(epoch).Seconds() / (1 + drift)
+		// the request went out before the reading and came back after it, asymmetrically
+		rtt := time.Duration(2+i%7*3) * time.Millisecond
+		sent := truth.Add(-rtt / 3)
+		at := e.Observe(dev, sent, sent.Add(rtt))
+		if i >= 100 {
+			if d := at.Sub(truth); d.Abs() > worst {
+				worst = d.Abs()
+			}
+		}
+	}
+	st := e.Stats()
+	if st.Samples != 200 || math.Abs(st.DriftPpm-200) > 20 {
+		t.Fatalf("stats %+v, want ~200 ppm over 200 samples", st)
+	}
+	if worst > 5*time.Millisecond {
+		t.Fatalf("corrected time off by up to %s", worst)
+	}
+	if d := st.DeviceEpoch.Sub(epoch).Abs(); d > 5*time.Millisecond {
+		t.Fatalf("device epoch %s, want %s", st.DeviceEpoch, epoch)
+	}
+}
+
+func TestClockEstimatorNoDriftOnShortSpan(t *testing.T) {
+	e := NewClockEstimator()
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		sent := now.Add(time.Duration(i) * 100 * time.Millisecond)
+		e.Observe(float64(i)*0.1*1.01, sent, sent.Add(time.Millisecond))
+	}
+	if st := e.Stats(); st.DriftPpm != 0 {
+		t.Fatalf("drift %g ppm estimated from a %gs span", st.DriftPpm, 0.9)
+	}
+}
+
+func TestClockEstimatorReset(t *testing.T) {
+	e := NewClockEstimator()
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		sent := now.Add(time.Duration(i) * time.Second)
+		e.Observe(1000+float64(i), sent, sent.Add(2*time.Millisecond))
+	}
+	// the instrument was power cycled: its clock restarts at zero
+	sent := now.Add(25 * time.Second)
+	at := e.Observe(0.5, sent, sent.Add(2*time.Millisecond))
+	st := e.Stats()
+	if st.Resets != 1 || st.Samples != 1 {
+		t.Fatalf("after restart: %+v", st)
+	}
+	if d := at.Sub(sent.Add(time.Millisecond)).Abs(); d > time.Millisecond {
+		t.Fatalf("first reading after restart corrected by %s", d)
+	}
+}
+
+func TestClockEstimatorWindow(t *testing.T) {
+	e := NewClockEstimator()
+	now := time.Now()
+	for i := 0; i < clockWindow+50; i++ {
+		sent := now.Add(time.Duration(i) * 10 * time.Millisecond)
+		e.Observe(float64(i)*0.01, sent, sent.Add(time.Millisecond))
+	}
+	if st := e.Stats(); st.Samples != clockWindow {
+		t.Fatalf("%d samples kept, want %d", st.Samples, clockWindow)
+	}
+}
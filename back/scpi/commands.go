@@ -2,7 +2,8 @@ package scpi
 
 import (
 	"fmt"
-	"log"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -29,122 +30,76 @@ func FrequencyToSpeed(hz float64) string {
 		return "FAST"
 	}
 	if hz >= 3 {
-		return "MED"
+		return "MID"
 	}
 	return "SLOW"
 }
 
-// DefaultSettings returns safe sensible defaults for TH2690
-func DefaultSettings() InstrumentSettings {
-	return InstrumentSettings{
-		Function:    "CURR",
-		SourceOn:    false,
-		SourceVolt:  0,
-		AutoRange:   true,
-		Range:       "",
-		Frequency:   5,
-		ZeroCorrect: true,
+// SpeedToFrequency is the inverse of FrequencyToSpeed, for settings read back from an
+// instrument: the polling frequency itself is not stored on it, only the speed it selects.
+// MED is accepted as well, as written by earlier versions.
+func SpeedToFrequency(speed string) (float64, error) {
+	switch strings.ToUpper(strings.TrimSpace(speed)) {
+	case "FAST":
+		return 10, nil
+	case "MED", "MID":
+		return 5, nil
+	case "SLOW":
+		return 1, nil
 	}
+	return 0, fmt.Errorf("unknown speed %q", speed)
 }
 
-// ApplySettings configures the TH2690 electrometer via SCPI.
-// TH2690 uses its own command tree (not standard Keithley SCPI):
-//
-//	FUNC:FUNC CURR, FUNC:SRC ON, SRC:VALUE <v>, CURR:RANGE 1, etc.
-//
-// Each command is sent on its own TCP connection.
-// Best-effort: logs warnings but does not block experiment start.
-func ApplySettings(host string, port int, s InstrumentSettings) error {
-	log.Printf("[SCPI] ApplySettings %s:%d func=%s freq=%.0f autoRange=%v sourceOn=%v sourceVolt=%.0f",
-		host, port, s.Function, s.Frequency, s.AutoRange, s.SourceOn, s.SourceVolt)
-
-	cmds := buildSettingsCommands(s)
-
-	// Send all commands on a single TCP connection — TH2690 requires this
-	results, err := SendBatch(host, port, cmds, 2*time.Second)
+// querySetting sends a settings query and fails on an empty reply
+func querySetting(c Conn, q string) (string, error) {
+	resp, err := c.Send(q, defaultTimeout)
 	if err != nil {
-		log.Printf("[SCPI] ApplySettings %s:%d batch ERROR: %v", host, port, err)
-		return err
+		return "", fmt.Errorf("%s: %w", q, err)
 	}
-	for _, cmd := range cmds {
-		resp := results[cmd]
-		if resp != "" {
-			log.Printf("[SCPI] ApplySettings %s:%d cmd=%q resp=%q", host, port, cmd, resp)
-		} else {
-			log.Printf("[SCPI] ApplySettings %s:%d cmd=%q OK", host, port, cmd)
-		}
+	resp = strings.TrimSpace(resp)
+	if resp == "" {
+		return "", fmt.Errorf("%s: empty reply", q)
 	}
-	return nil
+	return resp, nil
 }
 
-// buildSettingsCommands converts settings into ordered SCPI commands for TH2690.
-// Uses correct TH2690 command tree from official manual (Chapter 6.6):
-//
-//	FUNC:FUNC, FUNC:SRC, FUNC:AMMET, SRC:VALUE, SRC:RANGE, CURR:RANGE, CURR:SPEED, etc.
-func buildSettingsCommands(s InstrumentSettings) []string {
-	var cmds []string
-
-	// 1. Set measurement function (FUNC:FUNC <RES|VOLT|CURR|COUL|SRC>)
-	switch s.Function {
-	case "RES":
-		cmds = append(cmds, "FUNC:FUNC RES")
-	case "CHAR":
-		cmds = append(cmds, "FUNC:FUNC COUL")
-	default:
-		cmds = append(cmds, "FUNC:FUNC CURR")
+// queryFloat sends a settings query and parses its numeric reply
+func queryFloat(c Conn, q string) (float64, error) {
+	resp, err := querySetting(c, q)
+	if err != nil {
+		return 0, err
 	}
-
-	// 2. Enable ammeter (FUNC:AMMET ON)
-	cmds = append(cmds, "FUNC:AMMET ON")
-
-	// 3. Disable Null/Zero (FUNC:ZERO OFF) — prevents offset
-	if !s.ZeroCorrect {
-		cmds = append(cmds, "FUNC:ZERO OFF")
-	} else {
-		cmds = append(cmds, "FUNC:ZERO ON")
+	v, err := strconv.ParseFloat(resp, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: unexpected reply %q", q, resp)
 	}
+	return v, nil
+}
 
-	// 4. Measurement speed per function (e.g. CURR:SPEED <FAST|MID|SLOW>)
-	speed := FrequencyToSpeed(s.Frequency)
-	switch s.Function {
-	case "RES":
-		cmds = append(cmds, "RES:SPEED "+speed)
-	default:
-		cmds = append(cmds, "CURR:SPEED "+speed)
+// queryOnOff sends a settings query and parses its 1/ON or 0/OFF reply
+func queryOnOff(c Conn, q string) (bool, error) {
+	resp, err := querySetting(c, q)
+	if err != nil {
+		return false, err
 	}
-
-	// 5. Range: 1=Auto, 2..11=manual (CURR:RANGE <1..11>)
-	if s.AutoRange {
-		switch s.Function {
-		case "RES":
-			cmds = append(cmds, "RES:RANGE 1")
-		default:
-			cmds = append(cmds, "CURR:RANGE 1")
-		}
-	} else if s.Range != "" {
-		switch s.Function {
-		case "RES":
-			cmds = append(cmds, fmt.Sprintf("RES:RANGE %s", s.Range))
-		default:
-			cmds = append(cmds, fmt.Sprintf("CURR:RANGE %s", s.Range))
-		}
+	on, err := parseOnOff(resp)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", q, err)
 	}
+	return on, nil
+}
 
-	// 6. Source voltage (SRC:VALUE <float>, SRC:RANGE <1|2|3>)
-	if s.SourceOn {
-		// Set range first: 1=-20~20V, 2=0~1000V, 3=-1000~0V
-		if s.SourceVolt >= 0 {
-			cmds = append(cmds, "SRC:RANGE 2")
-		} else {
-			cmds = append(cmds, "SRC:RANGE 3")
-		}
-		cmds = append(cmds, fmt.Sprintf("SRC:VALUE %.3f", s.SourceVolt))
-		cmds = append(cmds, "FUNC:SRC ON")
-	} else {
-		cmds = append(cmds, "FUNC:SRC OFF")
+// DefaultSettings returns safe sensible defaults for TH2690
+func DefaultSettings() InstrumentSettings {
+	return InstrumentSettings{
+		Function:    "CURR",
+		SourceOn:    false,
+		SourceVolt:  0,
+		AutoRange:   true,
+		Range:       "",
+		Frequency:   5,
+		ZeroCorrect: true,
 	}
-
-	return cmds
 }
 
 // PollingInterval returns the duration between polls for the given settings
@@ -158,40 +113,3 @@ func (s InstrumentSettings) PollingInterval() time.Duration {
 	}
 	return time.Duration(1000.0/hz) * time.Millisecond
 }
-
-// ReadSettings queries current instrument state (best-effort)
-// Uses correct TH2690 query commands: FUNC:FUNC?, FUNC:SRC?, SRC:VALUE?
-func ReadSettings(host string, port int) (*InstrumentSettings, error) {
-	s := DefaultSettings()
-
-	// Query function
-	if resp, err := Send(host, port, "FUNC:FUNC?", defaultTimeout); err == nil && resp != "" {
-		switch resp {
-		case "RES":
-			s.Function = "RES"
-		case "COUL":
-			s.Function = "CHAR"
-		default:
-			s.Function = "CURR"
-		}
-	}
-
-	// Query source state
-	if resp, err := Send(host, port, "FUNC:SRC?", defaultTimeout); err == nil {
-		if resp == "ON" {
-			s.SourceOn = true
-		}
-	}
-
-	// Query source voltage
-	if resp, err := Send(host, port, "SRC:VALUE?", defaultTimeout); err == nil && resp != "" {
-		fmt.Sscanf(resp, "%f", &s.SourceVolt)
-	}
-
-	return &s, nil
-}
-
-// SendRaw sends an arbitrary SCPI command and returns the response
-func SendRaw(host string, port int, cmd string) (string, error) {
-	return Send(host, port, cmd, 2*time.Second)
-}
@@ -0,0 +1,236 @@
+package scpi
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"back/database"
+	"back/models"
+)
+
+// Conn is a command channel to a single instrument.
+// Send writes one command and returns the trimmed reply ("" for commands without one).
+type Conn interface {
+	Send(cmd string, timeout time.Duration) (string, error)
+}
+
+// Driver implements an instrument's command tree.
+// Drivers are stateless: every call gets the connection it must use.
+type Driver interface {
+	// Name is a short identifier shown in logs and the API (e.g. "th2690")
+	Name() string
+	// Identify queries *IDN? and parses the identity
+	Identify(c Conn) (*IDNInfo, error)
+	// Configure applies measurement function, speed, range and source settings
+	Configure(c Conn, s InstrumentSettings) error
+	// Start begins continuous measurement
+	Start(c Conn) error
+	// SetVoltage changes the HV source setpoint of a running measurement
+	SetVoltage(c Conn, v float64) error
+	// Fetch reads the latest measurement
+	Fetch(c Conn) (*Response, error)
+	// SafeState stops measurement and switches the HV source off
+	SafeState(c Conn) error
+	// ReadSettings queries the current instrument configuration
+	ReadSettings(c Conn) (*InstrumentSettings, error)
+}
+
+type driverEntry struct {
+	patterns []string // upper-case substrings of the *IDN? model
+	drv      Driver
+}
+
+var (
+	driversMu sync.RWMutex
+	drivers   []driverEntry
+)
+
+// RegisterDriver makes a driver available for instruments whose *IDN? model
+// contains any of the given patterns (case-insensitive). Later registrations win.
+func RegisterDriver(d Driver, modelPatterns ...string) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	e := driverEntry{drv: d}
+	for _, p := range modelPatterns {
+		e.patterns = append(e.patterns, strings.ToUpper(p))
+	}
+	drivers = append([]driverEntry{e}, drivers...)
+}
+
+// DriverForModel returns the driver matching an *IDN? model string.
+// Instruments that were never identified (or are unknown) get the TH2690 driver,
+// which is what the lab has historically used.
+func DriverForModel(model string) Driver {
+	m := strings.ToUpper(strings.TrimSpace(model))
+	if m != "" {
+		driversMu.RLock()
+		defer driversMu.RUnlock()
+		for _, e := range drivers {
+			for _, p := range e.patterns {
+				if strings.Contains(m, p) {
+					return e.drv
+				}
+			}
+		}
+	}
+	return TH2690
+}
+
+// DriverFor returns the driver for an instrument based on its stored model
+func DriverFor(inst models.Instrument) Driver {
+	return DriverForModel(inst.Model)
+}
+
+// sourceStateDriver is implemented by drivers that can report whether the HV source is on
+type sourceStateDriver interface {
+	SourceState(c Conn) (bool, error)
+}
+
+// sourceRangeDriver is implemented by drivers whose HV source has separate ranges per
+// polarity; the range must be switched at 0 V
+type sourceRangeDriver interface {
+	// SourceRange returns the range needed for v, given the range in use (0 = unknown)
+	SourceRange(v float64, current int) int
+	SetSourceRange(c Conn, rng int) error
+}
+
+// withConn runs fn on the instrument's session with the given priority
+func withConn(inst models.Instrument, prio Priority, fn func(c Conn) error) error {
+	return DefaultSessions.Get(inst).Exec(prio, fn)
+}
+
+// ApplySettings configures an instrument through its driver on a single connection,
+// then reads every setting back on it. Returns the first communication error, or a
+// *SettingsMismatch listing what the instrument did not accept.
+func ApplySettings(inst models.Instrument, s InstrumentSettings) error {
+	drv := DriverFor(inst)
+	log.Printf("[SCPI] ApplySettings %s:%d driver=%s func=%s freq=%.0f autoRange=%v sourceOn=%v sourceVolt=%.0f",
+		inst.Host, inst.Port, drv.Name(), s.Function, s.Frequency, s.AutoRange, s.SourceOn, s.SourceVolt)
+	var diffs []SettingsDiff
+	err := withConn(inst, PriorityUI, func(c Conn) error {
+		var err error
+		diffs, err = configure(c, inst, drv, s)
+		return err
+	})
+	if err != nil {
+		log.Printf("[SCPI] ApplySettings %s:%d ERROR: %v", inst.Host, inst.Port, err)
+		return err
+	}
+	if len(diffs) > 0 {
+		mismatch := &SettingsMismatch{InstrumentID: inst.ID, Name: inst.Name, Diffs: diffs}
+		log.Printf("[SCPI] ApplySettings %s:%d %v", inst.Host, inst.Port, mismatch)
+		return mismatch
+	}
+	return nil
+}
+
+// configure sends the settings and reads them back on an open connection
+func configure(c Conn, inst models.Instrument, drv Driver, s InstrumentSettings) ([]SettingsDiff, error) {
+	err := drv.Configure(c, s)
+	// Commands the instrument rejected only show up in its error queue
+	if eq, ok := drv.(errorQueueDriver); ok {
+		if msgs, _ := eq.ReadErrors(c); len(msgs) > 0 {
+			log.Printf("[SCPI] ApplySettings %s:%d instrument errors: %s", inst.Host, inst.Port, strings.Join(msgs, "; "))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return readback(c, drv, s), nil
+}
+
+// StartInstrument begins measurement on an instrument
+func StartInstrument(inst models.Instrument) error {
+	drv := DriverFor(inst)
+	err := withConn(inst, PriorityUI, drv.Start)
+	log.Printf("[SCPI] start %s:%d driver=%s err=%v", inst.Host, inst.Port, drv.Name(), err)
+	return err
+}
+
+// SetSourceVoltage changes the HV source setpoint of an instrument, within its voltage limit
+func SetSourceVoltage(inst models.Instrument, v float64) error {
+	if err := CheckVoltage(inst, v); err != nil {
+		return err
+	}
+	drv := DriverFor(inst)
+	err := withConn(inst, PriorityUI, func(c Conn) error { return drv.SetVoltage(c, v) })
+	log.Printf("[SCPI] set voltage %s:%d %.3fV err=%v", inst.Host, inst.Port, v, err)
+	return err
+}
+
+// SourceState reports whether the HV source of an instrument is on.
+// Unlike ReadSettings it fails when the state cannot be read.
+func SourceState(inst models.Instrument) (bool, error) {
+	drv := DriverFor(inst)
+	sd, ok := drv.(sourceStateDriver)
+	if !ok {
+		return false, fmt.Errorf("driver %s cannot report source state", drv.Name())
+	}
+	var on bool
+	err := withConn(inst, PrioritySafety, func(c Conn) error {
+		var err error
+		on, err = sd.SourceState(c)
+		return err
+	})
+	return on, err
+}
+
+// ReadSettings queries the current configuration of an instrument
+func ReadSettings(inst models.Instrument) (*InstrumentSettings, error) {
+	var s *InstrumentSettings
+	err := withConn(inst, PriorityUI, func(c Conn) error {
+		var err error
+		s, err = DriverFor(inst).ReadSettings(c)
+		return err
+	})
+	return s, err
+}
+
+// IdentifyInstrument queries *IDN? through the instrument's session
+func IdentifyInstrument(inst models.Instrument) (*IDNInfo, error) {
+	var info *IDNInfo
+	err := withConn(inst, PriorityUI, func(c Conn) error {
+		var err error
+		info, err = DriverFor(inst).Identify(c)
+		return err
+	})
+	return info, err
+}
+
+// RecordIdentity stores what *IDN? reported on the instrument record and on its
+// session, which switches to the framing of the driver the model selects
+func RecordIdentity(inst *models.Instrument, info *IDNInfo) error {
+	inst.Model = info.Model
+	inst.Firmware = info.Firmware
+	inst.Serial = info.Serial
+	// Only these columns: the record may be older than a concurrent change of its limits
+	err := database.DB.Model(&models.Instrument{}).Where("id = ?", inst.ID).
+		Updates(map[string]interface{}{"model": inst.Model, "firmware": inst.Firmware, "serial": inst.Serial}).Error
+	DefaultSessions.Get(*inst).setIdentity(info)
+	return err
+}
+
+// SendRaw sends an arbitrary SCPI command through the instrument's session and returns the response
+func SendRaw(inst models.Instrument, cmd string) (string, error) {
+	return DefaultSessions.Get(inst).Query(PriorityUI, cmd, 2*time.Second)
+}
+
+// sendAll sends commands in order on one connection, pausing between them
+func sendAll(c Conn, cmds []string, timeout, pause time.Duration) error {
+	for _, cmd := range cmds {
+		resp, err := c.Send(cmd, timeout)
+		if err != nil {
+			return fmt.Errorf("%s: %w", cmd, err)
+		}
+		if resp != "" {
+			log.Printf("[SCPI] cmd=%q resp=%q", cmd, resp)
+		}
+		if pause > 0 {
+			time.Sleep(pause)
+		}
+	}
+	return nil
+}
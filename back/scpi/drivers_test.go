@@ -0,0 +1,307 @@
+package scpi
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"back/models"
+	"back/simulator"
+)
+
+// replyConn answers queries from a fixed table and records every command
+type replyConn struct {
+	replies map[string]string
+	sent    []string
+}
+
+func (c *replyConn) Send(cmd string, timeout time.Duration) (string, error) {
+	c.sent = append(c.sent, cmd)
+	if r, ok := c.replies[cmd]; ok {
+		return r, nil
+	}
+	if strings.HasSuffix(cmd, "?") {
+		return "", fmt.Errorf("no reply for %s", cmd)
+	}
+	return "", nil
+}
+
+func TestDriverForModel(t *testing.T) {
+	for model, want := range map[string]string{
+		"":            "th2690",
+		"TH2690":      "th2690",
+		"MODEL 6517B": "keithley6517",
+		"6517a":       "keithley6517",
+		"B2985B":      "b2980",
+		"B2981A":      "b2980",
+		"unknown":     "th2690",
+	} {
+		if got := DriverForModel(model).Name(); got != want {
+			t.Errorf("DriverForModel(%q) = %s, want %s", model, got, want)
+		}
+	}
+	if got := DriverFor(models.Instrument{Model: "Keithley 6517B"}).Name(); got != "keithley6517" {
+		t.Errorf("DriverFor = %s", got)
+	}
+}
+
+func TestParseKeithleyReading(t *testing.T) {
+	for _, tt := range []struct {
+		raw  string
+		want Response
+	}{
+		{"+1.234567E-12NADC,+0000012.345secs,+0100.000Vsrc",
+			Response{Current: 1.234567e-12, DeviceTime: "12.345", Source: 100, Voltage: 100}},
+		{"+2.5E+14OHM,+0000001.000secs,+0500.000Vsrc",
+			Response{Resistance: 2.5e14, DeviceTime: "1.000", Source: 500, Voltage: 500}},
+		{"-3.0E-09COUL", Response{Charge: -3e-9}},
+		{"+1.5E+00VDC,+0000002.000secs,+0010.000Vsrc", Response{Voltage: 1.5, DeviceTime: "2.000", Source: 10}},
+	} {
+		got, err := parseKeithleyReading(tt.raw)
+		if err != nil {
+			t.Errorf("%q: %v", tt.raw, err)
+			continue
+		}
+		if *got != tt.want {
+			t.Errorf("%q: %+v, want %+v", tt.raw, *got, tt.want)
+		}
+	}
+	for _, raw := range []string{"", "NADC", ",12secs"} {
+		if _, err := parseKeithleyReading(raw); err == nil {
+			t.Errorf("%q accepted", raw)
+		}
+	}
+}
+
+func TestB2980Fetch(t *testing.T) {
+	c := &replyConn{replies: map[string]string{":MEAS:CURR?": "+1.200000E-13", ":SOUR:VOLT?": "+2.500000E+01"}}
+	r, err := B2980.Fetch(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Current != 1.2e-13 || r.Source != 25 || r.Voltage != 25 {
+		t.Fatalf("fetch %+v", r)
+	}
+
+	// a B2981 has no source: the current alone is a reading
+	c = &replyConn{replies: map[string]string{":MEAS:CURR?": "5E-12"}}
+	if r, err := B2980.Fetch(c); err != nil || r.Current != 5e-12 || r.Source != 0 {
+		t.Fatalf("fetch without source: %+v, %v", r, err)
+	}
+
+	if err := B2980.SafeState(c); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(c.sent[len(c.sent)-4:]); got != "[:OUTP OFF :SOUR:VOLT 0 :INIT:CONT OFF :INP OFF]" {
+		t.Fatalf("safe state sent %s", got)
+	}
+}
+
+func TestTH2690DriverOnSimulator(t *testing.T) {
+	sim := simulator.New(simulator.DefaultConfig())
+	if err := sim.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	inst := models.Instrument{ID: 9561, Name: "sim", Model: "TH2690"}
+	inst.Host, inst.Port = sim.HostPort()
+
+	got, err := ReadSettings(inst)
+	if err != nil || got.Function != "CURR" || got.SourceOn {
+		t.Fatalf("settings read back: %+v, %v", got, err)
+	}
+
+	var r *Response
+	err = withConn(inst, PriorityUI, func(c Conn) error {
+		idn, err := TH2690.Identify(c)
+		if err != nil || idn.Model != "TH2690" {
+			return fmt.Errorf("identify: %+v, %v", idn, err)
+		}
+		r, err = TH2690.Fetch(c)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.DeviceTime == "" || r.Temperature == 0 || r.ErrorCode != 0 {
+		t.Fatalf("reading %+v", r)
+	}
+}
+
+func TestTH2690SafeState(t *testing.T) {
+	c := &replyConn{}
+	if err := TH2690.SafeState(c); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(c.sent); got != "[FUNC:STOP FUNC:SRC OFF SRC:VALUE 0 FUNC:AMMET OFF]" {
+		t.Fatalf("safe state sent %s", got)
+	}
+}
+
+// driverConn opens a connection with the driver's framing, outside the session pool
+func driverConn(t *testing.T, drv Driver, host string, port int) *persistentConn {
+	t.Helper()
+	pc := newPersistentConn(host, port, framingFor(drv))
+	t.Cleanup(pc.close)
+	return pc
+}
+
+// configureAndCheck runs Configure, reads every setting back and compares ReadSettings
+func configureAndCheck(t *testing.T, c Conn, drv Driver, s InstrumentSettings) {
+	t.Helper()
+	if err := drv.Configure(c, s); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	if diffs := readback(c, drv, s); len(diffs) > 0 {
+		t.Fatalf("readback: %+v", diffs)
+	}
+	got, err := drv.ReadSettings(c)
+	if err != nil {
+		t.Fatalf("read settings: %v", err)
+	}
+	if *got != s {
+		t.Fatalf("read settings = %+v, want %+v", *got, s)
+	}
+}
+
+// flushWrites waits until the instrument has processed the commands sent so far:
+// they get no reply, but a query is answered after them
+func flushWrites(t *testing.T, c Conn) {
+	t.Helper()
+	if _, err := c.Send("*IDN?", defaultTimeout); err != nil {
+		t.Fatalf("*IDN?: %v", err)
+	}
+}
+
+func within(got, want, tol float64) bool {
+	return math.Abs(got-want) <= tol
+}
+
+var measureSettings = InstrumentSettings{Function: "CURR", SourceOn: true, SourceVolt: 100, AutoRange: true, Frequency: 5, ZeroCorrect: true}
+
+func TestTH2690AgainstSimulator(t *testing.T) {
+	cfg := simulator.DefaultConfig()
+	cfg.Noise = 0
+	cfg.SlewRate = 1e6
+	cfg.Seed = 1
+	sim, inst := startSim(t, 9311, cfg)
+	c := driverConn(t, TH2690, inst.Host, inst.Port)
+
+	idn, err := TH2690.Identify(c)
+	if err != nil {
+		t.Fatalf("identify: %v", err)
+	}
+	if idn.Model != cfg.Model || idn.Serial != cfg.Serial {
+		t.Fatalf("identify = %+v", idn)
+	}
+
+	configureAndCheck(t, c, TH2690, measureSettings)
+	if err := TH2690.Start(c); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	r, err := TH2690.Fetch(c)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	// 100 V over 1 TΩ, the offset removed by zero correction
+	if r.Source != 100 || !within(r.Voltage, 100, 1e-3) || !within(r.Current, 1e-10, 1e-13) || r.ErrorCode != 0 {
+		t.Fatalf("fetch = %+v", r)
+	}
+
+	if err := TH2690.SafeState(c); err != nil {
+		t.Fatalf("safe state: %v", err)
+	}
+	flushWrites(t, c)
+	if sim.SourceOn() || sim.Running() || sim.SourceValue() != 0 {
+		t.Fatalf("after safe state: source on %v, running %v, setpoint %v", sim.SourceOn(), sim.Running(), sim.SourceValue())
+	}
+}
+
+func TestKeithley6517AgainstFake(t *testing.T) {
+	f, inst := startFake(t, 9312, "MODEL 6517B", map[string]string{
+		"*IDN?":      "KEITHLEY INSTRUMENTS INC.,MODEL 6517B,4096123,A13/700x",
+		":SYST:ERR?": `0,"No error"`,
+		":FETC?":     "+1.000000E-10NADC,+0000012.345secs,+0100.000Vsrc",
+	})
+	c := driverConn(t, Keithley6517, inst.Host, inst.Port)
+
+	idn, err := Keithley6517.Identify(c)
+	if err != nil {
+		t.Fatalf("identify: %v", err)
+	}
+	if idn.Model != "MODEL 6517B" || idn.Firmware != "A13/700x" {
+		t.Fatalf("identify = %+v", idn)
+	}
+
+	configureAndCheck(t, c, Keithley6517, measureSettings)
+	if f.get(":SYST:ZCH") != "OFF" || f.get(":FORM:ELEM") != "READ,TST,VSO" {
+		t.Fatalf("zero check %q, elements %q", f.get(":SYST:ZCH"), f.get(":FORM:ELEM"))
+	}
+	// 5 Hz is the medium speed: 1 power line cycle
+	if f.get(":SENS:CURR:NPLC") != "1" {
+		t.Fatalf("NPLC %q at %g Hz", f.get(":SENS:CURR:NPLC"), measureSettings.Frequency)
+	}
+	if err := Keithley6517.Start(c); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	r, err := Keithley6517.Fetch(c)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if r.Current != 1e-10 || r.Source != 100 || r.Voltage != 100 || r.DeviceTime != "12.345" {
+		t.Fatalf("fetch = %+v", r)
+	}
+
+	if err := Keithley6517.SafeState(c); err != nil {
+		t.Fatalf("safe state: %v", err)
+	}
+	flushWrites(t, c)
+	if f.get(":OUTP") != "OFF" || f.get(":SOUR:VOLT") != "0" || f.get(":SYST:ZCH") != "ON" {
+		t.Fatalf("after safe state: output %q, voltage %q, zero check %q", f.get(":OUTP"), f.get(":SOUR:VOLT"), f.get(":SYST:ZCH"))
+	}
+}
+
+func TestB2980AgainstFake(t *testing.T) {
+	f, inst := startFake(t, 9313, "B2987A", map[string]string{
+		"*IDN?":       "Keysight Technologies,B2987A,MY54321001,2.0.1517.7142",
+		":SYST:ERR?":  `0,"No error"`,
+		":MEAS:CURR?": "+1.000000E-10",
+	})
+	c := driverConn(t, B2980, inst.Host, inst.Port)
+
+	idn, err := B2980.Identify(c)
+	if err != nil {
+		t.Fatalf("identify: %v", err)
+	}
+	if idn.Model != "B2987A" || idn.Serial != "MY54321001" {
+		t.Fatalf("identify = %+v", idn)
+	}
+
+	s := measureSettings
+	s.ZeroCorrect = false // the B2980 has no zero correction
+	configureAndCheck(t, c, B2980, s)
+	if f.get(":INP") != "ON" {
+		t.Fatalf("input %q, want ON", f.get(":INP"))
+	}
+	if err := B2980.Start(c); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	r, err := B2980.Fetch(c)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if r.Current != 1e-10 || r.Source != 100 || r.Voltage != 100 {
+		t.Fatalf("fetch = %+v", r)
+	}
+
+	if err := B2980.SafeState(c); err != nil {
+		t.Fatalf("safe state: %v", err)
+	}
+	flushWrites(t, c)
+	if f.get(":OUTP") != "OFF" || f.get(":SOUR:VOLT") != "0" || f.get(":INP") != "OFF" {
+		t.Fatalf("after safe state: output %q, voltage %q, input %q", f.get(":OUTP"), f.get(":SOUR:VOLT"), f.get(":INP"))
+	}
+}
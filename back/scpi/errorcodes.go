@@ -0,0 +1,140 @@
+package scpi
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"back/models"
+)
+
+// Error kinds, grouping the instrument error codes by what the operator should check
+const (
+	ErrorKindCommunication = "communication" // link between the instrument boards or to the host
+	ErrorKindSelfTest      = "self_test"     // a board failed its self-check
+	ErrorKindOverload      = "overload"      // voltage or current alert, check the load
+	ErrorKindOverheat      = "overheat"
+	ErrorKindAmmeter       = "ammeter"
+	ErrorKindUnknown       = "unknown"
+)
+
+// ErrorInfo is the decoded meaning of an instrument error code
+type ErrorInfo struct {
+	Code int    `json:"code"`
+	Text string `json:"text"`
+	Kind string `json:"kind"`
+}
+
+// th2690Errors is the error code table of the TH2690 manual (chapter 4, "Error"). The
+// last field of FETCH:ALL_S? carries the code; it stays set until HAND:ERROR clears it.
+// Codes 15 to 19 are left blank in the manual.
+var th2690Errors = map[int]ErrorInfo{
+	1:  {Text: "error sending command data", Kind: ErrorKindCommunication},
+	2:  {Text: "CRC check error", Kind: ErrorKindCommunication},
+	3:  {Text: "V board self-check 1V error", Kind: ErrorKindSelfTest},
+	4:  {Text: "V board self-check 1V error", Kind: ErrorKindSelfTest},
+	5:  {Text: "V board self-check high voltage error", Kind: ErrorKindSelfTest},
+	6:  {Text: "V board HV_V alert, check for potential overloading", Kind: ErrorKindOverload},
+	7:  {Text: "V board LV_I alert, check for potential overloading", Kind: ErrorKindOverload},
+	8:  {Text: "V board OPA_TEMP alert, check for potential overheating", Kind: ErrorKindOverheat},
+	9:  {Text: "V board HV_I alert, check for potential overloading", Kind: ErrorKindOverload},
+	10: {Text: "main board self-check AD error", Kind: ErrorKindSelfTest},
+	11: {Text: "main board U606-Pro, check whether the ammeter input is too large", Kind: ErrorKindOverload},
+	12: {Text: "main board U6-Pro, ammeter error", Kind: ErrorKindAmmeter},
+	13: {Text: "main board U7-Pro, ammeter error", Kind: ErrorKindAmmeter},
+	14: {Text: "main board U607-Pro, check whether the ammeter input is too large", Kind: ErrorKindOverload},
+	20: {Text: "error returning data", Kind: ErrorKindCommunication},
+}
+
+// DescribeError decodes the error code of a reading. Only the TH2690 reports codes in
+// its readings; other drivers always return 0.
+func DescribeError(code int) ErrorInfo {
+	if code == 0 {
+		return ErrorInfo{Code: 0, Text: "no error"}
+	}
+	if info, ok := th2690Errors[code]; ok {
+		info.Code = code
+		return info
+	}
+	return ErrorInfo{Code: code, Text: fmt.Sprintf("unknown error code %d", code), Kind: ErrorKindUnknown}
+}
+
+// ErrorText returns the human-readable reason for a reading's error code ("" for 0)
+func ErrorText(code int) string {
+	if code == 0 {
+		return ""
+	}
+	return DescribeError(code).Text
+}
+
+// ErrorCatalogue lists every documented code, for clients that decode codes themselves
+func ErrorCatalogue() []ErrorInfo {
+	out := make([]ErrorInfo, 0, len(th2690Errors))
+	for code := 1; code <= 20; code++ {
+		if _, ok := th2690Errors[code]; ok {
+			out = append(out, DescribeError(code))
+		}
+	}
+	return out
+}
+
+// errorQueueDriver is implemented by drivers with a standard SCPI error queue
+type errorQueueDriver interface {
+	// ReadErrors drains the error queue and returns the pending messages
+	ReadErrors(c Conn) ([]string, error)
+}
+
+// errorClearDriver is implemented by drivers whose readings carry a latched error code
+type errorClearDriver interface {
+	ClearError(c Conn) error
+}
+
+const (
+	maxQueuedErrors = 32 // SYST:ERR? reads per drain, in case an instrument never reports 0
+	errorQueuePolls = 50 // a running experiment drains the error queue every this many polls
+)
+
+// readErrorQueue reads SYST:ERR? until the instrument reports "0,No error"
+func readErrorQueue(c Conn) ([]string, error) {
+	var msgs []string
+	for i := 0; i < maxQueuedErrors; i++ {
+		resp, err := c.Send(":SYST:ERR?", defaultTimeout)
+		if err != nil {
+			return msgs, err
+		}
+		code, _, _ := strings.Cut(resp, ",")
+		if n, err := strconv.Atoi(strings.TrimSpace(code)); err != nil || n == 0 {
+			return msgs, nil
+		}
+		msgs = append(msgs, resp)
+	}
+	return msgs, nil
+}
+
+// ReadErrors drains the SCPI error queue of an instrument. Drivers without a queue return nil.
+func ReadErrors(inst models.Instrument) ([]string, error) {
+	eq, ok := DriverFor(inst).(errorQueueDriver)
+	if !ok {
+		return nil, nil
+	}
+	var msgs []string
+	err := withConn(inst, PriorityUI, func(c Conn) error {
+		var err error
+		msgs, err = eq.ReadErrors(c)
+		return err
+	})
+	return msgs, err
+}
+
+// ErrNoErrorCode is returned by ClearError for drivers without a latched error code
+var ErrNoErrorCode = errors.New("no error code to clear")
+
+// ClearError clears the latched error code of an instrument (HAND:ERROR on the TH2690)
+func ClearError(inst models.Instrument) error {
+	ec, ok := DriverFor(inst).(errorClearDriver)
+	if !ok {
+		return fmt.Errorf("driver %s: %w", DriverFor(inst).Name(), ErrNoErrorCode)
+	}
+	return withConn(inst, PriorityUI, ec.ClearError)
+}
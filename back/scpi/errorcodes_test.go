@@ -0,0 +1,139 @@
+package scpi
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"back/broker"
+	"back/events"
+	"back/models"
+	"back/simulator"
+)
+
+// scriptConn answers queries from a fixed list and records everything sent
+type scriptConn struct {
+	replies []string
+	sent    []string
+}
+
+func (c *scriptConn) Send(cmd string, timeout time.Duration) (string, error) {
+	c.sent = append(c.sent, cmd)
+	if len(c.replies) == 0 {
+		return "", fmt.Errorf("no reply scripted for %q", cmd)
+	}
+	r := c.replies[0]
+	c.replies = c.replies[1:]
+	return r, nil
+}
+
+func TestDescribeError(t *testing.T) {
+	if info := DescribeError(0); info.Text != "no error" || ErrorText(0) != "" {
+		t.Fatalf("code 0: %+v", info)
+	}
+	if info := DescribeError(9); info.Code != 9 || info.Kind != ErrorKindOverload || ErrorText(9) != info.Text {
+		t.Fatalf("code 9: %+v", info)
+	}
+	if info := DescribeError(17); info.Kind != ErrorKindUnknown || info.Text != "unknown error code 17" {
+		t.Fatalf("undocumented code: %+v", info)
+	}
+	cat := ErrorCatalogue()
+	if len(cat) != len(th2690Errors) || cat[0].Code != 1 || cat[len(cat)-1].Code != 20 {
+		t.Fatalf("catalogue %+v", cat)
+	}
+}
+
+func TestReadErrorQueue(t *testing.T) {
+	c := &scriptConn{replies: []string{`-113,"Undefined header"`, `-222,"Data out of range"`, `0,"No error"`, "unread"}}
+	msgs, err := readErrorQueue(c)
+	if err != nil || len(msgs) != 2 || msgs[1] != `-222,"Data out of range"` {
+		t.Fatalf("messages %q, %v", msgs, err)
+	}
+	if len(c.sent) != 3 {
+		t.Fatalf("sent %q, want the queue read up to 0", c.sent)
+	}
+
+	// an instrument that never reports 0 is read a bounded number of times
+	var flood []string
+	for i := 0; i < 2*maxQueuedErrors; i++ {
+		flood = append(flood, `-100,"Command error"`)
+	}
+	msgs, err = readErrorQueue(&scriptConn{replies: flood})
+	if err != nil || len(msgs) != maxQueuedErrors {
+		t.Fatalf("%d messages, %v", len(msgs), err)
+	}
+
+	msgs, err = readErrorQueue(&scriptConn{replies: []string{`-113,"Undefined header"`}})
+	if err == nil || len(msgs) != 1 {
+		t.Fatalf("failed read: %q, %v", msgs, err)
+	}
+}
+
+func TestClearError(t *testing.T) {
+	_, inst := liveSim(t, 9481)
+	errorCode := func() int {
+		var resp *Response
+		err := DefaultSessions.Get(inst).Exec(PriorityUI, func(c Conn) error {
+			var err error
+			resp, err = DriverFor(inst).Fetch(c)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.ErrorCode
+	}
+	// a positive setpoint on the negative source range latches the HV_V alert
+	if _, err := DefaultSessions.Get(inst).Query(PriorityUI, "SRC:RANGE 3;SRC:VALUE 50", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if code := errorCode(); code != simulator.ErrSourceRange {
+		t.Fatalf("error code %d", code)
+	}
+	if err := ClearError(inst); err != nil {
+		t.Fatal(err)
+	}
+	if code := errorCode(); code != 0 {
+		t.Fatalf("error code %d after ClearError", code)
+	}
+
+	if err := ClearError(models.Instrument{ID: 9482, Model: "MODEL 6517B"}); !errors.Is(err, ErrNoErrorCode) {
+		t.Fatal("ClearError on a driver without error codes")
+	}
+}
+
+// TestRunnerAutoClearErrors: an error code in a reading is recorded, cleared with
+// HAND:ERROR when the plan asks for it, and its clearing recorded too
+func TestRunnerAutoClearErrors(t *testing.T) {
+	_, inst := liveSim(t, 9483)
+	sub, _, _ := broker.Default.Subscribe(9483, 0)
+	defer broker.Default.Unsubscribe(sub)
+	if _, err := DefaultSessions.Get(inst).Query(PriorityUI, "SRC:RANGE 3;SRC:VALUE 50", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	DefaultRunner.Resume(9483, []models.Instrument{inst}, RunPlan{
+		InstrumentIDs:   []uint{inst.ID},
+		PollIntervalsMs: map[uint]int64{inst.ID: 50},
+		AutoClearErrors: true,
+		StartedAt:       time.Now(),
+	})
+	defer DefaultRunner.Stop(9483)
+
+	var seen []string
+	timeout := time.After(3 * time.Second)
+	for len(seen) < 2 {
+		select {
+		case ev := <-sub.C:
+			if ev.Kind == broker.KindEvent {
+				seen = append(seen, ev.Event.Type)
+			}
+		case <-timeout:
+			t.Fatalf("timeline %q", seen)
+		}
+	}
+	if seen[0] != events.InstrumentError || seen[1] != events.InstrumentErrorCleared {
+		t.Fatalf("timeline %q", seen)
+	}
+}
@@ -0,0 +1,100 @@
+package scpi
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"back/models"
+)
+
+// fakeInstrument is a line-based SCPI server for the drivers the simulator does not
+// cover: a command "HEADER arg" stores arg, a query "HEADER?" returns the stored arg.
+// Fixed replies take precedence; queries with neither get no reply. Like the real
+// instruments, setting a :RANG switches its autorange off.
+type fakeInstrument struct {
+	ln      net.Listener
+	mu      sync.Mutex
+	state   map[string]string
+	replies map[string]string
+}
+
+// startFake starts a fake instrument and returns it with an instrument record of the
+// given model pointing at it. IDs must be unique across the package tests.
+func startFake(t *testing.T, id uint, model string, replies map[string]string) (*fakeInstrument, models.Instrument) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeInstrument{ln: ln, state: make(map[string]string), replies: replies}
+	t.Cleanup(func() { ln.Close() })
+	go f.serve()
+	addr := ln.Addr().(*net.TCPAddr)
+	return f, models.Instrument{ID: id, Name: ln.Addr().String(), Host: addr.IP.String(), Port: addr.Port, Model: model}
+}
+
+func (f *fakeInstrument) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeInstrument) handle(conn net.Conn) {
+	defer conn.Close()
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		if resp, ok := f.answer(line); ok {
+			conn.Write([]byte(resp + "\n"))
+		}
+	}
+}
+
+// answer applies a command or returns the reply to a query
+func (f *fakeInstrument) answer(line string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if resp, ok := f.replies[line]; ok {
+		return resp, true
+	}
+	if header, ok := strings.CutSuffix(line, "?"); ok {
+		resp, ok := f.state[strings.ToUpper(header)]
+		return resp, ok
+	}
+	header, arg, _ := strings.Cut(line, " ")
+	header = strings.ToUpper(header)
+	f.state[header] = arg
+	if strings.HasSuffix(header, ":RANG") {
+		f.state[header+":AUTO"] = "0" // a fixed range switches autorange off
+	}
+	return "", false
+}
+
+// get returns the last argument written with a command header
+func (f *fakeInstrument) get(header string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state[header]
+}
+
+// tableConn is a Conn answering queries from a map; anything else fails
+type tableConn map[string]string
+
+func (r tableConn) Send(cmd string, _ time.Duration) (string, error) {
+	if resp, ok := r[cmd]; ok {
+		return resp, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrTimeout, cmd)
+}
@@ -0,0 +1,363 @@
+package scpi
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"back/database"
+	"back/models"
+)
+
+const (
+	journalReplayBatch    = 1000
+	journalReplayInterval = 10 * time.Second
+	journalMaxFailures    = 5 // failed replays of an experiment before its rows are set aside
+)
+
+// Journal spills measurements to append-only JSON-lines files when the database
+// rejects them, and replays them into `measurements` once it is reachable again.
+//
+// Files are per experiment: exp_<id>.jsonl receives new rows; before replay it is
+// renamed to exp_<id>.replay.jsonl so appends and replay never touch the same file.
+// Rows of an experiment that failed to replay journalMaxFailures times in a row are moved
+// to dead/exp_<id>.jsonl, where they wait for an operator instead of blocking the others.
+type Journal struct {
+	dir string
+
+	mu       sync.Mutex
+	pending  map[uint]int // experimentID -> rows on disk
+	failures map[uint]int // experimentID -> consecutive failed replays
+	started  bool
+	stop     chan struct{}
+	stopped  chan struct{} // closed when the replay loop returned
+}
+
+var DefaultJournal = NewJournal(journalDir())
+
+func journalDir() string {
+	if dir := os.Getenv("JOURNAL_DIR"); dir != "" {
+		return dir
+	}
+	return "journal"
+}
+
+// NewJournal creates a journal stored in dir
+func NewJournal(dir string) *Journal {
+	return &Journal{dir: dir, pending: make(map[uint]int), failures: make(map[uint]int), stop: make(chan struct{}), stopped: make(chan struct{})}
+}
+
+// Append writes rows to the journal and fsyncs before returning
+func (j *Journal) Append(rows []models.Measurement) error {
+	byExp := make(map[uint][]models.Measurement)
+	for _, m := range rows {
+		m.ID = 0 // let the database assign it on replay
+		byExp[m.ExperimentID] = append(byExp[m.ExperimentID], m)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := os.MkdirAll(j.dir, 0o755); err != nil {
+		return err
+	}
+	for expID, ms := range byExp {
+		if err := appendRows(j.activePath(expID), ms); err != nil {
+			return err
+		}
+		j.pending[expID] += len(ms)
+	}
+	return nil
+}
+
+// Pending returns the number of journaled rows of an experiment waiting for replay
+func (j *Journal) Pending(experimentID uint) int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.pending[experimentID]
+}
+
+// Start counts rows left over from a previous run and replays periodically
+func (j *Journal) Start() {
+	j.mu.Lock()
+	j.started = true
+	for _, path := range j.files() {
+		if id, ok := journalExperimentID(path); ok {
+			n, err := countRows(path)
+			if err != nil {
+				log.Printf("[JOURNAL] read %s: %v", path, err)
+				continue
+			}
+			j.pending[id] += n
+		}
+	}
+	total := 0
+	for _, n := range j.pending {
+		total += n
+	}
+	j.mu.Unlock()
+	if total > 0 {
+		log.Printf("[JOURNAL] %d rows pending replay in %s", total, j.dir)
+	}
+
+	go func() {
+		defer close(j.stopped)
+		for {
+			j.Replay()
+			select {
+			case <-j.stop:
+				return
+			case <-time.After(journalReplayInterval):
+			}
+		}
+	}()
+}
+
+// Close stops replaying and waits for a replay in progress. Rows can still be appended;
+// they are replayed by the next process.
+func (j *Journal) Close() {
+	j.mu.Lock()
+	started := j.started
+	select {
+	case <-j.stop:
+	default:
+		close(j.stop)
+	}
+	j.mu.Unlock()
+	if started {
+		<-j.stopped
+	}
+}
+
+// Replay inserts journaled rows into the database. Rows that could not be inserted
+// stay in the journal for the next attempt; an experiment that fails does not hold
+// back the others.
+func (j *Journal) Replay() {
+	j.mu.Lock()
+	ids := make([]uint, 0, len(j.pending))
+	for id, n := range j.pending {
+		if n > 0 {
+			ids = append(ids, id)
+		}
+	}
+	j.mu.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+	sqlDB, err := database.DB.DB()
+	if err != nil || sqlDB.Ping() != nil {
+		return
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+	for _, id := range ids {
+		err := j.replayExperiment(id)
+		if err == nil {
+			j.mu.Lock()
+			delete(j.failures, id)
+			j.mu.Unlock()
+			continue
+		}
+		// A database that went away is not the experiment's fault
+		if sqlDB.Ping() != nil {
+			log.Printf("[JOURNAL] exp=%d replay stopped, database unreachable: %v", id, err)
+			return
+		}
+		j.replayFailed(id, err)
+	}
+}
+
+// replayFailed counts a failed replay of an experiment and moves its rows to the
+// dead-letter file once it failed journalMaxFailures times in a row
+func (j *Journal) replayFailed(expID uint, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.failures[expID]++
+	n := j.failures[expID]
+	log.Printf("[JOURNAL] exp=%d replay failed (%d/%d): %v", expID, n, journalMaxFailures, err)
+	if n < journalMaxFailures {
+		return
+	}
+
+	dead := j.deadPath(expID)
+	if err := os.MkdirAll(filepath.Dir(dead), 0o755); err != nil {
+		log.Printf("[JOURNAL] exp=%d dead letter: %v", expID, err)
+		return
+	}
+	for _, path := range []string{j.replayPath(expID), j.activePath(expID)} {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := moveRows(path, dead); err != nil {
+			log.Printf("[JOURNAL] exp=%d dead letter: %v", expID, err)
+			return
+		}
+	}
+	log.Printf("[JOURNAL] exp=%d %d rows moved to %s after %d failed replays", expID, j.pending[expID], dead, n)
+	delete(j.pending, expID)
+	delete(j.failures, expID)
+}
+
+func (j *Journal) replayExperiment(expID uint) error {
+	replayPath := j.replayPath(expID)
+
+	// Move new rows behind the ones from an interrupted replay
+	j.mu.Lock()
+	active := j.activePath(expID)
+	if _, err := os.Stat(active); err == nil {
+		if err := moveRows(active, replayPath); err != nil {
+			j.mu.Unlock()
+			return err
+		}
+	}
+	j.mu.Unlock()
+
+	rows, err := readRows(replayPath)
+	if err != nil {
+		return err
+	}
+
+	done := 0
+	for done < len(rows) {
+		end := done + journalReplayBatch
+		if end > len(rows) {
+			end = len(rows)
+		}
+		if err := database.DB.CreateInBatches(rows[done:end], journalReplayBatch).Error; err != nil {
+			// Keep what is left for the next attempt
+			if werr := writeRows(replayPath, rows[done:]); werr != nil {
+				log.Printf("[JOURNAL] exp=%d rewrite %s: %v", expID, replayPath, werr)
+			}
+			j.addPending(expID, -done)
+			return err
+		}
+		done = end
+	}
+
+	if err := os.Remove(replayPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	j.addPending(expID, -done)
+	log.Printf("[JOURNAL] exp=%d replayed %d rows", expID, done)
+	return nil
+}
+
+func (j *Journal) addPending(expID uint, delta int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.pending[expID] += delta
+	if j.pending[expID] <= 0 {
+		delete(j.pending, expID)
+	}
+}
+
+func (j *Journal) activePath(expID uint) string {
+	return filepath.Join(j.dir, fmt.Sprintf("exp_%d.jsonl", expID))
+}
+
+func (j *Journal) replayPath(expID uint) string {
+	return filepath.Join(j.dir, fmt.Sprintf("exp_%d.replay.jsonl", expID))
+}
+
+// deadPath is outside the exp_*.jsonl pattern, so dead letters are never replayed
+func (j *Journal) deadPath(expID uint) string {
+	return filepath.Join(j.dir, "dead", fmt.Sprintf("exp_%d.jsonl", expID))
+}
+
+func (j *Journal) files() []string {
+	paths, _ := filepath.Glob(filepath.Join(j.dir, "exp_*.jsonl"))
+	return paths
+}
+
+// journalExperimentID extracts the experiment ID from exp_<id>[.replay].jsonl
+func journalExperimentID(path string) (uint, bool) {
+	name := strings.TrimPrefix(filepath.Base(path), "exp_")
+	name = strings.TrimSuffix(name, ".jsonl")
+	name = strings.TrimSuffix(name, ".replay")
+	id, err := strconv.ParseUint(name, 10, 64)
+	return uint(id), err == nil
+}
+
+func appendRows(path string, rows []models.Measurement) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for i := range rows {
+		if err := enc.Encode(&rows[i]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readRows(path string) ([]models.Measurement, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rows []models.Measurement
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var m models.Measurement
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			// A torn last line from a crash mid-write: skip it
+			log.Printf("[JOURNAL] %s: skipping bad line: %v", path, err)
+			continue
+		}
+		rows = append(rows, m)
+	}
+	return rows, sc.Err()
+}
+
+// writeRows atomically replaces path with rows
+func writeRows(path string, rows []models.Measurement) error {
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := appendRows(tmp, rows); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// moveRows appends the rows of src to dst and removes src
+func moveRows(src, dst string) error {
+	rows, err := readRows(src)
+	if err != nil {
+		return err
+	}
+	if err := appendRows(dst, rows); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// countRows counts the rows of a journal file that replay will insert; a torn line is
+// skipped by readRows and must not be counted as pending
+func countRows(path string) (int, error) {
+	rows, err := readRows(path)
+	return len(rows), err
+}
@@ -0,0 +1,191 @@
+package scpi
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"back/models"
+)
+
+func TestJournalAppendAndCount(t *testing.T) {
+	j := useTempJournal(t)
+	dir := os.Getenv("JOURNAL_DIR")
+
+	rows := []models.Measurement{
+		{ID: 5, ExperimentID: 900, InstrumentID: 79, RecordedAt: time.Now(), Current: 1e-12},
+		{ExperimentID: 900, InstrumentID: 79, RecordedAt: time.Now(), Current: 2e-12},
+		{ExperimentID: 901, InstrumentID: 79, RecordedAt: time.Now(), Current: 3e-12},
+	}
+	if err := j.Append(rows); err != nil {
+		t.Fatal(err)
+	}
+	if got := j.Pending(900); got != 2 {
+		t.Fatalf("pending(900) = %d, want 2", got)
+	}
+	if got := j.Pending(901); got != 1 {
+		t.Fatalf("pending(901) = %d, want 1", got)
+	}
+
+	path := filepath.Join(dir, "exp_900.jsonl")
+	back, err := readRows(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(back) != 2 || back[0].ID != 0 || back[1].Current != 2e-12 {
+		t.Fatalf("journaled rows = %+v", back)
+	}
+
+	// A restarted process finds the rows left on disk
+	again := NewJournal(dir)
+	again.Start()
+	if got := again.Pending(900); got != 2 {
+		t.Fatalf("pending after restart = %d, want 2", got)
+	}
+}
+
+func TestJournalExperimentID(t *testing.T) {
+	for path, want := range map[string]uint{"/x/exp_12.jsonl": 12, "exp_7.replay.jsonl": 7} {
+		if id, ok := journalExperimentID(path); !ok || id != want {
+			t.Errorf("journalExperimentID(%q) = %d, %v", path, id, ok)
+		}
+	}
+	if _, ok := journalExperimentID("exp_x.jsonl"); ok {
+		t.Error("journalExperimentID accepted a bad name")
+	}
+}
+
+func TestWriterSpillsToJournal(t *testing.T) {
+	j := useTempJournal(t)
+	w := NewMeasurementWriter(100)
+	w.Enqueue(models.Measurement{ExperimentID: 42, InstrumentID: 1, RecordedAt: time.Now()})
+	w.Flush()
+	if got := j.Pending(42); got != 1 {
+		t.Fatalf("pending = %d, want 1 (database is unreachable)", got)
+	}
+	if _, err := os.Stat(filepath.Join(os.Getenv("JOURNAL_DIR"), "exp_42.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWriterClose: Close writes what is queued, later flushes return at once and later
+// rows go straight to the journal
+func TestWriterClose(t *testing.T) {
+	j := useTempJournal(t)
+	w := NewMeasurementWriter(100)
+	w.Enqueue(models.Measurement{ExperimentID: 43, InstrumentID: 1, RecordedAt: time.Now()})
+	w.Close()
+	if got := j.Pending(43); got != 1 {
+		t.Fatalf("pending after close = %d, want 1", got)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		w.Flush()
+		w.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("flush after close blocked")
+	}
+	w.Enqueue(models.Measurement{ExperimentID: 43, InstrumentID: 1, RecordedAt: time.Now()})
+	if got := j.Pending(43); got != 2 {
+		t.Fatalf("pending after enqueue on a closed writer = %d, want 2", got)
+	}
+	if st := w.Stats(); st.Journaled != 2 || st.Queued != 0 {
+		t.Fatalf("stats = %+v", st)
+	}
+}
+
+func TestJournalClose(t *testing.T) {
+	j := useTempJournal(t)
+	j.Close() // never started
+	j = NewJournal(t.TempDir())
+	j.Start()
+	done := make(chan struct{})
+	go func() {
+		j.Close()
+		j.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("close did not stop the replay loop")
+	}
+}
+
+// TestJournalDeadLetter: an experiment whose rows keep failing to replay is set aside
+// after journalMaxFailures attempts, and a success in between resets the count
+func TestJournalDeadLetter(t *testing.T) {
+	j := useTempJournal(t)
+	dir := os.Getenv("JOURNAL_DIR")
+	rows := []models.Measurement{
+		{ExperimentID: 902, InstrumentID: 79, RecordedAt: time.Now()},
+		{ExperimentID: 902, InstrumentID: 79, RecordedAt: time.Now()},
+	}
+	if err := j.Append(rows); err != nil {
+		t.Fatal(err)
+	}
+	// an interrupted replay left one row behind the active file
+	if err := moveRows(j.activePath(902), j.replayPath(902)); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Append(rows[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < journalMaxFailures; i++ {
+		j.replayFailed(902, errors.New("violates foreign key constraint"))
+	}
+	if got := j.Pending(902); got != 3 {
+		t.Fatalf("pending before the last failure = %d, want 3", got)
+	}
+	j.replayFailed(902, errors.New("violates foreign key constraint"))
+
+	if got := j.Pending(902); got != 0 {
+		t.Fatalf("pending after dead letter = %d", got)
+	}
+	if len(j.files()) != 0 {
+		t.Fatalf("journal files left for replay: %v", j.files())
+	}
+	dead, err := readRows(filepath.Join(dir, "dead", "exp_902.jsonl"))
+	if err != nil || len(dead) != 3 {
+		t.Fatalf("dead letter rows %d, %v", len(dead), err)
+	}
+
+	// a restart does not pick dead letters up again
+	again := NewJournal(dir)
+	again.Start()
+	defer again.Close()
+	if got := again.Pending(902); got != 0 {
+		t.Fatalf("pending after restart = %d", got)
+	}
+}
+
+// TestJournalCountsParseableRows: a torn last line from a crash is not pending, so the
+// count drops to zero once the readable rows are replayed
+func TestJournalCountsParseableRows(t *testing.T) {
+	j := useTempJournal(t)
+	dir := os.Getenv("JOURNAL_DIR")
+	if err := j.Append([]models.Measurement{{ExperimentID: 903, RecordedAt: time.Now()}}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(j.activePath(903), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"experiment_id":903,"curr`)
+	f.Close()
+
+	again := NewJournal(dir)
+	again.Start()
+	defer again.Close()
+	if got := again.Pending(903); got != 1 {
+		t.Fatalf("pending = %d, want 1 readable row", got)
+	}
+}
@@ -0,0 +1,348 @@
+package scpi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keithley6517 is the driver for Keithley 6517-style electrometers
+var Keithley6517 Driver = keithley6517{}
+
+func init() {
+	RegisterDriver(Keithley6517, "6517")
+}
+
+// keithley6517 speaks the standard SCPI tree of the 6517A/6517B:
+//
+//	:SENS:FUNC 'CURR', :SENS:CURR:NPLC, :SENS:CURR:RANG, :SOUR:VOLT, :OUTP, :FETC?
+//
+// Readings are requested as READ,TST,VSO elements, e.g.
+// "+1.234567E-12NADC,+0000012.345secs,+0100.000Vsrc".
+type keithley6517 struct{}
+
+func (keithley6517) Name() string { return "keithley6517" }
+
+// Framing: the instrument terminates commands and replies with LF only
+func (keithley6517) Framing() Framing {
+	return Framing{WriteTerm: "\n", ReadTerm: "\n"}
+}
+
+func (keithley6517) Identify(c Conn) (*IDNInfo, error) {
+	return identify(c)
+}
+
+func (keithley6517) Configure(c Conn, s InstrumentSettings) error {
+	fn := keithleyFunction(s.Function)
+
+	cmds := []string{
+		":SYST:ZCH ON", // zero check on while reconfiguring the input
+		fmt.Sprintf(":SENS:FUNC '%s'", fn),
+	}
+	cmds = append(cmds, senseCommands(s)...)
+	cmds = append(cmds, ":SYST:ZCOR "+onOff(s.ZeroCorrect))
+	cmds = append(cmds, ":FORM:ELEM READ,TST,VSO")
+
+	if s.SourceOn {
+		cmds = append(cmds,
+			":SOUR:VOLT:RANG "+keithleySourceRange(s.SourceVolt),
+			fmt.Sprintf(":SOUR:VOLT %.3f", s.SourceVolt),
+			":OUTP ON")
+	} else {
+		cmds = append(cmds, ":OUTP OFF")
+	}
+	cmds = append(cmds, ":SYST:ZCH OFF")
+
+	return sendAll(c, cmds, 2*time.Second, 0)
+}
+
+// ConfigureMeasurement changes speed, range and zero correction without touching the source
+func (keithley6517) ConfigureMeasurement(c Conn, s InstrumentSettings) error {
+	cmds := append(senseCommands(s), ":SYST:ZCOR "+onOff(s.ZeroCorrect))
+	return sendAll(c, cmds, 2*time.Second, 0)
+}
+
+// AcquireZero runs the zero check / zero correct procedure: acquire the offset with the
+// input shorted, then measure with the correction applied
+func (keithley6517) AcquireZero(c Conn) error {
+	return sendAll(c, []string{":SYST:ZCH ON", ":SYST:ZCOR OFF", ":SYST:ZCOR:ACQ", ":SYST:ZCH OFF", ":SYST:ZCOR ON"}, 2*time.Second, 0)
+}
+
+// senseCommands sets the speed and range of the selected function, shared by the 6517 and the B2980
+func senseCommands(s InstrumentSettings) []string {
+	fn := keithleyFunction(s.Function)
+	cmds := []string{fmt.Sprintf(":SENS:%s:NPLC %s", fn, speedToNPLC(FrequencyToSpeed(s.Frequency)))}
+	if s.AutoRange || s.Range == "" {
+		cmds = append(cmds, fmt.Sprintf(":SENS:%s:RANG:AUTO ON", fn))
+	} else {
+		cmds = append(cmds, fmt.Sprintf(":SENS:%s:RANG %s", fn, s.Range))
+	}
+	return cmds
+}
+
+// keithleySourceRange picks the source range: 100 V covers ±100 V, 1000 V everything else
+func keithleySourceRange(v float64) string {
+	if v > 100 || v < -100 {
+		return "1000"
+	}
+	return "100"
+}
+
+// readbackChecks lists the queries that confirm what Configure wrote
+func (keithley6517) readbackChecks(s InstrumentSettings) []readbackCheck {
+	checks := senseReadbackChecks(s)
+	checks = append(checks,
+		readbackCheck{setting: "zero", query: ":SYST:ZCOR?", want: onOff(s.ZeroCorrect)},
+		readbackCheck{setting: "source", query: ":OUTP?", want: onOff(s.SourceOn)})
+	if s.SourceOn {
+		checks = append(checks,
+			readbackCheck{setting: "source_range", query: ":SOUR:VOLT:RANG?", want: keithleySourceRange(s.SourceVolt), numeric: true},
+			readbackCheck{setting: "source_volt", query: ":SOUR:VOLT?", want: fmt.Sprintf("%.3f", s.SourceVolt), numeric: true})
+	}
+	return checks
+}
+
+// stateQueries lists every setting Configure touches, for all measurement functions
+func (keithley6517) stateQueries() []string {
+	qs := append([]string{":SENS:FUNC?"}, senseStateQueries()...)
+	return append(qs,
+		":SYST:ZCH?", ":SYST:ZCOR?", ":FORM:ELEM?",
+		":SOUR:VOLT:RANG?", ":SOUR:VOLT?", ":OUTP?")
+}
+
+// CalibrationDate queries the date of the last calibration (:CAL:PROT:DATE?)
+func (keithley6517) CalibrationDate(c Conn) (string, error) {
+	return c.Send(":CAL:PROT:DATE?", defaultTimeout)
+}
+
+// senseStateQueries lists the speed and range queries of every measurement function
+func senseStateQueries() []string {
+	var qs []string
+	for _, fn := range []string{"CURR", "RES", "CHAR"} {
+		qs = append(qs,
+			fmt.Sprintf(":SENS:%s:NPLC?", fn),
+			fmt.Sprintf(":SENS:%s:RANG?", fn),
+			fmt.Sprintf(":SENS:%s:RANG:AUTO?", fn))
+	}
+	return qs
+}
+
+// senseReadbackChecks covers the :SENS settings shared by the 6517 and the B2980
+func senseReadbackChecks(s InstrumentSettings) []readbackCheck {
+	fn := keithleyFunction(s.Function)
+	checks := []readbackCheck{
+		{setting: "function", query: ":SENS:FUNC?", want: fn},
+		{setting: "speed", query: fmt.Sprintf(":SENS:%s:NPLC?", fn), want: speedToNPLC(FrequencyToSpeed(s.Frequency)), numeric: true},
+	}
+	if s.AutoRange || s.Range == "" {
+		checks = append(checks, readbackCheck{setting: "range", query: fmt.Sprintf(":SENS:%s:RANG:AUTO?", fn), want: "ON"})
+	} else {
+		checks = append(checks, readbackCheck{setting: "range", query: fmt.Sprintf(":SENS:%s:RANG?", fn), want: s.Range, numeric: true})
+	}
+	return checks
+}
+
+func (keithley6517) Start(c Conn) error {
+	_, err := c.Send(":INIT:CONT ON", defaultTimeout)
+	return err
+}
+
+func (keithley6517) SetVoltage(c Conn, v float64) error {
+	_, err := c.Send(fmt.Sprintf(":SOUR:VOLT %.3f", v), defaultTimeout)
+	return err
+}
+
+func (keithley6517) Fetch(c Conn) (*Response, error) {
+	raw, err := c.Send(":FETC?", defaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeithleyReading(raw)
+}
+
+// SafeState switches the source off, zeroes it and re-enables zero check
+func (keithley6517) SafeState(c Conn) error {
+	var firstErr error
+	for _, cmd := range []string{":OUTP OFF", ":SOUR:VOLT 0", ":INIT:CONT OFF", ":SYST:ZCH ON"} {
+		if _, err := c.Send(cmd, 2*time.Second); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %w", cmd, err)
+		}
+	}
+	return firstErr
+}
+
+func (keithley6517) ReadErrors(c Conn) ([]string, error) {
+	return readErrorQueue(c)
+}
+
+func (keithley6517) SourceState(c Conn) (bool, error) {
+	resp, err := c.Send(":OUTP?", defaultTimeout)
+	if err != nil {
+		return false, err
+	}
+	return parseOnOff(resp)
+}
+
+// ReadSettings queries every setting Configure writes and fails on a missing or
+// unexpected reply
+func (keithley6517) ReadSettings(c Conn) (*InstrumentSettings, error) {
+	s, err := readSenseSettings(c)
+	if err != nil {
+		return nil, err
+	}
+	if s.ZeroCorrect, err = queryOnOff(c, ":SYST:ZCOR?"); err != nil {
+		return nil, err
+	}
+	if s.SourceOn, err = queryOnOff(c, ":OUTP?"); err != nil {
+		return nil, err
+	}
+	if s.SourceVolt, err = queryFloat(c, ":SOUR:VOLT?"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// readSenseSettings reads back what senseCommands writes — function, speed and range —
+// shared by the 6517 and the B2980
+func readSenseSettings(c Conn) (*InstrumentSettings, error) {
+	var s InstrumentSettings
+
+	resp, err := querySetting(c, ":SENS:FUNC?")
+	if err != nil {
+		return nil, err
+	}
+	// Replies are quoted and may carry a suffix: "CURR:DC"
+	name, _, _ := strings.Cut(strings.ToUpper(strings.Trim(resp, "\"'")), ":")
+	switch name {
+	case "CURR", "RES", "CHAR":
+		s.Function = name
+	default:
+		return nil, fmt.Errorf(":SENS:FUNC?: unsupported function %q", resp)
+	}
+
+	nplc, err := queryFloat(c, fmt.Sprintf(":SENS:%s:NPLC?", name))
+	if err != nil {
+		return nil, err
+	}
+	if s.Frequency, err = SpeedToFrequency(nplcToSpeed(nplc)); err != nil {
+		return nil, err
+	}
+
+	if s.AutoRange, err = queryOnOff(c, fmt.Sprintf(":SENS:%s:RANG:AUTO?", name)); err != nil {
+		return nil, err
+	}
+	if !s.AutoRange {
+		rng, err := queryFloat(c, fmt.Sprintf(":SENS:%s:RANG?", name))
+		if err != nil {
+			return nil, err
+		}
+		s.Range = strconv.FormatFloat(rng, 'g', -1, 64)
+	}
+	return &s, nil
+}
+
+// keithleyFunction maps InstrumentSettings.Function to a :SENS:FUNC name
+func keithleyFunction(fn string) string {
+	switch fn {
+	case "RES":
+		return "RES"
+	case "CHAR":
+		return "CHAR"
+	}
+	return "CURR"
+}
+
+// speedToNPLC maps the integration speed name to power line cycles
+func speedToNPLC(speed string) string {
+	switch speed {
+	case "FAST":
+		return "0.1"
+	case "MID":
+		return "1"
+	}
+	return "10"
+}
+
+// nplcToSpeed maps power line cycles back to the speed name, the inverse of speedToNPLC
+func nplcToSpeed(nplc float64) string {
+	switch {
+	case nplc <= 0.1:
+		return "FAST"
+	case nplc <= 1:
+		return "MID"
+	}
+	return "SLOW"
+}
+
+// parseKeithleyReading parses a READ,TST,VSO reading with unit suffixes.
+// The reading unit decides which Response field it lands in.
+func parseKeithleyReading(raw string) (*Response, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) < 1 || strings.TrimSpace(parts[0]) == "" {
+		return nil, fmt.Errorf("unexpected reading format: %q", raw)
+	}
+
+	r := &Response{}
+	val, unit, err := splitUnit(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse reading: %w", err)
+	}
+	switch {
+	case strings.HasSuffix(unit, "OHM"):
+		r.Resistance = val
+	case strings.HasSuffix(unit, "COUL"):
+		r.Charge = val
+	case strings.HasSuffix(unit, "VDC"):
+		r.Voltage = val
+	default:
+		r.Current = val
+	}
+	if len(parts) >= 2 {
+		if t, _, err := splitUnit(parts[1]); err == nil {
+			r.DeviceTime = strconv.FormatFloat(t, 'f', 3, 64)
+		}
+	}
+	if len(parts) >= 3 {
+		if v, _, err := splitUnit(parts[2]); err == nil {
+			r.Source = v
+			if r.Voltage == 0 {
+				r.Voltage = v
+			}
+		}
+	}
+	return r, nil
+}
+
+// splitUnit separates "+1.234E-12NADC" into 1.234e-12 and "NADC"
+func splitUnit(field string) (float64, string, error) {
+	field = strings.TrimSpace(field)
+	i := len(field)
+	for i > 0 {
+		ch := field[i-1]
+		if (ch >= '0' && ch <= '9') || ch == '.' {
+			break
+		}
+		i--
+	}
+	v, err := strconv.ParseFloat(field[:i], 64)
+	return v, strings.ToUpper(field[i:]), err
+}
+
+func onOff(b bool) string {
+	if b {
+		return "ON"
+	}
+	return "OFF"
+}
+
+// parseOnOff parses a boolean reply: 1/ON or 0/OFF
+func parseOnOff(resp string) (bool, error) {
+	switch strings.ToUpper(strings.TrimSpace(resp)) {
+	case "1", "ON":
+		return true, nil
+	case "0", "OFF":
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected on/off reply: %q", resp)
+}
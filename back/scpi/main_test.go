@@ -0,0 +1,86 @@
+package scpi
+
+import (
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"back/database"
+	"back/models"
+	"back/simulator"
+)
+
+// TestMain points the package at an unreachable database, so writes fail fast and spill
+// to the journal, and keeps that journal in a temporary directory instead of the
+// working directory (the package source tree under go test)
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "scpi-journal-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Setenv("JOURNAL_DIR", dir)
+	DefaultJournal = NewJournal(journalDir())
+
+	database.DB, err = gorm.Open(postgres.Open("host=127.0.0.1 port=1 user=test dbname=test sslmode=disable connect_timeout=1"),
+		&gorm.Config{DisableAutomaticPing: true, Logger: logger.Discard})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// useTempJournal gives a test its own journal directory, set through JOURNAL_DIR
+func useTempJournal(t *testing.T) *Journal {
+	t.Helper()
+	t.Setenv("JOURNAL_DIR", t.TempDir())
+	prev := DefaultJournal
+	DefaultJournal = NewJournal(journalDir())
+	t.Cleanup(func() { DefaultJournal = prev })
+	return DefaultJournal
+}
+
+// startSim starts a simulated instrument and returns it with an instrument record
+// pointing at it. IDs must be unique across the package tests: sessions are shared.
+func startSim(t *testing.T, id uint, cfg simulator.Config) (*simulator.Server, models.Instrument) {
+	t.Helper()
+	sim := simulator.New(cfg)
+	if err := sim.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sim.Close() })
+	host, port := sim.HostPort()
+	return sim, models.Instrument{ID: id, Name: sim.Addr(), Host: host, Port: port, Model: cfg.Model}
+}
+
+// newTestRunner returns a runner of its own, so tests do not share DefaultRunner
+func newTestRunner() *Runner {
+	return &Runner{runs: make(map[uint]*runHandle), paused: make(map[uint]bool)}
+}
+
+// sampleSetpoints records the simulator's source setpoint every 10 ms until stop is closed
+func sampleSetpoints(sim *simulator.Server, stop <-chan struct{}) <-chan []float64 {
+	out := make(chan []float64, 1)
+	go func() {
+		var vs []float64
+		tick := time.NewTicker(10 * time.Millisecond)
+		defer tick.Stop()
+		for {
+			select {
+			case <-stop:
+				out <- vs
+				return
+			case <-tick.C:
+				vs = append(vs, sim.SourceValue())
+			}
+		}
+	}()
+	return out
+}
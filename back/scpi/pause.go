@@ -0,0 +1,21 @@
+package scpi
+
+import (
+	"time"
+
+	"back/database"
+	"back/models"
+)
+
+// HV handling while an experiment is paused
+const (
+	PauseHoldHV = "hold" // leave the source at its last setpoint
+	PauseZeroHV = "zero" // set the source to 0 V, restored on resume
+)
+
+// ClosePauses ends the open pause intervals of experiments that stopped while paused
+func ClosePauses(experimentIDs []uint, at time.Time) error {
+	return database.DB.Model(&models.ExperimentPause{}).
+		Where("experiment_id IN ? AND resumed_at IS NULL", experimentIDs).
+		Update("resumed_at", at).Error
+}
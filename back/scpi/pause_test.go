@@ -0,0 +1,63 @@
+package scpi
+
+import (
+	"testing"
+	"time"
+
+	"back/models"
+)
+
+func TestRunPlanClockStart(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	p := RunPlan{StartedAt: start, DurationSec: 60, PausedSec: 30.5}
+	if got := p.ClockStart(); !got.Equal(start.Add(30500 * time.Millisecond)) {
+		t.Fatalf("ClockStart = %s", got)
+	}
+	if got := p.Deadline(); !got.Equal(start.Add(90500 * time.Millisecond)) {
+		t.Fatalf("Deadline = %s, want the duration counted from the clock start", got)
+	}
+}
+
+func TestRunnerPause(t *testing.T) {
+	sim, inst := liveSim(t, 9511)
+	// two minutes since the start, one and a half of them paused: 30 s left of 60
+	plan := RunPlan{
+		InstrumentIDs:  []uint{inst.ID},
+		PollIntervalMs: 100,
+		DurationSec:    60,
+		StartedAt:      time.Now().Add(-2 * time.Minute),
+		PausedSec:      90,
+	}
+	DefaultRunner.Resume(9511, []models.Instrument{inst}, plan)
+	time.Sleep(500 * time.Millisecond)
+	if !DefaultRunner.IsRunning(9511) {
+		t.Fatal("run ended although paused time does not count towards its duration")
+	}
+
+	if !DefaultRunner.Pause(9511) {
+		t.Fatal("Pause did not find the run")
+	}
+	if DefaultRunner.IsRunning(9511) || !DefaultRunner.IsPaused(9511) {
+		t.Fatal("paused run still polling or not marked paused")
+	}
+	// the controller decides what happens to the HV; the runner leaves it alone
+	if !sim.SourceOn() {
+		t.Fatal("pausing the runner switched the source off")
+	}
+
+	DefaultRunner.Resume(9511, []models.Instrument{inst}, plan)
+	if !DefaultRunner.IsRunning(9511) || DefaultRunner.IsPaused(9511) {
+		t.Fatal("resumed run not polling")
+	}
+	DefaultRunner.Pause(9511)
+
+	// a paused run is still an experiment that a halt has to end
+	halted := DefaultRunner.Halt(time.Second)
+	found := false
+	for _, id := range halted {
+		found = found || id == 9511
+	}
+	if !found || DefaultRunner.IsPaused(9511) {
+		t.Fatalf("halt returned %v", halted)
+	}
+}
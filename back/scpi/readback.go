@@ -0,0 +1,93 @@
+package scpi
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// readbackCheck is one query that shows whether a setting was accepted
+type readbackCheck struct {
+	setting string // function, speed, range, zero, source, source_range, source_volt
+	query   string
+	want    string
+	numeric bool // compare as numbers, within readbackTolerance
+}
+
+// readbackDriver is implemented by drivers that can query back what Configure wrote
+type readbackDriver interface {
+	readbackChecks(s InstrumentSettings) []readbackCheck
+}
+
+// readbackTolerance is the relative difference accepted between numeric values
+// (instruments echo "100" as "+1.000000E+02" and round to their resolution)
+const readbackTolerance = 1e-3
+
+// SettingsDiff is a setting the instrument reports differently from what was requested
+type SettingsDiff struct {
+	Setting  string `json:"setting"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	Error    string `json:"error,omitempty"` // the query failed, the setting is unknown
+}
+
+// SettingsMismatch is returned when an instrument did not accept its settings
+type SettingsMismatch struct {
+	InstrumentID uint           `json:"instrument_id"`
+	Name         string         `json:"name"`
+	Diffs        []SettingsDiff `json:"diffs"`
+}
+
+func (e *SettingsMismatch) Error() string {
+	parts := make([]string, 0, len(e.Diffs))
+	for _, d := range e.Diffs {
+		if d.Error != "" {
+			parts = append(parts, fmt.Sprintf("%s unreadable (%s)", d.Setting, d.Error))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s is %s, expected %s", d.Setting, d.Actual, d.Expected))
+		}
+	}
+	return fmt.Sprintf("%s did not accept its settings: %s", e.Name, strings.Join(parts, "; "))
+}
+
+// readback runs the driver's checks and returns the settings that differ
+func readback(c Conn, drv Driver, s InstrumentSettings) []SettingsDiff {
+	rd, ok := drv.(readbackDriver)
+	if !ok {
+		log.Printf("[SCPI] driver %s cannot read settings back, not verified", drv.Name())
+		return nil
+	}
+	var diffs []SettingsDiff
+	for _, chk := range rd.readbackChecks(s) {
+		resp, err := c.Send(chk.query, defaultTimeout)
+		if err != nil {
+			diffs = append(diffs, SettingsDiff{Setting: chk.setting, Expected: chk.want, Error: err.Error()})
+			continue
+		}
+		if !readbackMatches(chk, resp) {
+			diffs = append(diffs, SettingsDiff{Setting: chk.setting, Expected: chk.want, Actual: resp})
+		}
+	}
+	return diffs
+}
+
+func readbackMatches(chk readbackCheck, resp string) bool {
+	got := strings.ToUpper(strings.Trim(strings.TrimSpace(resp), "\"'"))
+	want := strings.ToUpper(chk.want)
+	if chk.numeric {
+		g, errG := strconv.ParseFloat(got, 64)
+		w, errW := strconv.ParseFloat(want, 64)
+		if errG == nil && errW == nil {
+			return math.Abs(g-w) <= readbackTolerance*math.Max(1, math.Abs(w))
+		}
+	}
+	if want == "ON" || want == "OFF" {
+		if on, err := parseOnOff(got); err == nil {
+			return onOff(on) == want
+		}
+	}
+	// :SENS:FUNC? answers CURR:DC for CURR
+	return got == want || strings.HasPrefix(got, want+":")
+}
@@ -0,0 +1,102 @@
+package scpi
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadbackMatches(t *testing.T) {
+	for _, tt := range []struct {
+		chk  readbackCheck
+		resp string
+		want bool
+	}{
+		{readbackCheck{want: "CURR"}, "CURR", true},
+		{readbackCheck{want: "CURR"}, `"CURR:DC"`, true},
+		{readbackCheck{want: "CURR"}, "CURRENT", false},
+		{readbackCheck{want: "CURR"}, "RES", false},
+		{readbackCheck{want: "ON"}, "1", true},
+		{readbackCheck{want: "OFF"}, "0", true},
+		{readbackCheck{want: "ON"}, "OFF", false},
+		{readbackCheck{want: "100.000", numeric: true}, "+1.000000E+02", true},
+		{readbackCheck{want: "100.000", numeric: true}, "100.05", true},
+		{readbackCheck{want: "100.000", numeric: true}, "100.2", false},
+		{readbackCheck{want: "0.000", numeric: true}, "0.0005", true},
+		{readbackCheck{want: "3", numeric: true}, "2", false},
+		{readbackCheck{want: "FAST"}, " fast ", true},
+	} {
+		if got := readbackMatches(tt.chk, tt.resp); got != tt.want {
+			t.Errorf("want %q, reply %q: %v", tt.chk.want, tt.resp, got)
+		}
+	}
+}
+
+func TestReadbackDiffs(t *testing.T) {
+	s := InstrumentSettings{Function: "CURR", AutoRange: true, Frequency: 10, SourceOn: true, SourceVolt: -200}
+	checks := th2690{}.readbackChecks(s)
+	got := make([]string, len(checks))
+	for i, chk := range checks {
+		got[i] = chk.setting + "=" + chk.query
+	}
+	want := "function=FUNC:FUNC? zero=FUNC:ZERO? speed=CURR:SPEED? range=CURR:RANGE? source=FUNC:SRC? source_range=SRC:RANGE? source_volt=SRC:VALUE?"
+	if strings.Join(got, " ") != want {
+		t.Fatalf("checks %q", got)
+	}
+
+	// the range query fails, the source came up on the wrong range
+	c := &scriptConn{replies: []string{"CURR", "OFF", "FAST"}}
+	failing := &failAfterConn{scriptConn: c, failAt: 3}
+	failing.then = []string{"ON", "2", "-200.000"}
+	diffs := readback(failing, th2690{}, s)
+	if len(diffs) != 2 || diffs[0].Setting != "range" || diffs[0].Error == "" ||
+		diffs[1].Setting != "source_range" || diffs[1].Expected != "3" || diffs[1].Actual != "2" {
+		t.Fatalf("diffs %+v", diffs)
+	}
+
+	err := error(&SettingsMismatch{Name: "TH-1", Diffs: diffs})
+	var mismatch *SettingsMismatch
+	if !errors.As(err, &mismatch) ||
+		!strings.Contains(err.Error(), "TH-1 did not accept its settings: range unreadable (") ||
+		!strings.HasSuffix(err.Error(), "source_range is 2, expected 3") {
+		t.Fatalf("error %q", err)
+	}
+}
+
+// failAfterConn fails the query number failAt (0-based), then answers from then
+type failAfterConn struct {
+	*scriptConn
+	failAt int
+	n      int
+	then   []string
+}
+
+func (c *failAfterConn) Send(cmd string, timeout time.Duration) (string, error) {
+	defer func() { c.n++ }()
+	switch {
+	case c.n < c.failAt:
+		return c.scriptConn.Send(cmd, timeout)
+	case c.n == c.failAt:
+		return "", ErrTimeout
+	}
+	r := c.then[0]
+	c.then = c.then[1:]
+	return r, nil
+}
+
+func TestApplySettingsReadsBack(t *testing.T) {
+	_, inst := liveSim(t, 9491)
+	s := InstrumentSettings{Function: "CURR", AutoRange: true, Frequency: 5, ZeroCorrect: true, SourceOn: true, SourceVolt: 150}
+	if err := ApplySettings(inst, s); err != nil {
+		t.Fatalf("settings the simulator accepts: %v", err)
+	}
+
+	// the simulator has no current range 12: it keeps the old one
+	s.AutoRange, s.Range = false, "12"
+	err := ApplySettings(inst, s)
+	var mismatch *SettingsMismatch
+	if !errors.As(err, &mismatch) || len(mismatch.Diffs) != 1 || mismatch.Diffs[0].Setting != "range" {
+		t.Fatalf("unsupported range: %v", err)
+	}
+}
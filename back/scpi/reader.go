@@ -0,0 +1,174 @@
+package scpi
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrTimeout is returned when a query got no (complete) reply within its timeout
+var ErrTimeout = errors.New("reply timeout")
+
+// maxBlockLen bounds a definite-length block, so a corrupt header cannot allocate gigabytes
+const maxBlockLen = 1 << 20
+
+// Framing describes how commands and replies are terminated on the wire
+type Framing struct {
+	WriteTerm string // appended to every command
+	ReadTerm  string // marks the end of a reply: "\n" or "\r\n"
+}
+
+// DefaultFraming is used unless a driver provides its own.
+// Commands end with CRLF (the TH2690 needs the CR); replies end with LF, or CRLF
+// when SCPI_TERMINATOR=crlf. A trailing CR is stripped either way.
+var DefaultFraming = defaultFramingFromEnv()
+
+func defaultFramingFromEnv() Framing {
+	f := Framing{WriteTerm: "\r\n", ReadTerm: "\n"}
+	switch strings.ToLower(os.Getenv("SCPI_TERMINATOR")) {
+	case "crlf":
+		f.ReadTerm = "\r\n"
+	case "", "lf":
+	default:
+		log.Printf("[SCPI] unknown SCPI_TERMINATOR %q, using lf", os.Getenv("SCPI_TERMINATOR"))
+	}
+	return f
+}
+
+// framingDriver is implemented by drivers whose instrument needs non-default framing
+type framingDriver interface {
+	Framing() Framing
+}
+
+// framingFor returns the framing a driver needs
+func framingFor(d Driver) Framing {
+	if fd, ok := d.(framingDriver); ok {
+		return fd.Framing()
+	}
+	return DefaultFraming
+}
+
+// IsQuery reports whether a command expects a reply, i.e. any of its
+// ';'-separated parts has a header ending in '?'
+func IsQuery(cmd string) bool {
+	for _, part := range strings.Split(cmd, ";") {
+		header, _, _ := strings.Cut(strings.TrimSpace(part), " ")
+		if strings.HasSuffix(header, "?") {
+			return true
+		}
+	}
+	return false
+}
+
+// responseReader reads terminator-framed replies from a connection.
+// It is bound to the connection for its whole life, so bytes belonging to the
+// next reply stay buffered instead of being lost or merged.
+type responseReader struct {
+	br   *bufio.Reader
+	term string
+}
+
+func newResponseReader(r io.Reader, term string) *responseReader {
+	if term == "" {
+		term = "\n"
+	}
+	return &responseReader{br: bufio.NewReaderSize(r, 4096), term: term}
+}
+
+// discardBuffered drops bytes received before a new query was sent — they belong
+// to no pending query (a late reply, or a reply to a command that expects none)
+func (rr *responseReader) discardBuffered() string {
+	n := rr.br.Buffered()
+	if n == 0 {
+		return ""
+	}
+	b, _ := rr.br.Peek(n)
+	stale := string(b)
+	rr.br.Discard(n)
+	return stale
+}
+
+// ReadResponse reads one complete reply, without its terminator.
+// IEEE 488.2 definite-length blocks (#<n><len><data>) are read by length,
+// so binary data may contain terminator bytes; #0 indefinite blocks end at the terminator.
+func (rr *responseReader) ReadResponse() (string, error) {
+	first, err := rr.br.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if first[0] == '#' {
+		return rr.readBlock()
+	}
+	line, err := rr.readLine()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// readLine reads up to and including the terminator and returns the line without it
+func (rr *responseReader) readLine() (string, error) {
+	last := rr.term[len(rr.term)-1]
+	var sb strings.Builder
+	for {
+		chunk, err := rr.br.ReadString(last)
+		sb.WriteString(chunk)
+		if err != nil {
+			return "", err
+		}
+		if strings.HasSuffix(sb.String(), rr.term) {
+			break
+		}
+	}
+	line := strings.TrimSuffix(sb.String(), rr.term)
+	return strings.TrimSuffix(line, "\r"), nil
+}
+
+func (rr *responseReader) readBlock() (string, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(rr.br, hdr); err != nil {
+		return "", err
+	}
+	digits := int(hdr[1] - '0')
+	if digits < 0 || digits > 9 {
+		return "", fmt.Errorf("invalid block header %q", hdr)
+	}
+	if digits == 0 {
+		// Indefinite-length block: data runs to the terminator
+		return rr.readLine()
+	}
+	lenBuf := make([]byte, digits)
+	if _, err := io.ReadFull(rr.br, lenBuf); err != nil {
+		return "", err
+	}
+	// Only decimal digits: Atoi alone would accept a sign
+	for _, b := range lenBuf {
+		if b < '0' || b > '9' {
+			return "", fmt.Errorf("invalid block length %q", lenBuf)
+		}
+	}
+	n, err := strconv.Atoi(string(lenBuf))
+	if err != nil {
+		return "", fmt.Errorf("invalid block length %q", lenBuf)
+	}
+	if n > maxBlockLen {
+		return "", fmt.Errorf("block of %d bytes exceeds %d", n, maxBlockLen)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(rr.br, data); err != nil {
+		return "", err
+	}
+	// Consume the terminator that follows the block if it already arrived;
+	// otherwise it is dropped as stale before the next query
+	if rr.br.Buffered() > 0 {
+		if next, err := rr.br.Peek(1); err == nil && (next[0] == '\r' || next[0] == '\n') {
+			rr.readLine()
+		}
+	}
+	return string(data), nil
+}
@@ -0,0 +1,185 @@
+package scpi
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"back/simulator"
+)
+
+// chunkReader returns one chunk per Read, like replies arriving in separate TCP segments
+type chunkReader struct {
+	chunks []string
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	if r.chunks[0] == "" {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestReadResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		term   string
+		chunks []string
+		want   []string
+	}{
+		{"one reply", "\n", []string{"TH2690,V1.0.22,SN1\n"}, []string{"TH2690,V1.0.22,SN1"}},
+		{"split across reads", "\n", []string{"1.0E+", "02,2.5", "E-12\n"}, []string{"1.0E+02,2.5E-12"}},
+		{"byte by byte", "\r\n", []string{"O", "N", "\r", "\n"}, []string{"ON"}},
+		{"several in one read", "\n", []string{"1\n2\n3\n"}, []string{"1", "2", "3"}},
+		{"second reply split", "\n", []string{"A\nB", "C\n"}, []string{"A", "BC"}},
+		{"crlf stripped with lf framing", "\n", []string{"CURR\r\n"}, []string{"CURR"}},
+		{"bare lf inside crlf reply", "\r\n", []string{"a\nb\r\n"}, []string{"a\nb"}},
+		{"surrounding space", "\n", []string{"  MID \n"}, []string{"MID"}},
+		{"definite block", "\n", []string{"#15hello\n"}, []string{"hello"}},
+		{"definite block with terminators", "\n", []string{"#19a\nb\r\nc", "def\n"}, []string{"a\nb\r\ncdef"}},
+		{"definite block then reply", "\n", []string{"#13abc\nOK\n"}, []string{"abc", "OK"}},
+		{"definite block split in header", "\n", []string{"#", "2", "0", "4wxyz\n"}, []string{"wxyz"}},
+		{"empty definite block", "\n", []string{"#10\n"}, []string{""}},
+		{"indefinite block", "\n", []string{"#0raw data\n"}, []string{"raw data"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := newResponseReader(&chunkReader{chunks: append([]string(nil), tt.chunks...)}, tt.term)
+			for i, want := range tt.want {
+				got, err := rr.ReadResponse()
+				if err != nil {
+					t.Fatalf("reply %d: %v", i, err)
+				}
+				if got != want {
+					t.Fatalf("reply %d = %q, want %q", i, got, want)
+				}
+			}
+			if got, err := rr.ReadResponse(); err != io.EOF {
+				t.Fatalf("extra reply %q, err %v", got, err)
+			}
+		})
+	}
+}
+
+func TestReadResponseIncomplete(t *testing.T) {
+	for _, chunks := range [][]string{
+		{"no terminator"},
+		{"ends with cr\r"},
+		{"#15ab"},
+		{"#2"},
+	} {
+		rr := newResponseReader(&chunkReader{chunks: chunks}, "\r\n")
+		if got, err := rr.ReadResponse(); err == nil {
+			t.Errorf("%q: got %q, want an error", chunks, got)
+		}
+	}
+}
+
+func TestReadResponseMalformedBlock(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"negative length", "#2-5abcde\n"},
+		{"signed length", "#3+10abcdefghij\n"},
+		{"length over the bound", "#9999999999\n"},
+		{"letter for digit count", "#Aabc\n"},
+		{"letters in the length", "#2abxyz\n"},
+		{"space in the length", "#2 5abcde\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := newResponseReader(&chunkReader{chunks: []string{tc.data}}, "\n")
+			if got, err := rr.ReadResponse(); err == nil {
+				t.Fatalf("got %q, want an error", got)
+			}
+		})
+	}
+}
+
+func TestDiscardBuffered(t *testing.T) {
+	rr := newResponseReader(&chunkReader{chunks: []string{"late\nnext\n"}}, "\n")
+	if got, _ := rr.ReadResponse(); got != "late" {
+		t.Fatalf("first reply %q", got)
+	}
+	if stale := rr.discardBuffered(); stale != "next\n" {
+		t.Fatalf("discarded %q", stale)
+	}
+	if stale := rr.discardBuffered(); stale != "" {
+		t.Fatalf("discarded %q from an empty buffer", stale)
+	}
+}
+
+func TestIsQuery(t *testing.T) {
+	for cmd, want := range map[string]bool{
+		"*IDN?":                    true,
+		"FETCH:ALL_S?":             true,
+		"FUNC:SRC ON":              false,
+		"SRC:VALUE 100;SRC:VALUE?": true,
+		"SYST:ERR:ALL?":            true,
+		"CURR:SPEED FAST":          false,
+		":SENS:FUNC 'CURR'":        false,
+	} {
+		if got := IsQuery(cmd); got != want {
+			t.Errorf("IsQuery(%q) = %v", cmd, got)
+		}
+	}
+}
+
+func startReaderSim(t *testing.T, cfg simulator.Config) *persistentConn {
+	t.Helper()
+	sim := simulator.New(cfg)
+	if err := sim.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sim.Close() })
+	host, port := sim.HostPort()
+	pc := newPersistentConn(host, port, DefaultFraming)
+	t.Cleanup(pc.close)
+	return pc
+}
+
+func TestPersistentConnSplitReplies(t *testing.T) {
+	cfg := simulator.DefaultConfig()
+	cfg.SplitRate = 1
+	pc := startReaderSim(t, cfg)
+	for i := 0; i < 5; i++ {
+		resp, err := pc.Send("*IDN?", time.Second)
+		if err != nil || resp != "TH2690,V1.0.22,SIM0000001" {
+			t.Fatalf("query %d: %q, %v", i, resp, err)
+		}
+	}
+}
+
+func TestPersistentConnTimeout(t *testing.T) {
+	cfg := simulator.DefaultConfig()
+	cfg.DropRate = 1
+	pc := startReaderSim(t, cfg)
+
+	// commands without a reply return at once
+	if resp, err := pc.Send("FUNC:SRC OFF", 200*time.Millisecond); err != nil || resp != "" {
+		t.Fatalf("write: %q, %v", resp, err)
+	}
+	start := time.Now()
+	_, err := pc.Send("*IDN?", 200*time.Millisecond)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("dropped query: %v, want ErrTimeout", err)
+	}
+	if time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("timed out after %s", time.Since(start))
+	}
+	if pc.conn != nil {
+		t.Fatal("connection kept open after a timeout")
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		t.Fatal("timeout surfaced as a raw net.Error")
+	}
+}
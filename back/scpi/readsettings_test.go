@@ -0,0 +1,108 @@
+package scpi
+
+import (
+	"strings"
+	"testing"
+
+	"back/models"
+	"back/simulator"
+)
+
+// nonDefaultSettings differs from DefaultSettings in every field
+func nonDefaultSettings(rng string) InstrumentSettings {
+	return InstrumentSettings{
+		Function:    "RES",
+		SourceOn:    true,
+		SourceVolt:  -250,
+		AutoRange:   false,
+		Range:       rng,
+		Frequency:   10,
+		ZeroCorrect: false,
+	}
+}
+
+func checkReadSettings(t *testing.T, inst models.Instrument, want InstrumentSettings) {
+	t.Helper()
+	if err := ApplySettings(inst, want); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	got, err := ReadSettings(inst)
+	if err != nil {
+		t.Fatalf("read settings: %v", err)
+	}
+	if *got != want {
+		t.Fatalf("read settings = %+v, want %+v", *got, want)
+	}
+}
+
+func TestTH2690ReadSettings(t *testing.T) {
+	_, inst := startSim(t, 9301, simulator.Config{Model: "TH2690"})
+	checkReadSettings(t, inst, nonDefaultSettings("5"))
+
+	auto := DefaultSettings()
+	auto.Function = "CHAR"
+	auto.Frequency = 1
+	auto.SourceVolt = -250 // the setpoint stays on the instrument while the source is off
+	checkReadSettings(t, inst, auto)
+}
+
+func TestKeithley6517ReadSettings(t *testing.T) {
+	_, inst := startFake(t, 9302, "MODEL 6517B", map[string]string{":SYST:ERR?": `0,"No error"`})
+	checkReadSettings(t, inst, nonDefaultSettings("2e-09"))
+}
+
+func TestB2980ReadSettings(t *testing.T) {
+	_, inst := startFake(t, 9303, "B2987A", map[string]string{":SYST:ERR?": `0,"No error"`})
+	checkReadSettings(t, inst, nonDefaultSettings("2e-09"))
+}
+
+// TestReadSettingsFailsOnBadReply: a missing or unparseable reply is an error, not a default
+func TestReadSettingsFailsOnBadReply(t *testing.T) {
+	th := tableConn{
+		"FUNC:FUNC?": "CURR", "FUNC:ZERO?": "ON", "CURR:SPEED?": "FAST",
+		"CURR:RANGE?": "1", "FUNC:SRC?": "OFF", "SRC:VALUE?": "0.000",
+	}
+	keithley := tableConn{
+		":SENS:FUNC?": `"CURR:DC"`, ":SENS:CURR:NPLC?": "+1.000000E+00", ":SENS:CURR:RANG:AUTO?": "1",
+		":SYST:ZCOR?": "1", ":OUTP?": "0", ":SOUR:VOLT?": "+0.000000E+00",
+	}
+	if _, err := TH2690.ReadSettings(th); err != nil {
+		t.Fatalf("th2690: %v", err)
+	}
+	if _, err := Keithley6517.ReadSettings(keithley); err != nil {
+		t.Fatalf("keithley6517: %v", err)
+	}
+
+	cases := []struct {
+		name  string
+		drv   Driver
+		base  tableConn
+		query string
+		reply string
+		drop  bool // leave the query unanswered
+	}{
+		{"th2690 function", TH2690, th, "FUNC:FUNC?", "VOLT", false},
+		{"th2690 speed", TH2690, th, "CURR:SPEED?", "", true},
+		{"th2690 range", TH2690, th, "CURR:RANGE?", "12", false},
+		{"th2690 source", TH2690, th, "FUNC:SRC?", "", false},
+		{"th2690 voltage", TH2690, th, "SRC:VALUE?", "n/a", false},
+		{"keithley function", Keithley6517, keithley, ":SENS:FUNC?", `"VOLT:DC"`, false},
+		{"keithley zero", Keithley6517, keithley, ":SYST:ZCOR?", "", true},
+		{"b2980 voltage", B2980, keithley, ":SOUR:VOLT?", "", false},
+	}
+	for _, tc := range cases {
+		c := make(tableConn, len(tc.base))
+		for k, v := range tc.base {
+			c[k] = v
+		}
+		if tc.drop {
+			delete(c, tc.query)
+		} else {
+			c[tc.query] = tc.reply
+		}
+		_, err := tc.drv.ReadSettings(c)
+		if err == nil || !strings.Contains(err.Error(), tc.query) {
+			t.Errorf("%s: err = %v, want an error naming %s", tc.name, err, tc.query)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package scpi
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"back/database"
+	"back/models"
+)
+
+// RecoveryMode decides what happens to experiments left running by a previous process
+type RecoveryMode string
+
+const (
+	// RecoveryResume re-attaches to experiments whose instruments still answer,
+	// and safe-states the rest
+	RecoveryResume RecoveryMode = "resume"
+	// RecoverySafe safe-states every instrument of every interrupted experiment
+	RecoverySafe RecoveryMode = "safe"
+)
+
+// RecoveryModeFromEnv reads RECOVERY_MODE (resume|safe), defaulting to resume
+func RecoveryModeFromEnv() RecoveryMode {
+	if strings.EqualFold(os.Getenv("RECOVERY_MODE"), string(RecoverySafe)) {
+		return RecoverySafe
+	}
+	return RecoveryResume
+}
+
+// Recover handles experiments still marked running/paused/stopping after a restart.
+// Running experiments with a stored run plan are resumed (mode resume) when every
+// instrument answers; otherwise the instruments are safe-stated, the source is
+// verified off, and the experiment is marked error with the reason. Paused experiments
+// stay paused in mode resume.
+// Returns the IDs of resumed experiments.
+func Recover(mode RecoveryMode) []uint {
+	var exps []models.Experiment
+	if err := database.DB.Where("status IN ?", activeStatuses).
+		Find(&exps).Error; err != nil {
+		log.Printf("[RECOVERY] loading interrupted experiments failed: %v", err)
+		return nil
+	}
+	if len(exps) == 0 {
+		return nil
+	}
+	log.Printf("[RECOVERY] %d interrupted experiments, mode=%s", len(exps), mode)
+
+	var resumed []uint
+	for i := range exps {
+		if recoverExperiment(&exps[i], mode) {
+			resumed = append(resumed, exps[i].ID)
+		}
+	}
+	return resumed
+}
+
+func recoverExperiment(exp *models.Experiment, mode RecoveryMode) bool {
+	plan, planErr := ParseRunPlan(exp.RunPlanJSON)
+
+	var ids []uint
+	if planErr == nil {
+		ids = plan.InstrumentIDs
+	} else {
+		for _, s := range strings.Split(exp.InstrumentIDs, ",") {
+			if id, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+				ids = append(ids, uint(id))
+			}
+		}
+	}
+	var instruments []models.Instrument
+	var missing []string
+	for _, id := range ids {
+		var inst models.Instrument
+		if err := database.DB.First(&inst, id).Error; err != nil {
+			missing = append(missing, strconv.Itoa(int(id)))
+			continue
+		}
+		instruments = append(instruments, inst)
+	}
+
+	switch {
+	case exp.Status == models.StatusPaused && mode != RecoverySafe:
+		DefaultRunner.setPaused(exp.ID)
+		log.Printf("[RECOVERY] exp=%d stays paused", exp.ID)
+		return false
+	case exp.Status == models.StatusPaused:
+		shutdownExperiment(exp, instruments, models.StatusError, "backend restarted while paused (RECOVERY_MODE=safe)")
+		return false
+	case exp.Status != models.StatusRunning:
+		shutdownExperiment(exp, instruments, models.StatusCompleted, "stop was interrupted by a backend restart")
+		return false
+	case mode == RecoverySafe:
+		shutdownExperiment(exp, instruments, models.StatusError, "backend restarted (RECOVERY_MODE=safe)")
+		return false
+	case planErr != nil:
+		shutdownExperiment(exp, instruments, models.StatusError, "backend restarted, cannot resume: "+planErr.Error())
+		return false
+	case len(missing) > 0:
+		shutdownExperiment(exp, instruments, models.StatusError,
+			"backend restarted, cannot resume: instruments not found: "+strings.Join(missing, ","))
+		return false
+	}
+
+	if deadline := plan.Deadline(); !deadline.IsZero() && time.Now().After(deadline) {
+		exp.EndTime = &deadline
+		shutdownExperiment(exp, instruments, models.StatusCompleted, "planned duration elapsed while the backend was down")
+		return false
+	}
+
+	// Every instrument must still answer before polling is re-attached
+	for _, inst := range instruments {
+		if _, err := IdentifyInstrument(inst); err != nil {
+			shutdownExperiment(exp, instruments, models.StatusError,
+				fmt.Sprintf("backend restarted, cannot resume: %s not responding: %v", inst.Name, err))
+			return false
+		}
+	}
+
+	elapsed := time.Since(plan.ClockStart())
+	log.Printf("[RECOVERY] exp=%d resuming %d instruments at elapsed=%.0fs", exp.ID, len(instruments), elapsed.Seconds())
+	database.DB.Model(exp).Update("status_reason", fmt.Sprintf("resumed after backend restart at elapsed %.0fs", elapsed.Seconds()))
+	DefaultRunner.Resume(exp.ID, instruments, *plan)
+	return true
+}
+
+// shutdownExperiment safe-states the instruments, verifies the source is off and
+// stores the final status with the reason. A failed verification forces status error.
+func shutdownExperiment(exp *models.Experiment, instruments []models.Instrument, status models.ExperimentStatus, reason string) {
+	if failures := SafeStateAll(instruments); len(failures) > 0 {
+		status = models.StatusError
+		reason += "; " + SafeStateFailures(instruments, failures)
+	} else if len(instruments) > 0 {
+		reason += "; instruments safe-stated, source verified off"
+	}
+
+	end := time.Now()
+	if exp.EndTime != nil {
+		end = *exp.EndTime
+	}
+	database.DB.Model(exp).Updates(map[string]interface{}{
+		"status":        status,
+		"end_time":      end,
+		"status_reason": reason,
+	})
+	ReleaseInstruments(exp.ID)
+	ClosePauses([]uint{exp.ID}, end)
+	CloseSteps([]uint{exp.ID}, end, string(status))
+	log.Printf("[RECOVERY] exp=%d -> %s: %s", exp.ID, status, reason)
+}
@@ -0,0 +1,149 @@
+package scpi
+
+import (
+	"testing"
+	"time"
+
+	"back/models"
+	"back/simulator"
+)
+
+// liveSim starts a simulator with its source on and running, as a crashed backend leaves it
+func liveSim(t *testing.T, id uint) (*simulator.Server, models.Instrument) {
+	t.Helper()
+	sim := simulator.New(simulator.DefaultConfig())
+	if err := sim.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sim.Close() })
+	host, port := sim.HostPort()
+	inst := models.Instrument{ID: id, Name: "sim", Host: host, Port: port, Model: "TH2690"}
+	err := DefaultSessions.Get(inst).Exec(PriorityUI, func(c Conn) error {
+		for _, cmd := range []string{"FUNC:SRC ON", "FUNC:RUN"} {
+			if _, err := c.Send(cmd, time.Second); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if on, err := SourceState(inst); err != nil || !on {
+		t.Fatalf("source on = %v, %v", on, err)
+	}
+	return sim, inst
+}
+
+// waitSafe waits for a run that ended on its own to finish safe-stating the simulator
+func waitSafe(t *testing.T, sim *simulator.Server) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for sim.SourceOn() || sim.Running() {
+		if time.Now().After(deadline) {
+			t.Fatalf("source on %v, running %v after the run ended", sim.SourceOn(), sim.Running())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParseRunPlan(t *testing.T) {
+	started := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, raw := range []string{
+		"",
+		"{",
+		`{"poll_interval_ms":200,"started_at":"2026-01-02T03:04:05Z"}`,
+		`{"instrument_ids":[1],"poll_interval_ms":200}`,
+		`{"poll_intervals_ms":{"1":200},"started_at":"2026-01-02T03:04:05Z"}`,
+	} {
+		if _, err := ParseRunPlan(raw); err == nil {
+			t.Errorf("ParseRunPlan(%q) accepted", raw)
+		}
+	}
+
+	p, err := ParseRunPlan(`{"instrument_ids":[1,2],"poll_interval_ms":200,"duration_sec":90,"started_at":"2026-01-02T03:04:05Z"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.IntervalFor(1) != 200*time.Millisecond || !p.Deadline().Equal(started.Add(90*time.Second)) {
+		t.Fatalf("interval %s, deadline %s", p.IntervalFor(1), p.Deadline())
+	}
+	p.DurationSec = 0
+	if !p.Deadline().IsZero() {
+		t.Fatal("unlimited plan has a deadline")
+	}
+}
+
+func TestRecoveryModeFromEnv(t *testing.T) {
+	for env, want := range map[string]RecoveryMode{"": RecoveryResume, "resume": RecoveryResume, "SAFE": RecoverySafe, "bogus": RecoveryResume} {
+		t.Setenv("RECOVERY_MODE", env)
+		if got := RecoveryModeFromEnv(); got != want {
+			t.Errorf("RECOVERY_MODE=%q: %s, want %s", env, got, want)
+		}
+	}
+}
+
+func TestShutdownExperimentSafeStates(t *testing.T) {
+	sim, inst := liveSim(t, 9401)
+	// an instrument that is gone must not block the others
+	dead := models.Instrument{ID: 9402, Name: "gone", Host: "127.0.0.1", Port: 1, Model: "TH2690"}
+
+	done := make(chan struct{})
+	go func() {
+		shutdownExperiment(&models.Experiment{ID: 9401}, []models.Instrument{inst, dead}, models.StatusCompleted, "test")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("shutdown hangs on an unreachable instrument")
+	}
+	if sim.SourceOn() || sim.Running() {
+		t.Fatalf("source on %v, running %v after shutdown", sim.SourceOn(), sim.Running())
+	}
+}
+
+// TestResumeContinuesRunClock: a resumed run keeps its original start, so it ends at the
+// planned deadline rather than a full duration after the restart
+func TestResumeContinuesRunClock(t *testing.T) {
+	sim, inst := liveSim(t, 9403)
+	plan := RunPlan{
+		InstrumentIDs:  []uint{inst.ID},
+		PollIntervalMs: 100,
+		DurationSec:    60,
+		StartedAt:      time.Now().Add(-59*time.Second - 500*time.Millisecond),
+	}
+	DefaultRunner.Resume(9403, []models.Instrument{inst}, plan)
+	if !DefaultRunner.IsRunning(9403) {
+		t.Fatal("resumed run not registered")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for DefaultRunner.IsRunning(9403) {
+		if time.Now().After(deadline) {
+			DefaultRunner.Stop(9403)
+			t.Fatal("resumed run did not end at its planned deadline")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	waitSafe(t, sim)
+}
+
+func TestResumeAfterDeadlineEndsAtOnce(t *testing.T) {
+	sim, inst := liveSim(t, 9404)
+	plan := RunPlan{
+		InstrumentIDs:  []uint{inst.ID},
+		PollIntervalMs: 100,
+		DurationSec:    10,
+		StartedAt:      time.Now().Add(-time.Minute),
+	}
+	DefaultRunner.Resume(9404, []models.Instrument{inst}, plan)
+	deadline := time.Now().Add(2 * time.Second)
+	for DefaultRunner.IsRunning(9404) {
+		if time.Now().After(deadline) {
+			DefaultRunner.Stop(9404)
+			t.Fatal("run past its deadline kept polling")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	waitSafe(t, sim)
+}
@@ -0,0 +1,162 @@
+package scpi
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"back/database"
+	"back/models"
+)
+
+// ReservationConflict is returned when an instrument already belongs to another active experiment
+type ReservationConflict struct {
+	InstrumentID   uint   `json:"instrument_id"`
+	InstrumentName string `json:"instrument_name"`
+	ExperimentID   uint   `json:"experiment_id"`
+	ExperimentName string `json:"experiment_name"`
+	OwnerID        uint   `json:"owner_id"`
+	OwnerName      string `json:"owner_name"`
+}
+
+func (e *ReservationConflict) Error() string {
+	return fmt.Sprintf("instrument %s is in use by experiment #%d %q (owner: %s)",
+		e.InstrumentName, e.ExperimentID, e.ExperimentName, e.OwnerName)
+}
+
+// CalibrationInProgress is returned when an instrument is held by the calibration procedure
+type CalibrationInProgress struct {
+	InstrumentID   uint      `json:"instrument_id"`
+	InstrumentName string    `json:"instrument_name"`
+	Since          time.Time `json:"since"`
+}
+
+func (e *CalibrationInProgress) Error() string {
+	return fmt.Sprintf("instrument %s is being calibrated (since %s)", e.InstrumentName, e.Since.Format(time.RFC3339))
+}
+
+// activeStatuses are the experiment statuses that hold their instruments
+var activeStatuses = []string{string(models.StatusRunning), string(models.StatusPaused), "stopping"}
+
+// ReserveInstruments assigns instruments to an experiment inside tx. The rows are locked
+// FOR UPDATE so concurrent starts serialize. A reservation held by an experiment that is no
+// longer active is stale and taken over. Returns *ReservationConflict if any is taken.
+func ReserveInstruments(tx *gorm.DB, experimentID uint, instrumentIDs []uint) error {
+	var insts []models.Instrument
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id IN ?", instrumentIDs).Order("id").Find(&insts).Error; err != nil {
+		return err
+	}
+	for _, inst := range insts {
+		if inst.CalibratingSince != nil {
+			return &CalibrationInProgress{InstrumentID: inst.ID, InstrumentName: inst.Name, Since: *inst.CalibratingSince}
+		}
+		if inst.ReservedBy == nil || *inst.ReservedBy == experimentID {
+			continue
+		}
+		if err := holderConflict(tx, inst); err != nil {
+			return err
+		}
+	}
+	return tx.Model(&models.Instrument{}).Where("id IN ?", instrumentIDs).
+		Update("reserved_by", experimentID).Error
+}
+
+// holderConflict returns a *ReservationConflict if the experiment holding a reserved
+// instrument is still active; reservations of finished experiments are stale
+func holderConflict(tx *gorm.DB, inst models.Instrument) error {
+	var holder models.Experiment
+	err := tx.Preload("User").
+		Where("id = ? AND status IN ?", *inst.ReservedBy, activeStatuses).
+		First(&holder).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return &ReservationConflict{
+		InstrumentID:   inst.ID,
+		InstrumentName: inst.Name,
+		ExperimentID:   holder.ID,
+		ExperimentName: holder.Name,
+		OwnerID:        holder.UserID,
+		OwnerName:      strings.TrimSpace(holder.User.FirstName + " " + holder.User.LastName),
+	}
+}
+
+// ReserveForCalibration holds an idle instrument for the calibration procedure, under the
+// same row lock as ReserveInstruments so a start and a calibration cannot both take it.
+// Returns *ReservationConflict or *CalibrationInProgress if it is taken.
+func ReserveForCalibration(instrumentID uint) (*models.Instrument, error) {
+	var inst models.Instrument
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&inst, instrumentID).Error; err != nil {
+			return err
+		}
+		if inst.CalibratingSince != nil {
+			return &CalibrationInProgress{InstrumentID: inst.ID, InstrumentName: inst.Name, Since: *inst.CalibratingSince}
+		}
+		if inst.ReservedBy != nil {
+			if err := holderConflict(tx, inst); err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		inst.CalibratingSince = &now
+		return tx.Model(&models.Instrument{}).Where("id = ?", inst.ID).Update("calibrating_since", now).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &inst, nil
+}
+
+// ReleaseCalibration frees an instrument held by the calibration procedure
+func ReleaseCalibration(instrumentID uint) {
+	if err := database.DB.Model(&models.Instrument{}).Where("id = ?", instrumentID).
+		Update("calibrating_since", nil).Error; err != nil {
+		log.Printf("[SCPI] inst=%d releasing calibration hold failed: %v", instrumentID, err)
+	}
+}
+
+// ReleaseCalibrations frees instruments held by calibrations of a previous process
+func ReleaseCalibrations() {
+	if err := database.DB.Model(&models.Instrument{}).Where("calibrating_since IS NOT NULL").
+		Update("calibrating_since", nil).Error; err != nil {
+		log.Printf("[SCPI] releasing interrupted calibrations failed: %v", err)
+	}
+}
+
+// ReleaseInstruments frees every instrument reserved by an experiment
+func ReleaseInstruments(experimentID uint) {
+	if err := database.DB.Model(&models.Instrument{}).Where("reserved_by = ?", experimentID).
+		Update("reserved_by", nil).Error; err != nil {
+		log.Printf("[SCPI] exp=%d releasing instruments failed: %v", experimentID, err)
+	}
+}
+
+// InstrumentHolder returns the active experiment holding an instrument, if any
+func InstrumentHolder(inst models.Instrument) *ReservationConflict {
+	if inst.ReservedBy == nil {
+		return nil
+	}
+	var holder models.Experiment
+	if err := database.DB.Preload("User").
+		Where("id = ? AND status IN ?", *inst.ReservedBy, activeStatuses).
+		First(&holder).Error; err != nil {
+		return nil
+	}
+	return &ReservationConflict{
+		InstrumentID:   inst.ID,
+		InstrumentName: inst.Name,
+		ExperimentID:   holder.ID,
+		ExperimentName: holder.Name,
+		OwnerID:        holder.UserID,
+		OwnerName:      strings.TrimSpace(holder.User.FirstName + " " + holder.User.LastName),
+	}
+}
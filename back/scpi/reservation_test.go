@@ -0,0 +1,87 @@
+package scpi
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"back/broker"
+	"back/models"
+)
+
+func TestReservationConflictError(t *testing.T) {
+	err := error(&ReservationConflict{InstrumentID: 3, InstrumentName: "TH-3", ExperimentID: 12, ExperimentName: "leakage", OwnerName: "A. User"})
+	want := `instrument TH-3 is in use by experiment #12 "leakage" (owner: A. User)`
+	if err.Error() != want {
+		t.Fatalf("Error() = %q", err.Error())
+	}
+}
+
+// TestReserveInstrumentsLocksRows checks the statements ReserveInstruments issues: the
+// instrument rows are read FOR UPDATE before reserved_by is written. Dry run: nothing
+// reaches the database, and no implicit transaction is opened for the update
+func TestReserveInstrumentsLocksRows(t *testing.T) {
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=127.0.0.1 port=1"}),
+		&gorm.Config{DryRun: true, SkipDefaultTransaction: true, DisableAutomaticPing: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stmts []string
+	record := func(db *gorm.DB) { stmts = append(stmts, db.Statement.SQL.String()) }
+	db.Callback().Query().After("gorm:query").Register("test:record", record)
+	db.Callback().Update().After("gorm:update").Register("test:record", record)
+
+	if err := ReserveInstruments(db, 77, []uint{2, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if len(stmts) != 2 {
+		t.Fatalf("statements: %q", stmts)
+	}
+	if !strings.Contains(stmts[0], "FOR UPDATE") || !strings.Contains(stmts[0], "ORDER BY id") {
+		t.Errorf("select does not lock rows in id order: %s", stmts[0])
+	}
+	if !strings.Contains(stmts[1], "reserved_by") {
+		t.Errorf("update does not set reserved_by: %s", stmts[1])
+	}
+}
+
+// TestConcurrentRuns: two experiments on different instruments poll side by side
+func TestConcurrentRuns(t *testing.T) {
+	_, a := liveSim(t, 9411)
+	_, b := liveSim(t, 9412)
+	subA, _, _ := broker.Default.Subscribe(9411, 0)
+	defer broker.Default.Unsubscribe(subA)
+	subB, _, _ := broker.Default.Subscribe(9412, 0)
+	defer broker.Default.Unsubscribe(subB)
+
+	for _, run := range []struct {
+		expID uint
+		inst  models.Instrument
+	}{{9411, a}, {9412, b}} {
+		DefaultRunner.Resume(run.expID, []models.Instrument{run.inst}, RunPlan{
+			InstrumentIDs:  []uint{run.inst.ID},
+			PollIntervalMs: 50,
+			StartedAt:      time.Now(),
+		})
+	}
+	defer DefaultRunner.Stop(9411)
+	defer DefaultRunner.Stop(9412)
+
+	for _, sub := range []*broker.Subscription{subA, subB} {
+		select {
+		case ev := <-sub.C:
+			if ev.Kind != broker.KindMeasurement {
+				t.Fatalf("event %+v", ev)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no measurement from one of two concurrent runs")
+		}
+	}
+	if !DefaultRunner.IsRunning(9411) || !DefaultRunner.IsRunning(9412) {
+		t.Fatal("concurrent runs did not both keep running")
+	}
+}
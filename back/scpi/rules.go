@@ -0,0 +1,125 @@
+package scpi
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Rule actions
+const (
+	RuleStop     = "stop"      // stop the experiment and safe-state every instrument
+	RulePauseHV  = "pause_hv"  // freeze the HV schedule of the instrument while the condition holds
+	RuleRampDown = "ramp_down" // abandon the HV schedule and ramp the instrument to 0 V
+)
+
+const defaultRampDownRate = 10.0 // V/s
+
+// Rule fires an action when a reading meets a condition for Samples consecutive readings
+type Rule struct {
+	Name         string  `json:"name,omitempty"`
+	InstrumentID uint    `json:"instrument_id,omitempty"` // 0 = every instrument
+	Metric       string  `json:"metric"`                  // see ResponseMetric
+	Op           string  `json:"op"`                      // >, >=, <, <=, ==, !=
+	Value        float64 `json:"value"`
+	Samples      int     `json:"samples,omitempty"`   // consecutive readings required (default 1)
+	Action       string  `json:"action"`              // stop, pause_hv, ramp_down
+	RampRate     float64 `json:"ramp_rate,omitempty"` // ramp_down: V/s (default 10)
+}
+
+// String describes the rule for logs and events
+func (r Rule) String() string {
+	name := r.Name
+	if name == "" {
+		name = r.Action
+	}
+	n := r.Samples
+	if n < 1 {
+		n = 1
+	}
+	return fmt.Sprintf("%s: %s %s %g for %d samples", name, r.Metric, r.Op, r.Value, n)
+}
+
+// Validate checks a rule against the instruments of the experiment
+func (r Rule) Validate(instrumentIDs []uint) error {
+	if _, ok := ResponseMetric(&Response{}, r.Metric); !ok {
+		return fmt.Errorf("unknown metric %q", r.Metric)
+	}
+	if !validOp(r.Op) {
+		return fmt.Errorf("unknown operator %q", r.Op)
+	}
+	if r.Samples < 0 {
+		return fmt.Errorf("samples must not be negative")
+	}
+	switch r.Action {
+	case RuleStop, RulePauseHV:
+	case RuleRampDown:
+		if r.RampRate < 0 {
+			return fmt.Errorf("ramp_rate must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	if r.InstrumentID != 0 {
+		for _, id := range instrumentIDs {
+			if id == r.InstrumentID {
+				return nil
+			}
+		}
+		return fmt.Errorf("instrument %d is not part of the experiment", r.InstrumentID)
+	}
+	return nil
+}
+
+// ParseRules decodes Experiment.RulesJSON
+func ParseRules(raw string) ([]Rule, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var rules []Rule
+	if err := json.Unmarshal([]byte(raw), &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// ruleState tracks one rule on one instrument
+type ruleState struct {
+	rule   Rule
+	hits   int  // consecutive matching readings
+	active bool // fired and not cleared yet
+}
+
+// rulesFor returns fresh per-instrument state for the rules that apply to an instrument
+func rulesFor(rules []Rule, instrumentID uint) []*ruleState {
+	var out []*ruleState
+	for _, r := range rules {
+		if r.InstrumentID == 0 || r.InstrumentID == instrumentID {
+			out = append(out, &ruleState{rule: r})
+		}
+	}
+	return out
+}
+
+// observe feeds a reading to the rule. fired is true on the reading that triggers the
+// action, cleared on the first non-matching reading after a pause_hv fired.
+func (rs *ruleState) observe(resp *Response) (fired, cleared bool) {
+	v, _ := ResponseMetric(resp, rs.rule.Metric)
+	if !compare(v, rs.rule.Op, rs.rule.Value) {
+		rs.hits = 0
+		if rs.active && rs.rule.Action == RulePauseHV {
+			rs.active = false
+			return false, true
+		}
+		return false, false
+	}
+	rs.hits++
+	need := rs.rule.Samples
+	if need < 1 {
+		need = 1
+	}
+	if !rs.active && rs.hits >= need {
+		rs.active = true
+		return true, false
+	}
+	return false, false
+}
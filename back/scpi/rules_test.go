@@ -0,0 +1,170 @@
+package scpi
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"back/models"
+)
+
+func TestRuleValidate(t *testing.T) {
+	ids := []uint{1, 2}
+	tests := []struct {
+		rule Rule
+		err  string // "" = valid
+	}{
+		{Rule{Metric: "abs_current", Op: ">", Value: 1e-9, Action: RuleStop}, ""},
+		{Rule{Metric: "error_code", Op: "!=", Action: RulePauseHV, InstrumentID: 2}, ""},
+		{Rule{Metric: "voltage", Op: "<=", Action: RuleRampDown, RampRate: 5}, ""},
+		{Rule{Metric: "volts", Op: ">", Action: RuleStop}, "unknown metric"},
+		{Rule{Metric: "current", Op: "=>", Action: RuleStop}, "unknown operator"},
+		{Rule{Metric: "current", Op: ">", Samples: -1, Action: RuleStop}, "samples"},
+		{Rule{Metric: "current", Op: ">", Action: RuleRampDown, RampRate: -1}, "ramp_rate"},
+		{Rule{Metric: "current", Op: ">", Action: "explode"}, "unknown action"},
+		{Rule{Metric: "current", Op: ">", Action: RuleStop, InstrumentID: 3}, "not part of the experiment"},
+	}
+	for _, tt := range tests {
+		err := tt.rule.Validate(ids)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.rule, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: error %v, want %q", tt.rule, err, tt.err)
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(`[{"name":"leak","metric":"abs_current","op":">","value":1e-9,"samples":3,"action":"stop"}]`)
+	if err != nil || len(rules) != 1 || rules[0].Samples != 3 || rules[0].Action != RuleStop {
+		t.Fatalf("rules %+v, %v", rules, err)
+	}
+	if got := rules[0].String(); got != "leak: abs_current > 1e-09 for 3 samples" {
+		t.Fatalf("String() = %q", got)
+	}
+	if rules, err := ParseRules(""); err != nil || rules != nil {
+		t.Fatalf("empty: %v, %v", rules, err)
+	}
+	if _, err := ParseRules(`{"metric":"x"}`); err == nil {
+		t.Fatal("accepted an object")
+	}
+}
+
+func TestRulesFor(t *testing.T) {
+	rules := []Rule{{Name: "all"}, {Name: "one", InstrumentID: 1}, {Name: "two", InstrumentID: 2}}
+	got := rulesFor(rules, 1)
+	if len(got) != 2 || got[0].rule.Name != "all" || got[1].rule.Name != "one" {
+		t.Fatalf("rules for instrument 1: %+v", got)
+	}
+}
+
+func TestRuleObserve(t *testing.T) {
+	reading := func(i float64) *Response { return &Response{Current: i} }
+	type result struct{ fired, cleared bool }
+
+	stop := &ruleState{rule: Rule{Metric: "current", Op: ">", Value: 1, Samples: 3, Action: RuleStop}}
+	pause := &ruleState{rule: Rule{Metric: "current", Op: ">", Value: 1, Samples: 3, Action: RulePauseHV}}
+	seq := []float64{2, 2, 0, 2, 2, 2, 2, 0, 2}
+	wantStop := []result{{}, {}, {}, {}, {}, {true, false}, {}, {}, {}}
+	wantPause := []result{{}, {}, {}, {}, {}, {true, false}, {}, {false, true}, {}}
+	for i, v := range seq {
+		if f, c := stop.observe(reading(v)); (result{f, c}) != wantStop[i] {
+			t.Fatalf("stop rule, reading %d (%g): fired %v cleared %v", i, v, f, c)
+		}
+		if f, c := pause.observe(reading(v)); (result{f, c}) != wantPause[i] {
+			t.Fatalf("pause rule, reading %d (%g): fired %v cleared %v", i, v, f, c)
+		}
+	}
+}
+
+func TestApplyRulesPauseHV(t *testing.T) {
+	s := &instState{
+		inst:  models.Instrument{ID: 9441},
+		rules: rulesFor([]Rule{{Metric: "abs_current", Op: ">", Value: 1e-9, Action: RulePauseHV}}, 9441),
+	}
+	stopReq := make(chan stopRequest, 1)
+	s.applyRules(9441, &Response{Current: -2e-9}, 10, stopReq)
+	if !s.hvPaused() || s.pausedAt != 10 {
+		t.Fatalf("after firing: paused %v at %g", s.hvPaused(), s.pausedAt)
+	}
+	s.applyRules(9441, &Response{Current: -3e-9}, 12, stopReq)
+	s.applyRules(9441, &Response{Current: 1e-12}, 14, stopReq)
+	if s.hvPaused() || s.pausedTotal != 4 {
+		t.Fatalf("after clearing: paused %v, paused total %g", s.hvPaused(), s.pausedTotal)
+	}
+	if len(stopReq) != 0 {
+		t.Fatal("pause_hv asked to stop the run")
+	}
+}
+
+// TestApplyRulesOverlappingPauses: with two pause_hv rules the schedule stays paused until
+// both cleared, and the pause is counted once from the first firing to the last clearing
+func TestApplyRulesOverlappingPauses(t *testing.T) {
+	s := &instState{
+		inst: models.Instrument{ID: 9443},
+		rules: rulesFor([]Rule{
+			{Metric: "abs_current", Op: ">", Value: 1e-9, Action: RulePauseHV},
+			{Metric: "temperature", Op: ">", Value: 40, Action: RulePauseHV},
+		}, 9443),
+	}
+	stopReq := make(chan stopRequest, 1)
+	steps := []struct {
+		elapsed float64
+		resp    Response
+		paused  bool
+		total   float64
+	}{
+		{10, Response{Current: 2e-9, Temperature: 25}, true, 0},  // current rule fires
+		{12, Response{Current: 2e-9, Temperature: 45}, true, 0},  // temperature rule fires too
+		{15, Response{Current: 1e-12, Temperature: 45}, true, 0}, // current clears, temperature still holds
+		{20, Response{Current: 1e-12, Temperature: 25}, false, 10},
+		{30, Response{Current: 1e-12, Temperature: 45}, true, 10}, // a new pause
+		{33, Response{Current: 1e-12, Temperature: 25}, false, 13},
+	}
+	for _, st := range steps {
+		resp := st.resp
+		s.applyRules(9443, &resp, st.elapsed, stopReq)
+		if s.hvPaused() != st.paused || s.pausedTotal != st.total {
+			t.Fatalf("at %gs: paused %v, paused total %g; want %v, %g", st.elapsed, s.hvPaused(), s.pausedTotal, st.paused, st.total)
+		}
+	}
+}
+
+func TestApplyRulesRampDown(t *testing.T) {
+	s := &instState{
+		inst:   models.Instrument{ID: 9442},
+		lastHV: 100,
+		rules:  rulesFor([]Rule{{Metric: "current", Op: ">", Value: 1e-9, Action: RuleRampDown, RampRate: 20}}, 9442),
+	}
+	s.applyRules(9442, &Response{Current: 5e-9}, 30, make(chan stopRequest, 1))
+	if s.hv == nil {
+		t.Fatal("no ramp-down program")
+	}
+	for _, p := range []HvProfilePoint{{TimeSec: 30, Voltage: 100}, {TimeSec: 32.5, Voltage: 50}, {TimeSec: 35, Voltage: 0}, {TimeSec: 60, Voltage: 0}} {
+		if got := s.hv.target(p.TimeSec, nil); math.Abs(got-p.Voltage) > 1e-9 {
+			t.Errorf("ramp-down target at %gs = %g, want %g", p.TimeSec, got, p.Voltage)
+		}
+	}
+}
+
+// TestRunnerStopRule: a stop rule ends the run and safe-states the instrument
+func TestRunnerStopRule(t *testing.T) {
+	sim, inst := liveSim(t, 9443)
+	DefaultRunner.Resume(9443, []models.Instrument{inst}, RunPlan{
+		InstrumentIDs:   []uint{inst.ID},
+		PollIntervalsMs: map[uint]int64{inst.ID: 50},
+		Rules:           []Rule{{Name: "any", Metric: "error_code", Op: "==", Value: 0, Samples: 3, Action: RuleStop}},
+		StartedAt:       time.Now(),
+	})
+	deadline := time.Now().Add(3 * time.Second)
+	for DefaultRunner.IsRunning(9443) {
+		if time.Now().After(deadline) {
+			DefaultRunner.Stop(9443)
+			t.Fatal("stop rule did not end the run")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	waitSafe(t, sim)
+}
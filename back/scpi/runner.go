@@ -5,286 +5,828 @@ import (
 	"fmt"
 	"log"
 	"math"
-	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"back/broker"
 	"back/database"
+	"back/events"
 	"back/models"
 )
 
 // Runner manages active measurement polling goroutines
 type Runner struct {
-	mu      sync.Mutex
-	cancels map[uint]chan struct{} // experimentID -> cancel channel
+	mu     sync.Mutex
+	runs   map[uint]*runHandle // experimentID -> polling goroutine
+	paused map[uint]bool       // experiments whose polling is suspended
+}
+
+// runHandle controls one polling goroutine
+type runHandle struct {
+	cancel chan struct{} // closed to stop polling
+	halted chan struct{} // closed when no instrument is being polled any more
+	done   chan struct{} // closed when the goroutine has exited and flushed its data
+	amend  chan amendRequest
+
+	mu     sync.Mutex
+	health map[uint]InstrumentHealth // watchdog state per instrument, written by the pollers
+}
+
+func (h *runHandle) setHealth(hs InstrumentHealth) {
+	h.mu.Lock()
+	h.health[hs.InstrumentID] = hs
+	h.mu.Unlock()
+}
+
+// stopRequest asks the coordinator to end the run from inside a poller
+type stopRequest struct {
+	status models.ExperimentStatus
+	reason string
 }
 
 var DefaultRunner = &Runner{
-	cancels: make(map[uint]chan struct{}),
+	runs:   make(map[uint]*runHandle),
+	paused: make(map[uint]bool),
 }
 
 // IsRunning checks if an experiment is actively polling
 func (r *Runner) IsRunning(experimentID uint) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	_, ok := r.cancels[experimentID]
+	_, ok := r.runs[experimentID]
 	return ok
 }
 
-// Start begins polling instruments for an experiment
-func (r *Runner) Start(experiment *models.Experiment, instruments []models.Instrument, pollInterval time.Duration) {
+// IsPaused checks if an experiment's polling is suspended by Pause
+func (r *Runner) IsPaused(experimentID uint) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	return r.paused[experimentID]
+}
 
-	if _, ok := r.cancels[experiment.ID]; ok {
-		return // already running
-	}
-
-	cancel := make(chan struct{})
-	r.cancels[experiment.ID] = cancel
-
-	// Parse HV schedule from experiment
-	hvSchedule := make(map[uint][]HvPoint)
-	if experiment.HvScheduleJSON != "" && experiment.HvScheduleJSON != "{}" {
-		var raw map[string][]HvPoint
-		if err := json.Unmarshal([]byte(experiment.HvScheduleJSON), &raw); err == nil {
-			for idStr, pts := range raw {
-				var id uint
-				fmt.Sscanf(idStr, "%d", &id)
-				hvSchedule[id] = pts
-			}
-		}
+// Health returns the watchdog state of the instruments of a running experiment (nil if not running)
+func (r *Runner) Health(experimentID uint) []InstrumentHealth {
+	r.mu.Lock()
+	h, ok := r.runs[experimentID]
+	r.mu.Unlock()
+	if !ok {
+		return nil
 	}
-
-	var duration time.Duration
-	if experiment.DurationSec > 0 {
-		duration = time.Duration(experiment.DurationSec) * time.Second
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]InstrumentHealth, 0, len(h.health))
+	for _, hs := range h.health {
+		out = append(out, hs)
 	}
-
-	go r.poll(experiment.ID, instruments, pollInterval, cancel, duration, hvSchedule)
+	sort.Slice(out, func(i, j int) bool { return out[i].InstrumentID < out[j].InstrumentID })
+	return out
 }
 
-// Stop stops polling for an experiment
-func (r *Runner) Stop(experimentID uint) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// RunPlan is everything the runner needs to (re)start polling an experiment.
+// It is stored in Experiment.RunPlanJSON so a restarted backend can resume.
+type RunPlan struct {
+	InstrumentIDs   []uint                      `json:"instrument_ids"`
+	PollIntervalsMs map[uint]int64              `json:"poll_intervals_ms"`        // key = instrument ID
+	PollIntervalMs  int64                       `json:"poll_interval_ms"`         // for instruments without their own interval
+	DurationSec     int                         `json:"duration_sec"`             // 0 = unlimited
+	HvSchedule      map[uint]*HvProgram         `json:"hv_schedule,omitempty"`    // key = instrument ID
+	StartVolts      map[uint]float64            `json:"start_volts,omitempty"`    // source voltage set by the settings, where programs start
+	HvStartedSec    map[uint]float64            `json:"hv_started_sec,omitempty"` // schedule clock seconds when an amended or step program began
+	Settings        map[uint]InstrumentSettings `json:"settings,omitempty"`       // settings in effect, changed by amendments and sequence steps
+	Rules           []Rule                      `json:"rules,omitempty"`
+	Watchdog        WatchdogConfig              `json:"watchdog"`
+	AutoClearErrors bool                        `json:"auto_clear_errors,omitempty"` // clear latched error codes after recording them
+	StartedAt       time.Time                   `json:"started_at"`
+	PausedSec       float64                     `json:"paused_sec,omitempty"` // time spent in finished pauses, excluded from the run clock
+	Sequence        *Sequence                   `json:"sequence,omitempty"`
+	Step            int                         `json:"step,omitempty"`             // position of the running sequence step
+	StepStartedSec  float64                     `json:"step_started_sec,omitempty"` // run clock seconds when that step began
+	Baselines       map[uint]Baseline           `json:"baselines,omitempty"`        // offset currents subtracted from readings taken with matching settings
+}
 
-	if ch, ok := r.cancels[experimentID]; ok {
-		close(ch)
-		delete(r.cancels, experimentID)
-	}
+// ClockStart is when the run would have started had it never been paused. Elapsed time,
+// the HV schedule and the deadline are measured from here.
+func (p RunPlan) ClockStart() time.Time {
+	return p.StartedAt.Add(time.Duration(p.PausedSec * float64(time.Second)))
 }
 
-// persistentConn wraps a TCP connection with send/receive for SCPI over persistent socket
-type persistentConn struct {
-	host string
-	port int
-	conn net.Conn
-	buf  []byte
+// IntervalFor returns the polling interval of an instrument
+func (p RunPlan) IntervalFor(instrumentID uint) time.Duration {
+	if ms := p.PollIntervalsMs[instrumentID]; ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	if p.PollIntervalMs > 0 {
+		return time.Duration(p.PollIntervalMs) * time.Millisecond
+	}
+	return DefaultSettings().PollingInterval()
 }
 
-func newPersistentConn(host string, port int) *persistentConn {
-	return &persistentConn{host: host, port: port, buf: make([]byte, 4096)}
+// Deadline returns when the plan ends (zero time for unlimited)
+func (p RunPlan) Deadline() time.Time {
+	if p.DurationSec <= 0 {
+		return time.Time{}
+	}
+	return p.ClockStart().Add(time.Duration(p.DurationSec) * time.Second)
 }
 
-func (pc *persistentConn) connect() error {
-	if pc.conn != nil {
-		pc.conn.Close()
-		pc.conn = nil
+// ParseRunPlan decodes Experiment.RunPlanJSON
+func ParseRunPlan(raw string) (*RunPlan, error) {
+	if raw == "" {
+		return nil, fmt.Errorf("no run plan stored")
 	}
-	addr := fmt.Sprintf("%s:%d", pc.host, pc.port)
-	conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
-	if err != nil {
-		return err
+	var p RunPlan
+	if err := json.Unmarshal([]byte(raw), &p); err != nil {
+		return nil, fmt.Errorf("invalid run plan: %w", err)
 	}
-	pc.conn = conn
-	return nil
+	if len(p.InstrumentIDs) == 0 || p.StartedAt.IsZero() {
+		return nil, fmt.Errorf("incomplete run plan")
+	}
+	return &p, nil
 }
 
-func (pc *persistentConn) close() {
-	if pc.conn != nil {
-		pc.conn.Close()
-		pc.conn = nil
-	}
+// RunOptions are the run settings that are not stored on the experiment itself
+type RunOptions struct {
+	Watchdog        WatchdogConfig    `json:"watchdog"`
+	AutoClearErrors bool              `json:"auto_clear_errors"` // send HAND:ERROR after a reading reports an error code
+	Sequence        *Sequence         `json:"sequence"`          // run as steps; settings must be those of the first step
+	Baselines       map[uint]Baseline `json:"baselines"`         // key = instrument ID; subtracted from the current before rules and storage, while function and range match
 }
 
-// sendCmd sends a command on the persistent connection and reads the response.
-// Returns response string and error. On error the connection is closed so next call reconnects.
-func (pc *persistentConn) sendCmd(cmd string, timeout time.Duration) (string, error) {
-	if pc.conn == nil {
-		if err := pc.connect(); err != nil {
-			return "", fmt.Errorf("connect %s:%d: %w", pc.host, pc.port, err)
+// Start begins polling instruments for an experiment and persists the run plan.
+// Each instrument is polled at the frequency of its own settings (defaults if missing).
+func (r *Runner) Start(experiment *models.Experiment, instruments []models.Instrument, settings map[uint]InstrumentSettings, opts RunOptions) {
+	plan := RunPlan{
+		PollIntervalsMs: make(map[uint]int64, len(instruments)),
+		DurationSec:     experiment.DurationSec,
+		StartVolts:      make(map[uint]float64),
+		Settings:        make(map[uint]InstrumentSettings, len(instruments)),
+		Watchdog:        opts.Watchdog,
+		AutoClearErrors: opts.AutoClearErrors,
+		Baselines:       opts.Baselines,
+		StartedAt:       time.Now(),
+	}
+	if experiment.StartTime != nil {
+		plan.StartedAt = *experiment.StartTime
+	}
+	for _, inst := range instruments {
+		plan.InstrumentIDs = append(plan.InstrumentIDs, inst.ID)
+		s, ok := settings[inst.ID]
+		if !ok {
+			s = DefaultSettings()
+		}
+		plan.PollIntervalsMs[inst.ID] = s.PollingInterval().Milliseconds()
+		plan.Settings[inst.ID] = s
+		if s.SourceOn {
+			plan.StartVolts[inst.ID] = s.SourceVolt
 		}
 	}
-	pc.conn.SetDeadline(time.Now().Add(timeout))
-	_, err := pc.conn.Write([]byte(cmd + "\r\n"))
+
+	// Parse HV schedule from experiment (validated by the caller)
+	hv, err := ParseHvSchedule(experiment.HvScheduleJSON)
 	if err != nil {
-		pc.close()
-		return "", fmt.Errorf("write: %w", err)
+		log.Printf("[SCPI] exp=%d invalid HV schedule ignored: %v", experiment.ID, err)
 	}
-	n, err := pc.conn.Read(pc.buf)
+	plan.HvSchedule = hv
+
+	rules, err := ParseRules(experiment.RulesJSON)
 	if err != nil {
-		pc.close()
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			return "", nil
+		log.Printf("[SCPI] exp=%d invalid rules ignored: %v", experiment.ID, err)
+	}
+	plan.Rules = rules
+
+	if opts.Sequence != nil {
+		plan.startSequence(opts.Sequence)
+	}
+
+	if b, err := json.Marshal(plan); err == nil {
+		experiment.RunPlanJSON = string(b)
+		if err := database.DB.Model(&models.Experiment{}).Where("id = ?", experiment.ID).
+			Update("run_plan_json", experiment.RunPlanJSON).Error; err != nil {
+			log.Printf("[SCPI] exp=%d saving run plan failed, it cannot be resumed after a restart: %v", experiment.ID, err)
 		}
-		return "", fmt.Errorf("read: %w", err)
 	}
-	return strings.TrimSpace(string(pc.buf[:n])), nil
+
+	if plan.Sequence != nil {
+		beginStep(experiment.ID, &plan, plan.StartedAt)
+	}
+	r.Resume(experiment.ID, instruments, plan)
+}
+
+// Resume begins polling from an existing plan; elapsed time continues from plan.ClockStart
+func (r *Runner) Resume(experimentID uint, instruments []models.Instrument, plan RunPlan) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.runs[experimentID]; ok {
+		return // already running
+	}
+	delete(r.paused, experimentID)
+
+	h := &runHandle{
+		cancel: make(chan struct{}),
+		halted: make(chan struct{}),
+		done:   make(chan struct{}),
+		amend:  make(chan amendRequest),
+		health: make(map[uint]InstrumentHealth, len(instruments)),
+	}
+	r.runs[experimentID] = h
+
+	go func() {
+		defer close(h.done)
+		r.poll(experimentID, instruments, plan, h)
+	}()
 }
 
-// interpolateHV returns the interpolated voltage at elapsed seconds from sorted HvPoint slice
-func interpolateHV(points []HvPoint, elapsedSec float64) float64 {
-	if len(points) == 0 {
-		return 0
+// Stop stops polling for an experiment and waits until every queued measurement is persisted
+func (r *Runner) Stop(experimentID uint) {
+	if h := r.remove(experimentID); h != nil {
+		<-h.done
 	}
-	if elapsedSec <= points[0].TimeSec {
-		return points[0].Voltage
+	r.mu.Lock()
+	delete(r.paused, experimentID)
+	r.mu.Unlock()
+}
+
+// Pause stops polling like Stop but keeps the experiment known as paused, so an emergency
+// stop still ends it. Returns false if the experiment was not being polled.
+func (r *Runner) Pause(experimentID uint) bool {
+	h := r.remove(experimentID)
+	if h != nil {
+		<-h.done
 	}
-	if elapsedSec >= points[len(points)-1].TimeSec {
-		return points[len(points)-1].Voltage
+	r.setPaused(experimentID)
+	return h != nil
+}
+
+// setPaused marks an experiment as paused without a polling goroutine (restart recovery)
+func (r *Runner) setPaused(experimentID uint) {
+	r.mu.Lock()
+	r.paused[experimentID] = true
+	r.mu.Unlock()
+}
+
+// Halt cancels every run and waits up to wait for their instruments to stop being
+// polled, without waiting for data to be persisted. Returns the halted experiment IDs,
+// paused experiments included.
+func (r *Runner) Halt(wait time.Duration) []uint {
+	r.mu.Lock()
+	ids := make([]uint, 0, len(r.runs)+len(r.paused))
+	handles := make([]*runHandle, 0, len(r.runs))
+	for id, h := range r.runs {
+		close(h.cancel)
+		ids = append(ids, id)
+		handles = append(handles, h)
 	}
-	for i := 1; i < len(points); i++ {
-		if elapsedSec <= points[i].TimeSec {
-			p0, p1 := points[i-1], points[i]
-			dt := p1.TimeSec - p0.TimeSec
-			if dt <= 0 {
-				return p1.Voltage
-			}
-			t := (elapsedSec - p0.TimeSec) / dt
-			return p0.Voltage + t*(p1.Voltage-p0.Voltage)
+	for id := range r.paused {
+		ids = append(ids, id)
+	}
+	r.runs = make(map[uint]*runHandle)
+	r.paused = make(map[uint]bool)
+	r.mu.Unlock()
+
+	timeout := time.After(wait)
+	for i, h := range handles {
+		select {
+		case <-h.halted:
+		case <-timeout:
+			log.Printf("[SCPI] exp=%d still polling after %s, continuing", ids[i], wait)
 		}
 	}
-	return points[len(points)-1].Voltage
+	return ids
+}
+
+// remove cancels polling without waiting (used by the polling goroutine itself)
+func (r *Runner) remove(experimentID uint) *runHandle {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h, ok := r.runs[experimentID]
+	if !ok {
+		return nil
+	}
+	close(h.cancel)
+	delete(r.runs, experimentID)
+	return h
 }
 
 // instState holds per-instrument state for polling — each goroutine owns exactly one, no sharing
 type instState struct {
-	inst   models.Instrument
-	pc     *persistentConn
-	hvPts  []HvPoint
-	lastHV float64
-}
+	inst     models.Instrument
+	drv      Driver
+	sess     *Session
+	interval time.Duration
+	settings *InstrumentSettings // nil for plans stored before settings were recorded
+	amend    chan *instAmendment
+	exited   chan struct{} // closed when the poller returned
+	hv       *hvExecutor   // nil without an HV schedule
+	srcRange int           // source range in use, for drivers with polarity ranges
+	startV   float64       // source voltage before the schedule took over
+	lastHV   float64
+	lastResp *Response
+	count    int64
 
-func (r *Runner) poll(experimentID uint, instruments []models.Instrument, interval time.Duration, cancel chan struct{}, duration time.Duration, hvSchedule map[uint][]HvPoint) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	hvSeg       int    // last HV segment reported to the timeline
+	fetchErr    bool   // the last fetch failed
+	reconnects  uint64 // session reconnects already reported
+	wd          *watchdog
+	autoClear   bool      // clear latched error codes after recording them
+	errCode     int       // error code of the last reading, for edge-triggered events
+	baseline    *Baseline // offset current subtracted from the readings, nil for none
+	baselineOff bool      // the settings differ from the baseline's, it is not subtracted
+
+	step    int          // position of the sequence step the poller runs
+	until   *HvCondition // exit condition of that step read by this instrument
+	stepEnd chan<- int   // receives step when until is met
 
-	start := time.Now()
+	rules       []*ruleState
+	hvPausers   map[*ruleState]bool // pause_hv rules currently holding the HV schedule
+	pausedAt    float64             // elapsed seconds when the first of them paused it
+	pausedTotal float64             // seconds the HV schedule spent paused
+}
+
+// setVoltage changes the source setpoint. Drivers with polarity-specific source ranges
+// go through 0 V and switch range before crossing polarity.
+func (s *instState) setVoltage(c Conn, v float64) error {
+	if rd, ok := s.drv.(sourceRangeDriver); ok {
+		if rng := rd.SourceRange(v, s.srcRange); rng != s.srcRange {
+			if err := s.drv.SetVoltage(c, 0); err != nil {
+				return err
+			}
+			if err := rd.SetSourceRange(c, rng); err != nil {
+				return err
+			}
+			s.srcRange = rng
+		}
+	}
+	return s.drv.SetVoltage(c, v)
+}
 
-	// Duration timer (0 = unlimited)
+func (r *Runner) poll(experimentID uint, instruments []models.Instrument, plan RunPlan, h *runHandle) {
+	// Duration timer (0 = unlimited); fires at once if the deadline passed while resuming
 	var deadlineC <-chan time.Time
-	if duration > 0 {
-		deadlineC = time.After(duration)
+	if deadline := plan.Deadline(); !deadline.IsZero() {
+		deadlineC = time.After(time.Until(deadline))
 	}
 
+	// Sequence: the step ends on its timer or when a poller sees its exit condition
+	stepC := plan.stepTimer()
+	stepEnd := make(chan int, len(instruments))
+
 	// Per-instrument state — slice indexed by position, no shared maps
 	states := make([]instState, len(instruments))
 	for i, inst := range instruments {
 		states[i] = instState{
-			inst:   inst,
-			pc:     newPersistentConn(inst.Host, inst.Port),
-			hvPts:  hvSchedule[inst.ID],
-			lastHV: math.NaN(),
+			inst:     inst,
+			drv:      DriverFor(inst),
+			sess:     DefaultSessions.Get(inst),
+			interval: plan.IntervalFor(inst.ID),
+			lastHV:   math.NaN(),
+			amend:    make(chan *instAmendment, 1),
+			exited:   make(chan struct{}),
 		}
-	}
-	defer func() {
-		for i := range states {
-			states[i].pc.close()
+		if s, ok := plan.Settings[inst.ID]; ok {
+			states[i].settings = &s
 		}
-	}()
+		states[i].reconnects = states[i].sess.Stats().Reconnects
+		states[i].wd = newWatchdog(plan.Watchdog, inst.ID, inst.Name, states[i].interval)
+		states[i].autoClear = plan.AutoClearErrors
+		if b, ok := plan.Baselines[inst.ID]; ok {
+			states[i].baseline = &b
+		}
+		h.setHealth(states[i].wd.health)
+		start := plan.StartVolts[inst.ID]
+		states[i].startV = start
+		states[i].rules = rulesFor(plan.Rules, inst.ID)
+		states[i].step = plan.Step
+		states[i].until = plan.stepCondition(inst.ID)
+		states[i].stepEnd = stepEnd
+		if rd, ok := states[i].drv.(sourceRangeDriver); ok {
+			states[i].srcRange = rd.SourceRange(start, 0)
+		}
+		if prog := plan.HvSchedule[inst.ID]; prog != nil {
+			ex, err := newHvExecutor(prog, start)
+			if err != nil {
+				log.Printf("[SCPI] exp=%d inst=%d HV schedule ignored: %v", experimentID, inst.ID, err)
+				continue
+			}
+			if at, ok := plan.HvStartedSec[inst.ID]; ok {
+				ex.segStart = at // amended and step programs are timed from when they took over
+			} else if plan.Sequence != nil {
+				ex.segStart = plan.StepStartedSec
+			}
+			states[i].hv = ex
+		}
+	}
+
+	// Every instrument polls on its own ticker so a slow channel doesn't hold back a fast one
+	stop := make(chan struct{})
+	stopReq := make(chan stopRequest, 1) // a stop rule fired or an instrument was lost
+	var wg sync.WaitGroup
+	for i := range states {
+		wg.Add(1)
+		go func(s *instState) {
+			defer wg.Done()
+			defer close(s.exited)
+			r.pollInstrument(experimentID, s, plan.ClockStart(), stop, stopReq, h)
+		}(&states[i])
+	}
+
+	halt := func() {
+		close(stop)
+		wg.Wait()
+		close(h.halted)
+	}
 
-	var count int64
 	for {
 		select {
-		case <-cancel:
+		case <-h.cancel:
+			halt()
+			DefaultWriter.Flush()
 			return
 		case <-deadlineC:
 			// Auto-stop: duration expired
 			log.Printf("[SCPI] exp=%d duration expired, auto-stopping", experimentID)
-			r.Stop(experimentID)
-			// Mark experiment completed in DB
-			now := time.Now()
-			database.DB.Model(&models.Experiment{}).Where("id = ?", experimentID).
-				Updates(map[string]interface{}{"status": models.StatusCompleted, "end_time": now})
-			// Turn off instruments in parallel
-			var stopWg sync.WaitGroup
-			for i := range states {
-				stopWg.Add(1)
-				go func(s *instState) {
-					defer stopWg.Done()
-					Stop(s.inst.Host, s.inst.Port)
-					Send(s.inst.Host, s.inst.Port, "FUNC:SRC OFF", 2*time.Second)
-					Send(s.inst.Host, s.inst.Port, "FUNC:AMMET OFF", 2*time.Second)
-				}(&states[i])
+			events.Record(experimentID, 0, events.AutoStop, "planned duration elapsed",
+				map[string]interface{}{"duration_sec": plan.DurationSec})
+			r.remove(experimentID)
+			halt()
+			r.finish(experimentID, states, models.StatusCompleted, "")
+			return
+		case req := <-stopReq:
+			log.Printf("[SCPI] exp=%d ending (%s): %s", experimentID, req.status, req.reason)
+			r.remove(experimentID)
+			halt()
+			r.finish(experimentID, states, req.status, req.reason)
+			return
+		case <-stepC:
+			if r.nextStep(experimentID, &plan, states, "duration", &stepC, halt) {
+				return
+			}
+		case pos := <-stepEnd:
+			if pos != plan.Step {
+				continue // the step already ended
 			}
-			stopWg.Wait()
+			if r.nextStep(experimentID, &plan, states, "condition", &stepC, halt) {
+				return
+			}
+		case req := <-h.amend:
+			if err := r.amend(experimentID, &plan, states, req.am); err != nil {
+				req.reply <- amendResult{err: err}
+				continue
+			}
+			deadlineC = nil
+			if deadline := plan.Deadline(); !deadline.IsZero() {
+				deadlineC = time.After(time.Until(deadline))
+			}
+			// The caller gets its own copy; the maps keep changing with later amendments
+			var amended RunPlan
+			b, _ := json.Marshal(plan)
+			json.Unmarshal(b, &amended)
+			req.reply <- amendResult{plan: &amended}
+		}
+	}
+}
+
+// nextStep moves a sequence to its next step. Returns true when the run ended, because
+// the sequence finished or the next step could not be started.
+func (r *Runner) nextStep(experimentID uint, plan *RunPlan, states []instState, reason string, stepC *<-chan time.Time, halt func()) bool {
+	more, err := r.advance(experimentID, plan, states, reason)
+	if more {
+		*stepC = plan.stepTimer()
+		return false
+	}
+	r.remove(experimentID)
+	halt()
+	if err != nil {
+		log.Printf("[SCPI] exp=%d sequence failed: %v", experimentID, err)
+		r.finish(experimentID, states, models.StatusError, err.Error())
+		return true
+	}
+	events.Record(experimentID, 0, events.AutoStop, "sequence finished",
+		map[string]interface{}{"steps": plan.Sequence.Len()})
+	r.finish(experimentID, states, models.StatusCompleted, "")
+	return true
+}
+
+// finish ends an experiment from inside the runner: safe-states the instruments and
+// verifies their source is off, persists the data, stores the final status and releases
+// the instruments. An unverified safe-state turns the status into error.
+func (r *Runner) finish(experimentID uint, states []instState, status models.ExperimentStatus, reason string) {
+	instruments := make([]models.Instrument, len(states))
+	for i := range states {
+		instruments[i] = states[i].inst
+	}
+	if failures := SafeStateAll(instruments); len(failures) > 0 {
+		status = models.StatusError
+		if reason != "" {
+			reason += "; "
+		}
+		reason += SafeStateFailures(instruments, failures)
+	}
+
+	DefaultWriter.Flush()
+	now := time.Now()
+	database.DB.Model(&models.Experiment{}).Where("id = ?", experimentID).
+		Updates(map[string]interface{}{"status": status, "end_time": now, "status_reason": reason})
+	CloseSteps([]uint{experimentID}, now, string(status))
+	broker.Default.PublishStatus(experimentID, status)
+	broker.Default.Finish(experimentID)
+	ReleaseInstruments(experimentID)
+}
+
+// pollInstrument fetches one instrument at its own interval until stop is closed
+func (r *Runner) pollInstrument(experimentID uint, s *instState, start time.Time, stop chan struct{}, stopReq chan stopRequest, h *runHandle) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
 			return
+		case a := <-s.amend:
+			s.applyAmendment(experimentID, a, ticker, func() float64 { return time.Since(start).Seconds() - s.pausedTotal })
+			continue
 		case <-ticker.C:
-			elapsed := time.Since(start).Seconds()
-
-			// Poll all instruments in parallel — each goroutine owns its own *instState
-			var wg sync.WaitGroup
-			for i := range states {
-				wg.Add(1)
-				go func(s *instState) {
-					defer wg.Done()
-
-					// Apply HV schedule if needed
-					if len(s.hvPts) > 0 {
-						targetV := interpolateHV(s.hvPts, elapsed)
-						if math.IsNaN(s.lastHV) || math.Abs(targetV-s.lastHV) >= 0.1 {
-							s.pc.sendCmd(fmt.Sprintf("SRC:VALUE %.3f", targetV), defaultTimeout)
-							s.lastHV = targetV
-							if count%20 == 0 {
-								log.Printf("[SCPI] exp=%d inst=%d HV schedule -> %.1fV", experimentID, s.inst.ID, targetV)
-							}
-						}
-					}
+		}
+		if !s.wd.due(time.Now()) {
+			continue // degraded: waiting for the next reconnection attempt
+		}
+		elapsed := time.Since(start).Seconds()
 
-					// Fetch measurements
-					rawResp, rawErr := s.pc.sendCmd("FETCH:ALL_S?", defaultTimeout)
-					if rawErr != nil {
-						if count%10 == 0 {
-							log.Printf("[SCPI] exp=%d inst=%d fetch error (x10): %v", experimentID, s.inst.ID, rawErr)
-						}
-						return
+		// HV setpoint and fetch run as one job so nothing interleaves between them
+		var resp *Response
+		var sent, received time.Time
+		err := s.sess.Exec(PriorityPoll, func(c Conn) error {
+			if s.hv != nil && !s.hvPaused() {
+				targetV := s.hv.target(elapsed-s.pausedTotal, s.lastResp)
+				if math.IsNaN(s.lastHV) || math.Abs(targetV-s.lastHV) >= 0.1 {
+					if err := s.setVoltage(c, targetV); err != nil {
+						log.Printf("[SCPI] exp=%d inst=%d HV setpoint %.1fV failed: %v", experimentID, s.inst.ID, targetV, err)
+						events.Record(experimentID, s.inst.ID, events.HvSetpointFailed, fmt.Sprintf("setpoint %.1f V failed: %v", targetV, err),
+							map[string]interface{}{"voltage": targetV, "elapsed_sec": elapsed})
+					} else {
+						s.lastHV = targetV
 					}
-					resp, err := ParseAllS(rawResp)
-					if err != nil {
-						if count%10 == 0 {
-							log.Printf("[SCPI] exp=%d inst=%d parse error (x10): %v", experimentID, s.inst.ID, err)
-						}
-						return
+					if s.count%20 == 0 {
+						log.Printf("[SCPI] exp=%d inst=%d HV schedule -> %.1fV", experimentID, s.inst.ID, targetV)
 					}
+				}
+			}
+			if s.hv != nil {
+				s.reportSegment(experimentID, elapsed)
+			}
+			var err error
+			sent = time.Now()
+			resp, err = s.drv.Fetch(c)
+			received = time.Now()
+			if err != nil {
+				return err
+			}
+			s.checkErrors(experimentID, c, resp)
+			return nil
+		})
+		s.count++
+		s.reportReconnects(experimentID)
+		if err != nil {
+			if !s.fetchErr {
+				s.fetchErr = true
+				events.Record(experimentID, s.inst.ID, events.FetchError, err.Error(), map[string]interface{}{"elapsed_sec": elapsed})
+			}
+			if s.count%10 == 0 {
+				log.Printf("[SCPI] exp=%d inst=%d fetch error (x10): %v", experimentID, s.inst.ID, err)
+			}
+			if s.watchFailure(experimentID, err, stopReq, h) {
+				return
+			}
+			continue
+		}
+		if s.fetchErr {
+			s.fetchErr = false
+			events.Record(experimentID, s.inst.ID, events.FetchRecovered, "readings resumed", map[string]interface{}{"elapsed_sec": elapsed})
+		}
+		if s.wd.success(time.Now()) {
+			log.Printf("[SCPI] exp=%d inst=%d communication restored", experimentID, s.inst.ID)
+			events.Record(experimentID, s.inst.ID, events.InstrumentRecovered, "communication restored", nil)
+		}
+		h.setHealth(s.wd.health)
 
-					m := models.Measurement{
-						ExperimentID: experimentID,
-						InstrumentID: s.inst.ID,
-						DeviceTime:   resp.DeviceTime,
-						RecordedAt:   time.Now(),
-						Voltage:      resp.Voltage,
-						Current:      resp.Current,
-						Charge:       resp.Charge,
-						Resistance:   resp.Resistance,
-						Temperature:  resp.Temperature,
-						Humidity:     resp.Humidity,
-						Source:       resp.Source,
-						MathValue:    resp.MathValue,
-						ErrorCode:    resp.ErrorCode,
-					}
+		// Rules and step conditions see the corrected current, like the stored readings
+		var raw *float64
+		if off, ok := s.offset(experimentID, elapsed); ok {
+			rawCurrent := resp.Current
+			raw = &rawCurrent
+			resp.Current -= off
+		}
+		s.lastResp = resp
+		s.applyRules(experimentID, resp, elapsed, stopReq)
+		if s.until != nil && s.until.Met(resp) {
+			s.until = nil
+			select {
+			case s.stepEnd <- s.step:
+			default:
+			}
+		}
 
-					if err := database.DB.Create(&m).Error; err != nil {
-						log.Printf("[SCPI] exp=%d inst=%d save error: %v", experimentID, s.inst.ID, err)
-					}
-				}(&states[i])
+		// Map the device clock to host time; without one, the request midpoint is the best guess
+		rtt := received.Sub(sent)
+		acquired := sent.Add(rtt / 2)
+		if dev, ok := ParseDeviceTime(resp.DeviceTime); ok {
+			acquired = s.sess.Clock().Observe(dev, sent, received)
+		}
+
+		m := models.Measurement{
+			ExperimentID: experimentID,
+			InstrumentID: s.inst.ID,
+			DeviceTime:   resp.DeviceTime,
+			RecordedAt:   received,
+			AcquiredAt:   &acquired,
+			RoundTripMs:  float64(rtt.Microseconds()) / 1000,
+			Voltage:      resp.Voltage,
+			Current:      resp.Current,
+			RawCurrent:   raw,
+			Charge:       resp.Charge,
+			Resistance:   resp.Resistance,
+			Temperature:  resp.Temperature,
+			Humidity:     resp.Humidity,
+			Source:       resp.Source,
+			MathValue:    resp.MathValue,
+			ErrorCode:    resp.ErrorCode,
+			ErrorText:    ErrorText(resp.ErrorCode),
+		}
+
+		DefaultWriter.Enqueue(m)
+		broker.Default.PublishMeasurement(m)
+
+		if s.count%100 == 0 {
+			log.Printf("[SCPI] exp=%d inst=%d polls=%d every %s elapsed=%.0fs", experimentID, s.inst.ID, s.count, s.interval, elapsed)
+		}
+	}
+}
+
+// offset returns the baseline current to subtract from a reading. It applies only while
+// the instrument measures with the function and range it was calibrated with; switching
+// away from them and back is recorded on the timeline.
+func (s *instState) offset(experimentID uint, elapsed float64) (float64, bool) {
+	if s.baseline == nil {
+		return 0, false
+	}
+	match := s.settings != nil && s.baseline.Matches(*s.settings)
+	if match == s.baselineOff {
+		s.baselineOff = !match
+		data := map[string]interface{}{"elapsed_sec": elapsed, "baseline": s.baseline}
+		if match {
+			events.Record(experimentID, s.inst.ID, events.BaselineResumed, "baseline subtracted again", data)
+		} else {
+			log.Printf("[SCPI] exp=%d inst=%d baseline of calibration %d not subtracted: settings differ", experimentID, s.inst.ID, s.baseline.CalibrationID)
+			events.Record(experimentID, s.inst.ID, events.BaselineSuspended,
+				fmt.Sprintf("function, range or zero correction differ from calibration %d, baseline not subtracted", s.baseline.CalibrationID), data)
+		}
+	}
+	return s.baseline.Current, match
+}
+
+// checkErrors records changes of the reading's error code, clears latched codes when the
+// plan asks for it, and drains the SCPI error queue every errorQueuePolls polls. Runs
+// inside the poll job, on the instrument connection.
+func (s *instState) checkErrors(experimentID uint, c Conn, resp *Response) {
+	if resp.ErrorCode != s.errCode {
+		if resp.ErrorCode != 0 {
+			info := DescribeError(resp.ErrorCode)
+			log.Printf("[SCPI] exp=%d inst=%d error code %d: %s", experimentID, s.inst.ID, info.Code, info.Text)
+			events.Record(experimentID, s.inst.ID, events.InstrumentError, fmt.Sprintf("error %d: %s", info.Code, info.Text), info)
+		} else {
+			events.Record(experimentID, s.inst.ID, events.InstrumentErrorCleared, fmt.Sprintf("error %d cleared", s.errCode), nil)
+		}
+		s.errCode = resp.ErrorCode
+	}
+	if resp.ErrorCode != 0 && s.autoClear {
+		if ec, ok := s.drv.(errorClearDriver); ok {
+			if err := ec.ClearError(c); err != nil {
+				log.Printf("[SCPI] exp=%d inst=%d clearing error %d failed: %v", experimentID, s.inst.ID, resp.ErrorCode, err)
 			}
-			wg.Wait()
-			count++
-			if count%100 == 0 {
-				log.Printf("[SCPI] exp=%d polls=%d OK elapsed=%.0fs", experimentID, count, elapsed)
+		}
+	}
+	if eq, ok := s.drv.(errorQueueDriver); ok && s.count%errorQueuePolls == 0 {
+		if msgs, _ := eq.ReadErrors(c); len(msgs) > 0 {
+			log.Printf("[SCPI] exp=%d inst=%d instrument errors: %s", experimentID, s.inst.ID, strings.Join(msgs, "; "))
+			events.Record(experimentID, s.inst.ID, events.InstrumentError, strings.Join(msgs, "; "), map[string]interface{}{"messages": msgs})
+		}
+	}
+}
+
+// watchFailure feeds a failed poll to the watchdog. Returns true when the instrument was
+// lost for longer than the grace period and the experiment is being failed.
+func (s *instState) watchFailure(experimentID uint, err error, stopReq chan stopRequest, h *runHandle) bool {
+	degraded, failed := s.wd.failure(err, time.Now())
+	h.setHealth(s.wd.health)
+	if degraded {
+		log.Printf("[SCPI] exp=%d inst=%d degraded after %d failed polls: %v", experimentID, s.inst.ID, s.wd.health.ConsecutiveFailures, err)
+		events.Record(experimentID, s.inst.ID, events.InstrumentDegraded,
+			fmt.Sprintf("%d consecutive failed polls: %v", s.wd.health.ConsecutiveFailures, err), s.wd.health)
+	}
+	if !failed {
+		return false
+	}
+	reason := fmt.Sprintf("instrument %s lost for more than %ds: %v", s.inst.Name, s.wd.cfg.FailAfterSec, err)
+	events.Record(experimentID, s.inst.ID, events.InstrumentFailed, reason, s.wd.health)
+	select {
+	case stopReq <- stopRequest{status: models.StatusError, reason: reason}:
+	default: // already ending
+	}
+	return true
+}
+
+// reportSegment records a timeline event when the HV schedule moved to another segment
+func (s *instState) reportSegment(experimentID uint, elapsed float64) {
+	seg := s.hv.segment()
+	if seg == s.hvSeg {
+		return
+	}
+	s.hvSeg = seg
+	msg := fmt.Sprintf("segment %d of %d", seg+1, s.hv.segments())
+	if seg >= s.hv.segments() {
+		msg = "schedule finished"
+	}
+	events.Record(experimentID, s.inst.ID, events.HvSegment, msg,
+		map[string]interface{}{"segment": seg, "voltage": s.lastHV, "elapsed_sec": elapsed})
+}
+
+// reportReconnects records a timeline event for every session reconnect since the last poll
+func (s *instState) reportReconnects(experimentID uint) {
+	n := s.sess.Stats().Reconnects
+	if n == s.reconnects {
+		return
+	}
+	events.Record(experimentID, s.inst.ID, events.Reconnect, fmt.Sprintf("connection re-established (%d total)", n),
+		map[string]interface{}{"reconnects": n})
+	s.reconnects = n
+}
+
+// applyRules evaluates the instrument's rules against a reading and carries out their actions
+func (s *instState) applyRules(experimentID uint, resp *Response, elapsed float64, stopReq chan stopRequest) {
+	for _, rs := range s.rules {
+		fired, cleared := rs.observe(resp)
+		if cleared {
+			events.Record(experimentID, s.inst.ID, events.RuleCleared, rs.rule.String(), map[string]interface{}{"elapsed_sec": elapsed})
+			if !s.hvPausers[rs] {
+				continue
 			}
+			// The schedule resumes only when the last rule holding it clears
+			delete(s.hvPausers, rs)
+			if s.hvPaused() {
+				log.Printf("[SCPI] exp=%d inst=%d rule cleared, HV schedule still held by %d rules: %s", experimentID, s.inst.ID, len(s.hvPausers), rs.rule)
+				continue
+			}
+			s.pausedTotal += elapsed - s.pausedAt
+			log.Printf("[SCPI] exp=%d inst=%d rule cleared, HV schedule resumed: %s", experimentID, s.inst.ID, rs.rule)
+			continue
+		}
+		if !fired {
+			continue
+		}
+
+		value, _ := ResponseMetric(resp, rs.rule.Metric)
+		log.Printf("[SCPI] exp=%d inst=%d rule fired (%s=%g): %s -> %s", experimentID, s.inst.ID, rs.rule.Metric, value, rs.rule, rs.rule.Action)
+		events.Record(experimentID, s.inst.ID, events.RuleFired, fmt.Sprintf("%s -> %s", rs.rule, rs.rule.Action),
+			map[string]interface{}{"rule": rs.rule, "value": value, "elapsed_sec": elapsed})
+
+		switch rs.rule.Action {
+		case RuleStop:
+			select {
+			case stopReq <- stopRequest{
+				status: models.StatusStopped,
+				reason: fmt.Sprintf("stopped by rule %s (instrument %s, %s=%g)", rs.rule, s.inst.Name, rs.rule.Metric, value),
+			}:
+			default: // another rule already asked
+			}
+		case RulePauseHV:
+			if !s.hvPaused() {
+				s.pausedAt = elapsed
+				s.hvPausers = make(map[*ruleState]bool)
+			}
+			s.hvPausers[rs] = true
+		case RuleRampDown:
+			from := s.setpoint()
+			rate := rs.rule.RampRate
+			if rate <= 0 {
+				rate = defaultRampDownRate
+			}
+			zero := 0.0
+			ex, err := newHvExecutor(&HvProgram{Steps: []HvStep{{Type: HvStepRamp, Voltage: &zero, Rate: rate}}}, from)
+			if err != nil {
+				log.Printf("[SCPI] exp=%d inst=%d ramp-down failed: %v", experimentID, s.inst.ID, err)
+				continue
+			}
+			ex.segStart = elapsed - s.pausedTotal
+			s.hv = ex
+			s.hvPausers = nil
 		}
 	}
 }
+
+// hvPaused reports whether a pause_hv rule holds the HV schedule
+func (s *instState) hvPaused() bool {
+	return len(s.hvPausers) > 0
+}
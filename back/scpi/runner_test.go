@@ -0,0 +1,65 @@
+package scpi
+
+import (
+	"testing"
+	"time"
+
+	"back/broker"
+	"back/models"
+	"back/simulator"
+)
+
+func TestRunPlanIntervalFor(t *testing.T) {
+	p := RunPlan{PollIntervalsMs: map[uint]int64{1: 50, 2: 0}, PollIntervalMs: 400}
+	for id, want := range map[uint]time.Duration{1: 50 * time.Millisecond, 2: 400 * time.Millisecond, 3: 400 * time.Millisecond} {
+		if got := p.IntervalFor(id); got != want {
+			t.Errorf("IntervalFor(%d) = %s, want %s", id, got, want)
+		}
+	}
+	// plans stored before per-instrument intervals fall back to the default frequency
+	if got := (RunPlan{}).IntervalFor(1); got != DefaultSettings().PollingInterval() {
+		t.Errorf("empty plan interval %s", got)
+	}
+}
+
+// TestPerInstrumentPolling: each instrument polls at its own rate, and one that answers
+// slowly does not hold back the others
+func TestPerInstrumentPolling(t *testing.T) {
+	_, fast := liveSim(t, 9421)
+	_, slow := liveSim(t, 9422)
+
+	cfg := simulator.DefaultConfig()
+	cfg.Delay = 300 * time.Millisecond
+	lagSim := simulator.New(cfg)
+	if err := lagSim.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer lagSim.Close()
+	lagging := models.Instrument{ID: 9423, Name: "lagging", Model: "TH2690"}
+	lagging.Host, lagging.Port = lagSim.HostPort()
+
+	sub, _, _ := broker.Default.Subscribe(9421, 0)
+	defer broker.Default.Unsubscribe(sub)
+	DefaultRunner.Resume(9421, []models.Instrument{fast, slow, lagging}, RunPlan{
+		InstrumentIDs:   []uint{fast.ID, slow.ID, lagging.ID},
+		PollIntervalsMs: map[uint]int64{fast.ID: 50, slow.ID: 250, lagging.ID: 50},
+		StartedAt:       time.Now(),
+	})
+	time.Sleep(time.Second)
+
+	// count what arrived in that second; stopping takes a while on the lagging instrument
+	counts := make(map[uint]int)
+	for len(sub.C) > 0 {
+		ev := <-sub.C
+		if ev.Kind == broker.KindMeasurement {
+			counts[ev.InstrumentID]++
+		}
+	}
+	DefaultRunner.Stop(9421)
+	if counts[fast.ID] < 12 || counts[slow.ID] < 2 || counts[slow.ID] > 5 {
+		t.Fatalf("polls in 1s: %v (want ~20 at 50ms, ~4 at 250ms)", counts)
+	}
+	if counts[lagging.ID] > 6 {
+		t.Fatalf("lagging instrument polled %d times with 300ms replies", counts[lagging.ID])
+	}
+}
@@ -0,0 +1,274 @@
+package scpi
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"back/broker"
+	"back/database"
+	"back/models"
+)
+
+const (
+	safeStateAttempts   = 3
+	safeStateRetryDelay = 500 * time.Millisecond
+	emergencyHaltWait   = 5 * time.Second // how long emergency stop waits for pollers before safe-stating anyway
+)
+
+var errSourceStillOn = errors.New("source still on after safe-state")
+
+// VoltageLimitError is returned when a source voltage exceeds the limit of an instrument
+type VoltageLimitError struct {
+	InstrumentID uint    `json:"instrument_id"`
+	Voltage      float64 `json:"voltage"`
+	Limit        float64 `json:"limit"`
+	Command      string  `json:"command,omitempty"`
+}
+
+func (e *VoltageLimitError) Error() string {
+	if math.IsNaN(e.Voltage) {
+		return fmt.Sprintf("interlock: %q sets a source voltage that cannot be checked against the ±%g V limit of instrument %d",
+			e.Command, e.Limit, e.InstrumentID)
+	}
+	return fmt.Sprintf("interlock: %g V exceeds the ±%g V limit of instrument %d", e.Voltage, e.Limit, e.InstrumentID)
+}
+
+// CheckVoltage checks a source voltage against the instrument's limit (MaxVoltage 0 = none)
+func CheckVoltage(inst models.Instrument, v float64) error {
+	if inst.MaxVoltage > 0 && (math.IsNaN(v) || math.Abs(v) > inst.MaxVoltage) {
+		return &VoltageLimitError{InstrumentID: inst.ID, Voltage: v, Limit: inst.MaxVoltage}
+	}
+	return nil
+}
+
+// checkCommand enforces the voltage limit on a raw command line. Every command that sets
+// a source voltage is checked; arguments that cannot be parsed (MAX, UP, ...) are refused.
+func checkCommand(inst models.Instrument, line string) error {
+	if inst.MaxVoltage <= 0 {
+		return nil
+	}
+	for _, cmd := range strings.Split(line, ";") {
+		arg, ok := sourceVoltageArg(cmd)
+		if !ok {
+			continue
+		}
+		v, _, err := splitUnit(arg)
+		if err != nil {
+			v = math.NaN()
+		}
+		if err := CheckVoltage(inst, v); err != nil {
+			err.(*VoltageLimitError).Command = strings.TrimSpace(cmd)
+			return err
+		}
+	}
+	return nil
+}
+
+// scpiNode is one level of a command header: the short form and the long form
+type scpiNode struct{ short, long string }
+
+// sourceVoltageHeaders are the setpoint commands of the supported drivers: TH2690
+// SRC:VALUE and SOURce:VOLTage[:LEVel][:IMMediate|:TRIGgered][:AMPLitude]
+var sourceVoltageHeaders = [][]scpiNode{
+	{{"SRC", "SRC"}, {"VAL", "VALUE"}},
+	{{"SOUR", "SOURCE"}, {"VOLT", "VOLTAGE"}},
+}
+
+var sourceVoltageSuffixes = []scpiNode{
+	{"LEV", "LEVEL"}, {"IMM", "IMMEDIATE"}, {"TRIG", "TRIGGERED"}, {"AMPL", "AMPLITUDE"},
+}
+
+// sourceVoltageArg returns the argument of a command that sets a source voltage
+func sourceVoltageArg(cmd string) (string, bool) {
+	cmd = strings.TrimSpace(cmd)
+	header, arg, _ := strings.Cut(cmd, " ")
+	header = strings.ToUpper(strings.TrimLeft(header, ":"))
+	if header == "" || strings.HasSuffix(header, "?") {
+		return "", false
+	}
+	nodes := strings.Split(header, ":")
+	for i, n := range nodes {
+		nodes[i] = strings.TrimRight(n, "0123456789") // SOUR1:VOLT
+	}
+	for _, h := range sourceVoltageHeaders {
+		if len(nodes) < len(h) || !matchNodes(nodes[:len(h)], h) {
+			continue
+		}
+		for _, n := range nodes[len(h):] {
+			if !matchAnyNode(n, sourceVoltageSuffixes) {
+				return "", false // :SOUR:VOLT:RANG, :SOUR:VOLT:LIM, ...
+			}
+		}
+		return strings.TrimSpace(arg), true
+	}
+	return "", false
+}
+
+func matchNodes(nodes []string, pattern []scpiNode) bool {
+	for i, n := range nodes {
+		if !matchAnyNode(n, pattern[i:i+1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAnyNode accepts the short form, the long form, or anything in between
+func matchAnyNode(n string, options []scpiNode) bool {
+	for _, o := range options {
+		if len(n) >= len(o.short) && len(n) <= len(o.long) && strings.HasPrefix(o.long, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// SafeState stops measurement and switches the HV source off, then reads the source
+// state back. The sequence is retried until the source is verified off.
+func SafeState(inst models.Instrument) error {
+	drv := DriverFor(inst)
+	sd, canVerify := drv.(sourceStateDriver)
+
+	var err error
+	for attempt := 1; attempt <= safeStateAttempts; attempt++ {
+		err = withConn(inst, PrioritySafety, func(c Conn) error {
+			safeErr := drv.SafeState(c)
+			if !canVerify {
+				return safeErr
+			}
+			on, err := sd.SourceState(c)
+			if err != nil {
+				if safeErr != nil {
+					return safeErr
+				}
+				return fmt.Errorf("verify source state: %w", err)
+			}
+			if on {
+				return errSourceStillOn
+			}
+			if safeErr != nil {
+				log.Printf("[SCPI] safe-state %s:%d: %v (source verified off)", inst.Host, inst.Port, safeErr)
+			}
+			return nil
+		})
+		if err == nil {
+			break
+		}
+		log.Printf("[SCPI] safe-state %s:%d attempt %d/%d: %v", inst.Host, inst.Port, attempt, safeStateAttempts, err)
+		if attempt < safeStateAttempts {
+			time.Sleep(safeStateRetryDelay)
+		}
+	}
+	if err == nil && !canVerify {
+		log.Printf("[SCPI] safe-state %s:%d driver=%s ok (source state not verifiable)", inst.Host, inst.Port, drv.Name())
+	} else {
+		log.Printf("[SCPI] safe-state %s:%d driver=%s err=%v", inst.Host, inst.Port, drv.Name(), err)
+	}
+	return err
+}
+
+// SafeStateAll safe-states instruments in parallel and returns the failures by instrument ID
+func SafeStateAll(instruments []models.Instrument) map[uint]error {
+	var mu sync.Mutex
+	failures := make(map[uint]error)
+	var wg sync.WaitGroup
+	for _, inst := range instruments {
+		wg.Add(1)
+		go func(inst models.Instrument) {
+			defer wg.Done()
+			if err := SafeState(inst); err != nil {
+				mu.Lock()
+				failures[inst.ID] = err
+				mu.Unlock()
+			}
+		}(inst)
+	}
+	wg.Wait()
+	return failures
+}
+
+// SafeStateFailures describes the failures returned by SafeStateAll for a status reason
+func SafeStateFailures(instruments []models.Instrument, failures map[uint]error) string {
+	var parts []string
+	for _, inst := range instruments {
+		if err := failures[inst.ID]; err != nil {
+			parts = append(parts, fmt.Sprintf("%s: %v", inst.Name, err))
+		}
+	}
+	return "safe-state NOT verified: " + strings.Join(parts, "; ")
+}
+
+// EmergencyResult is the outcome of an emergency stop for one instrument
+type EmergencyResult struct {
+	InstrumentID uint   `json:"instrument_id"`
+	Name         string `json:"name"`
+	Address      string `json:"address"`
+	OK           bool   `json:"ok"`
+	Error        string `json:"error,omitempty"`
+}
+
+// EmergencyStop halts every running experiment and safe-states every instrument with an
+// open session. It uses no database, so it works while the database is unreachable;
+// the experiments are marked stopped in the background once it answers.
+// Returns the halted experiment IDs and the per-instrument results.
+func EmergencyStop(reason string) ([]uint, []EmergencyResult) {
+	halted := DefaultRunner.Halt(emergencyHaltWait)
+
+	var instruments []models.Instrument
+	for _, s := range DefaultSessions.All() {
+		instruments = append(instruments, s.Instrument())
+	}
+	failures := SafeStateAll(instruments)
+
+	results := make([]EmergencyResult, 0, len(instruments))
+	for _, inst := range instruments {
+		r := EmergencyResult{
+			InstrumentID: inst.ID,
+			Name:         inst.Name,
+			Address:      fmt.Sprintf("%s:%d", inst.Host, inst.Port),
+			OK:           true,
+		}
+		if err := failures[inst.ID]; err != nil {
+			r.OK = false
+			r.Error = err.Error()
+		}
+		results = append(results, r)
+	}
+	log.Printf("[SAFETY] emergency stop: %d experiments halted, %d instruments, %d failures", len(halted), len(instruments), len(failures))
+
+	for _, id := range halted {
+		broker.Default.PublishStatus(id, models.StatusStopped)
+		broker.Default.Finish(id)
+	}
+	if len(halted) > 0 {
+		go markHalted(halted, reason, time.Now())
+	}
+	return halted, results
+}
+
+// markHalted stores the final status of experiments halted by an emergency stop,
+// retrying until the database is reachable so they are never resumed after a restart
+func markHalted(ids []uint, reason string, at time.Time) {
+	for attempt := 0; ; attempt++ {
+		err := database.DB.Model(&models.Experiment{}).
+			Where("id IN ? AND status IN ?", ids, activeStatuses).
+			Updates(map[string]interface{}{"status": models.StatusStopped, "end_time": at, "status_reason": reason}).Error
+		if err == nil {
+			for _, id := range ids {
+				ReleaseInstruments(id)
+			}
+			ClosePauses(ids, at)
+			CloseSteps(ids, at, string(models.StatusStopped))
+			return
+		}
+		if attempt%30 == 0 {
+			log.Printf("[SAFETY] marking halted experiments %v failed, retrying: %v", ids, err)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
@@ -0,0 +1,106 @@
+package scpi
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"back/models"
+)
+
+func TestCheckVoltage(t *testing.T) {
+	inst := models.Instrument{ID: 4, MaxVoltage: 300}
+	for _, v := range []float64{0, 300, -300, 12.5} {
+		if err := CheckVoltage(inst, v); err != nil {
+			t.Errorf("%g V: %v", v, err)
+		}
+	}
+	var lim *VoltageLimitError
+	if err := CheckVoltage(inst, -300.5); !errors.As(err, &lim) || lim.Limit != 300 || lim.Voltage != -300.5 {
+		t.Fatalf("-300.5 V: %v", err)
+	}
+	if err := CheckVoltage(inst, math.NaN()); err == nil {
+		t.Fatal("NaN accepted")
+	}
+	if err := CheckVoltage(models.Instrument{}, 5000); err != nil {
+		t.Fatalf("no limit: %v", err)
+	}
+}
+
+func TestCheckCommand(t *testing.T) {
+	inst := models.Instrument{ID: 4, MaxVoltage: 300}
+	for line, refused := range map[string]bool{
+		"SRC:VALUE 200":               false,
+		"SRC:VALUE 500":               true,
+		"src:val -301":                true,
+		"SRC:VALUE?":                  false,
+		"FUNC:SRC ON;SRC:VAL 400":     true,
+		"FUNC:SRC ON; SRC:VAL 100":    false,
+		":SOUR:VOLT 1e3":              true,
+		":SOUR1:VOLT:LEV:IMM:AMPL 50": false,
+		"SOURC:VOLTA 310":             true,
+		"SOUR:VOLT MAX":               true,
+		"SOUR:VOLT 0.25kV":            false,
+		":SOUR:VOLT:RANG 1000":        false,
+		":SOUR:VOLT:LIM 1000":         false,
+		"SOURCE:VOLTAGE:LEVEL 299.9":  false,
+		"CURR:RANGE 3":                false,
+		"*RST":                        false,
+	} {
+		err := checkCommand(inst, line)
+		if (err != nil) != refused {
+			t.Errorf("%q: %v, want refused=%v", line, err, refused)
+		}
+		var lim *VoltageLimitError
+		if err != nil && (!errors.As(err, &lim) || lim.Command == "") {
+			t.Errorf("%q: error %v does not name the command", line, err)
+		}
+	}
+	if err := checkCommand(models.Instrument{}, "SRC:VALUE 5000"); err != nil {
+		t.Fatalf("no limit: %v", err)
+	}
+}
+
+func TestSafeStateAll(t *testing.T) {
+	sim, inst := liveSim(t, 9461)
+	dead := models.Instrument{ID: 9462, Name: "gone", Host: "127.0.0.1", Port: 1, Model: "TH2690"}
+
+	failures := SafeStateAll([]models.Instrument{inst, dead})
+	if sim.SourceOn() || sim.Running() {
+		t.Fatalf("source on %v, running %v after safe-state", sim.SourceOn(), sim.Running())
+	}
+	if len(failures) != 1 || failures[dead.ID] == nil {
+		t.Fatalf("failures %v", failures)
+	}
+	if msg := SafeStateFailures([]models.Instrument{inst, dead}, failures); !strings.HasPrefix(msg, "safe-state NOT verified: gone: ") {
+		t.Fatalf("failure summary %q", msg)
+	}
+}
+
+func TestEmergencyStop(t *testing.T) {
+	sim, inst := liveSim(t, 9463)
+	DefaultRunner.Resume(9463, []models.Instrument{inst}, RunPlan{
+		InstrumentIDs:   []uint{inst.ID},
+		PollIntervalsMs: map[uint]int64{inst.ID: 50},
+		StartedAt:       time.Now(),
+	})
+
+	halted, results := EmergencyStop("test")
+	found := false
+	for _, id := range halted {
+		found = found || id == 9463
+	}
+	if !found || DefaultRunner.IsRunning(9463) {
+		t.Fatalf("halted %v, still running %v", halted, DefaultRunner.IsRunning(9463))
+	}
+	for _, r := range results {
+		if r.InstrumentID == inst.ID && !r.OK {
+			t.Fatalf("result %+v", r)
+		}
+	}
+	if sim.SourceOn() || sim.Running() {
+		t.Fatalf("source on %v, running %v after emergency stop", sim.SourceOn(), sim.Running())
+	}
+}
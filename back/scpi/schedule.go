@@ -0,0 +1,444 @@
+package scpi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+const (
+	hvMaxVoltage  = 1000.0 // absolute limit of the HV source
+	hvMaxSegments = 100000 // compiled segments after expanding repeats
+	hvMaxDepth    = 4      // repeat nesting
+	hvMaxRepeat   = 10000
+)
+
+// HV program step types
+const (
+	HvStepSet       = "step"       // jump to voltage (ramped at max_rate if set)
+	HvStepRamp      = "ramp"       // ramp to voltage at rate V/s or over duration_sec
+	HvStepHold      = "hold"       // keep the voltage for duration_sec
+	HvStepHoldUntil = "hold_until" // keep the voltage until a reading meets the condition (or timeout_sec)
+	HvStepRepeat    = "repeat"     // run steps count times
+)
+
+// HvCondition is a threshold on the latest reading of the instrument
+type HvCondition struct {
+	Metric string  `json:"metric"` // see ResponseMetric
+	Op     string  `json:"op"`     // >, >=, <, <=, ==, !=
+	Value  float64 `json:"value"`
+}
+
+// HvStep is one instruction of an HV program
+type HvStep struct {
+	Type        string       `json:"type"`
+	Voltage     *float64     `json:"voltage,omitempty"`      // step, ramp: target voltage
+	Rate        float64      `json:"rate,omitempty"`         // ramp: V/s
+	DurationSec float64      `json:"duration_sec,omitempty"` // hold; ramp (instead of rate)
+	Until       *HvCondition `json:"until,omitempty"`        // hold_until
+	TimeoutSec  float64      `json:"timeout_sec,omitempty"`  // hold_until: give up and continue (0 = wait forever)
+	Count       int          `json:"count,omitempty"`        // repeat
+	Steps       []HvStep     `json:"steps,omitempty"`        // repeat body
+}
+
+// HvProgram is the HV schedule of one instrument.
+//
+// Example: 10 triangle sweeps between -500 V and +500 V at 20 V/s, then hold 0 V until
+// the current decays below 1 pA:
+//
+//	{"max_rate": 50, "steps": [
+//	  {"type": "repeat", "count": 10, "steps": [
+//	    {"type": "ramp", "voltage": 500, "rate": 20},
+//	    {"type": "ramp", "voltage": -500, "rate": 20}]},
+//	  {"type": "step", "voltage": 0},
+//	  {"type": "hold_until", "until": {"metric": "abs_current", "op": "<", "value": 1e-12}, "timeout_sec": 600}]}
+//
+// A legacy []HvPoint list is accepted as well and converted to steps.
+type HvProgram struct {
+	MaxRate float64  `json:"max_rate,omitempty"` // V/s limit on every voltage change (0 = none)
+	Steps   []HvStep `json:"steps"`
+}
+
+// UnmarshalJSON accepts a program object or a legacy []HvPoint list
+func (p *HvProgram) UnmarshalJSON(b []byte) error {
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '[' {
+		var pts []HvPoint
+		if err := json.Unmarshal(b, &pts); err != nil {
+			return err
+		}
+		*p = *ProgramFromPoints(pts)
+		return nil
+	}
+	type plain HvProgram
+	return json.Unmarshal(b, (*plain)(p))
+}
+
+// ParseHvSchedule decodes Experiment.HvScheduleJSON: a map from instrument ID to a
+// program or legacy point list
+func ParseHvSchedule(raw string) (map[uint]*HvProgram, error) {
+	out := make(map[uint]*HvProgram)
+	if raw == "" || raw == "{}" {
+		return out, nil
+	}
+	var byKey map[string]*HvProgram
+	if err := json.Unmarshal([]byte(raw), &byKey); err != nil {
+		return nil, err
+	}
+	for key, p := range byKey {
+		id, err := strconv.ParseUint(key, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid instrument id %q", key)
+		}
+		if p != nil && len(p.Steps) > 0 {
+			out[uint(id)] = p
+		}
+	}
+	return out, nil
+}
+
+// ProgramFromPoints converts piecewise-linear points over absolute seconds into steps:
+// the first voltage is held until its time, then each point is ramped to (or stepped to
+// when two points share a time).
+func ProgramFromPoints(points []HvPoint) *HvProgram {
+	pts := append([]HvPoint(nil), points...)
+	sort.SliceStable(pts, func(a, b int) bool { return pts[a].TimeSec < pts[b].TimeSec })
+
+	p := &HvProgram{}
+	if len(pts) == 0 {
+		return p
+	}
+	v0 := pts[0].Voltage
+	p.Steps = append(p.Steps, HvStep{Type: HvStepSet, Voltage: &v0})
+	if pts[0].TimeSec > 0 {
+		p.Steps = append(p.Steps, HvStep{Type: HvStepHold, DurationSec: pts[0].TimeSec})
+	}
+	for i := 1; i < len(pts); i++ {
+		v := pts[i].Voltage
+		if dt := pts[i].TimeSec - pts[i-1].TimeSec; dt > 0 {
+			p.Steps = append(p.Steps, HvStep{Type: HvStepRamp, Voltage: &v, DurationSec: dt})
+		} else {
+			p.Steps = append(p.Steps, HvStep{Type: HvStepSet, Voltage: &v})
+		}
+	}
+	return p
+}
+
+// Validate checks the program for an instrument whose source starts at start volts
+func (p *HvProgram) Validate(start float64) error {
+	_, err := p.compile(start)
+	return err
+}
+
+// hvSegment is one piece of a compiled program: linear from→to over duration, or a
+// conditional hold when until is set (duration is then the timeout, 0 = none)
+type hvSegment struct {
+	from, to float64
+	duration float64
+	until    *HvCondition
+}
+
+func (p *HvProgram) compile(start float64) ([]hvSegment, error) {
+	if p.MaxRate < 0 {
+		return nil, fmt.Errorf("max_rate must be positive")
+	}
+	var segs []hvSegment
+	cur := start
+	if err := p.expand(p.Steps, &cur, &segs, 0, "steps"); err != nil {
+		return nil, err
+	}
+	return segs, nil
+}
+
+func (p *HvProgram) expand(steps []HvStep, cur *float64, segs *[]hvSegment, depth int, path string) error {
+	add := func(s hvSegment) error {
+		if len(*segs) >= hvMaxSegments {
+			return fmt.Errorf("schedule too long (more than %d segments)", hvMaxSegments)
+		}
+		*segs = append(*segs, s)
+		return nil
+	}
+
+	for i, st := range steps {
+		where := fmt.Sprintf("%s[%d] (%s)", path, i, st.Type)
+		target := func() (float64, error) {
+			if st.Voltage == nil {
+				return 0, fmt.Errorf("%s: voltage is required", where)
+			}
+			v := *st.Voltage
+			if math.IsNaN(v) || math.Abs(v) > hvMaxVoltage {
+				return 0, fmt.Errorf("%s: voltage %.1f V outside ±%.0f V", where, v, hvMaxVoltage)
+			}
+			return v, nil
+		}
+
+		switch st.Type {
+		case HvStepSet:
+			v, err := target()
+			if err != nil {
+				return err
+			}
+			var d float64
+			if p.MaxRate > 0 {
+				d = math.Abs(v-*cur) / p.MaxRate
+			}
+			if err := add(hvSegment{from: *cur, to: v, duration: d}); err != nil {
+				return err
+			}
+			*cur = v
+
+		case HvStepRamp:
+			v, err := target()
+			if err != nil {
+				return err
+			}
+			var d float64
+			switch {
+			case st.Rate > 0 && st.DurationSec > 0:
+				return fmt.Errorf("%s: give either rate or duration_sec, not both", where)
+			case st.Rate > 0:
+				if p.MaxRate > 0 && st.Rate > p.MaxRate {
+					return fmt.Errorf("%s: rate %.3g V/s exceeds max_rate %.3g V/s", where, st.Rate, p.MaxRate)
+				}
+				d = math.Abs(v-*cur) / st.Rate
+			case st.DurationSec > 0:
+				d = st.DurationSec
+				if rate := math.Abs(v-*cur) / d; p.MaxRate > 0 && rate > p.MaxRate*1.000001 {
+					return fmt.Errorf("%s: %.1f V in %.3g s is %.3g V/s, exceeds max_rate %.3g V/s",
+						where, math.Abs(v-*cur), d, rate, p.MaxRate)
+				}
+			default:
+				return fmt.Errorf("%s: rate or duration_sec is required", where)
+			}
+			if err := add(hvSegment{from: *cur, to: v, duration: d}); err != nil {
+				return err
+			}
+			*cur = v
+
+		case HvStepHold:
+			if st.DurationSec <= 0 {
+				return fmt.Errorf("%s: duration_sec must be positive", where)
+			}
+			if err := add(hvSegment{from: *cur, to: *cur, duration: st.DurationSec}); err != nil {
+				return err
+			}
+
+		case HvStepHoldUntil:
+			if st.Until == nil {
+				return fmt.Errorf("%s: until is required", where)
+			}
+			if err := st.Until.validate(); err != nil {
+				return fmt.Errorf("%s: %w", where, err)
+			}
+			if st.TimeoutSec < 0 {
+				return fmt.Errorf("%s: timeout_sec must not be negative", where)
+			}
+			cond := *st.Until
+			if err := add(hvSegment{from: *cur, to: *cur, duration: st.TimeoutSec, until: &cond}); err != nil {
+				return err
+			}
+
+		case HvStepRepeat:
+			if st.Count < 1 || st.Count > hvMaxRepeat {
+				return fmt.Errorf("%s: count must be 1..%d", where, hvMaxRepeat)
+			}
+			if len(st.Steps) == 0 {
+				return fmt.Errorf("%s: steps are required", where)
+			}
+			if depth+1 >= hvMaxDepth {
+				return fmt.Errorf("%s: repeats nested deeper than %d", where, hvMaxDepth)
+			}
+			for n := 0; n < st.Count; n++ {
+				if err := p.expand(st.Steps, cur, segs, depth+1, where+".steps"); err != nil {
+					return err
+				}
+			}
+
+		default:
+			return fmt.Errorf("%s: unknown step type %q", where, st.Type)
+		}
+	}
+	return nil
+}
+
+func (c HvCondition) validate() error {
+	if _, ok := ResponseMetric(&Response{}, c.Metric); !ok {
+		return fmt.Errorf("unknown metric %q", c.Metric)
+	}
+	if !validOp(c.Op) {
+		return fmt.Errorf("unknown operator %q", c.Op)
+	}
+	return nil
+}
+
+// Met reports whether a reading satisfies the condition
+func (c HvCondition) Met(r *Response) bool {
+	v, ok := ResponseMetric(r, c.Metric)
+	return ok && compare(v, c.Op, c.Value)
+}
+
+func validOp(op string) bool {
+	switch op {
+	case ">", ">=", "<", "<=", "==", "!=":
+		return true
+	}
+	return false
+}
+
+func compare(v float64, op string, ref float64) bool {
+	switch op {
+	case ">":
+		return v > ref
+	case ">=":
+		return v >= ref
+	case "<":
+		return v < ref
+	case "<=":
+		return v <= ref
+	case "==":
+		return v == ref
+	case "!=":
+		return v != ref
+	}
+	return false
+}
+
+// ResponseMetric returns a named value of a reading
+func ResponseMetric(r *Response, metric string) (float64, bool) {
+	switch metric {
+	case "current":
+		return r.Current, true
+	case "abs_current":
+		return math.Abs(r.Current), true
+	case "voltage":
+		return r.Voltage, true
+	case "resistance":
+		return r.Resistance, true
+	case "charge":
+		return r.Charge, true
+	case "source":
+		return r.Source, true
+	case "temperature":
+		return r.Temperature, true
+	case "humidity":
+		return r.Humidity, true
+	case "math_value":
+		return r.MathValue, true
+	case "error_code":
+		return float64(r.ErrorCode), true
+	}
+	return 0, false
+}
+
+// HvProfilePoint is a breakpoint of a previewed voltage profile
+type HvProfilePoint struct {
+	TimeSec float64 `json:"time_sec"`
+	Voltage float64 `json:"voltage"`
+}
+
+// HvPreview is the computed voltage profile of a program
+type HvPreview struct {
+	Points            []HvProfilePoint `json:"points"`       // linear between breakpoints
+	DurationSec       float64          `json:"duration_sec"` // assuming conditional holds run to their timeout
+	MinVoltage        float64          `json:"min_voltage"`
+	MaxVoltage        float64          `json:"max_voltage"`
+	ConditionalHolds  int              `json:"conditional_holds"`
+	OpenEnded         bool             `json:"open_ended"` // a hold_until without timeout: the profile stops there
+	PolarityReversals int              `json:"polarity_reversals"`
+}
+
+// Preview computes the profile of the program starting at start volts
+func (p *HvProgram) Preview(start float64) (*HvPreview, error) {
+	segs, err := p.compile(start)
+	if err != nil {
+		return nil, err
+	}
+	pv := &HvPreview{
+		Points:     []HvProfilePoint{{TimeSec: 0, Voltage: start}},
+		MinVoltage: start,
+		MaxVoltage: start,
+	}
+	t := 0.0
+	sign := math.Copysign(1, start)
+	if start == 0 {
+		sign = 0
+	}
+	for _, s := range segs {
+		if s.until != nil {
+			pv.ConditionalHolds++
+			if s.duration == 0 {
+				pv.OpenEnded = true
+				break
+			}
+		}
+		t += s.duration
+		pv.Points = append(pv.Points, HvProfilePoint{TimeSec: t, Voltage: s.to})
+		pv.MinVoltage = math.Min(pv.MinVoltage, s.to)
+		pv.MaxVoltage = math.Max(pv.MaxVoltage, s.to)
+		if s.to != 0 {
+			if ns := math.Copysign(1, s.to); sign != 0 && ns != sign {
+				pv.PolarityReversals++
+			}
+			sign = math.Copysign(1, s.to)
+		}
+	}
+	pv.DurationSec = t
+	return pv, nil
+}
+
+// hvExecutor runs a compiled program against the run clock. After a backend restart it
+// replays from zero without readings, so conditional holds already passed count as timed
+// out (or wait again for the live condition when they have no timeout).
+type hvExecutor struct {
+	segs     []hvSegment
+	start    float64
+	i        int
+	segStart float64 // elapsed seconds when segment i began
+}
+
+func newHvExecutor(p *HvProgram, start float64) (*hvExecutor, error) {
+	segs, err := p.compile(start)
+	if err != nil {
+		return nil, err
+	}
+	return &hvExecutor{segs: segs, start: start}, nil
+}
+
+// segment returns the index of the running segment; it equals segments() once the program ended
+func (e *hvExecutor) segment() int { return e.i }
+
+// segments returns the number of compiled segments
+func (e *hvExecutor) segments() int { return len(e.segs) }
+
+// target returns the setpoint at elapsed seconds; last is the latest reading (may be nil)
+func (e *hvExecutor) target(elapsed float64, last *Response) float64 {
+	for e.i < len(e.segs) {
+		s := &e.segs[e.i]
+		local := elapsed - e.segStart
+		if s.until != nil {
+			if last != nil && s.until.Met(last) {
+				e.segStart = elapsed
+				e.i++
+				continue
+			}
+			if s.duration > 0 && local >= s.duration {
+				e.segStart += s.duration
+				e.i++
+				continue
+			}
+			return s.from
+		}
+		if local >= s.duration {
+			e.segStart += s.duration
+			e.i++
+			continue
+		}
+		return s.from + (s.to-s.from)*local/s.duration
+	}
+	if len(e.segs) == 0 {
+		return e.start
+	}
+	return e.segs[len(e.segs)-1].to
+}
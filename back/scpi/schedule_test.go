@@ -0,0 +1,224 @@
+package scpi
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"back/models"
+)
+
+func volts(v float64) *float64 { return &v }
+
+func TestParseHvSchedule(t *testing.T) {
+	got, err := ParseHvSchedule(`{
+		"1": {"max_rate": 50, "steps": [{"type": "ramp", "voltage": 100, "rate": 10}]},
+		"2": [{"time_sec": 0, "voltage": 10}, {"time_sec": 5, "voltage": 60}, {"time_sec": 5, "voltage": 0}],
+		"3": {"steps": []}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[1].MaxRate != 50 || len(got[1].Steps) != 1 {
+		t.Fatalf("programs %+v", got)
+	}
+	// legacy points: set the first voltage, ramp over the gap, step on a shared time
+	steps := got[2].Steps
+	if len(steps) != 3 || steps[0].Type != HvStepSet || *steps[0].Voltage != 10 ||
+		steps[1].Type != HvStepRamp || steps[1].DurationSec != 5 || *steps[1].Voltage != 60 ||
+		steps[2].Type != HvStepSet || *steps[2].Voltage != 0 {
+		t.Fatalf("converted points %+v", steps)
+	}
+
+	for _, raw := range []string{`{"x": {"steps": []}}`, `{"1": 5}`, `[`} {
+		if _, err := ParseHvSchedule(raw); err == nil {
+			t.Errorf("ParseHvSchedule(%s) accepted", raw)
+		}
+	}
+	if got, err := ParseHvSchedule(""); err != nil || len(got) != 0 {
+		t.Fatalf("empty schedule: %v, %v", got, err)
+	}
+}
+
+func TestProgramFromPointsDelayedStart(t *testing.T) {
+	p := ProgramFromPoints([]HvPoint{{TimeSec: 10, Voltage: 200}, {TimeSec: 3, Voltage: 50}})
+	pv, err := p.Preview(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 50 V at once, held until t=3, then ramped to 200 V by t=10
+	want := []HvProfilePoint{{0, 0}, {0, 50}, {3, 50}, {10, 200}}
+	if len(pv.Points) != len(want) {
+		t.Fatalf("points %+v", pv.Points)
+	}
+	for i := range want {
+		if pv.Points[i] != want[i] {
+			t.Fatalf("points %+v, want %+v", pv.Points, want)
+		}
+	}
+}
+
+func TestHvProgramValidate(t *testing.T) {
+	until := &HvCondition{Metric: "abs_current", Op: "<", Value: 1e-12}
+	tests := []struct {
+		name string
+		prog HvProgram
+		err  string // "" = valid
+	}{
+		{"ramp by rate", HvProgram{Steps: []HvStep{{Type: HvStepRamp, Voltage: volts(100), Rate: 10}}}, ""},
+		{"hold until with timeout", HvProgram{Steps: []HvStep{{Type: HvStepHoldUntil, Until: until, TimeoutSec: 60}}}, ""},
+		{"missing voltage", HvProgram{Steps: []HvStep{{Type: HvStepSet}}}, "voltage is required"},
+		{"over limit", HvProgram{Steps: []HvStep{{Type: HvStepSet, Voltage: volts(1500)}}}, "outside"},
+		{"rate and duration", HvProgram{Steps: []HvStep{{Type: HvStepRamp, Voltage: volts(10), Rate: 1, DurationSec: 1}}}, "not both"},
+		{"ramp without rate", HvProgram{Steps: []HvStep{{Type: HvStepRamp, Voltage: volts(10)}}}, "required"},
+		{"rate over max_rate", HvProgram{MaxRate: 5, Steps: []HvStep{{Type: HvStepRamp, Voltage: volts(10), Rate: 10}}}, "exceeds max_rate"},
+		{"duration over max_rate", HvProgram{MaxRate: 5, Steps: []HvStep{{Type: HvStepRamp, Voltage: volts(100), DurationSec: 1}}}, "exceeds max_rate"},
+		{"zero hold", HvProgram{Steps: []HvStep{{Type: HvStepHold}}}, "duration_sec must be positive"},
+		{"bad metric", HvProgram{Steps: []HvStep{{Type: HvStepHoldUntil, Until: &HvCondition{Metric: "x", Op: "<"}}}}, "unknown metric"},
+		{"bad op", HvProgram{Steps: []HvStep{{Type: HvStepHoldUntil, Until: &HvCondition{Metric: "current", Op: "~"}}}}, "unknown operator"},
+		{"empty repeat", HvProgram{Steps: []HvStep{{Type: HvStepRepeat, Count: 2}}}, "steps are required"},
+		{"repeat count", HvProgram{Steps: []HvStep{{Type: HvStepRepeat, Count: 0, Steps: []HvStep{{Type: HvStepHold, DurationSec: 1}}}}}, "count must be"},
+		{"unknown type", HvProgram{Steps: []HvStep{{Type: "wiggle"}}}, "unknown step type"},
+		{"error path", HvProgram{Steps: []HvStep{{Type: HvStepRepeat, Count: 2, Steps: []HvStep{{Type: HvStepHold, DurationSec: 1}, {Type: HvStepSet}}}}}, "steps[0] (repeat).steps[1] (step)"},
+	}
+	for _, tt := range tests {
+		err := tt.prog.Validate(0)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+
+	nested := HvStep{Type: HvStepHold, DurationSec: 1}
+	for i := 0; i < hvMaxDepth; i++ {
+		nested = HvStep{Type: HvStepRepeat, Count: 1, Steps: []HvStep{nested}}
+	}
+	if err := (&HvProgram{Steps: []HvStep{nested}}).Validate(0); err == nil || !strings.Contains(err.Error(), "nested") {
+		t.Errorf("deep nesting: %v", err)
+	}
+	huge := HvProgram{Steps: []HvStep{{Type: HvStepRepeat, Count: hvMaxRepeat, Steps: []HvStep{{Type: HvStepRepeat, Count: 20,
+		Steps: []HvStep{{Type: HvStepHold, DurationSec: 1}}}}}}}
+	if err := huge.Validate(0); err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Errorf("segment limit: %v", err)
+	}
+}
+
+func TestHvProgramPreview(t *testing.T) {
+	var p HvProgram
+	err := json.Unmarshal([]byte(`{"max_rate": 50, "steps": [
+		{"type": "repeat", "count": 3, "steps": [
+			{"type": "ramp", "voltage": 500, "rate": 20},
+			{"type": "ramp", "voltage": -500, "rate": 20}]},
+		{"type": "step", "voltage": 0},
+		{"type": "hold_until", "until": {"metric": "abs_current", "op": "<", "value": 1e-12}, "timeout_sec": 600}]}`), &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pv, err := p.Preview(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 25 s to +500, then 5 × 50 s swings, 10 s back to 0 at max_rate, 600 s timeout
+	if pv.DurationSec != 25+5*50+10+600 {
+		t.Fatalf("duration %g", pv.DurationSec)
+	}
+	if pv.MinVoltage != -500 || pv.MaxVoltage != 500 || pv.PolarityReversals != 5 ||
+		pv.ConditionalHolds != 1 || pv.OpenEnded {
+		t.Fatalf("preview %+v", pv)
+	}
+
+	open := HvProgram{Steps: []HvStep{
+		{Type: HvStepSet, Voltage: volts(100)},
+		{Type: HvStepHoldUntil, Until: &HvCondition{Metric: "current", Op: ">", Value: 1e-9}},
+		{Type: HvStepSet, Voltage: volts(0)},
+	}}
+	if pv, err := open.Preview(0); err != nil || !pv.OpenEnded || pv.DurationSec != 0 || len(pv.Points) != 2 {
+		t.Fatalf("open-ended preview %+v, %v", pv, err)
+	}
+}
+
+func TestHvExecutor(t *testing.T) {
+	p := &HvProgram{Steps: []HvStep{
+		{Type: HvStepRamp, Voltage: volts(100), DurationSec: 10},
+		{Type: HvStepHold, DurationSec: 5},
+		{Type: HvStepHoldUntil, Until: &HvCondition{Metric: "abs_current", Op: "<", Value: 1e-12}, TimeoutSec: 100},
+		{Type: HvStepSet, Voltage: volts(-50)},
+	}}
+	e, err := newHvExecutor(p, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	high := &Response{Current: -5e-12}
+	low := &Response{Current: 5e-13}
+	for _, step := range []struct {
+		elapsed float64
+		last    *Response
+		want    float64
+	}{
+		{0, nil, 20},
+		{5, nil, 60},
+		{12, nil, 100},
+		{16, high, 100}, // condition not met: still holding
+		{40, high, 100},
+		{41, low, -50},   // met: the step to -50 V follows at once
+		{1000, nil, -50}, // past the end the last voltage stays
+	} {
+		if got := e.target(step.elapsed, step.last); math.Abs(got-step.want) > 1e-9 {
+			t.Fatalf("target(%g) = %g, want %g", step.elapsed, got, step.want)
+		}
+	}
+
+	// a conditional hold gives up at its timeout
+	e, _ = newHvExecutor(p, 0)
+	if got := e.target(14.9+100, high); got != 100 {
+		t.Fatalf("before timeout: %g", got)
+	}
+	if got := e.target(15+100+0.1, high); got != -50 {
+		t.Fatalf("after timeout: %g", got)
+	}
+
+	empty, _ := newHvExecutor(&HvProgram{}, 30)
+	if got := empty.target(5, nil); got != 30 {
+		t.Fatalf("empty program target %g", got)
+	}
+}
+
+// TestRunnerFollowsHvProgram: the poller drives the source setpoint along the program
+func TestRunnerFollowsHvProgram(t *testing.T) {
+	_, inst := liveSim(t, 9431)
+	setpoint := func() float64 {
+		resp, err := DefaultSessions.Get(inst).Query(PriorityUI, "SRC:VALUE?", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := strconv.ParseFloat(resp, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	DefaultRunner.Resume(9431, []models.Instrument{inst}, RunPlan{
+		InstrumentIDs:   []uint{inst.ID},
+		PollIntervalsMs: map[uint]int64{inst.ID: 50},
+		HvSchedule: map[uint]*HvProgram{inst.ID: {Steps: []HvStep{
+			{Type: HvStepRamp, Voltage: volts(100), DurationSec: 1},
+			{Type: HvStepHold, DurationSec: 60},
+		}}},
+		StartedAt: time.Now(),
+	})
+	defer DefaultRunner.Stop(9431)
+
+	time.Sleep(500 * time.Millisecond)
+	if v := setpoint(); v < 20 || v > 80 {
+		t.Fatalf("setpoint %g V half way through a 1 s ramp to 100 V", v)
+	}
+	time.Sleep(800 * time.Millisecond)
+	if v := setpoint(); v != 100 {
+		t.Fatalf("setpoint %g V after the ramp", v)
+	}
+}
@@ -0,0 +1,277 @@
+package scpi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"back/database"
+	"back/events"
+	"back/models"
+)
+
+// maxSequenceSteps bounds the steps one sequence runs, repeats included
+const maxSequenceSteps = 10000
+
+// Sequence runs an experiment as consecutive steps, each with its own settings, HV
+// programs, duration and exit condition, all recorded under the same experiment.
+//
+//	zero correct, 60 s at 0 V -> ramp to 500 V -> RES for 10 min -> reverse polarity -> repeat
+type Sequence struct {
+	Steps  []SequenceStep `json:"steps"`
+	Repeat int            `json:"repeat,omitempty"` // times the steps run (0 = once)
+}
+
+// SequenceStep is one stage of a sequence. An instrument without settings in a step keeps
+// the ones it has; its program starts from the voltage on the output when the step begins.
+type SequenceStep struct {
+	Name        string                      `json:"name"`
+	Settings    map[uint]InstrumentSettings `json:"settings,omitempty"`    // key = instrument ID; function may change
+	HvSchedule  map[uint]*HvProgram         `json:"hv_schedule,omitempty"` // key = instrument ID; timed from the start of the step
+	DurationSec float64                     `json:"duration_sec"`          // 0 = until the exit condition
+	Until       *StepCondition              `json:"until,omitempty"`       // ends the step early
+}
+
+// StepCondition ends a step once a reading of the instrument meets it
+type StepCondition struct {
+	InstrumentID uint `json:"instrument_id"`
+	HvCondition
+}
+
+// Len is the number of steps the sequence runs, repeats included
+func (q *Sequence) Len() int {
+	if q.Repeat > 1 {
+		return q.Repeat * len(q.Steps)
+	}
+	return len(q.Steps)
+}
+
+// Step returns the step run at position i and the repetition it belongs to
+func (q *Sequence) Step(i int) (*SequenceStep, int) {
+	return &q.Steps[i%len(q.Steps)], i / len(q.Steps)
+}
+
+// Apply returns the settings in effect during the step at position i, given the ones
+// in effect before it
+func (q *Sequence) Apply(i int, settings map[uint]InstrumentSettings) map[uint]InstrumentSettings {
+	step, _ := q.Step(i)
+	out := make(map[uint]InstrumentSettings, len(settings))
+	for id, s := range settings {
+		out[id] = s
+	}
+	for id, s := range step.Settings {
+		out[id] = s
+	}
+	return out
+}
+
+// Validate checks every step against the instruments of the experiment; settings are
+// the ones the experiment is started with, before the first step applies its own
+func (q *Sequence) Validate(settings map[uint]InstrumentSettings) error {
+	if len(q.Steps) == 0 {
+		return fmt.Errorf("sequence: no steps")
+	}
+	if q.Repeat < 0 {
+		return fmt.Errorf("sequence: repeat must not be negative")
+	}
+	if q.Len() > maxSequenceSteps {
+		return fmt.Errorf("sequence: more than %d steps", maxSequenceSteps)
+	}
+	for i := range q.Steps {
+		step := &q.Steps[i]
+		path := fmt.Sprintf("sequence.steps[%d]", i)
+		if step.DurationSec < 0 {
+			return fmt.Errorf("%s: duration_sec must not be negative", path)
+		}
+		if step.DurationSec == 0 && step.Until == nil {
+			return fmt.Errorf("%s: needs duration_sec or until", path)
+		}
+		for id := range step.Settings {
+			if _, ok := settings[id]; !ok {
+				return fmt.Errorf("%s.settings: instrument %d is not part of the experiment", path, id)
+			}
+		}
+		settings = q.Apply(i, settings)
+		if c := step.Until; c != nil {
+			if _, ok := settings[c.InstrumentID]; !ok {
+				return fmt.Errorf("%s.until: instrument %d is not part of the experiment", path, c.InstrumentID)
+			}
+			if err := c.validate(); err != nil {
+				return fmt.Errorf("%s.until: %v", path, err)
+			}
+		}
+		for id, prog := range step.HvSchedule {
+			s, ok := settings[id]
+			if !ok {
+				return fmt.Errorf("%s.hv_schedule: instrument %d is not part of the experiment", path, id)
+			}
+			if prog == nil {
+				continue
+			}
+			if err := prog.Validate(sourceVoltage(s)); err != nil {
+				return fmt.Errorf("%s.hv_schedule[%d]: %v", path, id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// sourceVoltage is the source voltage settings leave an instrument at
+func sourceVoltage(s InstrumentSettings) float64 {
+	if s.SourceOn {
+		return s.SourceVolt
+	}
+	return 0
+}
+
+// startSequence puts the first step into a new plan; its settings were applied by the caller
+func (p *RunPlan) startSequence(q *Sequence) {
+	p.Sequence = q
+	p.Step = 0
+	p.StepStartedSec = 0
+	step, _ := q.Step(0)
+	p.HvSchedule = make(map[uint]*HvProgram, len(step.HvSchedule))
+	for id, prog := range step.HvSchedule {
+		if prog != nil {
+			p.HvSchedule[id] = prog
+		}
+	}
+}
+
+// stepTimer fires when the running step has lasted its duration (nil without one)
+func (p *RunPlan) stepTimer() <-chan time.Time {
+	if p.Sequence == nil {
+		return nil
+	}
+	step, _ := p.Sequence.Step(p.Step)
+	if step.DurationSec <= 0 {
+		return nil
+	}
+	end := p.ClockStart().Add(time.Duration((p.StepStartedSec + step.DurationSec) * float64(time.Second)))
+	return time.After(time.Until(end))
+}
+
+// stepCondition is the exit condition of the running step that concerns an instrument
+func (p *RunPlan) stepCondition(instrumentID uint) *HvCondition {
+	if p.Sequence == nil {
+		return nil
+	}
+	step, _ := p.Sequence.Step(p.Step)
+	if step.Until == nil || step.Until.InstrumentID != instrumentID {
+		return nil
+	}
+	return &step.Until.HvCondition
+}
+
+// advance ends the running step and starts the next one. Returns false once the
+// sequence has finished, or with the error that keeps the next step from starting.
+func (r *Runner) advance(experimentID uint, plan *RunPlan, states []instState, reason string) (bool, error) {
+	now := time.Now()
+	endStep(experimentID, plan.Step, now, reason)
+	next := plan.Step + 1
+	if next >= plan.Sequence.Len() {
+		log.Printf("[SCPI] exp=%d sequence finished after %d steps", experimentID, next)
+		return false, nil
+	}
+
+	step, rep := plan.Sequence.Step(next)
+	settings := plan.Sequence.Apply(next, plan.Settings)
+	parts := make(map[int]*instAmendment, len(states))
+	for i := range states {
+		id := states[i].inst.ID
+		p := &instAmendment{setHV: true, step: true, position: next, result: make(chan error, 1), commit: make(chan bool, 1), applied: make(chan struct{})}
+		if s, ok := step.Settings[id]; ok {
+			p.settings = &s
+		}
+		if prog := step.HvSchedule[id]; prog != nil {
+			if _, err := newHvExecutor(prog, sourceVoltage(settings[id])); err != nil {
+				return false, fmt.Errorf("step %d (%s): hv_schedule[%d]: %v", next+1, step.Name, id, err)
+			}
+			p.prog = prog
+		}
+		if step.Until != nil && step.Until.InstrumentID == id {
+			p.until = &step.Until.HvCondition
+		}
+		parts[i] = p
+	}
+	if err := dispatch(states, parts); err != nil {
+		return false, fmt.Errorf("step %d (%s): %w", next+1, step.Name, err)
+	}
+
+	plan.Step = next
+	plan.StepStartedSec = now.Sub(plan.ClockStart()).Seconds()
+	plan.Settings = settings
+	plan.HvSchedule = make(map[uint]*HvProgram, len(step.HvSchedule))
+	if plan.PollIntervalsMs == nil {
+		plan.PollIntervalsMs = make(map[uint]int64)
+	}
+	if plan.StartVolts == nil {
+		plan.StartVolts = make(map[uint]float64)
+	}
+	for id, s := range step.Settings {
+		plan.PollIntervalsMs[id] = s.PollingInterval().Milliseconds()
+		if s.SourceOn {
+			plan.StartVolts[id] = s.SourceVolt
+		} else {
+			delete(plan.StartVolts, id)
+		}
+	}
+	plan.HvStartedSec = make(map[uint]float64, len(step.HvSchedule))
+	for i, p := range parts {
+		if p.prog != nil {
+			plan.HvSchedule[states[i].inst.ID] = p.prog
+			plan.startProgram(states[i].inst.ID, p)
+		}
+	}
+
+	// The stored plan restarts the right step after a pause or a restart
+	if b, err := json.Marshal(plan); err == nil {
+		if err := database.DB.Model(&models.Experiment{}).Where("id = ?", experimentID).
+			Update("run_plan_json", string(b)).Error; err != nil {
+			log.Printf("[SCPI] exp=%d saving run plan at step %d failed: %v", experimentID, next+1, err)
+		}
+	}
+	beginStep(experimentID, plan, now)
+	log.Printf("[SCPI] exp=%d step %d/%d (%s, repetition %d)", experimentID, next+1, plan.Sequence.Len(), step.Name, rep+1)
+	return true, nil
+}
+
+// beginStep records the start of the running step of a plan
+func beginStep(experimentID uint, plan *RunPlan, at time.Time) {
+	step, rep := plan.Sequence.Step(plan.Step)
+	settingsJSON, _ := json.Marshal(plan.Settings)
+	row := models.ExperimentStep{
+		ExperimentID: experimentID,
+		Position:     plan.Step,
+		StepIndex:    plan.Step % len(plan.Sequence.Steps),
+		Iteration:    rep,
+		Name:         step.Name,
+		SettingsJSON: string(settingsJSON),
+		StartedAt:    at,
+	}
+	if err := database.DB.Create(&row).Error; err != nil {
+		log.Printf("[SCPI] exp=%d saving step %d failed: %v", experimentID, plan.Step+1, err)
+	}
+	events.Record(experimentID, 0, events.SequenceStep,
+		fmt.Sprintf("step %d of %d: %s", plan.Step+1, plan.Sequence.Len(), step.Name),
+		map[string]interface{}{"position": plan.Step, "step": row.StepIndex, "iteration": rep, "elapsed_sec": at.Sub(plan.ClockStart()).Seconds()})
+}
+
+// endStep records why the step at position ended
+func endStep(experimentID uint, position int, at time.Time, reason string) {
+	database.DB.Model(&models.ExperimentStep{}).
+		Where("experiment_id = ? AND position = ? AND ended_at IS NULL", experimentID, position).
+		Updates(map[string]interface{}{"ended_at": at, "end_reason": reason})
+}
+
+// CloseSteps ends the running step of experiments that stopped for a reason outside
+// the sequence (stop, failure, emergency stop)
+func CloseSteps(experimentIDs []uint, at time.Time, reason string) error {
+	if len(experimentIDs) == 0 {
+		return nil
+	}
+	return database.DB.Model(&models.ExperimentStep{}).
+		Where("experiment_id IN ? AND ended_at IS NULL", experimentIDs).
+		Updates(map[string]interface{}{"ended_at": at, "end_reason": reason}).Error
+}
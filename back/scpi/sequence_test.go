@@ -0,0 +1,158 @@
+package scpi
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"back/models"
+	"back/simulator"
+)
+
+func TestSequenceSteps(t *testing.T) {
+	a := DefaultSettings()
+	b := a
+	b.Function = "RES"
+	q := &Sequence{Steps: []SequenceStep{
+		{Name: "zero", DurationSec: 60},
+		{Name: "res", Settings: map[uint]InstrumentSettings{1: b}, DurationSec: 600},
+	}, Repeat: 3}
+	if q.Len() != 6 {
+		t.Fatalf("Len = %d", q.Len())
+	}
+	if step, rep := q.Step(3); step.Name != "res" || rep != 1 {
+		t.Fatalf("Step(3) = %s, repetition %d", step.Name, rep)
+	}
+	before := map[uint]InstrumentSettings{1: a, 2: a}
+	after := q.Apply(1, before)
+	if after[1].Function != "RES" || after[2] != a || before[1] != a {
+		t.Fatalf("Apply: %+v (before %+v)", after, before)
+	}
+}
+
+func TestSequenceValidate(t *testing.T) {
+	s := DefaultSettings()
+	settings := map[uint]InstrumentSettings{1: s}
+	v := 100.0
+	for _, tt := range []struct {
+		seq  Sequence
+		want string // "" = valid
+	}{
+		{Sequence{Steps: []SequenceStep{{DurationSec: 10}}}, ""},
+		{Sequence{Steps: []SequenceStep{{Until: &StepCondition{InstrumentID: 1, HvCondition: HvCondition{Metric: "current", Op: ">", Value: 1e-9}}}}}, ""},
+		{Sequence{}, "no steps"},
+		{Sequence{Steps: []SequenceStep{{DurationSec: 10}}, Repeat: -1}, "repeat"},
+		{Sequence{Steps: []SequenceStep{{DurationSec: 1}}, Repeat: maxSequenceSteps + 1}, "more than"},
+		{Sequence{Steps: []SequenceStep{{}}}, "needs duration_sec or until"},
+		{Sequence{Steps: []SequenceStep{{DurationSec: -1}}}, "negative"},
+		{Sequence{Steps: []SequenceStep{{DurationSec: 1, Settings: map[uint]InstrumentSettings{2: s}}}}, "steps[0].settings: instrument 2"},
+		{Sequence{Steps: []SequenceStep{{Until: &StepCondition{InstrumentID: 2, HvCondition: HvCondition{Metric: "current", Op: ">"}}}}}, "steps[0].until: instrument 2"},
+		{Sequence{Steps: []SequenceStep{{DurationSec: 1}, {DurationSec: 1,
+			HvSchedule: map[uint]*HvProgram{1: {Steps: []HvStep{{Type: HvStepRamp, Voltage: &v}}}}}}}, "steps[1].hv_schedule[1]"},
+	} {
+		err := tt.seq.Validate(settings)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%+v: %v", tt.seq, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%+v: error %v, want %q", tt.seq, err, tt.want)
+		}
+	}
+}
+
+func TestRunnerRunsSequence(t *testing.T) {
+	sim, inst := liveSim(t, 9541)
+	s := DefaultSettings()
+	s.Frequency = 10
+	s.SourceOn = true
+	v := 50.0
+	seq := &Sequence{Steps: []SequenceStep{
+		{Name: "hold", DurationSec: 0.3},
+		{Name: "step", HvSchedule: map[uint]*HvProgram{inst.ID: {Steps: []HvStep{{Type: HvStepSet, Voltage: &v}}}}, DurationSec: 0.3},
+	}, Repeat: 2}
+	if err := seq.Validate(map[uint]InstrumentSettings{inst.ID: s}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	start := now
+	DefaultRunner.Start(&models.Experiment{ID: 9541, StartTime: &now}, []models.Instrument{inst},
+		map[uint]InstrumentSettings{inst.ID: s}, RunOptions{Sequence: seq})
+	time.Sleep(450 * time.Millisecond)
+	resp, err := DefaultSessions.Get(inst).Query(PriorityUI, "SRC:VALUE?", time.Second)
+	if v, _ := strconv.ParseFloat(resp, 64); err != nil || v != 50 {
+		t.Errorf("setpoint in the second step = %q (%v), want 50", resp, err)
+	}
+	for DefaultRunner.IsRunning(9541) {
+		if time.Since(start) > 5*time.Second {
+			DefaultRunner.Stop(9541)
+			t.Fatal("run did not end with its sequence")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if d := time.Since(start); d < 1100*time.Millisecond {
+		t.Errorf("four steps of 0.3 s ended after %s", d)
+	}
+	waitSafe(t, sim)
+}
+
+func TestSequenceStepProgramContinuesFromSetpoint(t *testing.T) {
+	sim, inst := startSim(t, 9203, simulator.DefaultConfig())
+	s := DefaultSettings()
+	s.Frequency = 10
+	s.SourceOn = true
+	if err := ApplySettings(inst, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartInstrument(inst); err != nil {
+		t.Fatal(err)
+	}
+
+	// Step A ramps to 400 V; step B has settings saying 0 V and ramps down to 200 V
+	v400, v200 := 400.0, 200.0
+	seq := &Sequence{Steps: []SequenceStep{
+		{
+			Name:        "up",
+			HvSchedule:  map[uint]*HvProgram{inst.ID: {Steps: []HvStep{{Type: HvStepRamp, Voltage: &v400, Rate: 500}}}},
+			DurationSec: 1.2,
+		},
+		{
+			Name:        "down",
+			Settings:    map[uint]InstrumentSettings{inst.ID: s},
+			HvSchedule:  map[uint]*HvProgram{inst.ID: {Steps: []HvStep{{Type: HvStepRamp, Voltage: &v200, Rate: 200}}}},
+			DurationSec: 30,
+		},
+	}}
+	if err := seq.Validate(map[uint]InstrumentSettings{inst.ID: s}); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	samples := sampleSetpoints(sim, stop)
+	now := time.Now()
+	exp := &models.Experiment{ID: 9203, StartTime: &now}
+	r := newTestRunner()
+	r.Start(exp, []models.Instrument{inst}, map[uint]InstrumentSettings{inst.ID: s}, RunOptions{Sequence: seq})
+	time.Sleep(3 * time.Second)
+	close(stop)
+	vs := <-samples
+	r.Stop(exp.ID)
+
+	peak, jump := 0.0, 0.0
+	for i := 1; i < len(vs); i++ {
+		peak = math.Max(peak, vs[i])
+		jump = math.Max(jump, math.Abs(vs[i]-vs[i-1]))
+	}
+	if peak != 400 {
+		t.Errorf("step A peaked at %g V, want 400", peak)
+	}
+	// One poll moves the setpoint by at most 50 V at these rates
+	if jump > 60 {
+		t.Errorf("setpoint jumped by %g V between two samples", jump)
+	}
+	if last := vs[len(vs)-1]; last != 200 {
+		t.Errorf("setpoint at the end of step B = %g, want 200", last)
+	}
+}
@@ -0,0 +1,383 @@
+package scpi
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"back/models"
+)
+
+// Priority orders queued work on an instrument session
+type Priority int
+
+const (
+	PrioritySafety Priority = iota // HV off / emergency stop
+	PriorityPoll                   // measurement polling
+	PriorityUI                     // settings, pings, manual commands
+	numPriorities
+)
+
+const (
+	sessionQueueSize  = 64
+	sessionMaxWait    = 10 * time.Second // UI/poll jobs older than this are dropped
+	sessionBackoffMin = 250 * time.Millisecond
+	sessionBackoffMax = 10 * time.Second
+)
+
+var (
+	ErrSessionClosed = errors.New("instrument session closed")
+	ErrSessionBusy   = errors.New("instrument session queue full")
+)
+
+// SessionStats describes health and latency of an instrument session
+type SessionStats struct {
+	InstrumentID      uint        `json:"instrument_id"`
+	Address           string      `json:"address"`
+	Connected         bool        `json:"connected"`
+	Commands          uint64      `json:"commands"`
+	Errors            uint64      `json:"errors"`
+	Reconnects        uint64      `json:"reconnects"`
+	ConsecutiveErrors int         `json:"consecutive_errors"`
+	LastError         string      `json:"last_error,omitempty"`
+	LastErrorAt       *time.Time  `json:"last_error_at,omitempty"`
+	LastOKAt          *time.Time  `json:"last_ok_at,omitempty"`
+	LastLatencyMs     float64     `json:"last_latency_ms"`
+	AvgLatencyMs      float64     `json:"avg_latency_ms"`
+	MaxLatencyMs      float64     `json:"max_latency_ms"`
+	QueueDepth        [3]int      `json:"queue_depth"` // safety, poll, ui
+	RetryAt           *time.Time  `json:"retry_at,omitempty"`
+	Clock             *ClockStats `json:"clock,omitempty"` // device clock estimate, once readings carry timestamps
+}
+
+type sessionJob struct {
+	prio     Priority
+	fn       func(c Conn) error
+	done     chan error
+	enqueued time.Time
+}
+
+// Session owns the single connection to an instrument.
+// All callers are serialized through priority queues processed by one worker goroutine,
+// so replies can never interleave between callers.
+type Session struct {
+	instID uint
+	host   string
+	port   int
+	inst   models.Instrument // latest record, for the voltage interlock and emergency stop (guarded by mu)
+	// framing of the driver the latest record selects (guarded by mu); it changes once
+	// *IDN? has filled in the model, and the worker reconnects with it
+	framing Framing
+
+	queues [numPriorities]chan *sessionJob
+	quit   chan struct{}
+	exited chan struct{}
+	once   sync.Once
+
+	// owned by the worker goroutine
+	pc       *persistentConn
+	backoff  time.Duration
+	nextDial time.Time
+
+	clock *ClockEstimator
+
+	mu    sync.Mutex
+	stats SessionStats
+}
+
+func newSession(inst models.Instrument) *Session {
+	s := &Session{
+		instID:  inst.ID,
+		host:    inst.Host,
+		port:    inst.Port,
+		inst:    inst,
+		framing: framingFor(DriverFor(inst)),
+		quit:    make(chan struct{}),
+		exited:  make(chan struct{}),
+		clock:   NewClockEstimator(),
+	}
+	s.pc = newPersistentConn(inst.Host, inst.Port, s.framing)
+	for i := range s.queues {
+		s.queues[i] = make(chan *sessionJob, sessionQueueSize)
+	}
+	s.stats.InstrumentID = inst.ID
+	s.stats.Address = fmt.Sprintf("%s:%d", inst.Host, inst.Port)
+	go s.worker()
+	return s
+}
+
+// Exec runs fn with exclusive use of the instrument connection and waits for it to finish.
+// Commands sent by fn are never interleaved with other callers.
+func (s *Session) Exec(prio Priority, fn func(c Conn) error) error {
+	job := &sessionJob{prio: prio, fn: fn, done: make(chan error, 1), enqueued: time.Now()}
+	select {
+	case <-s.quit:
+		return ErrSessionClosed
+	default:
+	}
+	select {
+	case s.queues[prio] <- job:
+	default:
+		return ErrSessionBusy
+	}
+	select {
+	case err := <-job.done:
+		return err
+	case <-s.exited:
+		return ErrSessionClosed
+	}
+}
+
+// Query sends a single command and returns its reply
+func (s *Session) Query(prio Priority, cmd string, timeout time.Duration) (string, error) {
+	var resp string
+	err := s.Exec(prio, func(c Conn) error {
+		var err error
+		resp, err = c.Send(cmd, timeout)
+		return err
+	})
+	return resp, err
+}
+
+// Stats returns a snapshot of session health
+func (s *Session) Stats() SessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stats
+	for i := range s.queues {
+		st.QueueDepth[i] = len(s.queues[i])
+	}
+	if cs := s.clock.Stats(); cs.Samples > 0 {
+		st.Clock = &cs
+	}
+	return st
+}
+
+// Instrument returns the latest instrument record the session was obtained with
+func (s *Session) Instrument() models.Instrument {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inst
+}
+
+// setIdentity fills in what *IDN? reported on the session's record and takes the
+// framing of the driver the model selects
+func (s *Session) setIdentity(info *IDNInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inst.Model = info.Model
+	s.inst.Firmware = info.Firmware
+	s.inst.Serial = info.Serial
+	s.framing = framingFor(DriverFor(s.inst))
+}
+
+// Clock returns the device clock estimator of the instrument
+func (s *Session) Clock() *ClockEstimator {
+	return s.clock
+}
+
+// Close stops the worker and closes the connection. Queued jobs fail with ErrSessionClosed.
+func (s *Session) Close() {
+	s.once.Do(func() { close(s.quit) })
+	<-s.exited
+}
+
+func (s *Session) worker() {
+	defer close(s.exited)
+	defer s.pc.close()
+	for {
+		job := s.next()
+		if job == nil {
+			return
+		}
+		if job.prio != PrioritySafety && time.Since(job.enqueued) > sessionMaxWait {
+			job.done <- fmt.Errorf("instrument %s: waited %s in queue", s.stats.Address, sessionMaxWait)
+			continue
+		}
+		s.syncFraming()
+		job.done <- job.fn(&sessionConn{s: s, prio: job.prio})
+	}
+}
+
+// syncFraming drops a connection opened with another framing than the current driver's;
+// the next command reconnects with the new one
+func (s *Session) syncFraming() {
+	s.mu.Lock()
+	f := s.framing
+	s.mu.Unlock()
+	if s.pc.framing == f {
+		return
+	}
+	log.Printf("[SCPI] session %s: framing changed to write %q read %q", s.stats.Address, f.WriteTerm, f.ReadTerm)
+	s.pc.close()
+	s.pc.framing = f
+}
+
+// next returns the highest-priority queued job, blocking until one arrives. nil means quit.
+func (s *Session) next() *sessionJob {
+	for p := range s.queues {
+		select {
+		case job := <-s.queues[p]:
+			return job
+		default:
+		}
+	}
+	select {
+	case <-s.quit:
+		return nil
+	case job := <-s.queues[PrioritySafety]:
+		return job
+	case job := <-s.queues[PriorityPoll]:
+		return job
+	case job := <-s.queues[PriorityUI]:
+		return job
+	}
+}
+
+// ensureConn dials if needed, honoring reconnect backoff for everything but safety jobs
+func (s *Session) ensureConn(prio Priority) error {
+	if s.pc.conn != nil {
+		return nil
+	}
+	if prio != PrioritySafety && time.Now().Before(s.nextDial) {
+		return fmt.Errorf("connect %s: reconnecting, retry in %s", s.stats.Address, time.Until(s.nextDial).Round(time.Millisecond))
+	}
+	err := s.pc.connect()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		if s.backoff == 0 {
+			s.backoff = sessionBackoffMin
+		} else if s.backoff < sessionBackoffMax {
+			s.backoff *= 2
+			if s.backoff > sessionBackoffMax {
+				s.backoff = sessionBackoffMax
+			}
+		}
+		s.nextDial = time.Now().Add(s.backoff)
+		retry := s.nextDial
+		s.stats.RetryAt = &retry
+		return fmt.Errorf("connect %s: %w", s.stats.Address, err)
+	}
+	if s.stats.Commands > 0 || s.stats.Errors > 0 {
+		s.stats.Reconnects++
+		log.Printf("[SCPI] session %s reconnected (backoff was %s)", s.stats.Address, s.backoff)
+	}
+	s.backoff = 0
+	s.nextDial = time.Time{}
+	s.stats.RetryAt = nil
+	s.stats.Connected = true
+	return nil
+}
+
+func (s *Session) record(latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	ms := float64(latency.Microseconds()) / 1000
+	s.stats.Commands++
+	s.stats.LastLatencyMs = ms
+	if s.stats.AvgLatencyMs == 0 {
+		s.stats.AvgLatencyMs = ms
+	} else {
+		s.stats.AvgLatencyMs = 0.9*s.stats.AvgLatencyMs + 0.1*ms
+	}
+	if ms > s.stats.MaxLatencyMs {
+		s.stats.MaxLatencyMs = ms
+	}
+	if err != nil {
+		s.stats.Errors++
+		s.stats.ConsecutiveErrors++
+		s.stats.LastError = err.Error()
+		s.stats.LastErrorAt = &now
+	} else {
+		s.stats.ConsecutiveErrors = 0
+		s.stats.LastOKAt = &now
+	}
+	s.stats.Connected = s.pc.conn != nil
+}
+
+// sessionConn is the Conn handed to a job; it is only valid while the job runs
+type sessionConn struct {
+	s    *Session
+	prio Priority
+}
+
+func (sc *sessionConn) Send(cmd string, timeout time.Duration) (string, error) {
+	// The interlock sits here so no caller — driver, schedule or manual command — can bypass it
+	if err := checkCommand(sc.s.Instrument(), cmd); err != nil {
+		log.Printf("[SAFETY] %s refused %q: %v", sc.s.stats.Address, cmd, err)
+		return "", err
+	}
+	if err := sc.s.ensureConn(sc.prio); err != nil {
+		sc.s.record(0, err)
+		return "", err
+	}
+	start := time.Now()
+	resp, err := sc.s.pc.Send(cmd, timeout)
+	sc.s.record(time.Since(start), err)
+	return resp, err
+}
+
+// SessionManager keeps one Session per instrument
+type SessionManager struct {
+	mu       sync.Mutex
+	sessions map[uint]*Session
+}
+
+var DefaultSessions = &SessionManager{
+	sessions: make(map[uint]*Session),
+}
+
+// Get returns the session for an instrument, creating it (or replacing it if the address changed).
+// A newer record passed in replaces the session's instrument, so changed limits and a model
+// identified since apply at once.
+func (m *SessionManager) Get(inst models.Instrument) *Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[inst.ID]; ok {
+		if s.host == inst.Host && s.port == inst.Port {
+			s.mu.Lock()
+			if !inst.UpdatedAt.Before(s.inst.UpdatedAt) {
+				s.inst = inst
+				s.framing = framingFor(DriverFor(inst))
+			}
+			s.mu.Unlock()
+			return s
+		}
+		go s.Close()
+	}
+	s := newSession(inst)
+	m.sessions[inst.ID] = s
+	return s
+}
+
+// Open creates sessions for instruments so the emergency stop reaches them even when the
+// database is down. Sessions connect lazily, on their first command.
+func (m *SessionManager) Open(instruments []models.Instrument) {
+	for _, inst := range instruments {
+		m.Get(inst)
+	}
+}
+
+// Lookup returns an existing session without creating one
+func (m *SessionManager) Lookup(instrumentID uint) (*Session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[instrumentID]
+	return s, ok
+}
+
+// All returns every open session
+func (m *SessionManager) All() []*Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		out = append(out, s)
+	}
+	return out
+}
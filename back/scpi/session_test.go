@@ -0,0 +1,243 @@
+package scpi
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"back/models"
+	"back/simulator"
+)
+
+// freePort returns a local port with nothing listening on it
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	return port
+}
+
+// blockWorker occupies the session worker until the returned func is called
+func blockWorker(t *testing.T, s *Session) func() {
+	t.Helper()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go s.Exec(PriorityUI, func(c Conn) error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	return func() { close(release) }
+}
+
+func waitDepth(t *testing.T, s *Session, want [3]int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Stats().QueueDepth != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue depth %v, want %v", s.Stats().QueueDepth, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSessionPriorityOrder(t *testing.T) {
+	s := newSession(models.Instrument{ID: 9001, Host: "127.0.0.1", Port: freePort(t)})
+	defer s.Close()
+	release := blockWorker(t, s)
+
+	var mu sync.Mutex
+	var order []Priority
+	var wg sync.WaitGroup
+	queue := func(p Priority) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Exec(p, func(c Conn) error {
+				mu.Lock()
+				order = append(order, p)
+				mu.Unlock()
+				return nil
+			})
+		}()
+	}
+	// queued lowest first: the worker must still take safety, then poll, then UI
+	queue(PriorityUI)
+	waitDepth(t, s, [3]int{0, 0, 1})
+	queue(PriorityPoll)
+	waitDepth(t, s, [3]int{0, 1, 1})
+	queue(PrioritySafety)
+	waitDepth(t, s, [3]int{1, 1, 1})
+	release()
+	wg.Wait()
+
+	want := []Priority{PrioritySafety, PriorityPoll, PriorityUI}
+	if len(order) != len(want) {
+		t.Fatalf("ran %v", order)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("ran %v, want %v", order, want)
+		}
+	}
+}
+
+func TestSessionDropsStaleJobs(t *testing.T) {
+	s := newSession(models.Instrument{ID: 9002, Host: "127.0.0.1", Port: freePort(t)})
+	defer s.Close()
+
+	enqueue := func(p Priority) (*sessionJob, *bool) {
+		ran := new(bool)
+		job := &sessionJob{
+			prio:     p,
+			fn:       func(c Conn) error { *ran = true; return nil },
+			done:     make(chan error, 1),
+			enqueued: time.Now().Add(-sessionMaxWait - time.Second),
+		}
+		s.queues[p] <- job
+		return job, ran
+	}
+
+	for _, p := range []Priority{PriorityPoll, PriorityUI} {
+		job, ran := enqueue(p)
+		err := <-job.done
+		if err == nil || !strings.Contains(err.Error(), "waited") || *ran {
+			t.Fatalf("priority %d: stale job ran=%v err=%v", p, *ran, err)
+		}
+	}
+	// safety jobs run however long they waited
+	job, ran := enqueue(PrioritySafety)
+	if err := <-job.done; err != nil || !*ran {
+		t.Fatalf("stale safety job ran=%v err=%v", *ran, err)
+	}
+}
+
+func TestSessionQueueFull(t *testing.T) {
+	s := newSession(models.Instrument{ID: 9003, Host: "127.0.0.1", Port: freePort(t)})
+	defer s.Close()
+	release := blockWorker(t, s)
+	defer release()
+	for i := 0; i < sessionQueueSize; i++ {
+		go s.Exec(PriorityPoll, func(c Conn) error { return nil })
+	}
+	waitDepth(t, s, [3]int{0, sessionQueueSize, 0})
+	if err := s.Exec(PriorityPoll, func(c Conn) error { return nil }); !errors.Is(err, ErrSessionBusy) {
+		t.Fatalf("err = %v, want ErrSessionBusy", err)
+	}
+}
+
+func TestSessionReconnectBackoff(t *testing.T) {
+	port := freePort(t)
+	s := newSession(models.Instrument{ID: 9004, Host: "127.0.0.1", Port: port})
+	defer s.Close()
+	idn := func(p Priority) error {
+		_, err := s.Query(p, "*IDN?", time.Second)
+		return err
+	}
+
+	if err := idn(PriorityUI); err == nil || strings.Contains(err.Error(), "reconnecting") {
+		t.Fatalf("first attempt: %v, want a dial error", err)
+	}
+	st := s.Stats()
+	if st.Connected || st.RetryAt == nil {
+		t.Fatalf("after failed dial: connected=%v retry_at=%v", st.Connected, st.RetryAt)
+	}
+	if err := idn(PriorityUI); err == nil || !strings.Contains(err.Error(), "reconnecting") {
+		t.Fatalf("within backoff: %v, want the dial skipped", err)
+	}
+	// safety jobs dial regardless of backoff, and every failure doubles it
+	if err := idn(PrioritySafety); err == nil || strings.Contains(err.Error(), "reconnecting") {
+		t.Fatalf("safety within backoff: %v, want a dial error", err)
+	}
+	s.mu.Lock()
+	backoff := s.backoff
+	s.mu.Unlock()
+	if backoff != 2*sessionBackoffMin {
+		t.Fatalf("backoff %s after two failed dials, want %s", backoff, 2*sessionBackoffMin)
+	}
+
+	sim := simulator.New(simulator.DefaultConfig())
+	if err := sim.Listen(net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err != nil {
+		t.Skipf("port %d taken: %v", port, err)
+	}
+	defer sim.Close()
+	time.Sleep(time.Until(*s.Stats().RetryAt))
+	if err := idn(PriorityUI); err != nil {
+		t.Fatalf("after backoff: %v", err)
+	}
+	st = s.Stats()
+	if !st.Connected || st.RetryAt != nil || st.Reconnects != 1 || st.ConsecutiveErrors != 0 {
+		t.Fatalf("after reconnect: %+v", st)
+	}
+}
+
+// TestSessionFollowsIdentifiedFraming: once *IDN? has identified a Keithley, the session
+// reconnects and frames its commands with LF instead of the default CRLF
+func TestSessionFollowsIdentifiedFraming(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var mu sync.Mutex
+	var lines []string // raw lines received, prefixed with the connection number
+	go func() {
+		for n := 1; ; n++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(n int, conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 256)
+				var pending string
+				for {
+					k, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					pending += string(buf[:k])
+					for {
+						line, rest, ok := strings.Cut(pending, "\n")
+						if !ok {
+							break
+						}
+						pending = rest
+						mu.Lock()
+						lines = append(lines, strconv.Itoa(n)+":"+line)
+						mu.Unlock()
+						conn.Write([]byte("KEITHLEY INSTRUMENTS INC.,MODEL 6517B,1234567,A13\n"))
+					}
+				}
+			}(n, conn)
+		}
+	}()
+
+	inst := models.Instrument{ID: 9561, Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}
+	info, err := IdentifyInstrument(inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RecordIdentity(&inst, info) // the database is down in tests; the session still follows
+	if DriverFor(inst).Name() != "keithley6517" {
+		t.Fatalf("identified driver %s", DriverFor(inst).Name())
+	}
+	if _, err := DefaultSessions.Get(inst).Query(PriorityUI, "*IDN?", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(lines, "|"); got != "1:*IDN?\r|2:*IDN?" {
+		t.Fatalf("received %q, want CRLF before identification and LF on a new connection after", got)
+	}
+}
@@ -0,0 +1,86 @@
+package scpi
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"back/models"
+)
+
+// stateDriver is implemented by drivers that list the queries describing their full
+// configuration, for the snapshot taken when an experiment starts
+type stateDriver interface {
+	stateQueries() []string
+}
+
+// calibrationDriver is implemented by drivers that report their last calibration date
+type calibrationDriver interface {
+	CalibrationDate(c Conn) (string, error)
+}
+
+// Snapshot reads the identity and every readable setting of an instrument on one
+// connection. Parts that cannot be read are listed in the snapshot's Error; the returned
+// error is only set when the instrument could not be reached at all.
+func Snapshot(inst models.Instrument, requested InstrumentSettings) (*models.InstrumentSnapshot, error) {
+	drv := DriverFor(inst)
+	snap := &models.InstrumentSnapshot{
+		InstrumentID:   inst.ID,
+		InstrumentName: inst.Name,
+		Host:           inst.Host,
+		Port:           inst.Port,
+		Driver:         drv.Name(),
+	}
+	if b, err := json.Marshal(requested); err == nil {
+		snap.RequestedJSON = string(b)
+	}
+
+	var problems []string
+	err := withConn(inst, PriorityUI, func(c Conn) error {
+		idn, err := drv.Identify(c)
+		if err != nil {
+			return fmt.Errorf("identify: %w", err)
+		}
+		snap.IDN = idn.Raw
+		snap.Manufacturer = idn.Manufacturer
+		snap.Model = idn.Model
+		snap.Firmware = idn.Firmware
+		snap.Serial = idn.Serial
+
+		if s, err := drv.ReadSettings(c); err != nil {
+			problems = append(problems, "settings: "+err.Error())
+		} else if b, err := json.Marshal(s); err == nil {
+			snap.SettingsJSON = string(b)
+		}
+
+		if sd, ok := drv.(stateDriver); ok {
+			state := make(map[string]string)
+			for _, q := range sd.stateQueries() {
+				resp, err := c.Send(q, defaultTimeout)
+				if err != nil {
+					problems = append(problems, q+" "+err.Error())
+					continue
+				}
+				state[q] = resp
+			}
+			if b, err := json.Marshal(state); err == nil {
+				snap.StateJSON = string(b)
+			}
+		}
+
+		if cd, ok := drv.(calibrationDriver); ok {
+			if date, err := cd.CalibrationDate(c); err != nil {
+				problems = append(problems, "calibration date: "+err.Error())
+			} else {
+				snap.CalibrationDate = date
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		snap.Error = err.Error()
+		return snap, err
+	}
+	snap.Error = strings.Join(problems, "; ")
+	return snap, nil
+}
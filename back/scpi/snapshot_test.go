@@ -0,0 +1,49 @@
+package scpi
+
+import (
+	"encoding/json"
+	"testing"
+
+	"back/models"
+)
+
+func TestSnapshot(t *testing.T) {
+	_, inst := liveSim(t, 9501)
+	requested := InstrumentSettings{Function: "CURR", AutoRange: true, Frequency: 10, SourceVolt: 100}
+	snap, err := Snapshot(inst, requested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.InstrumentID != inst.ID || snap.Driver != "th2690" || snap.Model != "TH2690" || snap.IDN == "" {
+		t.Fatalf("identity %+v", snap)
+	}
+	if snap.Error != "" {
+		t.Errorf("unexpected problems: %s", snap.Error)
+	}
+
+	var req InstrumentSettings
+	if err := json.Unmarshal([]byte(snap.RequestedJSON), &req); err != nil || req != requested {
+		t.Errorf("requested %s", snap.RequestedJSON)
+	}
+	var actual InstrumentSettings
+	if err := json.Unmarshal([]byte(snap.SettingsJSON), &actual); err != nil || actual.Function != "CURR" {
+		t.Errorf("settings %s", snap.SettingsJSON)
+	}
+	var state map[string]string
+	if err := json.Unmarshal([]byte(snap.StateJSON), &state); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range (th2690{}).stateQueries() {
+		if _, ok := state[q]; !ok {
+			t.Errorf("state misses %s", q)
+		}
+	}
+}
+
+func TestSnapshotUnreachable(t *testing.T) {
+	inst := models.Instrument{ID: 9502, Name: "gone", Host: "127.0.0.1", Port: freePort(t), Model: "TH2690"}
+	snap, err := Snapshot(inst, InstrumentSettings{})
+	if err == nil || snap == nil || snap.Error == "" || snap.IDN != "" {
+		t.Fatalf("snapshot of a missing instrument: %+v, %v", snap, err)
+	}
+}
@@ -0,0 +1,316 @@
+package scpi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TH2690 is the driver for the Tonghui TH2690 electrometer
+var TH2690 Driver = th2690{}
+
+func init() {
+	RegisterDriver(TH2690, "TH2690")
+}
+
+// th2690 implements the TH2690 command tree (official manual, Chapter 6.6):
+//
+//	FUNC:FUNC, FUNC:SRC, FUNC:AMMET, SRC:VALUE, SRC:RANGE, CURR:RANGE, CURR:SPEED, etc.
+type th2690 struct{}
+
+func (th2690) Name() string { return "th2690" }
+
+func (th2690) Identify(c Conn) (*IDNInfo, error) {
+	return identify(c)
+}
+
+// Configure sends all settings commands on one connection — TH2690 requires this
+func (th2690) Configure(c Conn, s InstrumentSettings) error {
+	return sendAll(c, buildSettingsCommands(s), 2*time.Second, 50*time.Millisecond)
+}
+
+// ConfigureMeasurement changes zero, speed and range without touching the source
+func (th2690) ConfigureMeasurement(c Conn, s InstrumentSettings) error {
+	return sendAll(c, th2690MeasurementCommands(s), 2*time.Second, 50*time.Millisecond)
+}
+
+// AcquireZero takes a new zero: FUNC:ZERO ON stores the present input as the offset to
+// remove, so it is switched off and on again (with the source off)
+func (th2690) AcquireZero(c Conn) error {
+	return sendAll(c, []string{"FUNC:ZERO OFF", "FUNC:ZERO ON"}, 2*time.Second, 500*time.Millisecond)
+}
+
+func (th2690) Start(c Conn) error {
+	_, err := c.Send("FUNC:RUN", defaultTimeout)
+	return err
+}
+
+func (th2690) SetVoltage(c Conn, v float64) error {
+	_, err := c.Send(fmt.Sprintf("SRC:VALUE %.3f", v), defaultTimeout)
+	return err
+}
+
+// SourceRange picks SRC:RANGE 2 (0~1000V) for positive and 3 (-1000~0V) for negative
+// voltages, like Configure; 0 V fits the range in use
+func (th2690) SourceRange(v float64, current int) int {
+	switch {
+	case v > 0:
+		return 2
+	case v < 0:
+		return 3
+	case current != 0:
+		return current
+	}
+	return 2
+}
+
+func (th2690) SetSourceRange(c Conn, rng int) error {
+	_, err := c.Send(fmt.Sprintf("SRC:RANGE %d", rng), defaultTimeout)
+	return err
+}
+
+func (th2690) Fetch(c Conn) (*Response, error) {
+	raw, err := c.Send("FETCH:ALL_S?", defaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAllS(raw)
+}
+
+// SafeState runs the HV-off sequence: FUNC:STOP, FUNC:SRC OFF, FUNC:AMMET OFF.
+// Every step is attempted; the first error is returned.
+func (th2690) SafeState(c Conn) error {
+	var firstErr error
+	for _, cmd := range []string{"FUNC:STOP", "FUNC:SRC OFF", "SRC:VALUE 0", "FUNC:AMMET OFF"} {
+		if _, err := c.Send(cmd, 2*time.Second); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %w", cmd, err)
+		}
+	}
+	return firstErr
+}
+
+// ClearError resets the error code reported by FETCH:ALL_S? (HAND:ERROR)
+func (th2690) ClearError(c Conn) error {
+	_, err := c.Send("HAND:ERROR", defaultTimeout)
+	return err
+}
+
+// SourceState queries FUNC:SRC? (ON/OFF)
+func (th2690) SourceState(c Conn) (bool, error) {
+	resp, err := c.Send("FUNC:SRC?", defaultTimeout)
+	if err != nil {
+		return false, err
+	}
+	return parseOnOff(resp)
+}
+
+// ReadSettings queries every setting buildSettingsCommands writes: FUNC:FUNC?, FUNC:ZERO?,
+// <prefix>:SPEED?, <prefix>:RANGE?, FUNC:SRC?, SRC:VALUE?. A failed or unexpected reply
+// is an error, so the result never contains guessed values.
+func (th2690) ReadSettings(c Conn) (*InstrumentSettings, error) {
+	var s InstrumentSettings
+
+	resp, err := querySetting(c, "FUNC:FUNC?")
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToUpper(resp) {
+	case "CURR":
+		s.Function = "CURR"
+	case "RES":
+		s.Function = "RES"
+	case "COUL":
+		s.Function = "CHAR"
+	default:
+		return nil, fmt.Errorf("FUNC:FUNC?: unsupported function %q", resp)
+	}
+	_, prefix := th2690Function(s.Function)
+
+	if s.ZeroCorrect, err = queryOnOff(c, "FUNC:ZERO?"); err != nil {
+		return nil, err
+	}
+
+	if resp, err = querySetting(c, prefix+":SPEED?"); err != nil {
+		return nil, err
+	}
+	if s.Frequency, err = SpeedToFrequency(resp); err != nil {
+		return nil, fmt.Errorf("%s:SPEED?: %w", prefix, err)
+	}
+
+	// Range: 1=Auto, 2..11=manual
+	rng, err := queryFloat(c, prefix+":RANGE?")
+	if err != nil {
+		return nil, err
+	}
+	switch n := int(rng); {
+	case float64(n) != rng || n < 1 || n > 11:
+		return nil, fmt.Errorf("%s:RANGE?: unexpected range %v", prefix, rng)
+	case n == 1:
+		s.AutoRange = true
+	default:
+		s.Range = strconv.Itoa(n)
+	}
+
+	if s.SourceOn, err = queryOnOff(c, "FUNC:SRC?"); err != nil {
+		return nil, err
+	}
+	if s.SourceVolt, err = queryFloat(c, "SRC:VALUE?"); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// stateQueries lists every setting the TH2690 can report
+func (th2690) stateQueries() []string {
+	return []string{
+		"FUNC:FUNC?", "FUNC:AMMET?", "FUNC:ZERO?",
+		"CURR:SPEED?", "CURR:RANGE?", "RES:SPEED?", "RES:RANGE?",
+		"SRC:RANGE?", "SRC:VALUE?", "FUNC:SRC?",
+	}
+}
+
+// readbackChecks lists the queries that confirm what buildSettingsCommands wrote
+func (th2690) readbackChecks(s InstrumentSettings) []readbackCheck {
+	fn, prefix := th2690Function(s.Function)
+	checks := []readbackCheck{
+		{setting: "function", query: "FUNC:FUNC?", want: fn},
+		{setting: "zero", query: "FUNC:ZERO?", want: onOff(s.ZeroCorrect)},
+		{setting: "speed", query: prefix + ":SPEED?", want: FrequencyToSpeed(s.Frequency)},
+	}
+	if s.AutoRange {
+		checks = append(checks, readbackCheck{setting: "range", query: prefix + ":RANGE?", want: "1", numeric: true})
+	} else if s.Range != "" {
+		checks = append(checks, readbackCheck{setting: "range", query: prefix + ":RANGE?", want: s.Range, numeric: true})
+	}
+	checks = append(checks, readbackCheck{setting: "source", query: "FUNC:SRC?", want: onOff(s.SourceOn)})
+	if s.SourceOn {
+		checks = append(checks,
+			readbackCheck{setting: "source_range", query: "SRC:RANGE?", want: strconv.Itoa(th2690SourceRange(s.SourceVolt)), numeric: true},
+			readbackCheck{setting: "source_volt", query: "SRC:VALUE?", want: fmt.Sprintf("%.3f", s.SourceVolt), numeric: true})
+	}
+	return checks
+}
+
+// th2690Function maps InstrumentSettings.Function to the FUNC:FUNC name and the
+// command prefix of its speed and range settings
+func th2690Function(fn string) (name, prefix string) {
+	switch fn {
+	case "RES":
+		return "RES", "RES"
+	case "CHAR":
+		return "COUL", "CURR"
+	}
+	return "CURR", "CURR"
+}
+
+// th2690SourceRange is the SRC:RANGE Configure selects: 2 = 0~1000V, 3 = -1000~0V
+func th2690SourceRange(v float64) int {
+	if v >= 0 {
+		return 2
+	}
+	return 3
+}
+
+// buildSettingsCommands converts settings into ordered SCPI commands for TH2690.
+func buildSettingsCommands(s InstrumentSettings) []string {
+	var cmds []string
+
+	// 1. Set measurement function (FUNC:FUNC <RES|VOLT|CURR|COUL|SRC>)
+	fn, _ := th2690Function(s.Function)
+	cmds = append(cmds, "FUNC:FUNC "+fn)
+
+	// 2. Enable ammeter (FUNC:AMMET ON)
+	cmds = append(cmds, "FUNC:AMMET ON")
+
+	// 3-5. Zero, speed and range
+	cmds = append(cmds, th2690MeasurementCommands(s)...)
+
+	// 6. Source voltage (SRC:VALUE <float>, SRC:RANGE <1|2|3>)
+	if s.SourceOn {
+		// Set range first: 1=-20~20V, 2=0~1000V, 3=-1000~0V
+		cmds = append(cmds, fmt.Sprintf("SRC:RANGE %d", th2690SourceRange(s.SourceVolt)))
+		cmds = append(cmds, fmt.Sprintf("SRC:VALUE %.3f", s.SourceVolt))
+		cmds = append(cmds, "FUNC:SRC ON")
+	} else {
+		cmds = append(cmds, "FUNC:SRC OFF")
+	}
+
+	return cmds
+}
+
+// th2690MeasurementCommands sets zero, speed and range of the selected function
+func th2690MeasurementCommands(s InstrumentSettings) []string {
+	_, prefix := th2690Function(s.Function)
+	var cmds []string
+
+	// Disable Null/Zero (FUNC:ZERO OFF) — prevents offset
+	if !s.ZeroCorrect {
+		cmds = append(cmds, "FUNC:ZERO OFF")
+	} else {
+		cmds = append(cmds, "FUNC:ZERO ON")
+	}
+
+	// Measurement speed per function (e.g. CURR:SPEED <FAST|MID|SLOW>)
+	cmds = append(cmds, prefix+":SPEED "+FrequencyToSpeed(s.Frequency))
+
+	// Range: 1=Auto, 2..11=manual (CURR:RANGE <1..11>)
+	if s.AutoRange {
+		cmds = append(cmds, prefix+":RANGE 1")
+	} else if s.Range != "" {
+		cmds = append(cmds, fmt.Sprintf("%s:RANGE %s", prefix, s.Range))
+	}
+	return cmds
+}
+
+// ParseAllS parses a FETCH:ALL_S? response CSV string
+// Format: voltage,current,charge,resistance,time,source,math,temperature,humidity,error_code
+func ParseAllS(raw string) (*Response, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) < 10 {
+		return nil, fmt.Errorf("unexpected ALL_S format: %q (got %d fields)", raw, len(parts))
+	}
+
+	r := &Response{}
+	var err error
+
+	r.Voltage, err = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse voltage: %w", err)
+	}
+	r.Current, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse current: %w", err)
+	}
+	r.Charge, err = strconv.ParseFloat(strings.TrimSpace(parts[2]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse charge: %w", err)
+	}
+	r.Resistance, err = strconv.ParseFloat(strings.TrimSpace(parts[3]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse resistance: %w", err)
+	}
+	r.DeviceTime = strings.TrimSpace(parts[4])
+	r.Source, err = strconv.ParseFloat(strings.TrimSpace(parts[5]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse source: %w", err)
+	}
+	r.MathValue, err = strconv.ParseFloat(strings.TrimSpace(parts[6]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse math: %w", err)
+	}
+	r.Temperature, err = strconv.ParseFloat(strings.TrimSpace(parts[7]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse temperature: %w", err)
+	}
+	r.Humidity, err = strconv.ParseFloat(strings.TrimSpace(parts[8]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse humidity: %w", err)
+	}
+	r.ErrorCode, err = strconv.Atoi(strings.TrimSpace(parts[9]))
+	if err != nil {
+		return nil, fmt.Errorf("parse error_code: %w", err)
+	}
+
+	return r, nil
+}
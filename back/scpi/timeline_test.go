@@ -0,0 +1,63 @@
+package scpi
+
+import (
+	"testing"
+	"time"
+
+	"back/broker"
+	"back/events"
+	"back/models"
+	"back/simulator"
+)
+
+// TestRunnerTimeline: HV schedule progress and a fetch outage show up on the timeline
+func TestRunnerTimeline(t *testing.T) {
+	sim, inst := liveSim(t, 9451)
+	sub, _, _ := broker.Default.Subscribe(9451, 0)
+	defer broker.Default.Unsubscribe(sub)
+
+	DefaultRunner.Resume(9451, []models.Instrument{inst}, RunPlan{
+		InstrumentIDs:   []uint{inst.ID},
+		PollIntervalsMs: map[uint]int64{inst.ID: 50},
+		HvSchedule: map[uint]*HvProgram{inst.ID: {Steps: []HvStep{
+			{Type: HvStepSet, Voltage: volts(50)},
+			{Type: HvStepHold, DurationSec: 0.3},
+		}}},
+		StartedAt: time.Now(),
+	})
+	defer DefaultRunner.Stop(9451)
+
+	var seen []string
+	wait := func(typ string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case ev := <-sub.C:
+				if ev.Kind != broker.KindEvent {
+					continue
+				}
+				seen = append(seen, ev.Event.Type+": "+ev.Event.Message)
+				if ev.Event.Type == typ {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("no %s event; timeline %q", typ, seen)
+			}
+		}
+	}
+
+	wait(events.HvSegment)
+	wait(events.HvSegment)
+	if last := seen[len(seen)-1]; last != "hv_segment: schedule finished" {
+		t.Fatalf("timeline %q", seen)
+	}
+
+	cfg := simulator.DefaultConfig()
+	cfg.DropRate = 1
+	sim.SetConfig(cfg)
+	wait(events.FetchError)
+	cfg.DropRate = 0
+	sim.SetConfig(cfg)
+	wait(events.FetchRecovered)
+}
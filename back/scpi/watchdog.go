@@ -0,0 +1,122 @@
+package scpi
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	defaultWatchdogFailures = 5
+	watchdogMaxBackoff      = 30 * time.Second
+)
+
+// Instrument health states reported by the watchdog
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded" // too many consecutive failed polls, reconnecting with backoff
+	HealthFailed   = "failed"   // degraded longer than the grace period, the experiment was failed
+)
+
+// WatchdogConfig decides when an instrument that stopped answering is degraded and
+// when it fails the experiment
+type WatchdogConfig struct {
+	Failures     int `json:"failures,omitempty"`       // consecutive failed polls before degraded (default 5)
+	FailAfterSec int `json:"fail_after_sec,omitempty"` // degraded this long fails the experiment (0 = never)
+}
+
+// Validate checks the configuration
+func (w WatchdogConfig) Validate() error {
+	if w.Failures < 0 {
+		return fmt.Errorf("watchdog failures must not be negative")
+	}
+	if w.FailAfterSec < 0 {
+		return fmt.Errorf("watchdog fail_after_sec must not be negative")
+	}
+	return nil
+}
+
+// InstrumentHealth is the watchdog state of one instrument of a running experiment
+type InstrumentHealth struct {
+	InstrumentID        uint       `json:"instrument_id"`
+	Name                string     `json:"name"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastOKAt            *time.Time `json:"last_ok_at,omitempty"`
+	DegradedSince       *time.Time `json:"degraded_since,omitempty"`
+	NextAttemptAt       *time.Time `json:"next_attempt_at,omitempty"` // while degraded
+}
+
+// watchdog tracks the health of one instrument; owned by its polling goroutine
+type watchdog struct {
+	cfg      WatchdogConfig
+	interval time.Duration
+	health   InstrumentHealth
+	backoff  time.Duration
+}
+
+func newWatchdog(cfg WatchdogConfig, instrumentID uint, name string, interval time.Duration) *watchdog {
+	if cfg.Failures <= 0 {
+		cfg.Failures = defaultWatchdogFailures
+	}
+	return &watchdog{
+		cfg:      cfg,
+		interval: interval,
+		health:   InstrumentHealth{InstrumentID: instrumentID, Name: name, State: HealthOK},
+	}
+}
+
+// due reports whether the instrument should be polled now; a degraded instrument is
+// only retried when its backoff has elapsed
+func (w *watchdog) due(now time.Time) bool {
+	return w.health.NextAttemptAt == nil || !now.Before(*w.health.NextAttemptAt)
+}
+
+// failure records a failed poll. degraded is true on the failure that crosses the
+// threshold, failed when the instrument stayed degraded longer than the grace period.
+func (w *watchdog) failure(err error, now time.Time) (degraded, failed bool) {
+	w.health.ConsecutiveFailures++
+	w.health.LastError = err.Error()
+
+	if w.health.State == HealthOK && w.health.ConsecutiveFailures >= w.cfg.Failures {
+		w.health.State = HealthDegraded
+		since := now
+		w.health.DegradedSince = &since
+		degraded = true
+	}
+	if w.health.State != HealthDegraded {
+		return degraded, false
+	}
+
+	// Back off from the polling interval up to watchdogMaxBackoff
+	if w.backoff == 0 {
+		w.backoff = w.interval
+	} else if w.backoff < watchdogMaxBackoff {
+		w.backoff *= 2
+		if w.backoff > watchdogMaxBackoff {
+			w.backoff = watchdogMaxBackoff
+		}
+	}
+	next := now.Add(w.backoff)
+	w.health.NextAttemptAt = &next
+
+	if w.cfg.FailAfterSec > 0 && now.Sub(*w.health.DegradedSince) >= time.Duration(w.cfg.FailAfterSec)*time.Second {
+		w.health.State = HealthFailed
+		w.health.NextAttemptAt = nil
+		failed = true
+	}
+	return degraded, failed
+}
+
+// success records a good poll; recovered is true when the instrument was degraded
+func (w *watchdog) success(now time.Time) (recovered bool) {
+	recovered = w.health.State == HealthDegraded
+	w.health.State = HealthOK
+	w.health.ConsecutiveFailures = 0
+	w.health.LastError = ""
+	w.health.LastOKAt = &now
+	w.health.DegradedSince = nil
+	w.health.NextAttemptAt = nil
+	w.backoff = 0
+	return recovered
+}
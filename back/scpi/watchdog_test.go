@@ -0,0 +1,113 @@
+package scpi
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"back/models"
+)
+
+func TestWatchdogConfigValidate(t *testing.T) {
+	if err := (WatchdogConfig{Failures: 3, FailAfterSec: 60}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, cfg := range []WatchdogConfig{{Failures: -1}, {FailAfterSec: -1}} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+}
+
+func TestWatchdogStates(t *testing.T) {
+	w := newWatchdog(WatchdogConfig{Failures: 3, FailAfterSec: 10}, 7, "th", 100*time.Millisecond)
+	now := time.Now()
+	lost := errors.New("timeout")
+
+	for i := 1; i <= 2; i++ {
+		if degraded, failed := w.failure(lost, now); degraded || failed || w.health.State != HealthOK {
+			t.Fatalf("failure %d: degraded %v failed %v state %s", i, degraded, failed, w.health.State)
+		}
+		if !w.due(now) {
+			t.Fatal("healthy instrument not due")
+		}
+	}
+	if degraded, _ := w.failure(lost, now); !degraded || w.health.State != HealthDegraded {
+		t.Fatalf("third failure: degraded %v state %s", degraded, w.health.State)
+	}
+	// degraded: retried with a backoff that doubles from the polling interval
+	if w.due(now) || !w.due(now.Add(100*time.Millisecond)) {
+		t.Fatalf("next attempt %s after a 100ms backoff", w.health.NextAttemptAt.Sub(now))
+	}
+	w.failure(lost, now)
+	if got := w.health.NextAttemptAt.Sub(now); got != 200*time.Millisecond {
+		t.Fatalf("second backoff %s", got)
+	}
+	if w.health.LastError != "timeout" || w.health.ConsecutiveFailures != 4 {
+		t.Fatalf("health %+v", w.health)
+	}
+
+	if !w.success(now) || w.health.State != HealthOK || w.health.NextAttemptAt != nil || w.backoff != 0 {
+		t.Fatalf("after recovery: %+v", w.health)
+	}
+	if w.success(now) {
+		t.Fatal("recovered twice")
+	}
+
+	for i := 0; i < 3; i++ {
+		w.failure(lost, now)
+	}
+	if _, failed := w.failure(lost, now.Add(9*time.Second)); failed {
+		t.Fatal("failed before the grace period")
+	}
+	if _, failed := w.failure(lost, now.Add(10*time.Second)); !failed || w.health.State != HealthFailed {
+		t.Fatalf("after the grace period: failed %v state %s", failed, w.health.State)
+	}
+}
+
+func TestWatchdogBackoffLimit(t *testing.T) {
+	w := newWatchdog(WatchdogConfig{}, 7, "th", 10*time.Second)
+	now := time.Now()
+	for i := 0; i < defaultWatchdogFailures+5; i++ {
+		w.failure(errors.New("x"), now)
+	}
+	if got := w.health.NextAttemptAt.Sub(now); got != watchdogMaxBackoff {
+		t.Fatalf("backoff %s, want the %s cap", got, watchdogMaxBackoff)
+	}
+	if w.health.State != HealthDegraded {
+		t.Fatalf("state %s without fail_after_sec", w.health.State)
+	}
+}
+
+// TestRunnerWatchdogFailsLostInstrument: an instrument that goes away is reported
+// degraded and fails the run after the grace period
+func TestRunnerWatchdogFailsLostInstrument(t *testing.T) {
+	sim, inst := liveSim(t, 9471)
+	DefaultRunner.Resume(9471, []models.Instrument{inst}, RunPlan{
+		InstrumentIDs:   []uint{inst.ID},
+		PollIntervalsMs: map[uint]int64{inst.ID: 50},
+		Watchdog:        WatchdogConfig{Failures: 2, FailAfterSec: 1},
+		StartedAt:       time.Now(),
+	})
+	defer DefaultRunner.Stop(9471)
+	time.Sleep(200 * time.Millisecond)
+	if h := DefaultRunner.Health(9471); len(h) != 1 || h[0].State != HealthOK || h[0].LastOKAt == nil {
+		t.Fatalf("health while answering: %+v", h)
+	}
+
+	sim.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	sawDegraded := false
+	for DefaultRunner.IsRunning(9471) {
+		if h := DefaultRunner.Health(9471); len(h) == 1 && h[0].State == HealthDegraded {
+			sawDegraded = true
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("run with a lost instrument kept going")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !sawDegraded {
+		t.Fatal("instrument never reported degraded")
+	}
+}
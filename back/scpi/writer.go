@@ -0,0 +1,241 @@
+package scpi
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"back/database"
+	"back/models"
+)
+
+const (
+	writerCapacity      = 20000
+	writerBatchSize     = 500
+	writerFlushInterval = 250 * time.Millisecond
+	writerMaxBlock      = 100 * time.Millisecond // how long Enqueue waits on a full buffer
+)
+
+// WriterStats exposes write pipeline throughput and backpressure
+type WriterStats struct {
+	Queued      int     `json:"queued"`
+	Capacity    int     `json:"capacity"`
+	Enqueued    uint64  `json:"enqueued"`
+	Written     uint64  `json:"written"`
+	Dropped     uint64  `json:"dropped"`       // rows lost: buffer full or insert failed and the journal was unavailable
+	Blocked     uint64  `json:"blocked"`       // enqueues that had to wait for space
+	Failed      uint64  `json:"failed"`        // rows whose insert failed
+	Journaled   uint64  `json:"journaled"`     // rows spilled to the local journal
+	Flushes     uint64  `json:"flushes"`       // batches written
+	LastBatch   int     `json:"last_batch"`    // rows in the last batch
+	LastFlushMs float64 `json:"last_flush_ms"` // duration of the last batch insert
+	MaxFlushMs  float64 `json:"max_flush_ms"`
+}
+
+// MeasurementWriter decouples acquisition from persistence: pollers enqueue into a
+// bounded buffer, one goroutine inserts in batches with CreateInBatches.
+type MeasurementWriter struct {
+	in      chan models.Measurement
+	flushCh chan chan struct{}
+	closeCh chan chan struct{}
+	stopped chan struct{} // closed when the loop returned
+
+	mu      sync.Mutex
+	closed  bool
+	stats   WriterStats
+	pending map[uint]int // experimentID -> rows queued but not yet written
+}
+
+var DefaultWriter = NewMeasurementWriter(writerCapacity)
+
+// NewMeasurementWriter creates a writer with the given buffer capacity and starts it
+func NewMeasurementWriter(capacity int) *MeasurementWriter {
+	w := &MeasurementWriter{
+		in:      make(chan models.Measurement, capacity),
+		flushCh: make(chan chan struct{}),
+		closeCh: make(chan chan struct{}),
+		stopped: make(chan struct{}),
+		pending: make(map[uint]int),
+	}
+	w.stats.Capacity = capacity
+	go w.loop()
+	return w
+}
+
+// Enqueue queues a measurement for insertion. It never blocks for long:
+// on a full buffer it waits up to writerMaxBlock and then spills the row to the journal.
+// After Close every row goes to the journal.
+func (w *MeasurementWriter) Enqueue(m models.Measurement) bool {
+	w.mu.Lock()
+	closed := w.closed
+	w.pending[m.ExperimentID]++
+	w.stats.Enqueued++
+	w.mu.Unlock()
+
+	if !closed {
+		select {
+		case w.in <- m:
+			return true
+		default:
+		}
+
+		w.mu.Lock()
+		w.stats.Blocked++
+		w.mu.Unlock()
+		select {
+		case w.in <- m:
+			return true
+		case <-time.After(writerMaxBlock):
+		}
+	}
+
+	err := DefaultJournal.Append([]models.Measurement{m})
+
+	w.mu.Lock()
+	w.pending[m.ExperimentID]--
+	if err != nil {
+		w.stats.Dropped++
+	} else {
+		w.stats.Journaled++
+	}
+	w.mu.Unlock()
+	if err != nil {
+		log.Printf("[WRITER] buffer full (%d) and journal failed, dropped measurement exp=%d inst=%d: %v",
+			cap(w.in), m.ExperimentID, m.InstrumentID, err)
+		return false
+	}
+	return true
+}
+
+// Flush writes everything queued so far and returns when it is persisted
+func (w *MeasurementWriter) Flush() {
+	done := make(chan struct{})
+	select {
+	case w.flushCh <- done:
+		<-done
+	case <-w.stopped:
+	}
+}
+
+// Close writes everything queued so far and stops the writer. Call it once the
+// pollers stopped enqueueing.
+func (w *MeasurementWriter) Close() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	w.mu.Unlock()
+	done := make(chan struct{})
+	w.closeCh <- done
+	<-done
+}
+
+// Pending returns the number of rows of an experiment not yet written
+func (w *MeasurementWriter) Pending(experimentID uint) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pending[experimentID]
+}
+
+// Stats returns a snapshot of writer metrics
+func (w *MeasurementWriter) Stats() WriterStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st := w.stats
+	st.Queued = len(w.in)
+	return st
+}
+
+func (w *MeasurementWriter) loop() {
+	ticker := time.NewTicker(writerFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]models.Measurement, 0, writerBatchSize)
+	for {
+		select {
+		case m := <-w.in:
+			batch = append(batch, m)
+			if len(batch) >= writerBatchSize {
+				batch = w.write(batch)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				batch = w.write(batch)
+			}
+		case done := <-w.flushCh:
+			batch = w.drain(batch)
+			close(done)
+		case done := <-w.closeCh:
+			w.drain(batch)
+			close(w.stopped)
+			close(done)
+			return
+		}
+	}
+}
+
+// drain writes the batch and everything queued, and returns the emptied slice
+func (w *MeasurementWriter) drain(batch []models.Measurement) []models.Measurement {
+	for {
+		select {
+		case m := <-w.in:
+			batch = append(batch, m)
+			if len(batch) >= writerBatchSize {
+				batch = w.write(batch)
+			}
+		default:
+			if len(batch) > 0 {
+				batch = w.write(batch)
+			}
+			return batch
+		}
+	}
+}
+
+// write inserts a batch and returns the emptied slice for reuse
+func (w *MeasurementWriter) write(batch []models.Measurement) []models.Measurement {
+	start := time.Now()
+	err := database.DB.CreateInBatches(batch, writerBatchSize).Error
+	elapsed := float64(time.Since(start).Microseconds()) / 1000
+
+	// Keep the rows on disk until the database is back
+	var journalErr error
+	if err != nil {
+		journalErr = DefaultJournal.Append(batch)
+	}
+
+	w.mu.Lock()
+	for _, m := range batch {
+		w.pending[m.ExperimentID]--
+		if w.pending[m.ExperimentID] <= 0 {
+			delete(w.pending, m.ExperimentID)
+		}
+	}
+	w.stats.Flushes++
+	w.stats.LastBatch = len(batch)
+	w.stats.LastFlushMs = elapsed
+	if elapsed > w.stats.MaxFlushMs {
+		w.stats.MaxFlushMs = elapsed
+	}
+	switch {
+	case err == nil:
+		w.stats.Written += uint64(len(batch))
+	case journalErr == nil:
+		w.stats.Failed += uint64(len(batch))
+		w.stats.Journaled += uint64(len(batch))
+	default:
+		w.stats.Failed += uint64(len(batch))
+		w.stats.Dropped += uint64(len(batch))
+	}
+	w.mu.Unlock()
+
+	switch {
+	case err != nil && journalErr == nil:
+		log.Printf("[WRITER] insert of %d measurements failed, journaled for replay: %v", len(batch), err)
+	case err != nil:
+		log.Printf("[WRITER] insert of %d measurements failed and journal failed, rows lost: %v / %v", len(batch), err, journalErr)
+	}
+	return batch[:0]
+}
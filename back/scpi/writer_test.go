@@ -0,0 +1,106 @@
+package scpi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"back/database"
+	"back/models"
+)
+
+// unreachableDB points database.DB at a closed port for the duration of a test,
+// so every insert fails at once
+func unreachableDB(t *testing.T) {
+	t.Helper()
+	db, err := gorm.Open(postgres.Open("host=127.0.0.1 port=1 user=test dbname=test sslmode=disable connect_timeout=1"),
+		&gorm.Config{DisableAutomaticPing: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := database.DB
+	database.DB = db
+	t.Cleanup(func() { database.DB = prev })
+}
+
+func TestWriterFlushWritesQueuedRows(t *testing.T) {
+	unreachableDB(t)
+	j := useTempJournal(t)
+	w := NewMeasurementWriter(100)
+	for i := 0; i < 3; i++ {
+		if !w.Enqueue(models.Measurement{ExperimentID: 910, InstrumentID: 1, RecordedAt: time.Now()}) {
+			t.Fatal("enqueue refused with room in the buffer")
+		}
+	}
+	w.Flush()
+
+	st := w.Stats()
+	if st.Enqueued != 3 || st.Queued != 0 || st.LastBatch != 3 || st.Flushes == 0 {
+		t.Fatalf("stats after flush: %+v", st)
+	}
+	if st.Written != 0 || st.Failed != 3 || st.Journaled != 3 || st.Dropped != 0 {
+		t.Fatalf("rows of a failed insert not journaled: %+v", st)
+	}
+	if got := j.Pending(910); got != 3 {
+		t.Fatalf("journal holds %d rows, want 3", got)
+	}
+	if got := w.Pending(910); got != 0 {
+		t.Fatalf("pending = %d after flush", got)
+	}
+}
+
+func TestWriterSpillsFullBuffer(t *testing.T) {
+	j := useTempJournal(t)
+	// no loop goroutine: nothing drains the buffer
+	w := &MeasurementWriter{in: make(chan models.Measurement, 2), pending: make(map[uint]int)}
+	w.stats.Capacity = 2
+
+	for i := 0; i < 2; i++ {
+		if !w.Enqueue(models.Measurement{ExperimentID: 911}) {
+			t.Fatalf("row %d refused with room in the buffer", i)
+		}
+	}
+	start := time.Now()
+	if !w.Enqueue(models.Measurement{ExperimentID: 911}) {
+		t.Fatal("row lost although the journal is writable")
+	}
+	if waited := time.Since(start); waited < writerMaxBlock {
+		t.Fatalf("spilled after %s, want a wait of %s", waited, writerMaxBlock)
+	}
+	st := w.Stats()
+	if st.Queued != 2 || st.Blocked != 1 || st.Journaled != 1 || st.Dropped != 0 || st.Enqueued != 3 {
+		t.Fatalf("stats: %+v", st)
+	}
+	if got := j.Pending(911); got != 1 {
+		t.Fatalf("journal holds %d rows, want the spilled one", got)
+	}
+	if got := w.Pending(911); got != 2 {
+		t.Fatalf("pending = %d, want the 2 buffered rows", got)
+	}
+}
+
+func TestWriterDropsWithoutJournal(t *testing.T) {
+	// a regular file where the journal directory should be
+	blocker := filepath.Join(t.TempDir(), "journal")
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	prev := DefaultJournal
+	DefaultJournal = NewJournal(blocker)
+	t.Cleanup(func() { DefaultJournal = prev })
+
+	w := &MeasurementWriter{in: make(chan models.Measurement, 1), pending: make(map[uint]int)}
+	w.stats.Capacity = 1
+	w.Enqueue(models.Measurement{ExperimentID: 912})
+	if w.Enqueue(models.Measurement{ExperimentID: 912}) {
+		t.Fatal("row accepted with a full buffer and no journal")
+	}
+	if st := w.Stats(); st.Dropped != 1 || st.Journaled != 0 {
+		t.Fatalf("stats: %+v", st)
+	}
+}
@@ -0,0 +1,518 @@
+// Package simulator implements a fake TH2690 electrometer that speaks the
+// same SCPI command tree as the real instrument over TCP.
+//
+// It is meant for offline development and tests: point an INSTRUMENTS entry
+// at the simulator address and the whole start/poll/stop path works without
+// hardware. Faults (dropped, slow and split replies, connection resets) are
+// injected with configurable probabilities.
+package simulator
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error codes reported in the last field of FETCH:ALL_S?, from the manual's error table
+const (
+	ErrNone        = 0
+	ErrOverload    = 11 // U606-Pro: current exceeds the selected manual range
+	ErrSourceRange = 6  // HV_V alert: SRC:VALUE outside the selected SRC:RANGE
+	ErrSourceTrip  = 9  // HV_I alert: source switched off by the current trip
+)
+
+// Config controls simulated physics and fault injection
+type Config struct {
+	Model    string
+	Firmware string
+	Serial   string
+
+	Terminator string // reply terminator, "\r\n" by default
+
+	Resistance  float64 // sample resistance in ohms
+	Offset      float64 // input offset current (A), removed by FUNC:ZERO ON
+	Noise       float64 // gaussian current noise sigma (A)
+	Drift       float64 // current drift (A/s) since FUNC:RUN
+	SlewRate    float64 // HV source slew rate (V/s)
+	TripCurrent float64 // source trips off above this current (A), 0 = never
+
+	Delay      time.Duration // base reply latency
+	SlowRate   float64       // probability of a slow reply
+	SlowDelay  time.Duration // extra latency for a slow reply
+	DropRate   float64       // probability a query gets no reply
+	ResetRate  float64       // probability the connection is closed on a command
+	SplitRate  float64       // probability a reply is written in two TCP segments
+	Seed       int64         // RNG seed, 0 = time based
+	LogCommand bool          // log every received command
+}
+
+// DefaultConfig returns a well-behaved instrument with a 1 TΩ sample
+func DefaultConfig() Config {
+	return Config{
+		Model:       "TH2690",
+		Firmware:    "V1.0.22",
+		Serial:      "SIM0000001",
+		Terminator:  "\r\n",
+		Resistance:  1e12,
+		Offset:      2e-13,
+		Noise:       5e-15,
+		SlewRate:    500,
+		TripCurrent: 2e-3,
+		Delay:       5 * time.Millisecond,
+		SlowDelay:   3 * time.Second,
+	}
+}
+
+// state is the simulated front panel / measurement state
+type state struct {
+	function  string // CURR, RES, VOLT, COUL, SRC
+	ammeter   bool
+	zero      bool
+	speed     map[string]string
+	rng       map[string]int
+	srcOn     bool
+	srcRange  int
+	srcValue  float64
+	srcActual float64
+	running   bool
+	runStart  time.Time
+	lastStep  time.Time
+	charge    float64
+	errorCode int
+	temp      float64
+	humidity  float64
+}
+
+// Server is a simulated TH2690 listening on TCP
+type Server struct {
+	cfg Config
+
+	mu    sync.Mutex
+	st    state
+	rand  *rand.Rand
+	boot  time.Time
+	ln    net.Listener
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+
+	closed bool // set by Close; connections accepted after it are dropped
+}
+
+// New creates a simulator with the given config. Zero fields fall back to DefaultConfig.
+func New(cfg Config) *Server {
+	def := DefaultConfig()
+	if cfg.Model == "" {
+		cfg.Model = def.Model
+	}
+	if cfg.Firmware == "" {
+		cfg.Firmware = def.Firmware
+	}
+	if cfg.Serial == "" {
+		cfg.Serial = def.Serial
+	}
+	if cfg.Terminator == "" {
+		cfg.Terminator = def.Terminator
+	}
+	if cfg.Resistance == 0 {
+		cfg.Resistance = def.Resistance
+	}
+	if cfg.SlewRate == 0 {
+		cfg.SlewRate = def.SlewRate
+	}
+	if cfg.SlowDelay == 0 {
+		cfg.SlowDelay = def.SlowDelay
+	}
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	now := time.Now()
+	return &Server{
+		cfg:  cfg,
+		rand: rand.New(rand.NewSource(seed)),
+		boot: now,
+		st: state{
+			function: "CURR",
+			speed:    map[string]string{"CURR": "MID", "RES": "MID"},
+			rng:      map[string]int{"CURR": 1, "RES": 1},
+			srcRange: 1,
+			lastStep: now,
+			temp:     23.5,
+			humidity: 45,
+		},
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// Listen starts accepting connections on addr (e.g. "127.0.0.1:0")
+func (s *Server) Listen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go s.acceptLoop(ln)
+	return nil
+}
+
+// Addr returns the listening address
+func (s *Server) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return ""
+	}
+	return s.ln.Addr().String()
+}
+
+// HostPort returns the listening host and port, as stored in models.Instrument
+func (s *Server) HostPort() (string, int) {
+	host, portStr, err := net.SplitHostPort(s.Addr())
+	if err != nil {
+		return "", 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+// Close stops the listener and drops every open connection
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.ln != nil {
+		err = s.ln.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// SetConfig replaces the fault/physics config at runtime (identity fields are kept)
+func (s *Server) SetConfig(cfg Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cfg.Model, cfg.Firmware, cfg.Serial = s.cfg.Model, s.cfg.Firmware, s.cfg.Serial
+	if cfg.Terminator == "" {
+		cfg.Terminator = s.cfg.Terminator
+	}
+	s.cfg = cfg
+}
+
+// SourceOn reports whether the HV source is currently enabled
+func (s *Server) SourceOn() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.st.srcOn
+}
+
+// SourceValue returns the HV source setpoint (SRC:VALUE)
+func (s *Server) SourceValue() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.st.srcValue
+}
+
+// Running reports whether a measurement is running (FUNC:RUN)
+func (s *Server) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.st.running
+}
+
+func (s *Server) acceptLoop(ln net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			// Accepted while Close was dropping the others: it would never be closed
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		for _, cmd := range strings.Split(line, ";") {
+			cmd = strings.TrimSpace(cmd)
+			if cmd == "" {
+				continue
+			}
+			if !s.handle(conn, cmd) {
+				return
+			}
+		}
+	}
+}
+
+// handle executes one command and writes the reply. Returns false when the connection must be dropped.
+func (s *Server) handle(conn net.Conn, cmd string) bool {
+	s.mu.Lock()
+	cfg := s.cfg
+	if cfg.LogCommand {
+		log.Printf("[SIM] %s <- %q", conn.RemoteAddr(), cmd)
+	}
+	if s.chance(cfg.ResetRate) {
+		s.mu.Unlock()
+		log.Printf("[SIM] %s injected connection reset on %q", conn.RemoteAddr(), cmd)
+		return false
+	}
+	reply, isQuery := s.exec(cmd, time.Now())
+	drop := isQuery && s.chance(cfg.DropRate)
+	delay := cfg.Delay
+	if s.chance(cfg.SlowRate) {
+		delay += cfg.SlowDelay
+	}
+	split := s.chance(cfg.SplitRate)
+	s.mu.Unlock()
+
+	if !isQuery || drop {
+		return true
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	out := reply + cfg.Terminator
+	if split && len(out) > 1 {
+		half := len(out) / 2
+		if _, err := conn.Write([]byte(out[:half])); err != nil {
+			return false
+		}
+		time.Sleep(20 * time.Millisecond)
+		out = out[half:]
+	}
+	_, err := conn.Write([]byte(out))
+	return err == nil
+}
+
+// chance returns true with probability p. Caller holds s.mu.
+func (s *Server) chance(p float64) bool {
+	return p > 0 && s.rand.Float64() < p
+}
+
+// exec applies a command to the simulated state. Caller holds s.mu.
+func (s *Server) exec(raw string, now time.Time) (string, bool) {
+	s.step(now)
+
+	header, arg, _ := strings.Cut(raw, " ")
+	header = strings.ToUpper(strings.TrimPrefix(strings.TrimSpace(header), ":"))
+	arg = strings.ToUpper(strings.TrimSpace(arg))
+
+	if strings.HasSuffix(header, "?") {
+		return s.query(strings.TrimSuffix(header, "?"), now), true
+	}
+
+	switch header {
+	case "FUNC:FUNC":
+		switch arg {
+		case "CURR", "RES", "VOLT", "COUL", "SRC":
+			s.st.function = arg
+		}
+	case "FUNC:AMMET":
+		s.st.ammeter = arg == "ON"
+	case "FUNC:ZERO":
+		s.st.zero = arg == "ON"
+	case "FUNC:SRC":
+		s.st.srcOn = arg == "ON"
+		if s.st.srcOn && s.st.errorCode == ErrSourceTrip {
+			s.st.errorCode = ErrNone
+		}
+	case "FUNC:RUN":
+		if !s.st.running {
+			s.st.running = true
+			s.st.runStart = now
+			s.st.charge = 0
+		}
+	case "FUNC:STOP":
+		s.st.running = false
+	case "SRC:RANGE":
+		if v, err := strconv.Atoi(arg); err == nil && v >= 1 && v <= 3 {
+			s.st.srcRange = v
+		}
+	case "SRC:VALUE":
+		if v, err := strconv.ParseFloat(arg, 64); err == nil {
+			s.st.srcValue = v
+			if !sourceInRange(s.st.srcRange, v) {
+				s.st.errorCode = ErrSourceRange
+			}
+		}
+	case "CURR:SPEED", "RES:SPEED":
+		switch arg {
+		case "FAST", "MID", "SLOW":
+			s.st.speed[strings.TrimSuffix(header, ":SPEED")] = arg
+		}
+	case "CURR:RANGE", "RES:RANGE":
+		if v, err := strconv.Atoi(arg); err == nil && v >= 1 && v <= 11 {
+			s.st.rng[strings.TrimSuffix(header, ":RANGE")] = v
+		}
+	case "HAND:ERROR":
+		s.st.errorCode = ErrNone
+	}
+	return "", false
+}
+
+// query answers a query header (without the trailing '?'). Caller holds s.mu.
+func (s *Server) query(header string, now time.Time) string {
+	switch header {
+	case "*IDN":
+		return fmt.Sprintf("%s,%s,%s", s.cfg.Model, s.cfg.Firmware, s.cfg.Serial)
+	case "FUNC:FUNC":
+		return s.st.function
+	case "FUNC:SRC":
+		return onOff(s.st.srcOn)
+	case "FUNC:AMMET":
+		return onOff(s.st.ammeter)
+	case "FUNC:ZERO":
+		return onOff(s.st.zero)
+	case "SRC:VALUE":
+		return strconv.FormatFloat(s.st.srcValue, 'f', 3, 64)
+	case "SRC:RANGE":
+		return strconv.Itoa(s.st.srcRange)
+	case "CURR:SPEED", "RES:SPEED":
+		return s.st.speed[strings.TrimSuffix(header, ":SPEED")]
+	case "CURR:RANGE", "RES:RANGE":
+		return strconv.Itoa(s.st.rng[strings.TrimSuffix(header, ":RANGE")])
+	case "FETCH:ALL_S":
+		return s.allS(now)
+	}
+	return ""
+}
+
+// step advances the simulated physics up to now. Caller holds s.mu.
+func (s *Server) step(now time.Time) {
+	dt := now.Sub(s.st.lastStep).Seconds()
+	s.st.lastStep = now
+	if dt <= 0 {
+		return
+	}
+
+	target := 0.0
+	if s.st.srcOn {
+		target = s.st.srcValue
+	}
+	maxStep := s.cfg.SlewRate * dt
+	switch diff := target - s.st.srcActual; {
+	case math.Abs(diff) <= maxStep:
+		s.st.srcActual = target
+	case diff > 0:
+		s.st.srcActual += maxStep
+	default:
+		s.st.srcActual -= maxStep
+	}
+
+	// Slow random walk of the environment sensors
+	s.st.temp += s.rand.NormFloat64() * 0.002 * math.Sqrt(dt)
+	s.st.humidity += s.rand.NormFloat64() * 0.01 * math.Sqrt(dt)
+
+	if s.st.running {
+		s.st.charge += s.current(now) * dt
+	}
+}
+
+// current returns the instantaneous simulated current. Caller holds s.mu.
+func (s *Server) current(now time.Time) float64 {
+	i := s.st.srcActual / s.cfg.Resistance
+	if !s.st.zero {
+		i += s.cfg.Offset
+	}
+	if s.st.running {
+		i += s.cfg.Drift * now.Sub(s.st.runStart).Seconds()
+	}
+	return i + s.rand.NormFloat64()*s.cfg.Noise
+}
+
+// allS builds a FETCH:ALL_S? row:
+// voltage,current,charge,resistance,time,source,math,temperature,humidity,error_code
+func (s *Server) allS(now time.Time) string {
+	i := s.current(now)
+
+	if s.cfg.TripCurrent > 0 && math.Abs(i) > s.cfg.TripCurrent && s.st.srcOn {
+		s.st.srcOn = false
+		s.st.errorCode = ErrSourceTrip
+	}
+	if fs := rangeFullScale(s.st.rng["CURR"]); fs > 0 && math.Abs(i) > fs {
+		i = math.Copysign(fs, i)
+		if s.st.errorCode == ErrNone {
+			s.st.errorCode = ErrOverload
+		}
+	}
+
+	res := 9.9e37
+	if i != 0 {
+		res = math.Abs(s.st.srcActual / i)
+	}
+	if !s.st.running {
+		i, res = 0, 0
+	}
+
+	deviceTime := now.Sub(s.boot).Seconds()
+	return fmt.Sprintf("%.4f,%.6e,%.6e,%.6e,%.3f,%.3f,%.6e,%.2f,%.2f,%d",
+		s.st.srcActual, i, s.st.charge, res, deviceTime,
+		s.st.srcValue, 0.0, s.st.temp, s.st.humidity, s.st.errorCode)
+}
+
+// rangeFullScale maps a CURR:RANGE code to its full-scale current. 1 = auto (no limit).
+func rangeFullScale(code int) float64 {
+	if code <= 1 {
+		return 0
+	}
+	return 2e-12 * math.Pow(10, float64(code-2))
+}
+
+// sourceInRange checks SRC:VALUE against SRC:RANGE (1=-20~20V, 2=0~1000V, 3=-1000~0V)
+func sourceInRange(rng int, v float64) bool {
+	switch rng {
+	case 1:
+		return v >= -20 && v <= 20
+	case 2:
+		return v >= 0 && v <= 1000
+	case 3:
+		return v >= -1000 && v <= 0
+	}
+	return false
+}
+
+func onOff(b bool) string {
+	if b {
+		return "ON"
+	}
+	return "OFF"
+}
@@ -0,0 +1,241 @@
+package simulator
+
+import (
+	"bufio"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// client is a bare SCPI client: one command per line, replies read up to the terminator
+type client struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// start runs a simulator on a free port and connects a client to it
+func start(t *testing.T, cfg Config) (*Server, *client) {
+	t.Helper()
+	s := New(cfg)
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return s, &client{conn: conn, rd: bufio.NewReader(conn)}
+}
+
+func (c *client) send(t *testing.T, cmds ...string) {
+	t.Helper()
+	for _, cmd := range cmds {
+		if _, err := c.conn.Write([]byte(cmd + "\n")); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+}
+
+func (c *client) query(cmd string, timeout time.Duration) (string, error) {
+	if _, err := c.conn.Write([]byte(cmd + "\n")); err != nil {
+		return "", err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	line, err := c.rd.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+func (c *client) mustQuery(t *testing.T, cmd string) string {
+	t.Helper()
+	resp, err := c.query(cmd, time.Second)
+	if err != nil {
+		t.Fatalf("%s: %v", cmd, err)
+	}
+	return resp
+}
+
+// allS splits a FETCH:ALL_S? row into its ten numeric fields (the time field included)
+func allS(t *testing.T, c *client) []float64 {
+	t.Helper()
+	row := c.mustQuery(t, "FETCH:ALL_S?")
+	parts := strings.Split(row, ",")
+	if len(parts) != 10 {
+		t.Fatalf("ALL_S row %q has %d fields", row, len(parts))
+	}
+	vals := make([]float64, len(parts))
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			t.Fatalf("ALL_S field %d of %q: %v", i, row, err)
+		}
+		vals[i] = v
+	}
+	return vals
+}
+
+func quiet() Config {
+	cfg := DefaultConfig()
+	cfg.Noise = 0
+	cfg.SlewRate = 1e6
+	cfg.Delay = 0
+	cfg.Seed = 1
+	return cfg
+}
+
+// TestSimulatorRun walks the start/poll/stop path: identify, configure, run with the
+// source on, read ALL_S rows, stop
+func TestSimulatorRun(t *testing.T) {
+	s, c := start(t, quiet())
+
+	if idn := c.mustQuery(t, "*IDN?"); idn != "TH2690,V1.0.22,SIM0000001" {
+		t.Fatalf("*IDN? = %q", idn)
+	}
+	c.send(t, "FUNC:FUNC CURR", "FUNC:AMMET ON", "FUNC:ZERO ON", "CURR:RANGE 1",
+		"SRC:RANGE 2", "SRC:VALUE 100", "FUNC:SRC ON", "FUNC:RUN")
+	if got := c.mustQuery(t, "SRC:VALUE?"); got != "100.000" {
+		t.Fatalf("SRC:VALUE? = %q", got)
+	}
+	if !s.SourceOn() || !s.Running() {
+		t.Fatalf("source on %v, running %v after FUNC:RUN", s.SourceOn(), s.Running())
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	row := allS(t, c)
+	// voltage,current,charge,resistance,time,source,math,temperature,humidity,error_code
+	if row[0] != 100 || row[5] != 100 || row[9] != 0 {
+		t.Fatalf("row = %v", row)
+	}
+	if math.Abs(row[1]-1e-10) > 1e-15 || math.Abs(row[3]-1e12) > 1e6 {
+		t.Fatalf("current %g, resistance %g: want 100 V over 1 TΩ", row[1], row[3])
+	}
+	time.Sleep(10 * time.Millisecond)
+	if next := allS(t, c); next[4] <= row[4] || next[2] <= row[2] {
+		t.Fatalf("time and charge do not advance: %v then %v", row, next)
+	}
+
+	c.send(t, "FUNC:STOP", "FUNC:SRC OFF")
+	if row := allS(t, c); row[1] != 0 {
+		t.Fatalf("current %g after FUNC:STOP", row[1])
+	}
+	if s.SourceOn() || s.Running() {
+		t.Fatalf("source on %v, running %v after FUNC:STOP", s.SourceOn(), s.Running())
+	}
+}
+
+func TestSimulatorOffsetAndErrors(t *testing.T) {
+	_, c := start(t, quiet())
+	c.send(t, "FUNC:ZERO OFF", "FUNC:RUN")
+	if row := allS(t, c); math.Abs(row[1]-2e-13) > 1e-18 {
+		t.Fatalf("current %g without zero correction, want the 2e-13 A offset", row[1])
+	}
+
+	// SRC:RANGE 3 is -1000~0 V: a positive setpoint is out of range
+	c.send(t, "SRC:RANGE 3", "SRC:VALUE 50")
+	if row := allS(t, c); row[9] != ErrSourceRange {
+		t.Fatalf("error code %v, want %d", row[9], ErrSourceRange)
+	}
+	c.send(t, "HAND:ERROR")
+	if row := allS(t, c); row[9] != ErrNone {
+		t.Fatalf("error code %v after HAND:ERROR", row[9])
+	}
+}
+
+// TestSimulatorSpeed: only the TH2690 speed tokens are accepted, anything else keeps the
+// previous speed
+func TestSimulatorSpeed(t *testing.T) {
+	_, c := start(t, quiet())
+	c.send(t, "CURR:SPEED FAST", "CURR:SPEED MED")
+	if speed := c.mustQuery(t, "CURR:SPEED?"); speed != "FAST" {
+		t.Fatalf("speed %q after MED, want FAST kept", speed)
+	}
+	c.send(t, "CURR:SPEED MID")
+	if speed := c.mustQuery(t, "CURR:SPEED?"); speed != "MID" {
+		t.Fatalf("speed %q after MID", speed)
+	}
+}
+
+func TestSimulatorFaults(t *testing.T) {
+	cfg := quiet()
+	cfg.DropRate = 1
+	_, c := start(t, cfg)
+	if _, err := c.query("*IDN?", 200*time.Millisecond); err == nil {
+		t.Fatal("dropped query got a reply")
+	}
+
+	cfg = quiet()
+	cfg.SplitRate = 1
+	cfg.Terminator = "\n"
+	_, c = start(t, cfg)
+	if idn := c.mustQuery(t, "*IDN?"); idn != "TH2690,V1.0.22,SIM0000001" {
+		t.Fatalf("split reply reassembled as %q", idn)
+	}
+
+	cfg = quiet()
+	cfg.ResetRate = 1
+	_, c = start(t, cfg)
+	if _, err := c.query("*IDN?", time.Second); err == nil {
+		t.Fatal("reset connection still answered")
+	}
+}
+
+// TestSimulatorCloseDropsConnections: Close returns while clients are still connected
+func TestSimulatorCloseDropsConnections(t *testing.T) {
+	s, c := start(t, quiet())
+	c.mustQuery(t, "*IDN?")
+	done := make(chan struct{})
+	go func() {
+		s.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close hangs with an open connection")
+	}
+	if _, err := c.query("*IDN?", time.Second); err == nil {
+		t.Fatal("connection still answers after Close")
+	}
+}
+
+// lateListener hands out one connection, as if accepted just before Close stopped the
+// listener, then fails like a closed listener
+type lateListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l *lateListener) Accept() (net.Conn, error) {
+	if c, ok := <-l.conns; ok {
+		return c, nil
+	}
+	return nil, net.ErrClosed
+}
+
+// TestSimulatorDropsLateConnections: a connection accepted after Close is closed at once
+// instead of being served
+func TestSimulatorDropsLateConnections(t *testing.T) {
+	s := New(quiet())
+	s.Close()
+
+	server, client := net.Pipe()
+	ln := &lateListener{conns: make(chan net.Conn, 1)}
+	ln.conns <- server
+	close(ln.conns)
+	s.wg.Add(1)
+	s.acceptLoop(ln)
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	if _, err := client.Write([]byte("*IDN?\n")); err == nil {
+		t.Fatal("late connection still open")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.conns) != 0 {
+		t.Fatalf("%d connections tracked after Close", len(s.conns))
+	}
+}